@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"os"
 
 	"github.com/privapps/github-copilot-svcs/internal"
@@ -11,17 +12,33 @@ import (
 var version = "dev"
 
 func main() {
+	// Global flags can appear anywhere and only adjust logging
+	args, logLevel := internal.ParseGlobalFlags(os.Args[1:])
+
 	// Initialize logger early
-	internal.Init()
+	internal.Init(logLevel)
 
-	const minArgsRequired = 2
-	if len(os.Args) < minArgsRequired {
+	const minArgsRequired = 1
+	if len(args) < minArgsRequired {
 		internal.PrintUsage()
 		return
 	}
 
-	if err := internal.RunCommand(os.Args[1], os.Args[2:], version); err != nil {
-		internal.Error("Command failed", err)
-		os.Exit(1)
+	args, timeout, err := internal.ParseTimeoutFlag(args)
+	if err != nil {
+		internal.Error("Invalid arguments", "error", err)
+		os.Exit(internal.ExitCode(err))
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	if err := internal.RunCommandContext(ctx, args[0], args[1:], version); err != nil {
+		cancel()
+		internal.Error("Command failed", "error", err)
+		os.Exit(internal.ExitCode(err))
 	}
+	cancel()
 }
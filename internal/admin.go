@@ -0,0 +1,186 @@
+// Package internal provides the local admin API for github-copilot-svcs.
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	redactedValue        = "[REDACTED]"
+	maxAdminRequestBytes = 64 * 1024
+
+	// Routes under this prefix make up the admin API
+	adminPathPrefix = "/admin/"
+)
+
+// AdminService exposes the live configuration over a local admin API
+type AdminService struct {
+	config *Config
+
+	// For testability: override config save path
+	configPath string
+
+	mutex sync.Mutex
+}
+
+// NewAdminService creates a new admin service
+func NewAdminService(cfg *Config, opts ...func(*AdminService)) *AdminService {
+	svc := &AdminService{config: cfg}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
+
+// WithAdminConfigPath sets the path the admin service persists config updates to.
+func WithAdminConfigPath(path string) func(*AdminService) {
+	return func(s *AdminService) {
+		s.configPath = path
+	}
+}
+
+// ConfigHandler serves GET (redacted config) and PUT (partial hot-reload update) on /admin/config
+func (s *AdminService) ConfigHandler() http.HandlerFunc {
+	return RequireAdminAccess(s.config, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.writeConfig(w)
+		case http.MethodPut:
+			s.updateConfig(w, r)
+		default:
+			WriteHTTPError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	})
+}
+
+// updateConfig applies a partial JSON update to the hot-reloadable config fields and persists it
+func (s *AdminService) updateConfig(w http.ResponseWriter, r *http.Request) {
+	// A cross-site form can only send simple content types, never application/json
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		WriteHTTPError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminRequestBytes))
+	if err != nil {
+		WriteValidationError(w, "Failed to read request body")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Apply the update onto a deep copy so a rejected update leaves the live config untouched
+	candidate, err := s.config.persistable()
+	if err != nil {
+		Error("Failed to copy config", "error", err)
+		WriteInternalError(w)
+		return
+	}
+	if err := json.Unmarshal(body, candidate); err != nil {
+		WriteValidationError(w, "Invalid JSON")
+		return
+	}
+	if err := candidate.validateReloadable(); err != nil {
+		WriteValidationError(w, err.Error())
+		return
+	}
+
+	if err := s.config.publishReloadable(candidate); err != nil {
+		Error("Failed to publish config update", "error", err)
+		WriteInternalError(w)
+		return
+	}
+
+	var saveErr error
+	if s.configPath != "" {
+		saveErr = s.config.SaveConfig(s.configPath)
+	} else {
+		saveErr = s.config.SaveConfig()
+	}
+	if saveErr != nil {
+		Error("Failed to persist config update", "error", saveErr)
+		WriteInternalError(w)
+		return
+	}
+
+	Info("Configuration updated via admin API")
+	s.writeConfig(w)
+}
+
+func (s *AdminService) writeConfig(w http.ResponseWriter) {
+	redacted, err := s.config.redacted()
+	if err != nil {
+		Error("Failed to copy config", "error", err)
+		WriteInternalError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(redacted); err != nil {
+		Error("Error encoding config response", "error", err)
+	}
+}
+
+// RequireAdminAccess gates admin endpoints: with an API key configured the key is
+// required, otherwise only loopback clients are allowed. Requests from web pages of
+// another origin are always rejected, so a browser on the same host cannot drive it.
+func RequireAdminAccess(config *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !isSameOrigin(r, origin) {
+			Warn("Rejected cross-origin admin request", "origin", origin, "remote_addr", r.RemoteAddr)
+			WriteAuthorizationError(w)
+			return
+		}
+		if config.APIKey != "" {
+			RequireAPIKey(config, next)(w, r)
+			return
+		}
+		if !isLoopbackRequest(r) {
+			Warn("Rejected non-loopback admin request", "remote_addr", r.RemoteAddr)
+			WriteAuthorizationError(w)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isSameOrigin reports whether origin names the scheme and host r was sent to
+func isSameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return u.Scheme == scheme && strings.EqualFold(u.Host, r.Host)
+}
+
+// isAdminPath reports whether path belongs to the admin API
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, adminPathPrefix)
+}
+
+// isLoopbackRequest checks the immediate peer address, ignoring forwarded headers.
+// Requests on a Unix socket listener are local: the socket is only open to its owner.
+func isLoopbackRequest(r *http.Request) bool {
+	if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -4,9 +4,11 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,11 +19,33 @@ const (
 	copilotClientID      = "Iv1.b507a08c87ecfe98"
 	copilotScope         = "read:user"
 
-	// Retry configuration
-	maxRefreshRetries = 3
-	baseRetryDelay    = 2 // seconds
+	// Retry configuration; attempts and the backoff cap come from retry.*
+	baseRetryDelay = 2 // seconds
+
+	// Token refresh scheduling
+	tokenRefreshThreshold      = 300 * time.Second // Request path refreshes within this window of expiry
+	backgroundRefreshLead      = 60 * time.Second  // Background refresh runs this long before the request-path threshold
+	backgroundRefreshRetryWait = 30 * time.Second  // Wait after a failed or impossible background refresh
+
+	// Device flow polling
+	defaultDevicePollInterval = 5 * time.Second  // When GitHub sends no interval
+	defaultDeviceCodeExpiry   = 15 * time.Minute // When GitHub sends no expires_in
+	devicePollSlowDownStep    = 5 * time.Second  // Added to the interval on slow_down (RFC 8628)
+	maxDevicePollInterval     = 60 * time.Second // Cap for slow_down and failed-poll backoff
 )
 
+// Clock abstracts time so token refresh scheduling can be tested
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock backed by the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
 type deviceCodeResponse struct {
 	DeviceCode      string `json:"device_code"`
 	UserCode        string `json:"user_code"`
@@ -52,14 +76,44 @@ type AuthService struct {
 	// For testability: override config save path
 	configPath string
 
+	// store persists tokens; when nil they are saved with the config file
+	store CredentialStore
+
 	// For testability: optional custom token refresh function
 	refreshFunc func(cfg *Config) error
+
+	// For testability: time source for refresh scheduling and device flow polling
+	clock Clock
+
+	// pollTimeout caps how long the device flow waits for authorization (0 = until
+	// the device code expires)
+	pollTimeout time.Duration
+
+	// refreshMutex guards refreshing, the token refresh in flight per config, so the
+	// request path and the background refresher never refresh twice. It is not held
+	// during the refresh itself.
+	refreshMutex sync.Mutex
+	refreshing   map[*Config]*refreshCall
+
+	// stopRefresh and refreshWG stop the background refresher and wait for it
+	stopRefresh chan struct{}
+	stopOnce    sync.Once
+	refreshWG   sync.WaitGroup
+}
+
+// refreshCall is a token refresh in progress; err is set before done is closed
+type refreshCall struct {
+	done chan struct{}
+	err  error
 }
 
 // NewAuthService creates a new auth service
 func NewAuthService(httpClient *http.Client, opts ...func(*AuthService)) *AuthService {
 	svc := &AuthService{
-		httpClient: httpClient,
+		httpClient:  httpClient,
+		clock:       systemClock{},
+		refreshing:  make(map[*Config]*refreshCall),
+		stopRefresh: make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(svc)
@@ -75,6 +129,13 @@ func WithConfigPath(path string) func(*AuthService) {
 	}
 }
 
+// WithCredentialStore persists tokens through store instead of the config file.
+func WithCredentialStore(store CredentialStore) func(*AuthService) {
+	return func(s *AuthService) {
+		s.store = store
+	}
+}
+
 // WithRefreshFunc sets a custom refresh function for AuthService.
 func WithRefreshFunc(f func(cfg *Config) error) func(*AuthService) {
 	return func(s *AuthService) {
@@ -82,8 +143,29 @@ func WithRefreshFunc(f func(cfg *Config) error) func(*AuthService) {
 	}
 }
 
+// WithClock sets the time source used for token refresh scheduling.
+func WithClock(clock Clock) func(*AuthService) {
+	return func(s *AuthService) {
+		s.clock = clock
+	}
+}
+
+// WithPollTimeout stops waiting for device flow authorization after d, if that comes
+// before the device code expires.
+func WithPollTimeout(d time.Duration) func(*AuthService) {
+	return func(s *AuthService) {
+		s.pollTimeout = d
+	}
+}
+
 // Authenticate performs the full GitHub Copilot authentication flow
 func (s *AuthService) Authenticate(cfg *Config) error {
+	return s.AuthenticateWithContext(context.Background(), cfg)
+}
+
+// AuthenticateWithContext performs the full authentication flow; cancelling ctx stops
+// waiting for the user to authorize the device
+func (s *AuthService) AuthenticateWithContext(ctx context.Context, cfg *Config) error {
 	now := time.Now().Unix()
 	if cfg.CopilotToken != "" && cfg.ExpiresAt > now+60 {
 		Info("Token still valid", "expires_in", cfg.ExpiresAt-now)
@@ -97,7 +179,7 @@ func (s *AuthService) Authenticate(cfg *Config) error {
 	}
 
 	// Step 1: Get device code
-	dc, err := s.getDeviceCode(cfg)
+	dc, err := s.getDeviceCode(ctx, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to get device code: %w", err)
 	}
@@ -105,29 +187,20 @@ func (s *AuthService) Authenticate(cfg *Config) error {
 	fmt.Printf("\nTo authenticate, visit: %s\nEnter code: %s\n", dc.VerificationURI, dc.UserCode)
 
 	// Step 2: Poll for GitHub token
-	githubToken, err := s.pollForGitHubToken(cfg, dc.DeviceCode, dc.Interval)
+	githubToken, err := s.pollForGitHubToken(ctx, cfg, dc)
 	if err != nil {
 		return fmt.Errorf("failed to get GitHub token: %w", err)
 	}
 	cfg.GitHubToken = githubToken
 
 	// Step 3: Exchange GitHub token for Copilot token
-	copilotToken, expiresAt, refreshIn, err := s.getCopilotToken(cfg, githubToken)
+	copilotToken, expiresAt, refreshIn, err := s.getCopilotToken(ctx, cfg, githubToken)
 	if err != nil {
 		return fmt.Errorf("failed to get Copilot token: %w", err)
 	}
+	cfg.setToken(copilotToken, expiresAt, refreshIn)
 
-	cfg.CopilotToken = copilotToken
-	cfg.ExpiresAt = expiresAt
-	cfg.RefreshIn = refreshIn
-
-	var saveErr error
-	if s.configPath != "" {
-		saveErr = cfg.SaveConfig(s.configPath)
-	} else {
-		saveErr = cfg.SaveConfig()
-	}
-	if saveErr != nil {
+	if saveErr := s.saveCredentials(cfg); saveErr != nil {
 		return fmt.Errorf("failed to save config: %w", saveErr)
 	}
 
@@ -135,6 +208,35 @@ func (s *AuthService) Authenticate(cfg *Config) error {
 	return nil
 }
 
+// AuthenticateWithToken skips the device flow and exchanges an existing GitHub token
+// (PAT or OAuth) for a Copilot token, saving both. A token GitHub rejects is reported
+// as an AuthenticationError.
+func (s *AuthService) AuthenticateWithToken(cfg *Config, githubToken string) error {
+	copilotToken, expiresAt, refreshIn, err := s.getCopilotToken(context.Background(), cfg, githubToken)
+	if err != nil {
+		if errors.Is(err, ErrNotEntitled) {
+			return err
+		}
+		var networkErr *NetworkError
+		if errors.As(err, &networkErr) && networkErr.Err == nil {
+			// GitHub answered, but not with a Copilot token
+			return NewAuthError(fmt.Sprintf("GitHub token rejected (%s); check that it is valid and its account has Copilot access", networkErr.Message), nil)
+		}
+		return NewAuthError("failed to exchange GitHub token for a Copilot token", err)
+	}
+	if copilotToken == "" {
+		return NewAuthError("GitHub returned no Copilot token for this GitHub token", nil)
+	}
+
+	cfg.GitHubToken = githubToken
+	cfg.setToken(copilotToken, expiresAt, refreshIn)
+
+	if err := s.saveCredentials(cfg); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
 // RefreshToken refreshes the Copilot token using the stored GitHub token
 func (s *AuthService) RefreshToken(cfg *Config) error {
 	return s.RefreshTokenWithContext(context.Background(), cfg)
@@ -143,16 +245,17 @@ func (s *AuthService) RefreshToken(cfg *Config) error {
 // RefreshTokenWithContext refreshes the Copilot token using the provided context and config.
 func (s *AuthService) RefreshTokenWithContext(ctx context.Context, cfg *Config) error {
 	if s.refreshFunc != nil {
-		// Use injected refresh function for tests
-		err := s.refreshFunc(cfg)
+		// Use injected refresh function for tests; it fills in a copy, so the token is
+		// published the same way as a real refresh
+		fresh, err := cfg.clone()
 		if err != nil {
 			return err
 		}
-		// Save config to injected path if set
-		if s.configPath != "" {
-			return cfg.SaveConfig(s.configPath)
+		if err := s.refreshFunc(fresh); err != nil {
+			return err
 		}
-		return cfg.SaveConfig()
+		cfg.setToken(fresh.CopilotToken, fresh.ExpiresAt, fresh.RefreshIn)
+		return s.saveCredentials(cfg)
 	}
 
 	if cfg.GitHubToken == "" {
@@ -160,24 +263,29 @@ func (s *AuthService) RefreshTokenWithContext(ctx context.Context, cfg *Config)
 		return NewAuthError("no GitHub token available for refresh", nil)
 	}
 
-	// Retry with exponential backoff
-	for attempt := 1; attempt <= maxRefreshRetries; attempt++ {
-		Info("Attempting to refresh Copilot token", "attempt", attempt, "max_attempts", maxRefreshRetries)
+	// Retry with backoff capped at retry.max_delay
+	maxAttempts := retryAttempts(cfg)
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		Info("Attempting to refresh Copilot token", "attempt", attempt, "max_attempts", maxAttempts)
 
-		copilotToken, expiresAt, refreshIn, err := s.getCopilotToken(cfg, cfg.GitHubToken)
+		copilotToken, expiresAt, refreshIn, err := s.getCopilotToken(ctx, cfg, cfg.GitHubToken)
 		if err != nil {
-			if attempt == maxRefreshRetries {
-				Error("Token refresh failed after max attempts", "attempts", maxRefreshRetries, "error", err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Retrying cannot grant a missing subscription
+			if attempt == maxAttempts || errors.Is(err, ErrNotEntitled) {
+				Error("Token refresh failed after max attempts", "attempts", attempt, "error", err)
 				return err
 			}
 
 			// Wait before retry with exponential backoff
-			waitTime := time.Duration(baseRetryDelay*attempt*attempt) * time.Second
+			waitTime := retryBackoff(baseRetryDelay*time.Second, attempt, retryMaxDelay(cfg))
 			Warn("Token refresh failed, retrying", "attempt", attempt, "wait_time", waitTime, "error", err)
 
 			// Use context-aware sleep
 			select {
-			case <-time.After(waitTime):
+			case <-s.clock.After(waitTime):
 				continue
 			case <-ctx.Done():
 				return ctx.Err()
@@ -185,44 +293,169 @@ func (s *AuthService) RefreshTokenWithContext(ctx context.Context, cfg *Config)
 		}
 
 		Info("Token refresh successful", "expires_in", expiresAt-time.Now().Unix())
-		cfg.CopilotToken = copilotToken
-		cfg.ExpiresAt = expiresAt
-		cfg.RefreshIn = refreshIn
+		cfg.setToken(copilotToken, expiresAt, refreshIn)
 
-		return cfg.SaveConfig()
+		return s.saveCredentials(cfg)
 	}
 
 	return NewAuthError("maximum retry attempts exceeded", nil)
 }
 
+// saveCredentials persists cfg's tokens through the credential store, or with the
+// config file when no store is set
+func (s *AuthService) saveCredentials(cfg *Config) error {
+	if s.store != nil {
+		return s.store.Save(cfg.credentials())
+	}
+	if s.configPath != "" {
+		return cfg.SaveConfig(s.configPath)
+	}
+	return cfg.SaveConfig()
+}
+
 // EnsureValidToken ensures we have a valid token, refreshing if necessary
 func (s *AuthService) EnsureValidToken(cfg *Config) error {
-	now := time.Now().Unix()
-	if cfg.CopilotToken == "" {
+	if token, _ := cfg.Token(); token == "" {
 		return NewAuthError("no token available - authentication required", nil)
 	}
 
-	// Check if token needs refresh (within 5 minutes of expiry or already expired)
-	if cfg.ExpiresAt <= now+300 {
-		return s.RefreshToken(cfg)
+	// Refresh within 5 minutes of expiry or once expired
+	return s.refreshIfNeeded(context.Background(), cfg, tokenRefreshThreshold)
+}
+
+// needsRefresh reports whether the token expires within the given window
+func (s *AuthService) needsRefresh(cfg *Config, window time.Duration) bool {
+	_, expiresAt := cfg.Token()
+	return time.Unix(expiresAt, 0).Before(s.clock.Now().Add(window + time.Second))
+}
+
+// refreshIfNeeded refreshes cfg's token when it expires within window. A caller that
+// finds a refresh of cfg in flight waits for its result instead of starting another.
+// The refresh runs without holding refreshMutex, so callers whose token is still valid
+// never wait for it.
+func (s *AuthService) refreshIfNeeded(ctx context.Context, cfg *Config, window time.Duration) error {
+	s.refreshMutex.Lock()
+	if !s.needsRefresh(cfg, window) {
+		s.refreshMutex.Unlock()
+		return nil
 	}
+	if call, ok := s.refreshing[cfg]; ok {
+		s.refreshMutex.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	s.refreshing[cfg] = call
+	s.refreshMutex.Unlock()
 
-	return nil
+	call.err = s.RefreshTokenWithContext(ctx, cfg)
+
+	s.refreshMutex.Lock()
+	delete(s.refreshing, cfg)
+	s.refreshMutex.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// StartBackgroundRefresh refreshes the Copilot token ahead of the request-path
+// threshold until ctx is canceled or StopBackgroundRefresh is called, so requests
+// rarely have to wait for a refresh.
+func (s *AuthService) StartBackgroundRefresh(ctx context.Context, cfg *Config) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.refreshWG.Add(2)
+	go func() {
+		defer s.refreshWG.Done()
+		select {
+		case <-s.stopRefresh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer s.refreshWG.Done()
+		defer cancel()
+		s.runBackgroundRefresh(ctx, cfg)
+	}()
 }
 
-func (s *AuthService) getDeviceCode(cfg *Config) (*deviceCodeResponse, error) {
+// StopBackgroundRefresh stops the background refresher and waits for it to exit,
+// including a token save in progress. It may be called more than once.
+func (s *AuthService) StopBackgroundRefresh() {
+	s.stopOnce.Do(func() { close(s.stopRefresh) })
+	s.refreshWG.Wait()
+}
+
+func (s *AuthService) runBackgroundRefresh(ctx context.Context, cfg *Config) {
+	window := tokenRefreshThreshold + backgroundRefreshLead
+	for {
+		if wait := s.backgroundRefreshWait(cfg, window); wait > 0 {
+			Debug("Scheduling background token refresh", "wait", wait)
+			select {
+			case <-s.clock.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		backoff, err := s.backgroundRefresh(ctx, cfg, window)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			Warn("Background token refresh failed", "error", err)
+		}
+		if backoff {
+			select {
+			case <-s.clock.After(backgroundRefreshRetryWait):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// backgroundRefreshWait returns how long until the token enters the background refresh window
+func (s *AuthService) backgroundRefreshWait(cfg *Config, window time.Duration) time.Duration {
+	_, expiresAt := cfg.Token()
+	return time.Unix(expiresAt, 0).Add(-window).Sub(s.clock.Now())
+}
+
+// backgroundRefresh refreshes the token if it is inside the window and reports whether
+// the refresher should back off (no refreshable token, failed refresh or short-lived token)
+func (s *AuthService) backgroundRefresh(ctx context.Context, cfg *Config, window time.Duration) (bool, error) {
+	token, expiresAt := cfg.Token()
+	if token == "" || cfg.GitHubToken == "" {
+		return true, nil
+	}
+	// A request-path refresh may already have renewed the token
+	if !s.needsRefresh(cfg, window) {
+		return false, nil
+	}
+
+	Info("Refreshing Copilot token in background", "expires_in", expiresAt-s.clock.Now().Unix())
+	if err := s.refreshIfNeeded(ctx, cfg, window); err != nil {
+		return true, err
+	}
+	return s.needsRefresh(cfg, window), nil
+}
+
+func (s *AuthService) getDeviceCode(ctx context.Context, cfg *Config) (*deviceCodeResponse, error) {
 	body := fmt.Sprintf(`{"client_id":%q,"scope":%q}`, copilotClientID, copilotScope)
-	req, err := http.NewRequest("POST", copilotDeviceCodeURL, strings.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", copilotDeviceCodeURL, strings.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", cfg.Headers.UserAgent)
+	req.Header.Set("User-Agent", cfg.Live().Headers.UserAgent)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, NewNetworkError("getDeviceCode", copilotDeviceCodeURL, "request failed", err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -238,72 +471,110 @@ func (s *AuthService) getDeviceCode(cfg *Config) (*deviceCodeResponse, error) {
 	return &dc, nil
 }
 
-func (s *AuthService) pollForGitHubToken(cfg *Config, deviceCode string, interval int) (string, error) {
-	return s.pollForGitHubTokenWithContext(context.Background(), cfg, deviceCode, interval)
-}
+// pollForGitHubToken waits for the user to authorize the device code. Polling stops
+// when the code expires (or after the poll timeout, if shorter) and when ctx is done.
+// slow_down responses and failed polls lengthen the wait, up to maxDevicePollInterval.
+func (s *AuthService) pollForGitHubToken(ctx context.Context, cfg *Config, dc *deviceCodeResponse) (string, error) {
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDevicePollInterval
+	}
+	budget := time.Duration(dc.ExpiresIn) * time.Second
+	if budget <= 0 {
+		budget = defaultDeviceCodeExpiry
+	}
+	codeExpired := NewAuthError("device code expired before authorization; run auth again", nil)
+	expired := codeExpired
+	if s.pollTimeout > 0 && s.pollTimeout < budget {
+		budget = s.pollTimeout
+		expired = NewAuthError(fmt.Sprintf("authentication timed out after %s waiting for authorization", budget), nil)
+	}
+	deadline := s.clock.Now().Add(budget)
 
-func (s *AuthService) pollForGitHubTokenWithContext(ctx context.Context, cfg *Config, deviceCode string, interval int) (string, error) {
-	for i := 0; i < 120; i++ { // Poll for 2 minutes max
-		// Use context-aware sleep
+	wait := interval
+	for {
+		remaining := deadline.Sub(s.clock.Now())
+		if remaining <= 0 {
+			return "", expired
+		}
 		select {
-		case <-time.After(time.Duration(interval) * time.Second):
-			// Continue with polling
+		case <-s.clock.After(min(wait, remaining)):
 		case <-ctx.Done():
-			return "", ctx.Err()
+			return "", NewAuthError("authentication canceled", ctx.Err())
 		}
-
-		body := fmt.Sprintf(`{"client_id":%q,"device_code":%q,"grant_type":"urn:ietf:params:oauth:grant-type:device_code"}`,
-			copilotClientID, deviceCode)
-		req, err := http.NewRequest("POST", copilotTokenURL, strings.NewReader(body))
-		if err != nil {
-			return "", err
+		if err := ctx.Err(); err != nil {
+			return "", NewAuthError("authentication canceled", err)
+		}
+		if !s.clock.Now().Before(deadline) {
+			return "", expired
 		}
-		req.Header.Set("Accept", "application/json")
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", cfg.Headers.UserAgent)
 
-		resp, err := s.httpClient.Do(req)
+		tr, err := s.pollDeviceToken(ctx, cfg, dc.DeviceCode)
 		if err != nil {
+			Debug("Device flow poll failed", "error", err)
+			wait = min(wait*2, maxDevicePollInterval)
 			continue
 		}
 
-		var tr tokenResponse
-		if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
-			if err := resp.Body.Close(); err != nil {
-				Warn("Error closing response body", "error", err)
+		switch tr.Error {
+		case "":
+			if tr.AccessToken != "" {
+				return tr.AccessToken, nil
 			}
-			continue
+			wait = interval
+		case "authorization_pending":
+			wait = interval
+		case "slow_down":
+			interval = min(interval+devicePollSlowDownStep, maxDevicePollInterval)
+			wait = interval
+		case "expired_token":
+			return "", codeExpired
+		default:
+			return "", NewAuthError(fmt.Sprintf("authorization failed: %s - %s", tr.Error, tr.ErrorDesc), nil)
 		}
+	}
+}
+
+// pollDeviceToken asks GitHub once whether the device code has been authorized
+func (s *AuthService) pollDeviceToken(ctx context.Context, cfg *Config, deviceCode string) (*tokenResponse, error) {
+	body := fmt.Sprintf(`{"client_id":%q,"device_code":%q,"grant_type":"urn:ietf:params:oauth:grant-type:device_code"}`,
+		copilotClientID, deviceCode)
+	req, err := http.NewRequestWithContext(ctx, "POST", copilotTokenURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", cfg.Live().Headers.UserAgent)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, NewNetworkError("pollForGitHubToken", copilotTokenURL, "request failed", err)
+	}
+	defer func() {
 		if err := resp.Body.Close(); err != nil {
 			Warn("Error closing response body", "error", err)
 		}
+	}()
 
-		if tr.Error != "" {
-			if tr.Error == "authorization_pending" {
-				continue
-			}
-			return "", NewAuthError(fmt.Sprintf("authorization failed: %s - %s", tr.Error, tr.ErrorDesc), nil)
-		}
-
-		if tr.AccessToken != "" {
-			return tr.AccessToken, nil
-		}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, err
 	}
-
-	return "", NewAuthError("authentication timed out", nil)
+	return &tr, nil
 }
 
-func (s *AuthService) getCopilotToken(cfg *Config, githubToken string) (token string, expiresAt, refreshIn int64, err error) {
-	req, err := http.NewRequest("GET", copilotAPIKeyURL, http.NoBody)
+func (s *AuthService) getCopilotToken(ctx context.Context, cfg *Config, githubToken string) (token string, expiresAt, refreshIn int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, copilotAPIKeyURL, http.NoBody)
 	if err != nil {
 		return "", 0, 0, err
 	}
 	req.Header.Set("Authorization", "token "+githubToken)
-	req.Header.Set("User-Agent", cfg.Headers.UserAgent)
+	req.Header.Set("User-Agent", cfg.Live().Headers.UserAgent)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return "", 0, 0, err
+		return "", 0, 0, NewNetworkError("getCopilotToken", copilotAPIKeyURL, "request failed", err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -312,6 +583,9 @@ func (s *AuthService) getCopilotToken(cfg *Config, githubToken string) (token st
 	}()
 
 	if resp.StatusCode != http.StatusOK {
+		if tokenExchangeNotEntitled(resp) {
+			return "", 0, 0, newNotEntitledError(resp.StatusCode)
+		}
 		return "", 0, 0, NewNetworkError("getCopilotToken", copilotAPIKeyURL, fmt.Sprintf("HTTP %d response", resp.StatusCode), nil)
 	}
 
@@ -3,8 +3,15 @@ package internal_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -347,3 +354,512 @@ func TestAuthService_RefreshToken_SavesConfig(t *testing.T) {
 		t.Errorf("RefreshIn not saved")
 	}
 }
+
+// fakeClock jumps forward by the requested duration whenever a timer is requested
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	ch <- now
+	return ch
+}
+
+func TestAuthService_BackgroundRefresh(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clock := &fakeClock{now: start}
+	expiresAt := start.Add(30 * time.Minute)
+
+	cfg := createAuthTestConfig()
+	cfg.GitHubToken = "github-token"
+	cfg.CopilotToken = "old-token"
+	cfg.ExpiresAt = expiresAt.Unix()
+
+	refreshedAt := make(chan time.Time, 1)
+	var stopped atomic.Bool
+	refreshFunc := func(c *internal.Config) error {
+		if stopped.Load() {
+			return context.Canceled
+		}
+		now := clock.Now()
+		c.CopilotToken = "new-token"
+		c.ExpiresAt = now.Add(30 * time.Minute).Unix()
+		select {
+		case refreshedAt <- now:
+		default:
+		}
+		return nil
+	}
+
+	authSvc := internal.NewAuthService(&http.Client{},
+		internal.WithConfigPath(filepath.Join(t.TempDir(), "config.json")),
+		internal.WithRefreshFunc(refreshFunc),
+		internal.WithClock(clock),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	authSvc.StartBackgroundRefresh(ctx, cfg)
+
+	select {
+	case at := <-refreshedAt:
+		cancel()
+		if !at.Before(expiresAt.Add(-5 * time.Minute)) {
+			t.Errorf("Expected background refresh before the request-path threshold, fired at %v (expiry %v)", at, expiresAt)
+		}
+		if !at.After(start) {
+			t.Errorf("Expected background refresh to wait until close to expiry, fired at %v", at)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Background refresh did not fire")
+	}
+
+	// The fake clock keeps the refresher busy; stopping waits for a save in flight, so
+	// it finishes before TempDir cleanup
+	stopped.Store(true)
+	authSvc.StopBackgroundRefresh()
+}
+
+func TestAuthService_SlowBackgroundRefreshDoesNotBlockRequests(t *testing.T) {
+	cfg := createAuthTestConfig()
+	cfg.GitHubToken = "github-token"
+	cfg.CopilotToken = "old-token"
+	// Inside the background window, but still valid for the request path
+	cfg.ExpiresAt = time.Now().Add(5*time.Minute + 30*time.Second).Unix()
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	authSvc := internal.NewAuthService(&http.Client{},
+		internal.WithConfigPath(filepath.Join(t.TempDir(), "config.json")),
+		internal.WithRefreshFunc(func(c *internal.Config) error {
+			close(entered)
+			<-release
+			c.CopilotToken = "new-token"
+			c.ExpiresAt = time.Now().Add(time.Hour).Unix()
+			return nil
+		}),
+	)
+	authSvc.StartBackgroundRefresh(context.Background(), cfg)
+	defer authSvc.StopBackgroundRefresh()
+
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Background refresh did not start")
+	}
+
+	start := time.Now()
+	if err := authSvc.EnsureValidToken(cfg); err != nil {
+		t.Fatalf("EnsureValidToken failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected a valid token to be returned without waiting for the refresh, took %v", elapsed)
+	}
+	if token, _ := cfg.Token(); token != "old-token" {
+		t.Errorf("Expected the current token while the refresh runs, got %q", token)
+	}
+
+	close(release)
+	authSvc.StopBackgroundRefresh()
+	if token, _ := cfg.Token(); token != "new-token" {
+		t.Errorf("Expected the refreshed token to be published, got %q", token)
+	}
+}
+
+func TestAuthService_EnsureValidToken_SingleRefresh(t *testing.T) {
+	cfg := createAuthTestConfig()
+	cfg.GitHubToken = "github-token"
+	cfg.CopilotToken = "expiring-token"
+	cfg.ExpiresAt = time.Now().Add(time.Minute).Unix()
+
+	var refreshes int32
+	refreshFunc := func(c *internal.Config) error {
+		atomic.AddInt32(&refreshes, 1)
+		time.Sleep(50 * time.Millisecond)
+		c.CopilotToken = "new-token"
+		c.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		return nil
+	}
+	authSvc := internal.NewAuthService(&http.Client{},
+		internal.WithConfigPath(filepath.Join(t.TempDir(), "config.json")),
+		internal.WithRefreshFunc(refreshFunc),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := authSvc.EnsureValidToken(cfg); err != nil {
+				t.Errorf("EnsureValidToken failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&refreshes); got != 1 {
+		t.Errorf("Expected a single refresh, got %d", got)
+	}
+}
+
+// memoryCredentialStore is an in-memory CredentialStore
+type memoryCredentialStore struct {
+	mu    sync.Mutex
+	creds internal.Credentials
+	saves int
+}
+
+func (s *memoryCredentialStore) Load() (*internal.Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creds := s.creds
+	return &creds, nil
+}
+
+func (s *memoryCredentialStore) Save(creds *internal.Credentials) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds = *creds
+	s.saves++
+	return nil
+}
+
+func TestAuthService_CredentialStore(t *testing.T) {
+	store := &memoryCredentialStore{}
+	cfg := createAuthTestConfig()
+	cfg.GitHubToken = "github-token"
+
+	authSvc := internal.NewAuthService(&http.Client{},
+		internal.WithCredentialStore(store),
+		internal.WithRefreshFunc(func(c *internal.Config) error {
+			c.CopilotToken = "copilot-token"
+			c.ExpiresAt = time.Now().Unix() + 3600
+			c.RefreshIn = 1800
+			return nil
+		}),
+	)
+
+	if err := authSvc.RefreshToken(cfg); err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+	if store.saves != 1 {
+		t.Fatalf("Expected credentials to be saved once, got %d", store.saves)
+	}
+
+	// A fresh config picks the persisted tokens back up
+	reloaded := createAuthTestConfig()
+	if err := reloaded.LoadCredentials(store); err != nil {
+		t.Fatalf("LoadCredentials failed: %v", err)
+	}
+	if reloaded.GitHubToken != "github-token" || reloaded.CopilotToken != "copilot-token" {
+		t.Errorf("Expected reloaded tokens, got github=%q copilot=%q", reloaded.GitHubToken, reloaded.CopilotToken)
+	}
+	if reloaded.ExpiresAt != cfg.ExpiresAt || reloaded.RefreshIn != 1800 {
+		t.Errorf("Expected reloaded expiry %d/1800, got %d/%d", cfg.ExpiresAt, reloaded.ExpiresAt, reloaded.RefreshIn)
+	}
+
+	// The reloaded token is valid, so no further refresh or save happens
+	if err := authSvc.EnsureValidToken(reloaded); err != nil {
+		t.Fatalf("EnsureValidToken failed: %v", err)
+	}
+	if store.saves != 1 {
+		t.Errorf("Expected no additional saves, got %d", store.saves)
+	}
+}
+
+func TestConfig_SaveConfigUsesCredentialStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	store := &memoryCredentialStore{}
+
+	cfg := createAuthTestConfig()
+	cfg.Port = 8081
+	cfg.GitHubToken = "github-token"
+	cfg.CopilotToken = "copilot-token"
+	cfg.SetCredentialStore(store)
+
+	if err := cfg.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read config file: %v", err)
+	}
+	var onDisk internal.Config
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		t.Fatalf("failed to decode config file: %v", err)
+	}
+	if onDisk.GitHubToken != "" || onDisk.CopilotToken != "" {
+		t.Errorf("Expected no tokens in the config file, got github=%q copilot=%q", onDisk.GitHubToken, onDisk.CopilotToken)
+	}
+	if onDisk.Port != 8081 || onDisk.Headers.UserAgent != testUserAgent {
+		t.Errorf("Expected non-secret settings in the config file, got port=%d user_agent=%q", onDisk.Port, onDisk.Headers.UserAgent)
+	}
+	if store.creds.GitHubToken != "github-token" || store.creds.CopilotToken != "copilot-token" {
+		t.Errorf("Expected tokens in the credential store, got %+v", store.creds)
+	}
+	if cfg.CopilotToken != "copilot-token" {
+		t.Error("SaveConfig must not clear the live config's tokens")
+	}
+}
+
+func TestFileCredentialStore_KeepsOtherSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"port":9090,"copilot_token":"old"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &internal.FileCredentialStore{Path: path}
+	if err := store.Save(&internal.Credentials{GitHubToken: "gh", CopilotToken: "new", ExpiresAt: 42}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	creds, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if creds.CopilotToken != "new" || creds.GitHubToken != "gh" || creds.ExpiresAt != 42 {
+		t.Errorf("Unexpected credentials: %+v", creds)
+	}
+
+	var fields map[string]interface{}
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("invalid config file: %v", err)
+	}
+	if fields["port"] != float64(9090) {
+		t.Errorf("Expected port to be preserved, got %v", fields["port"])
+	}
+}
+
+func TestAuthService_DeviceFlowPolling(t *testing.T) {
+	t.Setenv("COPILOT_SVCS_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+
+	// newDeviceFlowServer issues a device code with expiresIn and keeps answering
+	// authorization_pending, calling onPoll before each answer
+	newDeviceFlowServer := func(t *testing.T, expiresIn int, onPoll func()) (*httptest.Server, *atomic.Int32) {
+		t.Helper()
+		var polls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/login/device/code":
+				_, _ = fmt.Fprintf(w, `{"device_code":"dc","user_code":"ABCD-1234","verification_uri":"https://github.com/login/device","expires_in":%d,"interval":5}`, expiresIn)
+			case "/login/oauth/access_token":
+				polls.Add(1)
+				if onPoll != nil {
+					onPoll()
+				}
+				_, _ = w.Write([]byte(`{"error":"authorization_pending"}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		return srv, &polls
+	}
+
+	t.Run("stops when the device code expires", func(t *testing.T) {
+		srv, polls := newDeviceFlowServer(t, 20, nil)
+		clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+		authSvc := internal.NewAuthService(newUpstreamClient(t, srv), internal.WithClock(clock))
+
+		err := authSvc.Authenticate(createAuthTestConfig())
+		if err == nil || !strings.Contains(err.Error(), "device code expired") {
+			t.Fatalf("Expected a device code expiry error, got %v", err)
+		}
+		// Polls at 5s, 10s and 15s; the 20s mark is the expiry itself
+		if got := polls.Load(); got != 3 {
+			t.Errorf("Expected 3 polls within the 20s expiry, got %d", got)
+		}
+	})
+
+	t.Run("stops at a shorter poll timeout", func(t *testing.T) {
+		srv, polls := newDeviceFlowServer(t, 900, nil)
+		clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+		authSvc := internal.NewAuthService(newUpstreamClient(t, srv), internal.WithClock(clock), internal.WithPollTimeout(12*time.Second))
+
+		err := authSvc.Authenticate(createAuthTestConfig())
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("Expected a timeout error, got %v", err)
+		}
+		var authErr *internal.AuthenticationError
+		if !errors.As(err, &authErr) {
+			t.Errorf("Expected an AuthenticationError, got %T", err)
+		}
+		if got := polls.Load(); got != 2 {
+			t.Errorf("Expected 2 polls within the 12s budget, got %d", got)
+		}
+		if elapsed := clock.Now().Sub(time.Unix(1_700_000_000, 0)); elapsed != 12*time.Second {
+			t.Errorf("Expected polling to stop at the 12s budget, stopped after %s", elapsed)
+		}
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		srv, polls := newDeviceFlowServer(t, 900, cancel)
+		clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+		authSvc := internal.NewAuthService(newUpstreamClient(t, srv), internal.WithClock(clock))
+
+		err := authSvc.AuthenticateWithContext(ctx, createAuthTestConfig())
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+		if got := polls.Load(); got != 1 {
+			t.Errorf("Expected polling to stop after the cancelled poll, got %d polls", got)
+		}
+	})
+}
+
+func TestAuthService_NotEntitled(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{name: "404 from the token exchange", status: http.StatusNotFound, body: `{"message":"Not Found"}`},
+		{name: "403 with an entitlement error", status: http.StatusForbidden,
+			body: `{"error_details":{"message":"You do not have access to GitHub Copilot.","notification_id":"no_copilot_access"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			auth := internal.NewAuthService(newUpstreamClient(t, srv), internal.WithConfigPath(filepath.Join(t.TempDir(), "config.json")))
+
+			err := auth.AuthenticateWithToken(createAuthTestConfig(), "ghp_no_copilot")
+			if !errors.Is(err, internal.ErrNotEntitled) {
+				t.Fatalf("Expected a not-entitled error, got %v", err)
+			}
+			var authErr *internal.AuthenticationError
+			if !errors.As(err, &authErr) || !strings.Contains(authErr.Message, "does not have Copilot access") {
+				t.Errorf("Expected an actionable AuthenticationError, got %v", err)
+			}
+			if code := internal.ExitCode(fmt.Errorf("auth: %w", err)); code != internal.ExitNoCopilot {
+				t.Errorf("Expected exit code %d, got %d", internal.ExitNoCopilot, code)
+			}
+
+			// A refresh gives up at once instead of retrying
+			calls.Store(0)
+			cfg := createAuthTestConfig()
+			cfg.GitHubToken = "ghp_no_copilot"
+			if err := auth.RefreshToken(cfg); !errors.Is(err, internal.ErrNotEntitled) {
+				t.Errorf("Expected refresh to report a not-entitled error, got %v", err)
+			}
+			if n := calls.Load(); n != 1 {
+				t.Errorf("Expected a single token exchange, got %d", n)
+			}
+		})
+	}
+
+	t.Run("other 403s stay generic", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"message":"Bad credentials"}`))
+		}))
+		defer srv.Close()
+		auth := internal.NewAuthService(newUpstreamClient(t, srv))
+
+		err := auth.AuthenticateWithToken(createAuthTestConfig(), "ghp_bad")
+		if err == nil || errors.Is(err, internal.ErrNotEntitled) {
+			t.Errorf("Expected a generic rejection, got %v", err)
+		}
+		if code := internal.ExitCode(err); code != internal.ExitAuth {
+			t.Errorf("Expected exit code %d, got %d", internal.ExitAuth, code)
+		}
+	})
+}
+
+// recordingClock records the waits requested of it and fires them at once
+type recordingClock struct {
+	fakeClock
+	waits []time.Duration
+}
+
+func (c *recordingClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	c.waits = append(c.waits, d)
+	c.mu.Unlock()
+	return c.fakeClock.After(d)
+}
+
+func TestAuthService_RefreshRetryBackoff(t *testing.T) {
+	newFailingServer := func(calls *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+	}
+
+	t.Run("waits are capped and attempts configurable", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := newFailingServer(&calls)
+		defer srv.Close()
+		clock := &recordingClock{fakeClock: fakeClock{now: time.Unix(1_700_000_000, 0)}}
+		auth := internal.NewAuthService(newUpstreamClient(t, srv), internal.WithClock(clock))
+
+		cfg := createAuthTestConfig()
+		cfg.GitHubToken = "ghp_test"
+		cfg.Retry.MaxDelay = 1
+		cfg.Retry.MaxAttempts = 5
+		if err := auth.RefreshTokenWithContext(context.Background(), cfg); err == nil {
+			t.Fatal("Expected the refresh to fail")
+		}
+		if n := calls.Load(); n != 5 {
+			t.Errorf("Expected 5 token exchanges, got %d", n)
+		}
+		if len(clock.waits) != 4 {
+			t.Fatalf("Expected 4 waits between attempts, got %v", clock.waits)
+		}
+		for _, wait := range clock.waits {
+			if wait <= 0 || wait > time.Second {
+				t.Errorf("Expected every wait capped at 1s, got %v", clock.waits)
+				break
+			}
+		}
+	})
+
+	t.Run("cancellation interrupts the wait", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := newFailingServer(&calls)
+		defer srv.Close()
+		auth := internal.NewAuthService(newUpstreamClient(t, srv))
+
+		cfg := createAuthTestConfig()
+		cfg.GitHubToken = "ghp_test"
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := auth.RefreshTokenWithContext(ctx, cfg)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the context error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected a prompt return after cancellation, took %v", elapsed)
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("Expected a single token exchange before cancellation, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryMaxDelay    = 30 // seconds
+	defaultRetryMaxAttempts = 3
+	maxRetryAttempts        = 10
+)
+
+var (
+	// backoffRand is seeded once per process so separate instances don't retry in lockstep
+	backoffRand      = rand.New(rand.NewSource(time.Now().UnixNano())) //nolint:gosec // jitter does not need a CSPRNG
+	backoffRandMutex sync.Mutex
+)
+
+// retryBackoff returns the wait before the next attempt using quadratic backoff with
+// equal jitter: half of the capped delay is fixed and the other half is random.
+func retryBackoff(base time.Duration, attempt int, maxDelay time.Duration) time.Duration {
+	delay := base * time.Duration(attempt*attempt)
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	backoffRandMutex.Lock()
+	jitter := time.Duration(backoffRand.Int63n(int64(half) + 1))
+	backoffRandMutex.Unlock()
+
+	return delay - half + jitter
+}
+
+// retryMaxDelay returns the configured backoff cap, falling back to the default
+func retryMaxDelay(cfg *Config) time.Duration {
+	if cfg == nil {
+		return defaultRetryMaxDelay * time.Second
+	}
+	if maxDelay := cfg.Live().Retry.MaxDelay; maxDelay > 0 {
+		return time.Duration(maxDelay) * time.Second
+	}
+	return defaultRetryMaxDelay * time.Second
+}
+
+// retryAttempts returns the configured number of attempts, falling back to the default
+func retryAttempts(cfg *Config) int {
+	if cfg == nil {
+		return defaultRetryMaxAttempts
+	}
+	if attempts := cfg.Live().Retry.MaxAttempts; attempts > 0 {
+		return attempts
+	}
+	return defaultRetryMaxAttempts
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoffJitterRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     time.Duration
+		attempt  int
+		maxDelay time.Duration
+		min, max time.Duration
+	}{
+		{name: "first attempt", base: time.Second, attempt: 1, maxDelay: 30 * time.Second, min: 500 * time.Millisecond, max: time.Second},
+		{name: "third attempt", base: time.Second, attempt: 3, maxDelay: 30 * time.Second, min: 4500 * time.Millisecond, max: 9 * time.Second},
+		{name: "capped by max delay", base: 2 * time.Second, attempt: 3, maxDelay: 10 * time.Second, min: 5 * time.Second, max: 10 * time.Second},
+		{name: "no cap", base: 2 * time.Second, attempt: 3, maxDelay: 0, min: 9 * time.Second, max: 18 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 1000; i++ {
+				d := retryBackoff(tt.base, tt.attempt, tt.maxDelay)
+				if d < tt.min || d > tt.max {
+					t.Fatalf("delay %v outside [%v, %v]", d, tt.min, tt.max)
+				}
+				seen[d] = true
+			}
+			if len(seen) < 2 {
+				t.Error("expected jittered delays to vary across samples")
+			}
+		})
+	}
+}
+
+func TestRetryMaxDelay(t *testing.T) {
+	if got := retryMaxDelay(nil); got != defaultRetryMaxDelay*time.Second {
+		t.Errorf("expected default max delay, got %v", got)
+	}
+	cfg := &Config{}
+	cfg.Retry.MaxDelay = 5
+	if got := retryMaxDelay(cfg); got != 5*time.Second {
+		t.Errorf("expected 5s max delay, got %v", got)
+	}
+}
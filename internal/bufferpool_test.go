@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// bodyReader hides bytes.Reader's WriteTo, like a network response body, so copies
+// go through the caller's buffer
+type bodyReader struct {
+	io.Reader
+}
+
+// writeSizeRecorder records the largest single write it receives
+type writeSizeRecorder struct {
+	*httptest.ResponseRecorder
+	largest int
+}
+
+func (w *writeSizeRecorder) Write(data []byte) (int, error) {
+	w.largest = max(w.largest, len(data))
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestHandleRegularResponseUsesPooledBuffer(t *testing.T) {
+	const bufferSize = 4096
+	body := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1 MiB
+
+	cfg := &Config{}
+	SetDefaultTimeouts(cfg)
+	cfg.Proxy.CopyBufferSize = bufferSize
+	workerPool := NewWorkerPool(1)
+	t.Cleanup(workerPool.Stop)
+	proxy := NewProxyService(cfg, http.DefaultClient, NewAuthService(http.DefaultClient), workerPool)
+
+	for range 2 {
+		w := &writeSizeRecorder{ResponseRecorder: httptest.NewRecorder()}
+		resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bodyReader{bytes.NewReader(body)})}
+		if err := proxy.handleRegularResponse(w, resp); err != nil {
+			t.Fatalf("handleRegularResponse failed: %v", err)
+		}
+		if !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("Expected the %d byte body to be copied unchanged, got %d bytes", len(body), w.Body.Len())
+		}
+		// Without the pooled buffer io.CopyBuffer allocates its own 32 KiB one
+		if w.largest != bufferSize {
+			t.Errorf("Expected writes of the %d byte pooled buffer, largest was %d", bufferSize, w.largest)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	captureDirPerm = 0o700 // Captures hold prompts
+
+	// Run flag overriding debug.capture_dir
+	captureDirFlag = "--capture-dir"
+)
+
+// captureSkippedHeaders are never written to capture files
+var captureSkippedHeaders = map[string]bool{
+	"Authorization": true,
+	"X-Api-Key":     true,
+	"Cookie":        true,
+}
+
+// CapturedRequest is a chat completion request saved for replay
+type CapturedRequest struct {
+	CapturedAt time.Time         `json:"captured_at"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       json.RawMessage   `json:"body"`
+}
+
+// captureRequest writes the client's chat request to debug.capture_dir, if set.
+// Failures are logged and never fail the request.
+func (s *ProxyService) captureRequest(r *http.Request, body []byte) {
+	dir := s.config.Debug.CaptureDir
+	if dir == "" {
+		return
+	}
+
+	captured := CapturedRequest{
+		CapturedAt: time.Now().UTC(),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: getClientIP(r),
+		Headers:    make(map[string]string),
+		Body:       body,
+	}
+	for name, values := range r.Header {
+		if !captureSkippedHeaders[http.CanonicalHeaderKey(name)] {
+			captured.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	path, err := writeCapture(dir, &captured)
+	if err != nil {
+		Warn("Failed to capture request", "dir", dir, "error", err)
+		return
+	}
+	Debug("Captured request", "file", path)
+}
+
+// writeCapture stores a capture in its own file under dir and returns the path
+func writeCapture(dir string, captured *CapturedRequest) (string, error) {
+	if err := os.MkdirAll(dir, captureDirPerm); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(captured, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(dir, "request-"+captured.CapturedAt.Format("20060102T150405")+"-*.json")
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// LoadCapturedRequest reads a capture file written with debug.capture_dir
+func LoadCapturedRequest(path string) (*CapturedRequest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var captured CapturedRequest
+	if err := json.Unmarshal(data, &captured); err != nil {
+		return nil, NewValidationError("file", path, "not a captured request", err)
+	}
+	if len(captured.Body) == 0 {
+		return nil, NewValidationError("body", path, "captured request has no body", nil)
+	}
+	if captured.Method == "" {
+		captured.Method = http.MethodPost
+	}
+	if captured.Path == "" {
+		captured.Path = "/v1/chat/completions"
+	}
+	return &captured, nil
+}
+
+// Request rebuilds the captured request for the proxy handler
+func (c *CapturedRequest) Request() (*http.Request, error) {
+	req, err := http.NewRequest(c.Method, "http://localhost"+c.Path, bytes.NewReader(c.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	// Print the response as sent, not compressed
+	req.Header.Del("Accept-Encoding")
+	return req, nil
+}
+
+// replayResponseWriter prints a response as it arrives: status line, headers, then body
+type replayResponseWriter struct {
+	out         io.Writer
+	header      http.Header
+	status      int
+	wroteHeader bool
+}
+
+func newReplayResponseWriter(out io.Writer) *replayResponseWriter {
+	return &replayResponseWriter{out: out, header: make(http.Header)}
+}
+
+func (rw *replayResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *replayResponseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.status = statusCode
+	fmt.Fprintf(rw.out, "HTTP %d %s\n", statusCode, http.StatusText(statusCode))
+	_ = rw.header.Write(rw.out)
+	fmt.Fprintln(rw.out)
+}
+
+func (rw *replayResponseWriter) Write(data []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.out.Write(data)
+}
+
+// Flush is a no-op; writes go straight to the output
+func (rw *replayResponseWriter) Flush() {}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// newHalfOpenReadyBreaker returns an open breaker whose timeout has already elapsed
+func newHalfOpenReadyBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		state:           CircuitOpen,
+		failureCount:    circuitBreakerFailureThreshold,
+		lastFailureTime: time.Now().Add(-time.Minute),
+		timeout:         time.Second,
+	}
+}
+
+// admitConcurrently calls canExecute from n goroutines at once and returns the probe IDs admitted
+func admitConcurrently(cb *CircuitBreaker, n int) []uint64 {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		admitted []uint64
+		start    = make(chan struct{})
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if ok, probe := cb.canExecute(); ok {
+				mu.Lock()
+				admitted = append(admitted, probe)
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return admitted
+}
+
+func TestCircuitBreaker_HalfOpenAdmitsSingleProbe(t *testing.T) {
+	cb := newHalfOpenReadyBreaker()
+
+	admitted := admitConcurrently(cb, 50)
+	if len(admitted) != 1 {
+		t.Fatalf("Expected exactly one request admitted in half-open, got %d", len(admitted))
+	}
+	if admitted[0] == 0 {
+		t.Error("Expected the admitted request to carry a probe ID")
+	}
+	if cb.State() != CircuitHalfOpen {
+		t.Errorf("Expected half-open state while probing, got %v", cb.State())
+	}
+	if ok, _ := cb.canExecute(); ok {
+		t.Error("Expected requests to fail fast while the probe is in flight")
+	}
+}
+
+func TestCircuitBreaker_ProbeOutcome(t *testing.T) {
+	t.Run("success closes the circuit", func(t *testing.T) {
+		cb := newHalfOpenReadyBreaker()
+		if ok, _ := cb.canExecute(); !ok {
+			t.Fatal("Expected the probe to be admitted")
+		}
+		cb.onSuccess()
+
+		if cb.State() != CircuitClosed {
+			t.Errorf("Expected closed state, got %v", cb.State())
+		}
+		if admitted := admitConcurrently(cb, 10); len(admitted) != 10 {
+			t.Errorf("Expected all requests admitted once closed, got %d", len(admitted))
+		}
+	})
+
+	t.Run("failure re-opens the circuit", func(t *testing.T) {
+		cb := newHalfOpenReadyBreaker()
+		if ok, _ := cb.canExecute(); !ok {
+			t.Fatal("Expected the probe to be admitted")
+		}
+		cb.onFailure()
+
+		if cb.State() != CircuitOpen {
+			t.Errorf("Expected open state, got %v", cb.State())
+		}
+		if ok, _ := cb.canExecute(); ok {
+			t.Error("Expected requests to be rejected until the timeout elapses again")
+		}
+	})
+
+	t.Run("abandoned probe frees the slot", func(t *testing.T) {
+		cb := newHalfOpenReadyBreaker()
+		_, first := cb.canExecute()
+		cb.endProbe(first)
+
+		ok, second := cb.canExecute()
+		if !ok {
+			t.Fatal("Expected a new probe after the first ended without an outcome")
+		}
+
+		// A late release of the first probe must not free the second one's slot
+		cb.endProbe(first)
+		if ok, _ := cb.canExecute(); ok {
+			t.Error("Expected a stale endProbe to leave the current probe in place")
+		}
+		cb.endProbe(second)
+	})
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBreakerGroup keys requests without a recognised model, including the
+// reverse-proxied endpoints
+const defaultBreakerGroup = "default"
+
+// errCircuitOpen is returned when the breaker for a request's model group is open
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// modelGroupPrefixes maps Copilot model ID prefixes to the backend serving them
+var modelGroupPrefixes = []struct{ prefix, group string }{
+	{"claude", "anthropic"},
+	{"gemini", "google"},
+	{"gpt", "openai"},
+	{"o1", "openai"},
+	{"o3", "openai"},
+	{"o4", "openai"},
+	{"text-embedding", "openai"},
+	{"grok", "xai"},
+}
+
+// modelGroup returns the circuit breaker key for a normalized model ID, so one failing
+// backend does not trip requests for models served elsewhere
+func modelGroup(model string) string {
+	model = strings.ToLower(model)
+	for _, p := range modelGroupPrefixes {
+		if strings.HasPrefix(model, p.prefix) {
+			return p.group
+		}
+	}
+	return defaultBreakerGroup
+}
+
+// String returns the state name reported in health details
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreakerSet holds one circuit breaker per model group, created on first use
+type circuitBreakerSet struct {
+	timeout  time.Duration
+	disabled bool
+
+	mutex    sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+func newCircuitBreakerSet(timeout time.Duration, disabled bool) *circuitBreakerSet {
+	return &circuitBreakerSet{timeout: timeout, disabled: disabled, breakers: make(map[string]*CircuitBreaker)}
+}
+
+// get returns the breaker for group
+func (cs *circuitBreakerSet) get(group string) *CircuitBreaker {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cb, ok := cs.breakers[group]
+	if !ok {
+		cb = &CircuitBreaker{state: CircuitClosed, timeout: cs.timeout, disabled: cs.disabled}
+		cs.breakers[group] = cb
+	}
+	return cb
+}
+
+// States returns the state of every breaker created so far, keyed by group
+func (cs *circuitBreakerSet) States() map[string]CircuitBreakerState {
+	cs.mutex.Lock()
+	breakers := make(map[string]*CircuitBreaker, len(cs.breakers))
+	for group, cb := range cs.breakers {
+		breakers[group] = cb
+	}
+	cs.mutex.Unlock()
+
+	states := make(map[string]CircuitBreakerState, len(breakers))
+	for group, cb := range breakers {
+		states[group] = cb.State()
+	}
+	return states
+}
+
+// State aggregates the breakers: open only when every group is open, half-open when
+// some are open or recovering, and closed otherwise
+func (cs *circuitBreakerSet) State() CircuitBreakerState {
+	states := cs.States()
+	open, closed := 0, 0
+	for _, state := range states {
+		switch state {
+		case CircuitOpen:
+			open++
+		case CircuitClosed:
+			closed++
+		}
+	}
+	switch {
+	case closed == len(states):
+		return CircuitClosed
+	case open == len(states):
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+// Worst returns the most severe group state: open when any group is open, half-open
+// when any is recovering, and closed otherwise. This is what the single breaker used
+// to report, so github_copilot_circuit_breaker_state keeps its meaning.
+func (cs *circuitBreakerSet) Worst() CircuitBreakerState {
+	worst := CircuitClosed
+	for _, state := range cs.States() {
+		switch state {
+		case CircuitOpen:
+			return CircuitOpen
+		case CircuitHalfOpen:
+			worst = CircuitHalfOpen
+		}
+	}
+	return worst
+}
@@ -1,28 +1,73 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
 )
 
 // Command constants to avoid goconst errors
 const (
-	cmdAuth    = "auth"
-	cmdRun     = "run"
-	cmdStart   = "start"
-	cmdModels  = "models"
-	cmdConfig  = "config"
-	cmdStatus  = "status"
-	cmdRefresh = "refresh"
+	cmdAuth        = "auth"
+	cmdRun         = "run"
+	cmdStart       = "start"
+	cmdModels      = "models"
+	cmdConfig      = "config"
+	cmdStatus      = "status"
+	cmdRefresh     = "refresh"
+	cmdReplay      = "replay"
+	cmdPrune       = "prune"
+	cmdHeaders     = "headers"
+	cmdStats       = "stats"
+	cmdHealthcheck = "healthcheck"
 
 	// Constants to avoid magic numbers
 	defaultRefreshThreshold = 300 // 5 minutes minimum refresh threshold
 	secondsInMinute         = 60
 	refreshPercentThreshold = 5 // 20% = 1/5
+
+	// Output formats for the models command
+	modelsFormatList = "list"
+	modelsFormatWide = "wide"
+	modelsFormatJSON = "json"
+
+	// Headless mode: fail instead of starting the interactive device flow
+	noAuthPromptFlag = "--no-auth-prompt"
+	noAuthPromptEnv  = "COPILOT_NO_AUTH_PROMPT"
+
+	// auth flags: the device flow (default), an existing GitHub token or the gh CLI's token
+	authDeviceFlag = "--device"
+	authTokenFlag  = "--token"
+	authGHFlag     = "--gh"
+
+	// auth --token - reads the token from stdin; --token-env names a variable holding it.
+	// Both keep the token out of argv, where other users can see it in the process list.
+	authTokenStdin   = "-"
+	authTokenEnvFlag = "--token-env"
+	maxAuthTokenSize = 64 << 10
+
+	// HTTPS listener flags, overriding tls.cert_file and tls.key_file
+	tlsCertFlag = "--tls-cert"
+	tlsKeyFlag  = "--tls-key"
+
+	// Global deadline for one-off commands
+	timeoutFlag = "--timeout"
+
+	// Run flag overriding debug.disable_circuit_breaker
+	failFastFlag = "--fail-fast"
 )
 
 // PrintUsage prints the command usage information
@@ -32,52 +77,175 @@ func PrintUsage() {
 A reverse proxy for GitHub Copilot providing OpenAI-compatible endpoints.
 
 Usage:
-  %s [command] [options]
+  %[1]s [command] [options]
 
 Commands:
   start    Start the proxy server (default)
-  auth     Authenticate with GitHub Copilot using device flow
+  auth     Authenticate with GitHub Copilot using device flow (--token -, --token-env <VAR> or --gh to use a GitHub token;
+           prefer these to --token <t>, which leaves the token visible in the process list)
   status   Show detailed authentication and token status
   config   Display current configuration details
+  headers  Show the headers sent with upstream chat requests (token redacted)
   models   List all available AI models
+  stats    Show the usage recorded by the server (requests, tokens, errors per model)
   refresh  Manually force token refresh
+  replay   Resend a captured request (replay <file>) and print the response
+  prune    List stale caches and leftover files in the config directory (--delete removes them)
+  healthcheck  Query /health on the configured port; exit 0 when the server is healthy
   help     Show this help message
   version  Show version information
 
 Examples:
-  %s auth                    # Authenticate with GitHub
-  %s run --port 8080         # Run server on port 8080
-  %s status --json           # Show status in JSON format
+  %[1]s auth                    # Authenticate with GitHub
+  %[1]s auth --token - < token.txt  # Use an existing GitHub token read from stdin
+  %[1]s auth --token-env GH_PAT  # Use the GitHub token in $GH_PAT
+  %[1]s auth --gh               # Use the token of the logged-in GitHub CLI (gh)
+  %[1]s run --port 8080         # Run server on port 8080
+  %[1]s status --json           # Show status in JSON format
+  %[1]s config --json           # Show the effective configuration in JSON format
+  %[1]s headers                 # Show the editor headers sent to the Copilot API
+  %[1]s models --wide           # List models with owner and release date
+  %[1]s stats --json            # Show recorded usage in JSON format
+  %[1]s start --no-auth-prompt  # Fail instead of prompting when no token is available
+  %[1]s start --tls-cert cert.pem --tls-key key.pem  # Serve HTTPS
+  %[1]s start --capture-dir ./captures  # Save each chat request for replay
+  %[1]s start --self-test       # Send one tiny completion through the server before listening
+  %[1]s start --fail-fast       # Disable the circuit breaker to see every upstream error
+  %[1]s replay ./captures/request-20250101T120000-1234.json
+  %[1]s prune --delete          # Remove stale files from the config directory
 
 Environment Variables:
-  COPILOT_PORT      Server port (default: 8081)
-  GITHUB_TOKEN      GitHub OAuth token
-  COPILOT_TOKEN     GitHub Copilot API token
-  LOG_LEVEL         Log level (debug, info, warn, error)
+  COPILOT_PORT         Server port (default: 8081)
+  GITHUB_TOKEN         GitHub OAuth token
+  COPILOT_TOKEN        GitHub Copilot API token
+  COPILOT_API_KEY      API key for protected endpoints (e.g. /metrics)
+  COPILOT_SVCS_CONFIG  Path to the config file
+  COPILOT_NO_AUTH_PROMPT  Set to true for headless mode (same as --no-auth-prompt)
+  LOG_LEVEL            Log level (debug, info, warn, error)
+  LOG_REDACTION        How message content in logged bodies is hidden (hash, truncate)
+  LOG_UNSAFE           Set to true to log prompts and model output in full
+
+Global Options:
+  -v, --verbose        Enable debug logging (overrides LOG_LEVEL)
+  -q, --quiet          Only log errors (overrides LOG_LEVEL)
+  --timeout DURATION   Abort a one-off command after DURATION (e.g. 30s); no deadline by default
 
 Options:
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+`, os.Args[0])
 	flag.PrintDefaults()
 }
 
+// ParseGlobalFlags removes the global -v/--verbose and -q/--quiet flags from args and
+// returns the remaining arguments with the log level they select ("" when neither is set).
+// When both are given the last one wins.
+func ParseGlobalFlags(args []string) (rest []string, logLevel string) {
+	rest = make([]string, 0, len(args))
+	for _, arg := range args {
+		switch arg {
+		case "-v", "--verbose":
+			logLevel = "debug"
+		case "-q", "--quiet":
+			logLevel = "error"
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return rest, logLevel
+}
+
+// ParseTimeoutFlag removes the global -timeout/--timeout flag from args, given as
+// "--timeout 30s" or "--timeout=30s", and returns the remaining arguments with the
+// deadline it sets (0 when absent). When given more than once the last one wins.
+func ParseTimeoutFlag(args []string) (rest []string, timeout time.Duration, err error) {
+	rest = make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if name != timeoutFlag && name != timeoutFlag[1:] {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, 0, NewValidationError("flag", arg, "usage: --timeout <duration>", nil)
+			}
+			i++
+			value = args[i]
+		}
+		timeout, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, 0, NewValidationError("timeout", value, "invalid duration (e.g. 30s, 2m)", err)
+		}
+		if timeout <= 0 {
+			return nil, 0, NewValidationError("timeout", value, "timeout must be positive", nil)
+		}
+	}
+	return rest, timeout, nil
+}
+
+// newHTTPClient builds the HTTP client used by CLI commands; replaced in tests
+var newHTTPClient = CreateHTTPClient
+
 // RunCommand executes the specified command with arguments
 func RunCommand(command string, args []string, version string) error {
+	return RunCommandContext(context.Background(), command, args, version)
+}
+
+// RunCommandContext executes the specified command, aborting its network calls and
+// waits once ctx is done. A deadline on ctx only applies to one-off commands; the
+// server is long-running and refuses one.
+func RunCommandContext(ctx context.Context, command string, args []string, version string) error {
+	if _, ok := ctx.Deadline(); ok && (command == cmdRun || command == cmdStart) {
+		return NewValidationError("flag", timeoutFlag, "--timeout is not supported for the server", nil)
+	}
+
+	err := runCommand(ctx, command, args, version)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s did not finish before the %s deadline: %w", command, timeoutFlag, ctx.Err())
+	}
+	return err
+}
+
+func runCommand(ctx context.Context, command string, args []string, version string) error {
 	// Check for flags
-	jsonOutput := len(args) >= 1 && args[0] == "--json"
+	jsonOutput := len(args) >= 1 && (args[0] == "--json" || args[0] == "-json")
 
 	switch command {
 	case cmdAuth:
-		return handleAuth()
+		githubToken, fromGH, err := parseAuthToken(args, os.Stdin)
+		if err != nil {
+			return err
+		}
+		if fromGH {
+			if githubToken, err = ghAuthToken(ctx); err != nil {
+				return err
+			}
+		}
+		return handleAuth(ctx, githubToken)
 	case cmdRun, cmdStart:
-		return handleRun()
+		return handleRun(parseRunOptions(args))
 	case cmdModels:
-		return handleModels()
+		format, err := parseModelsFormat(args)
+		if err != nil {
+			return err
+		}
+		return handleModels(ctx, format)
 	case cmdConfig:
-		return handleConfig()
+		return handleConfig(jsonOutput)
 	case cmdStatus:
 		return handleStatusWithFormat(jsonOutput)
+	case cmdHeaders:
+		return handleHeaders(jsonOutput)
+	case cmdStats:
+		return handleStats(jsonOutput)
 	case cmdRefresh:
-		return handleRefresh()
+		return handleRefresh(ctx)
+	case cmdReplay:
+		return handleReplay(ctx, args)
+	case cmdPrune:
+		return handlePrune(args)
+	case cmdHealthcheck:
+		return handleHealthcheck(ctx)
 	case "version":
 		fmt.Printf("github-copilot-svcs version %s\n", version)
 		return nil
@@ -87,23 +255,91 @@ func RunCommand(command string, args []string, version string) error {
 	default:
 		logger.Error("Unknown command", "command", command)
 		PrintUsage()
-		return fmt.Errorf("unknown command: %s", command)
+		return NewValidationError("command", command, "unknown command", nil)
 	}
 }
 
-func handleAuth() error {
+// parseAuthToken returns the GitHub token given with --token, or "" for the device flow.
+// "--token -" reads it from stdin and "--token-env VAR" from the environment, which keeps
+// it out of argv. fromGH reports that --gh asks for the GitHub CLI's token instead.
+func parseAuthToken(args []string, stdin io.Reader) (token string, fromGH bool, err error) {
+	var (
+		sources int
+		device  bool
+		envName string
+	)
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == authDeviceFlag:
+			device = true
+		case arg == authGHFlag:
+			fromGH = true
+		case (arg == authTokenFlag || arg == authTokenEnvFlag) && i+1 < len(args):
+			if arg == authTokenFlag {
+				token = args[i+1]
+			} else {
+				envName = args[i+1]
+			}
+			sources++
+			i++
+		case strings.HasPrefix(arg, authTokenFlag+"="):
+			token = strings.TrimPrefix(arg, authTokenFlag+"=")
+			sources++
+		case strings.HasPrefix(arg, authTokenEnvFlag+"="):
+			envName = strings.TrimPrefix(arg, authTokenEnvFlag+"=")
+			sources++
+		default:
+			return "", false, NewValidationError("flag", arg, "usage: auth [--device | --token <github_token|-> | --token-env <VAR> | --gh]", nil)
+		}
+	}
+	withToken := sources > 0
+	if sources > 1 || (device && withToken) || (device && fromGH) || (withToken && fromGH) {
+		return "", false, NewValidationError("flag", strings.Join(args, " "), "--device, --token, --token-env and --gh are mutually exclusive", nil)
+	}
+
+	switch {
+	case envName != "":
+		token = os.Getenv(envName)
+		if token == "" {
+			return "", false, NewValidationError("flag", authTokenEnvFlag, fmt.Sprintf("environment variable %s is not set", envName), nil)
+		}
+	case token == authTokenStdin:
+		data, err := io.ReadAll(io.LimitReader(stdin, maxAuthTokenSize))
+		if err != nil {
+			return "", false, NewValidationError("flag", authTokenFlag, "failed to read the GitHub token from stdin", err)
+		}
+		token = string(data)
+	}
+	token = strings.TrimSpace(token)
+	if withToken && token == "" {
+		return "", false, NewValidationError("flag", authTokenFlag, "GitHub token must not be empty", nil)
+	}
+	return token, fromGH, nil
+}
+
+// handleAuth runs the device flow, or exchanges githubToken directly when set
+func handleAuth(ctx context.Context, githubToken string) error {
 	cfg, err := LoadConfig(true)
 	if err != nil {
-		return fmt.Errorf("failed to load config: %v", err)
+		return NewConfigError("config_file", "", "failed to load config", err)
 	}
 
 	// Create HTTP client with timeouts
-	httpClient := CreateHTTPClient(cfg)
+	httpClient := commandHTTPClient(ctx, cfg)
 	authService := NewAuthService(httpClient)
 
+	if githubToken != "" {
+		fmt.Println("Exchanging GitHub token for a Copilot token...")
+		if err := authService.AuthenticateWithToken(cfg, githubToken); err != nil {
+			return err
+		}
+		fmt.Println("Authentication successful!")
+		return nil
+	}
+
 	fmt.Println("Starting GitHub Copilot authentication...")
-	if err := authService.Authenticate(cfg); err != nil {
-		return fmt.Errorf("authentication failed: %v", err)
+	if err := authService.AuthenticateWithContext(ctx, cfg); err != nil {
+		return NewAuthError("authentication failed", err)
 	}
 
 	fmt.Println("Authentication successful!")
@@ -117,7 +353,7 @@ func handleStatusWithFormat(jsonOutput bool) error {
 			fmt.Println("Not authenticated. Run 'auth' to authenticate.")
 			return nil
 		}
-		return fmt.Errorf("failed to load config: %v", err)
+		return NewConfigError("config_file", "", "failed to load config", err)
 	}
 
 	if jsonOutput {
@@ -211,19 +447,152 @@ func printStatusText(cfg *Config) error {
 	return nil
 }
 
-func handleConfig() error {
+func handleConfig(jsonOutput bool) error {
 	cfg, err := LoadConfig()
 	if err != nil {
 		if strings.Contains(err.Error(), "either github_token or copilot_token must be provided") {
 			fmt.Println("Not authenticated. Run 'auth' to authenticate.")
 			return nil
 		}
-		return fmt.Errorf("failed to load config: %v", err)
+		return NewConfigError("config_file", "", "failed to load config", err)
+	}
+
+	if jsonOutput {
+		return printConfigJSON(cfg)
 	}
+	printConfigText(cfg)
+	return nil
+}
+
+// handleHeaders prints the headers the proxy attaches to an upstream chat request, so
+// upstream rejections of the editor identity can be debugged. The token is redacted.
+func handleHeaders(jsonOutput bool) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		if strings.Contains(err.Error(), "either github_token or copilot_token must be provided") {
+			fmt.Println("Not authenticated. Run 'auth' to authenticate.")
+			return nil
+		}
+		return NewConfigError("config_file", "", "failed to load config", err)
+	}
+
+	headers := upstreamChatHeaders(cfg)
+	if jsonOutput {
+		out := make(map[string]string, len(headers))
+		for name := range headers {
+			out[name] = headers.Get(name)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+			return fmt.Errorf("failed to encode headers as JSON: %w", err)
+		}
+		return nil
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("Headers sent with upstream chat requests to %s:\n", copilotAPIBase)
+	for _, name := range names {
+		fmt.Printf("  %s: %s\n", name, headers.Get(name))
+	}
+	if cfg.Proxy.AcceptEncoding == "" || cfg.Proxy.AcceptEncoding == acceptEncodingAuto {
+		fmt.Printf("\nStreaming requests also send Accept-Encoding: %s.\n", acceptEncodingIdentity)
+	}
+	fmt.Printf("Clients may override Openai-Intent with a known %s header.\n", copilotIntentHeader)
+	return nil
+}
+
+// handleStats prints the usage statistics saved by a server running with stats.enabled
+func handleStats(jsonOutput bool) error {
+	cfg, err := LoadConfig(true)
+	if err != nil {
+		return NewConfigError("config_file", "", "failed to load config", err)
+	}
+	path, err := statsFilePath(cfg)
+	if err != nil {
+		return NewConfigError("stats.file", "", "cannot locate the usage statistics file", err)
+	}
+	stats, err := LoadUsageStats(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewConfigError("stats.file", path, "no usage recorded yet; set stats.enabled and run the server", err)
+	}
+	if err != nil {
+		return NewConfigError("stats.file", path, "failed to read usage statistics", err)
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(stats); err != nil {
+			return fmt.Errorf("failed to encode usage statistics as JSON: %w", err)
+		}
+		return nil
+	}
+	return printUsageStats(os.Stdout, stats)
+}
+
+// upstreamChatHeaders returns the headers of an upstream chat request that sets no
+// client intent, with the Copilot token redacted
+func upstreamChatHeaders(cfg *Config) http.Header {
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/json")
+	setUpstreamHeaders(headers, cfg, redactedValue, cfg.Headers.OpenaiIntent)
+	if cfg.CopilotToken == "" {
+		headers.Set("Authorization", "(no Copilot token yet; one is exchanged for the GitHub token on the first request)")
+	}
+	if cfg.Proxy.AcceptEncoding == acceptEncodingIdentity {
+		headers.Set("Accept-Encoding", acceptEncodingIdentity)
+	}
+	return headers
+}
+
+// listenAddress returns the address the server binds to
+func listenAddress(cfg *Config) string {
+	scheme := "http"
+	if cfg.TLSEnabled() {
+		scheme = "https"
+	}
+	if path, ok := unixSocketPath(cfg.Host); ok {
+		return unixSocketPrefix + "//" + path
+	}
+	host := cfg.Host
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s://%s", scheme, tcpListenAddress(host, cfg.Port))
+}
+
+// printConfigJSON prints the effective configuration, after defaults, without secrets
+func printConfigJSON(cfg *Config) error {
+	path, _ := GetConfigPath()
+
+	out := map[string]interface{}{
+		"config_file":       path,
+		"port":              cfg.Port,
+		"listen_address":    listenAddress(cfg),
+		"upstream_base":     copilotAPIBase,
+		"has_github_token":  cfg.GitHubToken != "",
+		"has_copilot_token": cfg.CopilotToken != "",
+		"token_expires_at":  cfg.ExpiresAt,
+		"headers":           cfg.Headers,
+		"cors":              cfg.CORS,
+		"timeouts":          cfg.Timeouts,
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+		return fmt.Errorf("failed to encode config as JSON: %w", err)
+	}
+	return nil
+}
 
+func printConfigText(cfg *Config) {
 	path, _ := GetConfigPath()
 	fmt.Printf("Configuration file: %s\n", path)
 	fmt.Printf("Port: %d\n", cfg.Port)
+	fmt.Printf("Listen address: %s\n", listenAddress(cfg))
+	fmt.Printf("Upstream base: %s\n", copilotAPIBase)
 	fmt.Printf("Has GitHub token: %t\n", cfg.GitHubToken != "")
 	fmt.Printf("Has Copilot token: %t\n", cfg.CopilotToken != "")
 	if cfg.ExpiresAt > 0 {
@@ -238,103 +607,361 @@ func handleConfig() error {
 	fmt.Printf("  Openai-Intent: %s\n", cfg.Headers.OpenaiIntent)
 	fmt.Printf("  X-Initiator: %s\n", cfg.Headers.XInitiator)
 
-	return nil
+	fmt.Printf("\nCORS:\n")
+	fmt.Printf("  Allowed origins: %s\n", strings.Join(cfg.CORS.AllowedOrigins, ", "))
+	fmt.Printf("  Allowed headers: %s\n", strings.Join(cfg.CORS.AllowedHeaders, ", "))
+
+	// Effective values, with defaults applied for fields the config file omits
+	fmt.Printf("\nTimeouts:\n")
+	for _, timeout := range effectiveTimeouts(cfg) {
+		fmt.Printf("  %s: %s\n", timeout.name, timeout.value)
+	}
+}
+
+// timeoutSetting is one effective timeout as shown by the config command and the
+// startup summary
+type timeoutSetting struct {
+	name  string
+	value string
+}
+
+// routeSeconds shows a route timeout in seconds, naming proxy_context when the route
+// has no timeout of its own
+func routeSeconds(name string, configured int, effective time.Duration) timeoutSetting {
+	value := fmt.Sprintf("%ds", int(effective.Seconds()))
+	if configured <= 0 {
+		value += " (proxy_context)"
+	}
+	return timeoutSetting{name, value}
+}
+
+// effectiveTimeouts returns the timeouts cfg runs with, in display order
+func effectiveTimeouts(cfg *Config) []timeoutSetting {
+	t := cfg.Timeouts
+	seconds := func(name string, value int) timeoutSetting {
+		return timeoutSetting{name, fmt.Sprintf("%ds", value)}
+	}
+	// first_byte and queue_wait are off at 0
+	optionalSeconds := func(name string, value int) timeoutSetting {
+		if value <= 0 {
+			return timeoutSetting{name, "0s (off)"}
+		}
+		return seconds(name, value)
+	}
+	return []timeoutSetting{
+		seconds("http_client", t.HTTPClient),
+		seconds("server_read", t.ServerRead),
+		seconds("server_write", t.ServerWrite),
+		seconds("server_idle", t.ServerIdle),
+		seconds("proxy_context", t.ProxyContext),
+		seconds("max_proxy_context", t.MaxProxyContext),
+		routeSeconds("chat", t.Chat, routeTimeout(cfg, "/v1/chat/completions")),
+		routeSeconds("models", t.Models, routeTimeout(cfg, "/v1/models")),
+		optionalSeconds("first_byte", t.FirstByte),
+		optionalSeconds("queue_wait", t.QueueWait),
+		seconds("upstream_acquire", t.UpstreamAcquire),
+		seconds("circuit_breaker", t.CircuitBreaker),
+		seconds("keep_alive", t.KeepAlive),
+		seconds("tls_handshake", t.TLSHandshake),
+		seconds("dial_timeout", t.DialTimeout),
+		seconds("idle_conn_timeout", t.IdleConnTimeout),
+	}
 }
 
 func getCurrentTime() int64 {
 	return time.Now().Unix()
 }
 
-func handleRun() error {
+// isHeadless reports whether the interactive device flow is disabled, via
+// --no-auth-prompt or COPILOT_NO_AUTH_PROMPT
+func isHeadless(args []string) bool {
+	for _, arg := range args {
+		if arg == noAuthPromptFlag {
+			return true
+		}
+	}
+	headless, _ := strconv.ParseBool(os.Getenv(noAuthPromptEnv))
+	return headless
+}
+
+// runOptions are the command-line options of run/start
+type runOptions struct {
+	headless   bool
+	tlsCert    string
+	tlsKey     string
+	captureDir string
+	selfTest   bool
+	failFast   bool
+}
+
+// parseRunOptions reads --no-auth-prompt, --tls-cert, --tls-key, --capture-dir, --self-test
+// and --fail-fast
+func parseRunOptions(args []string) runOptions {
+	opts := runOptions{headless: isHeadless(args)}
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == tlsCertFlag && i+1 < len(args):
+			i++
+			opts.tlsCert = args[i]
+		case strings.HasPrefix(arg, tlsCertFlag+"="):
+			opts.tlsCert = strings.TrimPrefix(arg, tlsCertFlag+"=")
+		case arg == tlsKeyFlag && i+1 < len(args):
+			i++
+			opts.tlsKey = args[i]
+		case strings.HasPrefix(arg, tlsKeyFlag+"="):
+			opts.tlsKey = strings.TrimPrefix(arg, tlsKeyFlag+"=")
+		case arg == captureDirFlag && i+1 < len(args):
+			i++
+			opts.captureDir = args[i]
+		case strings.HasPrefix(arg, captureDirFlag+"="):
+			opts.captureDir = strings.TrimPrefix(arg, captureDirFlag+"=")
+		case arg == selfTestFlag:
+			opts.selfTest = true
+		case arg == failFastFlag:
+			opts.failFast = true
+		}
+	}
+	return opts
+}
+
+func handleRun(opts runOptions) error {
+	if l := GetLogger(); l != nil {
+		Info("Log level configured", "level", l.LevelName())
+	}
+
 	cfg, err := LoadConfig()
 	if err != nil {
 		if strings.Contains(err.Error(), "either github_token or copilot_token must be provided") {
-			if authErr := handleAuth(); authErr != nil {
-				return fmt.Errorf("authentication failed: %v", authErr)
+			if opts.headless {
+				// Nobody can answer the device-code prompt; exit so the failure is visible
+				return NewAuthError("no token configured and interactive authentication is disabled; run 'auth' or set GITHUB_TOKEN", nil)
+			}
+			if authErr := handleAuth(context.Background(), ""); authErr != nil {
+				return NewAuthError("authentication failed", authErr)
 			}
 			cfg, err = LoadConfig()
 			if err != nil {
-				return fmt.Errorf("failed to load config after authentication: %v", err)
+				return NewConfigError("config_file", "", "failed to load config after authentication", err)
 			}
 		} else {
-			return fmt.Errorf("failed to load config: %v", err)
+			return NewConfigError("config_file", "", "failed to load config", err)
 		}
 	}
 
+	// TLS flags take precedence over the config file
+	if opts.tlsCert != "" {
+		cfg.TLS.CertFile = opts.tlsCert
+	}
+	if opts.tlsKey != "" {
+		cfg.TLS.KeyFile = opts.tlsKey
+	}
+	if err := cfg.validateTLS(); err != nil {
+		return NewConfigError("tls", "", "invalid TLS options", err)
+	}
+	if opts.captureDir != "" {
+		cfg.Debug.CaptureDir = opts.captureDir
+	}
+	if cfg.Debug.CaptureDir != "" {
+		Warn("Capturing chat requests, including prompts, to disk", "dir", cfg.Debug.CaptureDir)
+	}
+	if opts.failFast {
+		cfg.Debug.DisableCircuitBreaker = true
+	}
+
 	// Create HTTP client and auth service
-	httpClient := CreateHTTPClient(cfg)
+	httpClient := newHTTPClient(cfg)
 	authService := NewAuthService(httpClient)
 
-	// Ensure we're authenticated
+	// Ensure we're authenticated. Headless services may only have a GitHub token,
+	// which is exchanged for a Copilot token without prompting.
+	if opts.headless && cfg.CopilotToken == "" && cfg.GitHubToken != "" {
+		if err := authService.RefreshToken(cfg); err != nil {
+			return NewAuthError("token refresh failed and interactive authentication is disabled", err)
+		}
+	}
 	if err := authService.EnsureValidToken(cfg); err != nil {
-		return fmt.Errorf("authentication failed: %v", err)
+		return NewAuthError("authentication failed", err)
 	}
 
 	// Create and start server
-	srv := NewServer(cfg, httpClient)
+	var serverOpts []func(*Server)
+	if opts.selfTest {
+		serverOpts = append(serverOpts, WithSelfTest())
+	}
+	srv := NewServer(cfg, httpClient, serverOpts...)
 	return srv.Start()
 }
 
-func handleModels() error {
+// handleReplay sends a captured request through the full proxy path and prints the response
+func handleReplay(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] == "" {
+		return NewValidationError("file", "", "usage: replay <capture-file>", nil)
+	}
+	captured, err := LoadCapturedRequest(args[0])
+	if err != nil {
+		return NewValidationError("file", args[0], "failed to read captured request", err)
+	}
+	req, err := captured.Request()
+	if err != nil {
+		return NewValidationError("file", args[0], "invalid captured request", err)
+	}
+
 	cfg, err := LoadConfig()
 	if err != nil {
 		if strings.Contains(err.Error(), "either github_token or copilot_token must be provided") {
-			fmt.Println("Not authenticated. Run 'auth' to authenticate.")
-			return nil
+			return NewAuthError("not authenticated; run 'auth' first", err)
 		}
-		return fmt.Errorf("failed to load config: %v", err)
+		return NewConfigError("config_file", "", "failed to load config", err)
 	}
+	// Don't capture the replay itself
+	cfg.Debug.CaptureDir = ""
 
-	// Create HTTP client and auth service
-	httpClient := CreateHTTPClient(cfg)
-	authService := NewAuthService(httpClient)
+	httpClient := commandHTTPClient(ctx, cfg)
+	if err := NewAuthService(httpClient).EnsureValidToken(cfg); err != nil {
+		return NewAuthError("authentication failed", err)
+	}
+
+	srv := NewServer(cfg, httpClient)
+	defer srv.workerPool.Stop()
 
-	// Ensure we're authenticated
-	if authErr := authService.EnsureValidToken(cfg); authErr != nil {
-		return fmt.Errorf("authentication failed: %v", authErr)
+	rw := newReplayResponseWriter(os.Stdout)
+	srv.Handler().ServeHTTP(rw, req.WithContext(ctx))
+	fmt.Println()
+
+	if rw.status >= http.StatusBadRequest {
+		return NewProxyError("replay", fmt.Sprintf("replayed request failed with HTTP %d", rw.status), nil)
 	}
+	return nil
+}
 
-	// Fetch models
-	modelList, err := FetchFromModelsDev(httpClient)
+// parseModelsFormat returns the output format selected by --json, --wide or --output
+func parseModelsFormat(args []string) (string, error) {
+	format := modelsFormatList
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--json":
+			format = modelsFormatJSON
+		case arg == "--wide":
+			format = modelsFormatWide
+		case arg == "--output" && i+1 < len(args):
+			i++
+			format = args[i]
+		case strings.HasPrefix(arg, "--output="):
+			format = strings.TrimPrefix(arg, "--output=")
+		}
+	}
+
+	switch format {
+	case modelsFormatList, modelsFormatWide, modelsFormatJSON:
+		return format, nil
+	default:
+		return "", NewValidationError("output", format, "unknown output format (expected list, wide or json)", nil)
+	}
+}
+
+// handleModels lists models from models.dev, which needs no authentication. When that
+// fails, the Copilot models API is tried if a token is configured, then the defaults.
+func handleModels(ctx context.Context, format string) error {
+	cfg, err := LoadConfig(true)
+	if err != nil {
+		return NewConfigError("config_file", "", "failed to load config", err)
+	}
+
+	httpClient := commandHTTPClient(ctx, cfg)
+	modelList, err := FetchFromModelsDevWithContext(ctx, httpClient)
 	if err != nil {
-		fmt.Printf("Failed to fetch models from models.dev: %v\n", err)
-		fmt.Println("Using default models:")
-		defaultModels := GetDefault()
-		for _, model := range defaultModels {
-			fmt.Printf("  - %s (%s)\n", model.ID, model.OwnedBy)
+		// Out of time: falling back to the defaults would hide the abort
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Keep JSON output parseable by sending the notice to stderr
+		notice := io.Writer(os.Stdout)
+		if format == modelsFormatJSON {
+			notice = os.Stderr
+		}
+		fmt.Fprintf(notice, "Failed to fetch models from models.dev: %v\n", err)
+
+		modelList = fetchCopilotModels(httpClient, cfg)
+		if modelList == nil {
+			fmt.Fprintln(notice, "Using default models:")
+			modelList = &transform.ModelList{Object: "list", Data: GetDefault()}
 		}
-		return nil
 	}
 
-	fmt.Printf("Available models (%d total):\n", len(modelList.Data))
-	for _, model := range modelList.Data {
-		fmt.Printf("  - %s (%s)\n", model.ID, model.OwnedBy)
+	sortModels(modelList)
+	return printModels(os.Stdout, modelList, format)
+}
+
+// fetchCopilotModels returns the Copilot API model list, or nil when there is no usable
+// token or the request fails. It never starts the device flow.
+func fetchCopilotModels(httpClient *http.Client, cfg *Config) *transform.ModelList {
+	if cfg.CopilotToken == "" {
+		return nil
 	}
+	if err := NewAuthService(httpClient).EnsureValidToken(cfg); err != nil {
+		Debug("Skipping Copilot models API", "error", err)
+		return nil
+	}
+	modelList, err := FetchFromCopilotAPI(httpClient, cfg)
+	if err != nil {
+		Debug("Failed to fetch from Copilot API", "error", err)
+		return nil
+	}
+	return modelList
+}
 
-	return nil
+// printModels writes the model list to w in the requested format
+func printModels(w io.Writer, modelList *transform.ModelList, format string) error {
+	switch format {
+	case modelsFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(modelList); err != nil {
+			return fmt.Errorf("failed to encode models as JSON: %w", err)
+		}
+		return nil
+	case modelsFormatWide:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tOWNER\tRELEASED")
+		for _, model := range modelList.Data {
+			released := model.ReleaseDate
+			if released == "" {
+				released = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", model.ID, model.OwnedBy, released)
+		}
+		return tw.Flush()
+	default:
+		fmt.Fprintf(w, "Available models (%d total):\n", len(modelList.Data))
+		for _, model := range modelList.Data {
+			fmt.Fprintf(w, "  - %s (%s)\n", model.ID, model.OwnedBy)
+		}
+		return nil
+	}
 }
 
-func handleRefresh() error {
+func handleRefresh(ctx context.Context) error {
 	cfg, err := LoadConfig()
 	if err != nil {
 		if strings.Contains(err.Error(), "either github_token or copilot_token must be provided") {
 			fmt.Println("Not authenticated. Run 'auth' to authenticate.")
 			return nil
 		}
-		return fmt.Errorf("failed to load config: %v", err)
+		return NewConfigError("config_file", "", "failed to load config", err)
 	}
 
 	if cfg.CopilotToken == "" {
-		return fmt.Errorf("no token to refresh - run 'auth' command first")
+		return NewAuthError("no token to refresh - run 'auth' command first", nil)
 	}
 
 	// Create HTTP client and auth service
-	httpClient := CreateHTTPClient(cfg)
+	httpClient := commandHTTPClient(ctx, cfg)
 	authService := NewAuthService(httpClient)
 
 	fmt.Println("Forcing token refresh...")
-	if err := authService.RefreshToken(cfg); err != nil {
-		return fmt.Errorf("token refresh failed: %v", err)
+	if err := authService.RefreshTokenWithContext(ctx, cfg); err != nil {
+		return NewAuthError("token refresh failed", err)
 	}
 
 	fmt.Printf("✅ Token refresh successful!\n")
@@ -348,3 +975,60 @@ func handleRefresh() error {
 
 	return nil
 }
+
+// commandHTTPClient returns the client for a CLI command, bounding every request it
+// sends by ctx so a --timeout also covers calls made without a context
+func commandHTTPClient(ctx context.Context, cfg *Config) *http.Client {
+	client := newHTTPClient(cfg)
+	if ctx.Done() == nil {
+		return client
+	}
+	bounded := *client
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	bounded.Transport = &contextTransport{ctx: ctx, next: transport}
+	return &bounded
+}
+
+// contextTransport cancels each request when either its own context or ctx is done
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(t.ctx, cancel)
+	release := func() {
+		stop()
+		cancel()
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		if ctxErr := t.ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody frees the request's context once the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
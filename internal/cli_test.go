@@ -2,8 +2,24 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
 )
 
 func captureStdout(f func()) string {
@@ -26,3 +42,961 @@ func TestPrintUsage(t *testing.T) {
 		t.Error("PrintUsage did not print anything")
 	}
 }
+
+func TestParseGlobalFlags(t *testing.T) {
+	rest, level := ParseGlobalFlags([]string{"-v", "models", "--json"})
+	if level != "debug" {
+		t.Errorf("expected debug level, got %q", level)
+	}
+	if strings.Join(rest, " ") != "models --json" {
+		t.Errorf("expected global flags to be removed, got %v", rest)
+	}
+
+	rest, level = ParseGlobalFlags([]string{"status", "--quiet"})
+	if level != "error" || strings.Join(rest, " ") != "status" {
+		t.Errorf("unexpected result: level=%q rest=%v", level, rest)
+	}
+
+	if _, level = ParseGlobalFlags([]string{"run"}); level != "" {
+		t.Errorf("expected no level override, got %q", level)
+	}
+}
+
+func TestParseTimeoutFlag(t *testing.T) {
+	rest, timeout, err := ParseTimeoutFlag([]string{"models", "--timeout", "5s", "--json"})
+	if err != nil || timeout != 5*time.Second || strings.Join(rest, " ") != "models --json" {
+		t.Errorf("unexpected result: rest=%v timeout=%v err=%v", rest, timeout, err)
+	}
+
+	if _, timeout, err = ParseTimeoutFlag([]string{"-timeout=2m", "refresh"}); err != nil || timeout != 2*time.Minute {
+		t.Errorf("expected -timeout=2m to parse, got timeout=%v err=%v", timeout, err)
+	}
+
+	if _, timeout, _ = ParseTimeoutFlag([]string{"status"}); timeout != 0 {
+		t.Errorf("expected no deadline by default, got %v", timeout)
+	}
+
+	for _, args := range [][]string{{"--timeout"}, {"--timeout", "soon"}, {"--timeout=0s"}, {"--timeout=-1s"}} {
+		var validationErr *ValidationError
+		if _, _, err := ParseTimeoutFlag(args); !errors.As(err, &validationErr) {
+			t.Errorf("%v: expected a validation error, got %v", args, err)
+		}
+	}
+}
+
+func testModelList() *transform.ModelList {
+	return &transform.ModelList{
+		Object: "list",
+		Data: []transform.Model{
+			{ID: "gpt-4", Object: "model", Created: 1700000000, OwnedBy: "openai", ReleaseDate: "2023-03-14"},
+			{ID: "claude-3-opus", Object: "model", Created: 1700000000, OwnedBy: "anthropic"},
+		},
+	}
+}
+
+func TestParseModelsFormat(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{args: nil, want: modelsFormatList},
+		{args: []string{"--wide"}, want: modelsFormatWide},
+		{args: []string{"--json"}, want: modelsFormatJSON},
+		{args: []string{"--output", "wide"}, want: modelsFormatWide},
+		{args: []string{"--output=json"}, want: modelsFormatJSON},
+		{args: []string{"--output=yaml"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseModelsFormat(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseModelsFormat(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseModelsFormat(%v) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPrintModelsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printModels(&buf, testModelList(), modelsFormatJSON); err != nil {
+		t.Fatalf("printModels failed: %v", err)
+	}
+
+	var raw struct {
+		Object string                   `json:"object"`
+		Data   []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &raw); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, buf.String())
+	}
+	if raw.Object != "list" || len(raw.Data) != 2 {
+		t.Fatalf("unexpected model list shape: %s", buf.String())
+	}
+	first := raw.Data[0]
+	for _, key := range []string{"id", "object", "created", "owned_by", "release_date"} {
+		if _, ok := first[key]; !ok {
+			t.Errorf("expected key %q in model JSON, got %v", key, first)
+		}
+	}
+	if first["release_date"] != "2023-03-14" {
+		t.Errorf("expected release_date 2023-03-14, got %v", first["release_date"])
+	}
+	if _, ok := raw.Data[1]["release_date"]; ok {
+		t.Error("expected release_date to be omitted when unknown")
+	}
+}
+
+func TestPrintModelsWide(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printModels(&buf, testModelList(), modelsFormatWide); err != nil {
+		t.Fatalf("printModels failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header and 2 rows, got %q", buf.String())
+	}
+	if fields := strings.Fields(lines[0]); strings.Join(fields, " ") != "ID OWNER RELEASED" {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "gpt-4 openai 2023-03-14" {
+		t.Errorf("unexpected row %q", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); strings.Join(fields, " ") != "claude-3-opus anthropic -" {
+		t.Errorf("unexpected row %q", lines[2])
+	}
+	// Columns are aligned
+	if strings.Index(lines[0], "RELEASED") != strings.Index(lines[1], "2023-03-14") {
+		t.Errorf("expected aligned columns:\n%s", buf.String())
+	}
+}
+
+func TestPrintModelsList(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printModels(&buf, testModelList(), modelsFormatList); err != nil {
+		t.Fatalf("printModels failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Available models (2 total):") || !strings.Contains(buf.String(), "  - gpt-4 (openai)") {
+		t.Errorf("unexpected list output %q", buf.String())
+	}
+}
+
+// failingTransport fails every request as if the network were unreachable
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestModelsWithoutToken(t *testing.T) {
+	var otherRequests []string
+	original := newHTTPClient
+	newHTTPClient = func(*Config) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			rec := httptest.NewRecorder()
+			if req.URL.String() == modelsDevURL {
+				rec.WriteHeader(http.StatusNotFound)
+				return rec.Result(), nil
+			}
+			otherRequests = append(otherRequests, req.URL.String())
+			return nil, errors.New("unexpected request")
+		})}
+	}
+	t.Cleanup(func() { newHTTPClient = original })
+	t.Setenv(configPathEnv, filepath.Join(t.TempDir(), "config.json"))
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("COPILOT_TOKEN", "")
+
+	var err error
+	output := captureStdout(func() {
+		err = RunCommand(cmdModels, nil, "test")
+	})
+	if err != nil {
+		t.Fatalf("models failed without a token: %v", err)
+	}
+	if len(otherRequests) > 0 {
+		t.Errorf("expected no authentication or Copilot API requests, got %v", otherRequests)
+	}
+	if strings.Contains(output, "Not authenticated") {
+		t.Errorf("expected models to be listed without authentication, got:\n%s", output)
+	}
+	for _, model := range GetDefault() {
+		if !strings.Contains(output, model.ID) {
+			t.Errorf("expected default model %s in output, got:\n%s", model.ID, output)
+		}
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	original := newHTTPClient
+	newHTTPClient = func(*Config) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			// A stalled upstream that only gives up when the request is canceled
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(5 * time.Second):
+				return nil, errors.New("stub was not canceled")
+			}
+		})}
+	}
+	t.Cleanup(func() { newHTTPClient = original })
+	t.Setenv(configPathEnv, filepath.Join(t.TempDir(), "config.json"))
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("COPILOT_TOKEN", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	captureStdout(func() {
+		err = RunCommandContext(ctx, cmdModels, nil, "test")
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a context deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the command to abort at the deadline, took %v", elapsed)
+	}
+
+	if err := RunCommandContext(ctx, cmdStart, nil, "test"); ExitCode(err) != ExitValidation {
+		t.Errorf("expected --timeout to be rejected for the server, got %v", err)
+	}
+}
+
+func TestRunHeadlessWithoutToken(t *testing.T) {
+	var requests int
+	original := newHTTPClient
+	newHTTPClient = func(*Config) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			requests++
+			return nil, errors.New("unexpected request")
+		})}
+	}
+	t.Cleanup(func() { newHTTPClient = original })
+
+	for name, setup := range map[string]func(t *testing.T) []string{
+		"flag": func(*testing.T) []string { return []string{noAuthPromptFlag} },
+		"environment": func(t *testing.T) []string {
+			t.Setenv(noAuthPromptEnv, "true")
+			return nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			requests = 0
+			t.Setenv(configPathEnv, filepath.Join(t.TempDir(), "config.json"))
+			t.Setenv("GITHUB_TOKEN", "")
+			t.Setenv("COPILOT_TOKEN", "")
+			args := setup(t)
+
+			var err error
+			output := captureStdout(func() {
+				err = RunCommand(cmdStart, args, "test")
+			})
+
+			var authErr *AuthenticationError
+			if !errors.As(err, &authErr) {
+				t.Fatalf("expected an AuthenticationError, got %v", err)
+			}
+			if got := ExitCode(err); got != ExitAuth {
+				t.Errorf("expected exit code %d, got %d", ExitAuth, got)
+			}
+			if requests != 0 || strings.Contains(output, "github.com/login/device") {
+				t.Errorf("expected no device flow, got %d requests and output %q", requests, output)
+			}
+		})
+	}
+}
+
+func TestConfigShowsEffectiveTimeouts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"port":9090,"github_token":"gh","timeouts":{"server_read":42}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configPathEnv, path)
+	t.Setenv("GITHUB_TOKEN", "")
+
+	want := &Config{}
+	SetDefaultTimeouts(want)
+	want.Timeouts.ServerRead = 42
+
+	t.Run("text", func(t *testing.T) {
+		var err error
+		output := captureStdout(func() { err = RunCommand(cmdConfig, nil, "test") })
+		if err != nil {
+			t.Fatalf("config failed: %v", err)
+		}
+
+		for _, line := range []string{
+			fmt.Sprintf("http_client: %ds", want.Timeouts.HTTPClient),
+			"server_read: 42s",
+			fmt.Sprintf("server_write: %ds", want.Timeouts.ServerWrite),
+			fmt.Sprintf("server_idle: %ds", want.Timeouts.ServerIdle),
+			fmt.Sprintf("proxy_context: %ds", want.Timeouts.ProxyContext),
+			fmt.Sprintf("max_proxy_context: %ds", want.Timeouts.MaxProxyContext),
+			fmt.Sprintf("chat: %ds (proxy_context)", want.Timeouts.ProxyContext),
+			fmt.Sprintf("models: %ds (proxy_context)", want.Timeouts.ProxyContext),
+			"first_byte: 0s (off)",
+			"queue_wait: 0s (off)",
+			fmt.Sprintf("upstream_acquire: %ds", want.Timeouts.UpstreamAcquire),
+			fmt.Sprintf("circuit_breaker: %ds", want.Timeouts.CircuitBreaker),
+			fmt.Sprintf("keep_alive: %ds", want.Timeouts.KeepAlive),
+			fmt.Sprintf("tls_handshake: %ds", want.Timeouts.TLSHandshake),
+			fmt.Sprintf("dial_timeout: %ds", want.Timeouts.DialTimeout),
+			fmt.Sprintf("idle_conn_timeout: %ds", want.Timeouts.IdleConnTimeout),
+			"Listen address: http://0.0.0.0:9090",
+			"Upstream base: " + copilotAPIBase,
+			"Allowed origins: *",
+		} {
+			if !strings.Contains(output, line) {
+				t.Errorf("expected output to contain %q, got:\n%s", line, output)
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var err error
+		output := captureStdout(func() { err = RunCommand(cmdConfig, []string{"-json"}, "test") })
+		if err != nil {
+			t.Fatalf("config -json failed: %v", err)
+		}
+
+		var got struct {
+			UpstreamBase string          `json:"upstream_base"`
+			Timeouts     json.RawMessage `json:"timeouts"`
+		}
+		if err := json.Unmarshal([]byte(output), &got); err != nil {
+			t.Fatalf("invalid JSON output: %v\n%s", err, output)
+		}
+		wantTimeouts, _ := json.Marshal(want.Timeouts)
+		if string(got.Timeouts) != string(wantTimeouts) {
+			t.Errorf("expected timeouts %s, got %s", wantTimeouts, got.Timeouts)
+		}
+		if got.UpstreamBase != copilotAPIBase {
+			t.Errorf("expected upstream base %q, got %q", copilotAPIBase, got.UpstreamBase)
+		}
+		if strings.Contains(output, `"gh"`) {
+			t.Error("expected tokens to be left out of the output")
+		}
+	})
+}
+
+func TestHeadersCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := fmt.Sprintf(`{"copilot_token":"secret-copilot-token","expires_at":%d,`+
+		`"headers":{"user_agent":"TestAgent/1.0","editor_version":"vscode/9.9.9","copilot_integration_id":"test-chat","openai_intent":"conversation-panel"}}`,
+		time.Now().Add(time.Hour).Unix())
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configPathEnv, path)
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("COPILOT_TOKEN", "")
+
+	defaults := &Config{}
+	SetDefaultHeaders(defaults)
+	want := map[string]string{
+		"Authorization":          "Bearer " + redactedValue,
+		"Content-Type":           "application/json",
+		"Accept":                 "application/json",
+		"User-Agent":             "TestAgent/1.0",
+		"Editor-Version":         "vscode/9.9.9",
+		"Editor-Plugin-Version":  defaults.Headers.EditorPluginVersion,
+		"Copilot-Integration-Id": "test-chat",
+		"Openai-Intent":          "conversation-panel",
+		"X-Initiator":            defaults.Headers.XInitiator,
+	}
+
+	t.Run("text", func(t *testing.T) {
+		var err error
+		output := captureStdout(func() { err = RunCommand(cmdHeaders, nil, "test") })
+		if err != nil {
+			t.Fatalf("headers failed: %v", err)
+		}
+		for name, value := range want {
+			if line := name + ": " + value; !strings.Contains(output, line) {
+				t.Errorf("expected output to contain %q, got:\n%s", line, output)
+			}
+		}
+		if strings.Contains(output, "secret-copilot-token") {
+			t.Error("expected the Copilot token to be redacted")
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var err error
+		output := captureStdout(func() { err = RunCommand(cmdHeaders, []string{"--json"}, "test") })
+		if err != nil {
+			t.Fatalf("headers --json failed: %v", err)
+		}
+		var got map[string]string
+		if err := json.Unmarshal([]byte(output), &got); err != nil {
+			t.Fatalf("invalid JSON output: %v\n%s", err, output)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected headers %v, got %v", want, got)
+		}
+	})
+}
+
+func TestReplayCapturedRequest(t *testing.T) {
+	var gotBody, gotIntent, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotBody, gotIntent, gotAuth = string(body), r.Header.Get("Openai-Intent"), r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(gotBody, "unknown-model") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"message":"model not supported"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-replayed"}`))
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	original := newHTTPClient
+	newHTTPClient = func(*Config) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+			return http.DefaultTransport.RoundTrip(req)
+		})}
+	}
+	t.Cleanup(func() { newHTTPClient = original })
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	config := fmt.Sprintf(`{"copilot_token":"replay-token","expires_at":%d}`, time.Now().Add(time.Hour).Unix())
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configPathEnv, configPath)
+
+	writeCaptureFile := func(t *testing.T, model string, headers map[string]string) string {
+		t.Helper()
+		path, err := writeCapture(filepath.Join(dir, "captures"), &CapturedRequest{
+			CapturedAt: time.Now().UTC(),
+			Method:     http.MethodPost,
+			Path:       "/v1/chat/completions",
+			Headers:    headers,
+			Body:       json.RawMessage(`{"model":"` + model + `","messages":[{"role":"user","content":"replay me"}]}`),
+		})
+		if err != nil {
+			t.Fatalf("writeCapture failed: %v", err)
+		}
+		return path
+	}
+
+	t.Run("sends the captured body and prints the response", func(t *testing.T) {
+		path := writeCaptureFile(t, "gpt-4o", map[string]string{"X-Copilot-Intent": "conversation-panel"})
+
+		var err error
+		output := captureStdout(func() { err = RunCommand(cmdReplay, []string{path}, "test") })
+		if err != nil {
+			t.Fatalf("replay failed: %v", err)
+		}
+		if !strings.Contains(gotBody, "replay me") {
+			t.Errorf("Expected the captured body upstream, got %q", gotBody)
+		}
+		if gotIntent != "conversation-panel" {
+			t.Errorf("Expected captured headers to be replayed, got intent %q", gotIntent)
+		}
+		if gotAuth != "Bearer replay-token" {
+			t.Errorf("Expected the configured Copilot token upstream, got %q", gotAuth)
+		}
+		if !strings.Contains(output, "HTTP 200 OK") || !strings.Contains(output, "chatcmpl-replayed") {
+			t.Errorf("Expected status and body in the output, got:\n%s", output)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "captures", "*.json")); len(files) != 1 {
+			t.Errorf("Expected the replay not to be captured again, got %v", files)
+		}
+	})
+
+	t.Run("failed replay exits non-zero", func(t *testing.T) {
+		path := writeCaptureFile(t, "unknown-model", nil)
+
+		var err error
+		output := captureStdout(func() { err = RunCommand(cmdReplay, []string{path}, "test") })
+		if got := ExitCode(err); got != ExitProxy {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitProxy, got, err)
+		}
+		if !strings.Contains(output, "HTTP 400") || !strings.Contains(output, "model not supported") {
+			t.Errorf("Expected the upstream status in the output, got:\n%s", output)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		err := RunCommand(cmdReplay, []string{filepath.Join(dir, "absent.json")}, "test")
+		if got := ExitCode(err); got != ExitValidation {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitValidation, got, err)
+		}
+	})
+}
+
+func TestAuthWithToken(t *testing.T) {
+	var requests int
+	original := newHTTPClient
+	newHTTPClient = func(*Config) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			requests++
+			if req.URL.String() != copilotAPIKeyURL {
+				return nil, fmt.Errorf("unexpected request to %s", req.URL)
+			}
+			rec := httptest.NewRecorder()
+			if req.Header.Get("Authorization") != "token gho_valid" {
+				rec.WriteHeader(http.StatusUnauthorized)
+				return rec.Result(), nil
+			}
+			fmt.Fprintf(rec, `{"token":"copilot-token","expires_at":%d,"refresh_in":1500}`, time.Now().Add(30*time.Minute).Unix())
+			return rec.Result(), nil
+		})}
+	}
+	t.Cleanup(func() { newHTTPClient = original })
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("COPILOT_TOKEN", "")
+
+	savedTokens := func(t *testing.T, path string) Credentials {
+		t.Helper()
+		var creds Credentials
+		if data, err := os.ReadFile(path); err == nil {
+			_ = json.Unmarshal(data, &creds)
+		}
+		return creds
+	}
+
+	t.Run("valid token is exchanged and saved", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		t.Setenv(configPathEnv, path)
+		requests = 0
+
+		captureStdout(func() {
+			if err := RunCommand(cmdAuth, []string{"--token", "gho_valid"}, "test"); err != nil {
+				t.Errorf("auth --token failed: %v", err)
+			}
+		})
+		if requests != 1 {
+			t.Errorf("expected a single token exchange and no device flow, got %d requests", requests)
+		}
+		creds := savedTokens(t, path)
+		if creds.GitHubToken != "gho_valid" || creds.CopilotToken != "copilot-token" {
+			t.Errorf("expected both tokens to be saved, got %+v", creds)
+		}
+	})
+
+	t.Run("rejected token is an authentication error", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		t.Setenv(configPathEnv, path)
+
+		var err error
+		captureStdout(func() {
+			err = RunCommand(cmdAuth, []string{"--token=gho_revoked"}, "test")
+		})
+		if got := ExitCode(err); got != ExitAuth {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitAuth, got, err)
+		}
+		if err == nil || !strings.Contains(err.Error(), "rejected") {
+			t.Errorf("expected a clear rejection message, got %v", err)
+		}
+		if creds := savedTokens(t, path); creds.GitHubToken != "" {
+			t.Errorf("expected the rejected token not to be saved, got %+v", creds)
+		}
+	})
+
+	t.Run("device and token are exclusive", func(t *testing.T) {
+		err := RunCommand(cmdAuth, []string{"--device", "--token", "gho_valid"}, "test")
+		if got := ExitCode(err); got != ExitValidation {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitValidation, got, err)
+		}
+	})
+}
+
+func TestParseAuthToken(t *testing.T) {
+	t.Setenv("TEST_GH_PAT", "gho_from_env")
+	t.Setenv("TEST_EMPTY_PAT", "")
+
+	tests := []struct {
+		name    string
+		args    []string
+		stdin   string
+		want    string
+		wantErr bool
+	}{
+		{name: "device flow", args: nil, want: ""},
+		{name: "argv", args: []string{"--token", "gho_argv"}, want: "gho_argv"},
+		{name: "stdin", args: []string{"--token", "-"}, stdin: "gho_stdin\n", want: "gho_stdin"},
+		{name: "stdin with equals", args: []string{"--token=-"}, stdin: "gho_stdin", want: "gho_stdin"},
+		{name: "empty stdin", args: []string{"--token", "-"}, stdin: "\n", wantErr: true},
+		{name: "environment", args: []string{"--token-env", "TEST_GH_PAT"}, want: "gho_from_env"},
+		{name: "environment with equals", args: []string{"--token-env=TEST_GH_PAT"}, want: "gho_from_env"},
+		{name: "unset environment variable", args: []string{"--token-env", "TEST_EMPTY_PAT"}, wantErr: true},
+		{name: "token and token-env", args: []string{"--token", "gho_argv", "--token-env", "TEST_GH_PAT"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := parseAuthToken(tt.args, strings.NewReader(tt.stdin))
+			if tt.wantErr {
+				if _, ok := err.(*ValidationError); !ok {
+					t.Fatalf("expected a ValidationError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected token %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// fakeGH points auth --gh at a shell script standing in for the GitHub CLI
+func fakeGH(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake gh is a shell script")
+	}
+	path := filepath.Join(t.TempDir(), "gh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	original := ghCommand
+	ghCommand = path
+	t.Cleanup(func() { ghCommand = original })
+}
+
+func TestAuthWithGHCLI(t *testing.T) {
+	var gotAuth string
+	original := newHTTPClient
+	newHTTPClient = func(*Config) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			gotAuth = req.Header.Get("Authorization")
+			rec := httptest.NewRecorder()
+			fmt.Fprintf(rec, `{"token":"copilot-token","expires_at":%d,"refresh_in":1500}`, time.Now().Add(30*time.Minute).Unix())
+			return rec.Result(), nil
+		})}
+	}
+	t.Cleanup(func() { newHTTPClient = original })
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("COPILOT_TOKEN", "")
+
+	t.Run("token from gh is exchanged", func(t *testing.T) {
+		fakeGH(t, `[ "$*" = "auth token --hostname github.com" ] || exit 2
+echo gho_from_gh
+`)
+		t.Setenv(configPathEnv, filepath.Join(t.TempDir(), "config.json"))
+		gotAuth = ""
+
+		captureStdout(func() {
+			if err := RunCommand(cmdAuth, []string{authGHFlag}, "test"); err != nil {
+				t.Errorf("auth --gh failed: %v", err)
+			}
+		})
+		if gotAuth != "token gho_from_gh" {
+			t.Errorf("expected the gh token to be exchanged, got Authorization %q", gotAuth)
+		}
+	})
+
+	t.Run("gh not logged in", func(t *testing.T) {
+		fakeGH(t, `echo "no oauth token found for github.com" >&2
+exit 1
+`)
+		t.Setenv(configPathEnv, filepath.Join(t.TempDir(), "config.json"))
+		gotAuth = ""
+
+		err := RunCommand(cmdAuth, []string{authGHFlag}, "test")
+		if got := ExitCode(err); got != ExitAuth {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitAuth, got, err)
+		}
+		if err == nil || !strings.Contains(err.Error(), "gh auth login") || !strings.Contains(err.Error(), "no oauth token found") {
+			t.Errorf("expected guidance and gh's own message, got %v", err)
+		}
+		if gotAuth != "" {
+			t.Error("expected no token exchange without a gh token")
+		}
+	})
+
+	t.Run("gh not installed", func(t *testing.T) {
+		original := ghCommand
+		ghCommand = filepath.Join(t.TempDir(), "missing", "gh")
+		t.Cleanup(func() { ghCommand = original })
+
+		err := RunCommand(cmdAuth, []string{authGHFlag}, "test")
+		if err == nil || !strings.Contains(err.Error(), "cli.github.com") {
+			t.Errorf("expected installation guidance, got %v", err)
+		}
+	})
+
+	t.Run("gh and token are exclusive", func(t *testing.T) {
+		err := RunCommand(cmdAuth, []string{authGHFlag, "--token", "gho_valid"}, "test")
+		if got := ExitCode(err); got != ExitValidation {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitValidation, got, err)
+		}
+	})
+}
+
+// writeAgedFile writes a file whose modification time is age in the past
+func writeAgedFile(t *testing.T, path, content string, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-age)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	const stale = 30 * 24 * time.Hour
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	writeAgedFile(t, configPath, `{"github_token":"gho_active","port":8081}`, stale)
+	writeAgedFile(t, filepath.Join(dir, "models-cache.json"), `{"data":[]}`, stale)
+	writeAgedFile(t, filepath.Join(dir, statsFileName+"-1.tmp"), `{"version":1}`, 3*time.Hour)
+	writeAgedFile(t, filepath.Join(dir, statsFileName+"-2.tmp"), `{"version":1}`, time.Minute)
+	writeAgedFile(t, filepath.Join(dir, "proxy.log"), "someone else's log\n", stale)
+	writeAgedFile(t, filepath.Join(dir, "editor.tmp"), "someone else's file", stale)
+	writeAgedFile(t, filepath.Join(dir, "models.json"), `{"data":[]}`, time.Hour)
+	writeAgedFile(t, filepath.Join(dir, "config.json.bak"), `{"github_token":"gho_backup"}`, stale)
+	writeAgedFile(t, filepath.Join(dir, "notes.txt"), "mine", stale)
+	writeAgedFile(t, filepath.Join(dir, ".write-check-1"), "", stale)
+	writeAgedFile(t, filepath.Join(dir, ".write-check-2"), "", time.Minute)
+	t.Setenv(configPathEnv, configPath)
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	t.Run("identifies expired artifacts only", func(t *testing.T) {
+		candidates, err := findPruneCandidates(configPath, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, c := range candidates {
+			names = append(names, filepath.Base(c.Path))
+		}
+		if want := []string{".write-check-1", statsFileName + "-1.tmp"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("expected candidates %v, got %v", want, names)
+		}
+	})
+
+	t.Run("never selects the active config", func(t *testing.T) {
+		activeBackup := filepath.Join(dir, "active.bak")
+		writeAgedFile(t, activeBackup, `{"port":8081}`, stale)
+		defer os.Remove(activeBackup)
+
+		candidates, err := findPruneCandidates(activeBackup, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range candidates {
+			if c.Path == activeBackup {
+				t.Error("expected the active config file to be skipped")
+			}
+		}
+	})
+
+	t.Run("dry run by default", func(t *testing.T) {
+		output := captureStdout(func() {
+			if err := RunCommand(cmdPrune, nil, "test"); err != nil {
+				t.Errorf("prune failed: %v", err)
+			}
+		})
+		if !strings.Contains(output, "Would remove 2 files") {
+			t.Errorf("expected a dry-run summary, got:\n%s", output)
+		}
+		if !exists(".write-check-1") || !exists(statsFileName+"-1.tmp") {
+			t.Error("expected a dry run to keep every file")
+		}
+	})
+
+	t.Run("delete keeps config and tokens", func(t *testing.T) {
+		captureStdout(func() {
+			if err := RunCommand(cmdPrune, []string{"--delete"}, "test"); err != nil {
+				t.Errorf("prune --delete failed: %v", err)
+			}
+		})
+		if exists(".write-check-1") || exists(statsFileName+"-1.tmp") {
+			t.Error("expected expired artifacts to be removed")
+		}
+		for _, name := range []string{"config.json", "config.json.bak", "models.json", "models-cache.json", "notes.txt", statsFileName + "-2.tmp", ".write-check-2", "proxy.log", "editor.tmp"} {
+			if !exists(name) {
+				t.Errorf("expected %s to be kept", name)
+			}
+		}
+	})
+}
+
+func TestRunCommandExitCodes(t *testing.T) {
+	original := newHTTPClient
+	newHTTPClient = func(*Config) *http.Client {
+		return &http.Client{Transport: failingTransport{}}
+	}
+	t.Cleanup(func() { newHTTPClient = original })
+
+	t.Run("network failure during auth", func(t *testing.T) {
+		t.Setenv(configPathEnv, filepath.Join(t.TempDir(), "config.json"))
+
+		err := RunCommand(cmdAuth, nil, "test")
+		if got := ExitCode(err); got != ExitNetwork {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitNetwork, got, err)
+		}
+	})
+
+	t.Run("unreadable config", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(configPathEnv, path)
+
+		err := RunCommand(cmdConfig, nil, "test")
+		if got := ExitCode(err); got != ExitConfig {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitConfig, got, err)
+		}
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		err := RunCommand(cmdModels, []string{"--output", "yaml"}, "test")
+		if got := ExitCode(err); got != ExitValidation {
+			t.Errorf("expected exit code %d, got %d (%v)", ExitValidation, got, err)
+		}
+	})
+}
+
+func TestStatsCommand(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(configPathEnv, filepath.Join(dir, "config.json"))
+
+	if err := RunCommand(cmdStats, nil, "test"); ExitCode(err) != ExitConfig {
+		t.Fatalf("Expected a config error before any usage is recorded, got %v", err)
+	}
+
+	recorder, err := NewUsageRecorder(filepath.Join(dir, statsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Record("gpt-4o", false, &transform.ChatCompletionUsage{PromptTokens: 120, CompletionTokens: 30, TotalTokens: 150})
+	recorder.Record("claude-sonnet-4", true, nil)
+	if err := recorder.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("text", func(t *testing.T) {
+		var err error
+		output := captureStdout(func() { err = RunCommand(cmdStats, nil, "test") })
+		if err != nil {
+			t.Fatalf("stats failed: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(output), "\n")
+		if !strings.HasPrefix(lines[0], "Usage since ") {
+			t.Errorf("Expected a header line, got %q", lines[0])
+		}
+		want := [][]string{
+			{"MODEL", "REQUESTS", "ERRORS", "PROMPT", "TOKENS", "COMPLETION", "TOKENS", "TOTAL", "TOKENS"},
+			{"claude-sonnet-4", "1", "1", "0", "0", "0"},
+			{"gpt-4o", "1", "0", "120", "30", "150"},
+			{"TOTAL", "2", "1", "120", "30", "150"},
+		}
+		rows := lines[2:]
+		if len(rows) != len(want) {
+			t.Fatalf("Expected %d table rows, got:\n%s", len(want), output)
+		}
+		for i, row := range rows {
+			if fields := strings.Fields(row); !reflect.DeepEqual(fields, want[i]) {
+				t.Errorf("Row %d: expected %v, got %v", i, want[i], fields)
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var err error
+		output := captureStdout(func() { err = RunCommand(cmdStats, []string{"-json"}, "test") })
+		if err != nil {
+			t.Fatalf("stats -json failed: %v", err)
+		}
+		var stats UsageStats
+		if err := json.Unmarshal([]byte(output), &stats); err != nil {
+			t.Fatalf("Output is not JSON: %v\n%s", err, output)
+		}
+		if stats.Total.Requests != 2 || stats.Models["gpt-4o"].TotalTokens != 150 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+}
+
+func TestHealthcheckCommand(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		status   int
+		health   HealthStatus
+		wantCode int
+	}{
+		{name: "healthy", status: http.StatusOK, health: StatusHealthy, wantCode: ExitOK},
+		{name: "degraded", status: http.StatusOK, health: StatusDegraded, wantCode: ExitOK},
+		{name: "unhealthy", status: http.StatusServiceUnavailable, health: StatusUnhealthy, wantCode: ExitProxy},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/health" {
+					t.Errorf("expected a request for /health, got %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				_ = json.NewEncoder(w).Encode(HealthResponse{Status: tt.health})
+			}))
+			defer server.Close()
+
+			// Listening on all interfaces is checked through the loopback address
+			port := server.Listener.Addr().(*net.TCPAddr).Port
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(fmt.Sprintf(`{"host":"0.0.0.0","port":%d}`, port)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(configPathEnv, path)
+			t.Setenv("COPILOT_PORT", "")
+
+			var err error
+			output := captureStdout(func() { err = RunCommand(cmdHealthcheck, nil, "test") })
+			if got := ExitCode(err); got != tt.wantCode {
+				t.Fatalf("expected exit code %d, got %d (%v)", tt.wantCode, got, err)
+			}
+			if err == nil && strings.TrimSpace(output) != string(tt.health) {
+				t.Errorf("expected %q to be printed, got %q", tt.health, output)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		_ = listener.Close()
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(`{"host":"127.0.0.1","port":%d}`, port)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(configPathEnv, path)
+		t.Setenv("COPILOT_PORT", "")
+
+		if got := ExitCode(RunCommand(cmdHealthcheck, nil, "test")); got != ExitNetwork {
+			t.Errorf("expected exit code %d, got %d", ExitNetwork, got)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
+)
+
+// CompletionsHandler serves legacy /v1/completions requests. The prompt is sent upstream
+// as a single-message chat completion through Handler, and the response (streamed or
+// not) is translated back into the legacy completion shape.
+func (s *ProxyService) CompletionsHandler() http.HandlerFunc {
+	chat := s.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.handlePreflight(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, fmt.Sprintf("bad request: failed to read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var legacy transform.CompletionRequest
+		if err := json.Unmarshal(body, &legacy); err != nil {
+			http.Error(w, fmt.Sprintf("bad request: invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		chatReq, err := transform.CompletionToChat(&legacy)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+			return
+		}
+		chatBody, err := json.Marshal(chatReq)
+		if err != nil {
+			WriteInternalError(w)
+			return
+		}
+
+		chatHTTPReq := r.Clone(r.Context())
+		chatHTTPReq.URL.Path = "/v1/chat/completions"
+		chatHTTPReq.Body = io.NopCloser(bytes.NewReader(chatBody))
+		chatHTTPReq.ContentLength = int64(len(chatBody))
+
+		cw := &responseRewriter{
+			ResponseWriter: w,
+			rewriteLines:   translateCompletionStream,
+			rewriteBody:    translateCompletionBody,
+		}
+		chat(cw, chatHTTPReq)
+		cw.finish()
+	}
+}
+
+// translateCompletionBody converts a chat completion into a legacy completion
+func translateCompletionBody(body []byte) ([]byte, string, error) {
+	var chatResp transform.ChatCompletionResponse
+	if err := json.Unmarshal(body, &chatResp); err != nil {
+		return nil, "", err
+	}
+	converted, err := json.Marshal(transform.ChatToCompletion(&chatResp))
+	return converted, "", err
+}
+
+// translateCompletionStream rewrites the chat chunks in SSE data lines as legacy
+// completion chunks, leaving other lines (including [DONE]) untouched
+func translateCompletionStream(data []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		payload, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r\n"), []byte("data:"))
+		payload = bytes.TrimSpace(payload)
+		if !ok || string(payload) == "[DONE]" {
+			out.Write(line)
+			continue
+		}
+
+		var chunk transform.ChatCompletionChunk
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			out.Write(line)
+			continue
+		}
+		converted, err := json.Marshal(transform.ChatChunkToCompletion(&chunk))
+		if err != nil {
+			out.Write(line)
+			continue
+		}
+		out.WriteString("data: ")
+		out.Write(converted)
+		out.Write(line[len(bytes.TrimRight(line, "\r\n")):])
+	}
+	return out.Bytes()
+}
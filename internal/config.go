@@ -1,13 +1,21 @@
 package internal
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"mime"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Constants for configuration
@@ -16,6 +24,15 @@ const (
 	configFileName    = "config.json"
 	defaultServerPort = 8081
 	dirPerm           = 0o755 // More permissive for Docker containers
+	configFilePerm    = 0o600 // Config may hold tokens
+
+	// Config location overrides
+	configPathEnv  = "COPILOT_SVCS_CONFIG" // Explicit config file path
+	xdgDataHomeEnv = "XDG_DATA_HOME"       // Fallback base directory when the default is unwritable
+	xdgAppDirName  = "github-copilot-svcs"
+
+	// Temporary file probing that the config directory is writable
+	writeCheckPattern = ".write-check-*"
 
 	// Default header values
 	defaultUserAgent            = "GitHubCopilotChat/0.29.1"
@@ -31,6 +48,8 @@ const (
 	defaultServerWriteTimeout    = 120 // Increased for streaming responses
 	defaultServerIdleTimeout     = 60  // Reduced for better resource usage
 	defaultProxyContextTimeout   = 180 // Increased for long-running requests
+	defaultMaxProxyContext       = 900 // Cap for per-request X-Upstream-Timeout-Seconds overrides
+	defaultUpstreamAcquire       = 5   // Wait for a free upstream slot before returning 503
 	defaultCircuitBreakerTimeout = 15  // Reduced for faster recovery
 	defaultKeepAliveTimeout      = 60  // Increased for connection reuse
 	defaultTLSHandshakeTimeout   = 10
@@ -50,11 +69,79 @@ const (
 // Config represents the application configuration
 type Config struct {
 	Port         int    `json:"port"`
+	Host         string `json:"host,omitempty"` // Default: "" (all interfaces); an IP, hostname or unix:///path/to.sock
+	AutoPort     bool   `json:"auto_port"`      // Default: false; try the next ports when port is in use
 	GitHubToken  string `json:"github_token"`
 	CopilotToken string `json:"copilot_token"`
 	ExpiresAt    int64  `json:"expires_at"`
 	RefreshIn    int64  `json:"refresh_in"`
 
+	// GitHubTokens are extra GitHub accounts whose Copilot seats share upstream chat requests
+	GitHubTokens []string `json:"github_tokens,omitempty"`
+
+	// TokenStore selects where tokens are persisted: "file" (config.json, default) or "keychain"
+	TokenStore string `json:"token_store,omitempty"`
+
+	// store overrides the credential store selected by TokenStore
+	store CredentialStore
+
+	// tokenMutex guards CopilotToken, ExpiresAt and RefreshIn, which token refreshes
+	// replace while requests read them; see Token
+	tokenMutex sync.RWMutex
+
+	// live is the config published by the latest hot reload; nil until then, when the
+	// config itself is current. See Live.
+	live atomic.Pointer[Config]
+
+	// APIKey is the key clients must present to protected endpoints
+	APIKey string `json:"api_key,omitempty"`
+
+	// ModelAliases maps client model names to Copilot model IDs, on top of the built-in aliases
+	ModelAliases map[string]string `json:"model_aliases,omitempty"`
+
+	// AllowedModels restricts requests to these models, after alias normalization (empty = any).
+	// Buffered proxy mode only; validation rejects it in reverse_proxy mode.
+	AllowedModels []string `json:"allowed_models,omitempty"`
+
+	// FallbackModel is retried once when the upstream reports the requested model unavailable
+	FallbackModel string `json:"fallback_model,omitempty"`
+
+	// DefaultModel is used for chat requests whose model is missing, empty or whitespace
+	DefaultModel string `json:"default_model,omitempty"`
+
+	// ModelsCacheTTL is how long, in seconds, the model list is cached before it is reloaded
+	ModelsCacheTTL int `json:"models_cache_ttl,omitempty"`
+
+	// DefaultSystemPrompt is prepended to chat requests without a system message
+	DefaultSystemPrompt string `json:"default_system_prompt,omitempty"`
+
+	// MaxMessages caps the messages in a chat request (0 = unlimited); MaxMessagesMode is
+	// "reject" (the default) or "truncate"
+	MaxMessages     int    `json:"max_messages,omitempty"`
+	MaxMessagesMode string `json:"max_messages_mode,omitempty"`
+
+	// DefaultTemperature and DefaultTopP are added to chat requests that omit them
+	DefaultTemperature *float64 `json:"default_temperature,omitempty"`
+	DefaultTopP        *float64 `json:"default_top_p,omitempty"`
+
+	// ServiceName identifies this deployment in health output and the X-Served-By header
+	ServiceName string `json:"service_name,omitempty"`
+
+	// InstanceID distinguishes replicas sharing a service name (empty = not reported)
+	InstanceID string `json:"instance_id,omitempty"`
+
+	// TrustedProxies lists proxy CIDRs or IPs whose X-Forwarded-For/X-Real-IP headers are honored
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// MaxConcurrentUpstream caps simultaneous upstream Copilot requests (0 = unlimited)
+	MaxConcurrentUpstream int `json:"max_concurrent_upstream,omitempty"`
+
+	// MaxConcurrentStreams caps simultaneous streaming chat requests (0 = unlimited)
+	MaxConcurrentStreams int `json:"max_concurrent_streams,omitempty"`
+
+	// MaxHeaderBytes caps the size of a request's headers (0 = 1 MiB)
+	MaxHeaderBytes int `json:"max_header_bytes,omitempty"`
+
 	// HTTP Headers configuration
 	Headers struct {
 		UserAgent            string `json:"user_agent"`             // Default: "GitHubCopilotChat/0.29.1"
@@ -71,68 +158,306 @@ type Config struct {
 		AllowedHeaders []string `json:"allowed_headers"` // Default: ["*"]
 	} `json:"cors"`
 
+	// Client request headers passed on to the upstream next to the injected ones
+	RequestHeaders struct {
+		Forward []string `json:"forward"` // Default: [] (none); "*" forwards every header not denied
+		Deny    []string `json:"deny"`    // Added to the built-in Authorization, Cookie, X-Api-Key and Accept-Encoding
+	} `json:"request_headers"`
+
+	// Response header filtering for headers copied from the upstream
+	ResponseHeaders struct {
+		Allow []string `json:"allow"` // Default: [] (all headers not denied)
+		Deny  []string `json:"deny"`  // Added to the built-in Set-Cookie
+	} `json:"response_headers"`
+
+	// Metrics endpoint configuration
+	Metrics struct {
+		RequireAPIKey bool `json:"require_api_key"` // Default: false (unauthenticated /metrics)
+
+		// LargeResponseBytes logs a warning for proxied responses above this size
+		LargeResponseBytes int `json:"large_response_bytes"` // Default: 1048576 (1 MiB)
+
+		// Background push to a metrics backend
+		Push struct {
+			Backend  string `json:"backend"`  // Default: "" (disabled); "statsd" or "otlp"
+			Endpoint string `json:"endpoint"` // StatsD host:port or OTLP/HTTP metrics URL
+			Interval int    `json:"interval"` // Default: 10s
+			Prefix   string `json:"prefix"`   // StatsD metric prefix, default: "github_copilot"
+		} `json:"push"`
+	} `json:"metrics"`
+
+	// HTTPS listener; the server speaks plain HTTP unless both paths are set
+	TLS struct {
+		CertFile string `json:"cert_file"` // PEM certificate (chain) path
+		KeyFile  string `json:"key_file"`  // PEM private key path
+
+		// ClientCAFile requires clients to present a certificate signed by one of its CAs
+		ClientCAFile string `json:"client_ca_file"` // Default: "" (no client certificates)
+
+		// Client certificate the healthcheck command presents when client_ca_file is set
+		HealthcheckCertFile string `json:"healthcheck_cert_file"` // Default: "" (cert_file)
+		HealthcheckKeyFile  string `json:"healthcheck_key_file"`  // Default: "" (key_file)
+	} `json:"tls"`
+
+	// UpstreamProxy sends outbound requests (GitHub auth and Copilot) through an HTTP proxy
+	UpstreamProxy struct {
+		URL      string `json:"url"`      // Default: "" (HTTPS_PROXY/HTTP_PROXY from the environment)
+		Username string `json:"username"` // Basic Auth user; overrides credentials in url
+		Password string `json:"password"` // Basic Auth password
+	} `json:"upstream_proxy"`
+
+	// UpstreamTLS adds trust anchors for outbound TLS, e.g. a TLS-inspecting corporate proxy's CA
+	UpstreamTLS struct {
+		CAFiles []string `json:"ca_files"` // Default: [] (system roots only); PEM bundles trusted in addition
+	} `json:"upstream_tls"`
+
+	// Debugging aids
+	Debug struct {
+		CaptureDir string `json:"capture_dir"` // Default: "" (off); directory receiving one JSON file per chat request
+
+		// DisableCircuitBreaker sends every request upstream, so repeated upstream errors stay visible
+		DisableCircuitBreaker bool `json:"disable_circuit_breaker"` // Default: false
+
+		// TraceUpstream logs DNS, connect, TLS and first-byte timings of upstream requests at debug level
+		TraceUpstream bool `json:"trace_upstream"` // Default: false
+	} `json:"debug"`
+
+	// Token management configuration
+	Auth struct {
+		BackgroundRefresh bool `json:"background_refresh"` // Default: false (refresh only on the request path)
+	} `json:"auth"`
+
+	// Chat completions proxy configuration
+	Proxy struct {
+		Mode              string   `json:"mode"`               // Default: "buffered"; "reverse_proxy" streams via httputil.ReverseProxy
+		PassthroughRoutes []string `json:"passthrough_routes"` // Default: [] (e.g. ["/v1/audio/transcriptions"])
+		StreamBufferSize  int      `json:"stream_buffer_size"` // Default: 1024 bytes read per streamed chunk
+		CopyBufferSize    int      `json:"copy_buffer_size"`   // Default: 32768 bytes per pooled buffer copying regular responses
+		AcceptEncoding    string   `json:"accept_encoding"`    // Default: "auto" (gzip for regular responses, identity for streams); "gzip" or "identity"
+		WarmUp            bool     `json:"warm_up"`            // Default: false; open an upstream connection before serving
+		StreamReconnects  int      `json:"stream_reconnects"`  // Default: 0 (off); continuations of a chat stream dropped before [DONE]
+		WebSocket         bool     `json:"websocket"`          // Default: false; serve streamed chat completions on /v1/chat/ws
+
+		// Routes maps client paths to Copilot API paths for the buffered JSON handler
+		Routes map[string]string `json:"routes,omitempty"` // Default: {"/v1/chat/completions": "/chat/completions"}
+
+		// AllowedContentTypes are the request media types the chat and completions
+		// endpoints accept, in either proxy mode; passthrough_routes are not checked
+		AllowedContentTypes []string `json:"allowed_content_types,omitempty"` // Default: ["application/json"]
+	} `json:"proxy"`
+
+	// Opt-in cache for deterministic (temperature 0, non-streaming) completions
+	ResponseCache struct {
+		Enabled    bool `json:"enabled"`     // Default: false
+		TTL        int  `json:"ttl"`         // Default: 300s
+		MaxEntries int  `json:"max_entries"` // Default: 100
+	} `json:"response_cache"`
+
+	// Deduplication of retried completions by Idempotency-Key
+	Idempotency struct {
+		Enabled    bool `json:"enabled"`     // Default: false
+		Window     int  `json:"window"`      // Default: 60s
+		MaxEntries int  `json:"max_entries"` // Default: 100
+		DeriveKeys bool `json:"derive_keys"` // Default: false; true also dedupes identical bodies without a key
+	} `json:"idempotency"`
+
+	// Opt-in per-client request rate limit for proxied requests
+	RateLimit struct {
+		RequestsPerMinute int  `json:"requests_per_minute"` // Default: 0 (off)
+		Burst             int  `json:"burst"`               // Default: requests_per_minute
+		PerUser           bool `json:"per_user"`            // Default: false; key on the body's "user" field, falling back to the client IP
+		MaxConcurrent     int  `json:"max_concurrent"`      // Default: 0 (off); requests in flight per client IP
+	} `json:"rate_limit"`
+
+	// Local usage summary read by the stats command
+	Stats struct {
+		Enabled  bool   `json:"enabled"`  // Default: false
+		Interval int    `json:"interval"` // Default: 60s between saves
+		File     string `json:"file"`     // Default: stats.json next to config.json
+	} `json:"stats"`
+
+	// Retry backoff configuration (in seconds)
+	Retry struct {
+		MaxDelay    int `json:"max_delay"`    // Default: 30s cap on a single retry wait
+		MaxAttempts int `json:"max_attempts"` // Default: 3 attempts for token refreshes and upstream requests
+	} `json:"retry"`
+
 	// Timeout configurations (in seconds)
 	Timeouts struct {
-		HTTPClient      int `json:"http_client"`       // Default: 300s for streaming responses
-		ServerRead      int `json:"server_read"`       // Default: 30s for request reading
-		ServerWrite     int `json:"server_write"`      // Default: 300s for streaming responses
-		ServerIdle      int `json:"server_idle"`       // Default: 120s for idle connections
-		ProxyContext    int `json:"proxy_context"`     // Default: 300s for proxy request context
-		CircuitBreaker  int `json:"circuit_breaker"`   // Default: 30s for circuit breaker recovery
-		KeepAlive       int `json:"keep_alive"`        // Default: 30s for connection keep-alive
-		TLSHandshake    int `json:"tls_handshake"`     // Default: 10s for TLS handshake
-		DialTimeout     int `json:"dial_timeout"`      // Default: 10s for connection dialing
-		IdleConnTimeout int `json:"idle_conn_timeout"` // Default: 90s for idle connection timeout
+		HTTPClient      int `json:"http_client"`          // Default: 300s for streaming responses
+		ServerRead      int `json:"server_read"`          // Default: 30s for request reading
+		ServerWrite     int `json:"server_write"`         // Default: 300s for streaming responses
+		ServerIdle      int `json:"server_idle"`          // Default: 120s for idle connections
+		ProxyContext    int `json:"proxy_context"`        // Default: 300s for proxy request context
+		MaxProxyContext int `json:"max_proxy_context"`    // Default: 900s cap for per-request timeout overrides
+		Chat            int `json:"chat,omitempty"`       // Default: 0 (proxy_context) for /v1/chat/completions
+		Models          int `json:"models,omitempty"`     // Default: 0 (proxy_context) for /v1/models
+		FirstByte       int `json:"first_byte,omitempty"` // Default: 0 (off); wait for upstream headers of a streamed chat
+		QueueWait       int `json:"queue_wait,omitempty"` // Default: 0 (off); wait for a free worker before returning 503
+		UpstreamAcquire int `json:"upstream_acquire"`     // Default: 5s wait for a free upstream slot
+		CircuitBreaker  int `json:"circuit_breaker"`      // Default: 30s for circuit breaker recovery
+		KeepAlive       int `json:"keep_alive"`           // Default: 30s for connection keep-alive
+		TLSHandshake    int `json:"tls_handshake"`        // Default: 10s for TLS handshake
+		DialTimeout     int `json:"dial_timeout"`         // Default: 10s for connection dialing
+		IdleConnTimeout int `json:"idle_conn_timeout"`    // Default: 90s for idle connection timeout
 	} `json:"timeouts"`
 }
 
 // GetConfigPath returns the path to the config file
 func GetConfigPath() (string, error) {
-	// Use Docker-mountable location that works in containers
-	var dir string
+	// An explicit config file location takes precedence
+	if path := os.Getenv(configPathEnv); path != "" {
+		dir := filepath.Dir(path)
+		if err := ensureConfigDir(dir); err != nil {
+			return "", NewConfigError(configPathEnv, path, fmt.Sprintf("cannot use config directory %s (%s)", dir, describeFSError(err)), err)
+		}
+		return path, nil
+	}
 
-	// Check if we're in a container environment or if /app exists
+	dirs, err := configDirCandidates()
+	if err != nil {
+		return "", err
+	}
+	dir, err := firstUsableConfigDir(dirs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configFileName), nil
+}
+
+// configDirCandidates returns the directories to try for the config file, in order
+func configDirCandidates() ([]string, error) {
+	var dirs []string
+
+	// Use Docker-mountable location that works in containers
 	if _, err := os.Stat("/app"); err == nil {
-		dir = "/app/config"
+		dirs = append(dirs, "/app/config")
 	} else {
 		// Fallback to user's home directory for local development
 		usr, err := user.Current()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		dir = filepath.Join(usr.HomeDir, configDirName)
+		dirs = append(dirs, filepath.Join(usr.HomeDir, configDirName))
 	}
 
-	// Create directory if it doesn't exist, but don't fail if it already exists
-	if err := os.MkdirAll(dir, dirPerm); err != nil && !os.IsExist(err) {
-		return "", err
+	// Read-only home directories (some containers) can still use XDG_DATA_HOME
+	if dataHome := os.Getenv(xdgDataHomeEnv); dataHome != "" {
+		dirs = append(dirs, filepath.Join(dataHome, xdgAppDirName))
 	}
+	return dirs, nil
+}
 
-	return filepath.Join(dir, configFileName), nil
+// firstUsableConfigDir returns the first directory that exists or can be created
+// and is writable
+func firstUsableConfigDir(dirs []string) (string, error) {
+	var firstErr error
+	for _, dir := range dirs {
+		err := ensureConfigDir(dir)
+		if err == nil {
+			return dir, nil
+		}
+		Debug("Config directory unavailable", "dir", dir, "error", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(dirs) == 0 {
+		return "", NewConfigError("config_dir", "", "no config directory candidates", nil)
+	}
+	return "", NewConfigError("config_dir", dirs[0],
+		fmt.Sprintf("cannot use config directory (%s); set %s or %s to a writable location", describeFSError(firstErr), configPathEnv, xdgDataHomeEnv),
+		firstErr)
 }
 
-// LoadConfig loads the configuration from file and environment variables
-func LoadConfig(skipTokenValidation ...bool) (*Config, error) {
-	path, err := GetConfigPath()
+// errNotDirectory is reported when a config directory path names a regular file
+var errNotDirectory = errors.New("not a directory")
+
+// ensureConfigDir creates dir if it doesn't exist and checks that it is a directory
+// the process can write to, since the config, token and stats files all live there
+func ensureConfigDir(dir string) error {
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(dir, dirPerm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return &fs.PathError{Op: "stat", Path: dir, Err: errNotDirectory}
+	}
+
+	// Permission bits don't tell the whole story (read-only mounts, ACLs), so probe
+	probe, err := os.CreateTemp(dir, writeCheckPattern)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	name := probe.Name()
+	if err := probe.Close(); err != nil {
+		Debug("Error closing write probe", "path", name, "error", err)
+	}
+	if err := os.Remove(name); err != nil {
+		Debug("Error removing write probe", "path", name, "error", err)
 	}
+	return nil
+}
 
-	// Start with default config
+// describeFSError turns a filesystem error into a short explanation for config errors
+func describeFSError(err error) string {
+	switch {
+	case errors.Is(err, errNotDirectory):
+		return "path is a file, not a directory"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission denied"
+	case errors.Is(err, fs.ErrNotExist):
+		return "path does not exist"
+	default:
+		return "not writable"
+	}
+}
+
+// DefaultConfig returns a configuration with every default applied and no tokens,
+// as LoadConfig would produce from an empty file. It never touches the filesystem.
+func DefaultConfig() *Config {
 	cfg := &Config{Port: defaultServerPort}
 	SetDefaultTimeouts(cfg)
 	SetDefaultHeaders(cfg)
 	SetDefaultCORS(cfg)
+	return cfg
+}
+
+// LoadConfig loads the configuration from file and environment variables
+func LoadConfig(skipTokenValidation ...bool) (*Config, error) {
+	path, err := GetConfigPath()
+	if err != nil {
+		// Read-only commands can still run from environment variables and defaults
+		Warn("Config directory unavailable, using in-memory configuration", "error", err)
+	}
+
+	// Start with default config
+	cfg := DefaultConfig()
 
 	// Load from file if it exists
-	file, err := os.Open(path)
-	if err == nil {
-		defer func() {
-			if closeErr := file.Close(); closeErr != nil {
-				Error("Failed to close config file", "error", closeErr)
+	if path != "" {
+		if file, err := os.Open(path); err == nil {
+			defer func() {
+				if closeErr := file.Close(); closeErr != nil {
+					Error("Failed to close config file", "error", closeErr)
+				}
+			}()
+			if err := json.NewDecoder(file).Decode(cfg); err != nil {
+				return nil, err
 			}
-		}()
-		if err := json.NewDecoder(file).Decode(cfg); err != nil {
+		}
+	}
+
+	// Tokens may live outside the config file
+	if err := cfg.validateTokenStore(); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	}
+	if store := cfg.credentialStore(path); store != nil {
+		if err := cfg.LoadCredentials(store); err != nil {
 			return nil, err
 		}
 	}
@@ -149,6 +474,9 @@ func LoadConfig(skipTokenValidation ...bool) (*Config, error) {
 	if token := os.Getenv("COPILOT_TOKEN"); token != "" {
 		cfg.CopilotToken = token
 	}
+	if key := os.Getenv("COPILOT_API_KEY"); key != "" {
+		cfg.APIKey = key
+	}
 
 	// Set default port if still not specified
 	if cfg.Port == 0 {
@@ -157,24 +485,8 @@ func LoadConfig(skipTokenValidation ...bool) (*Config, error) {
 
 	// Validate configuration
 	skip := len(skipTokenValidation) > 0 && skipTokenValidation[0]
-	if skip {
-		// Validate everything except tokens
-		if err := cfg.validatePort(); err != nil {
-			return nil, fmt.Errorf("configuration validation failed: %w", err)
-		}
-		if err := cfg.validateTimeouts(); err != nil {
-			return nil, fmt.Errorf("configuration validation failed: %w", err)
-		}
-		if err := cfg.validateHeaders(); err != nil {
-			return nil, fmt.Errorf("configuration validation failed: %w", err)
-		}
-		if err := cfg.validateCORS(); err != nil {
-			return nil, fmt.Errorf("configuration validation failed: %w", err)
-		}
-	} else {
-		if err := cfg.Validate(); err != nil {
-			return nil, fmt.Errorf("configuration validation failed: %w", err)
-		}
+	if err := cfg.validate(!skip); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
 	}
 
 	return cfg, nil
@@ -197,6 +509,12 @@ func SetDefaultTimeouts(cfg *Config) {
 	if cfg.Timeouts.ProxyContext == 0 {
 		cfg.Timeouts.ProxyContext = defaultProxyContextTimeout
 	}
+	if cfg.Timeouts.MaxProxyContext == 0 {
+		cfg.Timeouts.MaxProxyContext = defaultMaxProxyContext
+	}
+	if cfg.Timeouts.UpstreamAcquire == 0 {
+		cfg.Timeouts.UpstreamAcquire = defaultUpstreamAcquire
+	}
 	if cfg.Timeouts.CircuitBreaker == 0 {
 		cfg.Timeouts.CircuitBreaker = defaultCircuitBreakerTimeout
 	}
@@ -248,12 +566,22 @@ func SetDefaultCORS(cfg *Config) {
 
 // Validate checks the configuration for correctness.
 func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+// validate runs every check; commands that can run before login skip the token check
+func (c *Config) validate(checkTokens bool) error {
 	if err := c.validatePort(); err != nil {
 		return err
 	}
-	if err := c.validateTokens(); err != nil {
+	if err := c.validateHost(); err != nil {
 		return err
 	}
+	if checkTokens {
+		if err := c.validateTokens(); err != nil {
+			return err
+		}
+	}
 	if err := c.validateTimeouts(); err != nil {
 		return err
 	}
@@ -263,6 +591,69 @@ func (c *Config) Validate() error {
 	if err := c.validateCORS(); err != nil {
 		return err
 	}
+	if err := c.validateMetrics(); err != nil {
+		return err
+	}
+	if err := c.validateRetry(); err != nil {
+		return err
+	}
+	if err := c.validateProxyMode(); err != nil {
+		return err
+	}
+	if err := c.validateConcurrency(); err != nil {
+		return err
+	}
+	if err := c.validateMaxHeaderBytes(); err != nil {
+		return err
+	}
+	if err := c.validateResponseCache(); err != nil {
+		return err
+	}
+	if err := c.validateTrustedProxies(); err != nil {
+		return err
+	}
+	if err := c.validateIdempotency(); err != nil {
+		return err
+	}
+	if err := c.validateRateLimit(); err != nil {
+		return err
+	}
+	if err := c.validateStats(); err != nil {
+		return err
+	}
+	if err := c.validateFallbackModel(); err != nil {
+		return err
+	}
+	if err := c.validateDefaultModel(); err != nil {
+		return err
+	}
+	if err := c.validateModelsCacheTTL(); err != nil {
+		return err
+	}
+	if err := c.validateMaxMessages(); err != nil {
+		return err
+	}
+	if err := c.validateTLS(); err != nil {
+		return err
+	}
+	if err := c.validateUpstreamProxy(); err != nil {
+		return err
+	}
+	if err := c.validateUpstreamTLS(); err != nil {
+		return err
+	}
+	if err := c.validateAllowedModels(); err != nil {
+		return err
+	}
+	if err := c.validateSamplingDefaults(); err != nil {
+		return err
+	}
+	if err := c.validateServiceIdentity(); err != nil {
+		return err
+	}
+	if err := c.validateTokenStore(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -277,6 +668,11 @@ func (c *Config) validateTokens() error {
 	if c.GitHubToken == "" && c.CopilotToken == "" {
 		return NewValidationError("github_token", "", "either github_token or copilot_token must be provided", nil)
 	}
+	for i, token := range c.GitHubTokens {
+		if token == "" {
+			return NewValidationError(fmt.Sprintf("github_tokens[%d]", i), "", "must not be empty", nil)
+		}
+	}
 	return nil
 }
 
@@ -296,6 +692,18 @@ func (c *Config) validateTimeouts() error {
 	if err := c.validateProxyContextTimeout(); err != nil {
 		return err
 	}
+	if err := c.validateMaxProxyContextTimeout(); err != nil {
+		return err
+	}
+	if err := c.validateEndpointTimeouts(); err != nil {
+		return err
+	}
+	if err := c.validateQueueWaitTimeout(); err != nil {
+		return err
+	}
+	if err := c.validateUpstreamAcquireTimeout(); err != nil {
+		return err
+	}
 	if err := c.validateCircuitBreakerTimeout(); err != nil {
 		return err
 	}
@@ -354,6 +762,52 @@ func (c *Config) validateProxyContextTimeout() error {
 	return nil
 }
 
+func (c *Config) validateMaxProxyContextTimeout() error {
+	// Zero falls back to the default at the point of use
+	if c.Timeouts.MaxProxyContext == 0 {
+		return nil
+	}
+	if c.Timeouts.MaxProxyContext < minTimeout || c.Timeouts.MaxProxyContext > maxLongTimeout {
+		return NewValidationError("timeouts.max_proxy_context", c.Timeouts.MaxProxyContext,
+			fmt.Sprintf("must be between %d and %d seconds", minTimeout, maxLongTimeout), nil)
+	}
+	return nil
+}
+
+func (c *Config) validateEndpointTimeouts() error {
+	// Zero falls back to proxy_context at the point of use
+	for field, seconds := range map[string]int{"timeouts.chat": c.Timeouts.Chat, "timeouts.models": c.Timeouts.Models, "timeouts.first_byte": c.Timeouts.FirstByte} {
+		if seconds != 0 && (seconds < minTimeout || seconds > maxLongTimeout) {
+			return NewValidationError(field, seconds, fmt.Sprintf("must be between %d and %d seconds", minTimeout, maxLongTimeout), nil)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateQueueWaitTimeout() error {
+	// Zero leaves the wait bounded only by the request timeout
+	if c.Timeouts.QueueWait == 0 {
+		return nil
+	}
+	if c.Timeouts.QueueWait < minTimeout || c.Timeouts.QueueWait > maxShortTimeout {
+		return NewValidationError("timeouts.queue_wait", c.Timeouts.QueueWait,
+			fmt.Sprintf("must be between %d and %d seconds", minTimeout, maxShortTimeout), nil)
+	}
+	return nil
+}
+
+func (c *Config) validateUpstreamAcquireTimeout() error {
+	// Zero falls back to the default at the point of use
+	if c.Timeouts.UpstreamAcquire == 0 {
+		return nil
+	}
+	if c.Timeouts.UpstreamAcquire < minTimeout || c.Timeouts.UpstreamAcquire > maxShortTimeout {
+		return NewValidationError("timeouts.upstream_acquire", c.Timeouts.UpstreamAcquire,
+			fmt.Sprintf("must be between %d and %d seconds", minTimeout, maxShortTimeout), nil)
+	}
+	return nil
+}
+
 func (c *Config) validateCircuitBreakerTimeout() error {
 	if c.Timeouts.CircuitBreaker < minTimeout || c.Timeouts.CircuitBreaker > maxShortTimeout {
 		return NewValidationError("timeouts.circuit_breaker", c.Timeouts.CircuitBreaker,
@@ -435,6 +889,445 @@ func (c *Config) validateCORS() error {
 	return nil
 }
 
+func (c *Config) validateMetrics() error {
+	if c.Metrics.RequireAPIKey && c.APIKey == "" {
+		return NewValidationError("metrics.require_api_key", true, "api_key must be set to protect /metrics", nil)
+	}
+	if c.Metrics.LargeResponseBytes < 0 {
+		return NewValidationError("metrics.large_response_bytes", c.Metrics.LargeResponseBytes, "must not be negative", nil)
+	}
+
+	push := c.Metrics.Push
+	switch push.Backend {
+	case "":
+		return nil
+	case metricsPushStatsD, metricsPushOTLP:
+	default:
+		return NewValidationError("metrics.push.backend", push.Backend, fmt.Sprintf("must be %q or %q", metricsPushStatsD, metricsPushOTLP), nil)
+	}
+	if push.Endpoint == "" {
+		return NewValidationError("metrics.push.endpoint", "", "endpoint is required when a push backend is set", nil)
+	}
+	if push.Interval < 0 || push.Interval > maxShortTimeout {
+		return NewValidationError("metrics.push.interval", push.Interval, fmt.Sprintf("must be between 0 and %d seconds", maxShortTimeout), nil)
+	}
+	return nil
+}
+
+func (c *Config) validateRetry() error {
+	if c.Retry.MaxDelay < 0 || c.Retry.MaxDelay > maxShortTimeout {
+		return NewValidationError("retry.max_delay", c.Retry.MaxDelay, fmt.Sprintf("must be between 0 and %d seconds", maxShortTimeout), nil)
+	}
+	if c.Retry.MaxAttempts < 0 || c.Retry.MaxAttempts > maxRetryAttempts {
+		return NewValidationError("retry.max_attempts", c.Retry.MaxAttempts, fmt.Sprintf("must be between 0 and %d", maxRetryAttempts), nil)
+	}
+	return nil
+}
+
+func (c *Config) validateConcurrency() error {
+	if c.MaxConcurrentUpstream < 0 {
+		return NewValidationError("max_concurrent_upstream", c.MaxConcurrentUpstream, "must not be negative", nil)
+	}
+	if c.MaxConcurrentStreams < 0 {
+		return NewValidationError("max_concurrent_streams", c.MaxConcurrentStreams, "must not be negative", nil)
+	}
+	return nil
+}
+
+func (c *Config) validateMaxHeaderBytes() error {
+	if c.MaxHeaderBytes != 0 && (c.MaxHeaderBytes < minHeaderBytes || c.MaxHeaderBytes > maxHeaderBytesLimit) {
+		return NewValidationError("max_header_bytes", c.MaxHeaderBytes, fmt.Sprintf("must be between %d and %d", minHeaderBytes, maxHeaderBytesLimit), nil)
+	}
+	return nil
+}
+
+func (c *Config) validateStats() error {
+	if c.Stats.Interval < 0 || c.Stats.Interval > maxLongTimeout {
+		return NewValidationError("stats.interval", c.Stats.Interval, fmt.Sprintf("must be between 0 and %d seconds", maxLongTimeout), nil)
+	}
+	return nil
+}
+
+func (c *Config) validateResponseCache() error {
+	if c.ResponseCache.TTL < 0 || c.ResponseCache.TTL > maxLongTimeout {
+		return NewValidationError("response_cache.ttl", c.ResponseCache.TTL, fmt.Sprintf("must be between 0 and %d seconds", maxLongTimeout), nil)
+	}
+	if c.ResponseCache.MaxEntries < 0 {
+		return NewValidationError("response_cache.max_entries", c.ResponseCache.MaxEntries, "must not be negative", nil)
+	}
+	return nil
+}
+
+func (c *Config) validateIdempotency() error {
+	if c.Idempotency.Window < 0 || c.Idempotency.Window > maxLongTimeout {
+		return NewValidationError("idempotency.window", c.Idempotency.Window, fmt.Sprintf("must be between 0 and %d seconds", maxLongTimeout), nil)
+	}
+	if c.Idempotency.MaxEntries < 0 {
+		return NewValidationError("idempotency.max_entries", c.Idempotency.MaxEntries, "must not be negative", nil)
+	}
+	return nil
+}
+
+func (c *Config) validateRateLimit() error {
+	if c.RateLimit.RequestsPerMinute < 0 {
+		return NewValidationError("rate_limit.requests_per_minute", c.RateLimit.RequestsPerMinute, "must not be negative", nil)
+	}
+	if c.RateLimit.Burst < 0 {
+		return NewValidationError("rate_limit.burst", c.RateLimit.Burst, "must not be negative", nil)
+	}
+	if c.RateLimit.MaxConcurrent < 0 {
+		return NewValidationError("rate_limit.max_concurrent", c.RateLimit.MaxConcurrent, "must not be negative", nil)
+	}
+	if c.RateLimit.RequestsPerMinute == 0 && (c.RateLimit.Burst != 0 || c.RateLimit.PerUser) {
+		return NewValidationError("rate_limit", c.RateLimit, "requests_per_minute must be set to enable rate limiting", nil)
+	}
+	return nil
+}
+
+// TLSEnabled reports whether the server should serve HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.TLS.CertFile != "" && c.TLS.KeyFile != ""
+}
+
+func (c *Config) validateTLS() error {
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return NewValidationError("tls", "", "cert_file and key_file must be set together", nil)
+	}
+	if (c.TLS.HealthcheckCertFile == "") != (c.TLS.HealthcheckKeyFile == "") {
+		return NewValidationError("tls", "", "healthcheck_cert_file and healthcheck_key_file must be set together", nil)
+	}
+	if c.TLS.CertFile == "" {
+		if c.TLS.ClientCAFile != "" {
+			return NewValidationError("tls.client_ca_file", c.TLS.ClientCAFile, "client certificates require cert_file and key_file", nil)
+		}
+		return nil
+	}
+	if _, err := os.Stat(c.TLS.CertFile); err != nil {
+		return NewValidationError("tls.cert_file", c.TLS.CertFile, "file not found", err)
+	}
+	if _, err := os.Stat(c.TLS.KeyFile); err != nil {
+		return NewValidationError("tls.key_file", c.TLS.KeyFile, "file not found", err)
+	}
+	if c.TLS.ClientCAFile != "" {
+		if _, err := loadCertPool(c.TLS.ClientCAFile); err != nil {
+			return NewValidationError("tls.client_ca_file", c.TLS.ClientCAFile, "invalid CA bundle", err)
+		}
+	}
+	if c.TLS.HealthcheckCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLS.HealthcheckCertFile, c.TLS.HealthcheckKeyFile); err != nil {
+			return NewValidationError("tls.healthcheck_cert_file", c.TLS.HealthcheckCertFile, "invalid certificate or key", err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateUpstreamProxy() error {
+	if c.UpstreamProxy.URL == "" {
+		if c.UpstreamProxy.Username != "" || c.UpstreamProxy.Password != "" {
+			return NewValidationError("upstream_proxy", "", "username and password require url", nil)
+		}
+		return nil
+	}
+	proxyURL, err := url.Parse(c.UpstreamProxy.URL)
+	if err != nil || proxyURL.Host == "" {
+		return NewValidationError("upstream_proxy.url", c.UpstreamProxy.URL, "must be an absolute URL", err)
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return NewValidationError("upstream_proxy.url", c.UpstreamProxy.URL, "scheme must be http or https", nil)
+	}
+	return nil
+}
+
+func (c *Config) validateUpstreamTLS() error {
+	for _, path := range c.UpstreamTLS.CAFiles {
+		if _, err := loadCertPool(path); err != nil {
+			return NewValidationError("upstream_tls.ca_files", path, "invalid CA bundle", err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateSamplingDefaults() error {
+	if t := c.DefaultTemperature; t != nil && (*t < 0 || *t > 2) {
+		return NewValidationError("default_temperature", *t, "must be between 0 and 2", nil)
+	}
+	if p := c.DefaultTopP; p != nil && (*p < 0 || *p > 1) {
+		return NewValidationError("default_top_p", *p, "must be between 0 and 1", nil)
+	}
+	return nil
+}
+
+func (c *Config) validateDefaultModel() error {
+	if c.DefaultModel == "" {
+		return nil
+	}
+	if strings.TrimSpace(c.DefaultModel) != c.DefaultModel {
+		return NewValidationError("default_model", c.DefaultModel, "must not have leading or trailing whitespace", nil)
+	}
+	live := c.Live()
+	if !isModelAllowed(NormalizeModel(c.DefaultModel, live.ModelAliases), live.AllowedModels, live.ModelAliases) {
+		return NewValidationError("default_model", c.DefaultModel, "must be one of allowed_models", nil)
+	}
+	return nil
+}
+
+// isModelAllowed reports whether allowed permits a normalized model ID, comparing
+// after alias normalization. An empty list allows any model.
+func isModelAllowed(model string, allowed []string, aliases map[string]string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if NormalizeModel(a, aliases) == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validateAllowedModels() error {
+	for i, model := range c.AllowedModels {
+		if strings.TrimSpace(model) == "" {
+			return NewValidationError(fmt.Sprintf("allowed_models[%d]", i), model, "must not be empty", nil)
+		}
+	}
+	return nil
+}
+
+// validateServiceIdentity ensures service_name and instance_id can be sent in a header
+func (c *Config) validateServiceIdentity() error {
+	for field, value := range map[string]string{"service_name": c.ServiceName, "instance_id": c.InstanceID} {
+		for _, r := range value {
+			if r < ' ' || r > '~' {
+				return NewValidationError(field, value, "must contain only printable ASCII characters", nil)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateTrustedProxies() error {
+	for i, entry := range c.TrustedProxies {
+		if _, err := parseTrustedProxy(strings.TrimSpace(entry)); err != nil {
+			return NewValidationError(fmt.Sprintf("trusted_proxies[%d]", i), entry, "must be an IP address or CIDR", err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateProxyMode() error {
+	switch c.Proxy.Mode {
+	case "", proxyModeBuffered, proxyModeReverse:
+	default:
+		return NewValidationError("proxy.mode", c.Proxy.Mode, fmt.Sprintf("must be %q or %q", proxyModeBuffered, proxyModeReverse), nil)
+	}
+	// The reverse proxy streams the body unread, so it cannot check the model or user
+	if c.Proxy.Mode == proxyModeReverse && len(c.AllowedModels) > 0 {
+		return NewValidationError("allowed_models", c.AllowedModels, fmt.Sprintf("cannot be enforced in %q proxy mode", proxyModeReverse), nil)
+	}
+	if c.Proxy.Mode == proxyModeReverse && c.RateLimit.PerUser {
+		return NewValidationError("rate_limit.per_user", c.RateLimit.PerUser, fmt.Sprintf("cannot be enforced in %q proxy mode", proxyModeReverse), nil)
+	}
+	if size := c.Proxy.StreamBufferSize; size != 0 && (size < minStreamBufferSize || size > maxStreamBufferSize) {
+		return NewValidationError("proxy.stream_buffer_size", size, fmt.Sprintf("must be between %d and %d bytes", minStreamBufferSize, maxStreamBufferSize), nil)
+	}
+	if size := c.Proxy.CopyBufferSize; size != 0 && (size < minCopyBufferSize || size > maxCopyBufferSize) {
+		return NewValidationError("proxy.copy_buffer_size", size, fmt.Sprintf("must be between %d and %d bytes", minCopyBufferSize, maxCopyBufferSize), nil)
+	}
+	for i, contentType := range c.Proxy.AllowedContentTypes {
+		if _, params, err := mime.ParseMediaType(contentType); err != nil || len(params) > 0 {
+			return NewValidationError(fmt.Sprintf("proxy.allowed_content_types[%d]", i), contentType, "must be a media type without parameters, e.g. application/json", nil)
+		}
+	}
+	if n := c.Proxy.StreamReconnects; n < 0 || n > maxStreamReconnects {
+		return NewValidationError("proxy.stream_reconnects", n, fmt.Sprintf("must be between 0 and %d", maxStreamReconnects), nil)
+	}
+	switch c.Proxy.AcceptEncoding {
+	case "", acceptEncodingAuto, acceptEncodingGzip, acceptEncodingIdentity:
+	default:
+		return NewValidationError("proxy.accept_encoding", c.Proxy.AcceptEncoding,
+			fmt.Sprintf("must be %q, %q or %q", acceptEncodingAuto, acceptEncodingGzip, acceptEncodingIdentity), nil)
+	}
+	for i, route := range c.Proxy.PassthroughRoutes {
+		if !strings.HasPrefix(route, "/v1/") {
+			return NewValidationError(fmt.Sprintf("proxy.passthrough_routes[%d]", i), route, "must start with /v1/", nil)
+		}
+		if route == "/v1/chat/completions" || route == "/v1/models" || route == "/v1/completions" || c.Proxy.WebSocket && route == chatWebSocketRoute {
+			return NewValidationError(fmt.Sprintf("proxy.passthrough_routes[%d]", i), route, "conflicts with a built-in route", nil)
+		}
+		if slices.Contains(c.Proxy.PassthroughRoutes[:i], route) {
+			return NewValidationError(fmt.Sprintf("proxy.passthrough_routes[%d]", i), route, "is listed more than once", nil)
+		}
+	}
+	for route, upstream := range c.Proxy.Routes {
+		field := fmt.Sprintf("proxy.routes[%q]", route)
+		if !strings.HasPrefix(route, "/v1/") {
+			return NewValidationError(field, route, "must start with /v1/", nil)
+		}
+		if route == "/v1/models" || route == "/v1/completions" || c.Proxy.WebSocket && route == chatWebSocketRoute || slices.Contains(c.Proxy.PassthroughRoutes, route) {
+			return NewValidationError(field, route, "conflicts with another route", nil)
+		}
+		if !strings.HasPrefix(upstream, "/") {
+			return NewValidationError(field, upstream, "upstream path must start with /", nil)
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of the configuration
+func (c *Config) clone() (*Config, error) {
+	c.tokenMutex.RLock()
+	data, err := json.Marshal(c)
+	c.tokenMutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	cp := &Config{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// persistable returns a copy of the configuration carrying the live hot-reloadable
+// settings, as it is saved and shown
+func (c *Config) persistable() (*Config, error) {
+	cp, err := c.clone()
+	if err != nil {
+		return nil, err
+	}
+	if live := c.live.Load(); live != nil {
+		cp.copyReloadable(live)
+	}
+	return cp, nil
+}
+
+// redacted returns a copy of the configuration with secrets masked
+func (c *Config) redacted() (*Config, error) {
+	cp, err := c.persistable()
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range []*string{&cp.GitHubToken, &cp.CopilotToken, &cp.APIKey, &cp.UpstreamProxy.Password} {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	for i := range cp.GitHubTokens {
+		cp.GitHubTokens[i] = redactedValue
+	}
+	// The proxy URL may carry credentials as userinfo
+	if proxyURL := cp.UpstreamProxy.URL; proxyURL != "" {
+		if u, err := url.Parse(proxyURL); err == nil {
+			cp.UpstreamProxy.URL = u.Redacted()
+		} else if strings.Contains(proxyURL, "@") {
+			cp.UpstreamProxy.URL = redactedValue
+		}
+	}
+	return cp, nil
+}
+
+// validateReloadable validates the settings that can be changed at runtime
+func (c *Config) validateReloadable() error {
+	if err := c.validateTimeouts(); err != nil {
+		return err
+	}
+	if err := c.validateHeaders(); err != nil {
+		return err
+	}
+	if err := c.validateRetry(); err != nil {
+		return err
+	}
+	if err := c.validateAllowedModels(); err != nil {
+		return err
+	}
+	if err := c.validateDefaultModel(); err != nil {
+		return err
+	}
+	if err := c.validateFallbackModel(); err != nil {
+		return err
+	}
+	if err := c.validateProxyMode(); err != nil {
+		return err
+	}
+	return c.validateCORS()
+}
+
+// copyReloadable copies the settings that take effect without a restart from src
+func (c *Config) copyReloadable(src *Config) {
+	c.Headers = src.Headers
+	c.CORS = src.CORS
+	c.Timeouts = src.Timeouts
+	c.Retry = src.Retry
+	c.RequestHeaders = src.RequestHeaders
+	c.ResponseHeaders = src.ResponseHeaders
+	c.ModelAliases = src.ModelAliases
+	c.AllowedModels = src.AllowedModels
+}
+
+// Live returns the config holding the current hot-reloadable settings: headers, CORS,
+// timeouts, retry, request and response header filters, model aliases and allowed
+// models. Request paths read those settings from it, once per use, rather than from
+// c. A published config is never modified, so it needs no lock; its tokens are left
+// empty, as they are read from c.
+func (c *Config) Live() *Config {
+	if live := c.live.Load(); live != nil {
+		return live
+	}
+	return c
+}
+
+// publishReloadable publishes a copy of the live config carrying src's hot-reloadable
+// settings. The config in use is never modified in place.
+func (c *Config) publishReloadable(src *Config) error {
+	for {
+		current := c.live.Load()
+		base := current
+		if base == nil {
+			base = c
+		}
+		next, err := base.clone()
+		if err != nil {
+			return err
+		}
+		next.copyReloadable(src)
+		next.GitHubToken, next.CopilotToken, next.ExpiresAt, next.RefreshIn, next.GitHubTokens = "", "", 0, 0, nil
+		if c.live.CompareAndSwap(current, next) {
+			return nil
+		}
+	}
+}
+
+// ReloadFromFile re-reads the config file at path and publishes its hot-reloadable
+// settings; see Live. Nothing changes if the file is invalid.
+func (c *Config) ReloadFromFile(path string) error {
+	fresh := &Config{}
+	SetDefaultTimeouts(fresh)
+	SetDefaultHeaders(fresh)
+	SetDefaultCORS(fresh)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return NewConfigError("config_path", path, "cannot read config file", err)
+	}
+	if err := json.Unmarshal(data, fresh); err != nil {
+		return NewConfigError("config_path", path, "invalid JSON in config file", err)
+	}
+
+	// Validate the settings as they would be in effect, so allowed_models is checked
+	// against the default and fallback models and proxy mode read at startup
+	candidate, err := c.persistable()
+	if err != nil {
+		return err
+	}
+	candidate.copyReloadable(fresh)
+	if err := candidate.validateReloadable(); err != nil {
+		return fmt.Errorf("configuration validation failed: %w", err)
+	}
+
+	return c.publishReloadable(fresh)
+}
+
 // SaveConfig saves the configuration to file
 func (c *Config) SaveConfig(pathOverride ...string) error {
 	var path string
@@ -447,14 +1340,36 @@ func (c *Config) SaveConfig(pathOverride ...string) error {
 			return err
 		}
 	}
-	f, err := os.Create(path)
+
+	saved, err := c.persistable()
 	if err != nil {
+		return NewConfigError("config_path", path, "cannot encode config", err)
+	}
+
+	// Tokens stay in the config file unless another credential store is selected
+	store := c.credentialStore(path)
+	if fileStore, ok := store.(*FileCredentialStore); ok && fileStore.Path == path {
+		return writeConfigFile(path, saved)
+	}
+
+	creds := saved.credentials()
+	saved.GitHubToken, saved.CopilotToken, saved.ExpiresAt, saved.RefreshIn = "", "", 0, 0
+	if err := writeConfigFile(path, saved); err != nil {
 		return err
 	}
+	return store.Save(creds)
+}
+
+// writeConfigFile encodes cfg as JSON to path
+func writeConfigFile(path string, cfg *Config) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return NewConfigError("config_path", path, fmt.Sprintf("cannot write config file (%s)", describeFSError(err)), err)
+	}
 	defer func() {
 		if closeErr := f.Close(); closeErr != nil {
 			Error("Failed to close config file", "error", closeErr)
 		}
 	}()
-	return json.NewEncoder(f).Encode(c)
+	return json.NewEncoder(f).Encode(cfg)
 }
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFirstUsableConfigDir(t *testing.T) {
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, []byte("x"), 0o600); err != nil {
+		t.Fatalf("failed to create blocker file: %v", err)
+	}
+	unwritable := filepath.Join(blocker, "config")
+	fallback := filepath.Join(t.TempDir(), xdgAppDirName)
+
+	dir, err := firstUsableConfigDir([]string{unwritable, fallback})
+	if err != nil {
+		t.Fatalf("expected fallback directory, got error: %v", err)
+	}
+	if dir != fallback {
+		t.Errorf("expected %s, got %s", fallback, dir)
+	}
+
+	_, err = firstUsableConfigDir([]string{unwritable})
+	if _, ok := err.(*ConfigurationError); !ok {
+		t.Fatalf("expected ConfigurationError, got %T: %v", err, err)
+	}
+}
+
+func TestEnsureConfigDir(t *testing.T) {
+	t.Run("creates a missing directory", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "a", "b")
+		if err := ensureConfigDir(dir); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Fatalf("expected %s to be created: %v", dir, err)
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 0 {
+			t.Errorf("expected the write check to leave nothing behind, got %v", entries)
+		}
+	})
+
+	t.Run("rejects a regular file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "config")
+		if err := os.WriteFile(file, []byte("x"), 0o600); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+		err := ensureConfigDir(file)
+		if !errors.Is(err, errNotDirectory) {
+			t.Fatalf("expected errNotDirectory, got %v", err)
+		}
+		_, err = firstUsableConfigDir([]string{file})
+		if err == nil || !strings.Contains(err.Error(), "not a directory") {
+			t.Errorf("expected the error to explain the path is a file, got %v", err)
+		}
+	})
+
+	t.Run("rejects a read-only directory", func(t *testing.T) {
+		if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+			t.Skip("directory permissions are not enforced for this user")
+		}
+		dir := t.TempDir()
+		if err := os.Chmod(dir, 0o500); err != nil {
+			t.Fatalf("chmod failed: %v", err)
+		}
+		t.Cleanup(func() { _ = os.Chmod(dir, 0o700) })
+		if err := ensureConfigDir(dir); err == nil {
+			t.Fatal("expected a read-only directory to be rejected")
+		}
+	})
+}
+
+func TestConfigDirCandidatesUsesXDGDataHome(t *testing.T) {
+	dataHome := t.TempDir()
+	t.Setenv(xdgDataHomeEnv, dataHome)
+
+	dirs, err := configDirCandidates()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := filepath.Join(dataHome, xdgAppDirName)
+	if dirs[len(dirs)-1] != want {
+		t.Errorf("expected last candidate %s, got %v", want, dirs)
+	}
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Token store types selectable with the token_store config field
+const (
+	tokenStoreFile     = "file"     // tokens live in config.json (default)
+	tokenStoreKeychain = "keychain" // macOS Keychain or libsecret
+)
+
+// Credentials are the secrets persisted by a CredentialStore
+type Credentials struct {
+	GitHubToken  string `json:"github_token"`
+	CopilotToken string `json:"copilot_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	RefreshIn    int64  `json:"refresh_in"`
+}
+
+// CredentialStore persists GitHub and Copilot tokens. Load returns empty
+// credentials, not an error, when nothing has been stored yet.
+type CredentialStore interface {
+	Load() (*Credentials, error)
+	Save(*Credentials) error
+}
+
+// FileCredentialStore keeps tokens in the JSON config file alongside the other settings
+type FileCredentialStore struct {
+	Path string
+}
+
+// Load reads the token fields from the config file
+func (s *FileCredentialStore) Load() (*Credentials, error) {
+	creds := &Credentials{}
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, NewConfigError("config_path", s.Path, "cannot read config file", err)
+	}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, NewConfigError("config_path", s.Path, "invalid JSON in config file", err)
+	}
+	return creds, nil
+}
+
+// Save writes the token fields into the config file, keeping its other settings
+func (s *FileCredentialStore) Save(creds *Credentials) error {
+	fields := map[string]json.RawMessage{}
+	data, err := os.ReadFile(s.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return NewConfigError("config_path", s.Path, "cannot read config file", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return NewConfigError("config_path", s.Path, "invalid JSON in config file", err)
+		}
+	}
+
+	secrets, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(secrets, &fields); err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.Path, data, configFilePerm); err != nil {
+		return NewConfigError("config_path", s.Path, fmt.Sprintf("cannot write config file (%s)", describeFSError(err)), err)
+	}
+	return nil
+}
+
+// newCredentialStore returns the store for the configured token_store type.
+// File stores need the config file path and are nil without one.
+func newCredentialStore(storeType, configPath string) CredentialStore {
+	switch storeType {
+	case tokenStoreKeychain:
+		return newKeychainCredentialStore()
+	default:
+		if configPath == "" {
+			return nil
+		}
+		return &FileCredentialStore{Path: configPath}
+	}
+}
+
+// SetCredentialStore overrides the store used by SaveConfig for tokens.
+func (c *Config) SetCredentialStore(store CredentialStore) {
+	c.store = store
+}
+
+// credentialStore returns the injected store or the one selected by token_store
+func (c *Config) credentialStore(configPath string) CredentialStore {
+	if c.store != nil {
+		return c.store
+	}
+	return newCredentialStore(c.TokenStore, configPath)
+}
+
+// Token returns the current Copilot token and its expiry (Unix seconds). Code running
+// alongside token refreshes reads the token through it rather than the fields.
+func (c *Config) Token() (string, int64) {
+	c.tokenMutex.RLock()
+	defer c.tokenMutex.RUnlock()
+	return c.CopilotToken, c.ExpiresAt
+}
+
+// hasCopilotToken reports whether a Copilot token is set
+func (c *Config) hasCopilotToken() bool {
+	token, _ := c.Token()
+	return token != ""
+}
+
+// setToken publishes a new Copilot token
+func (c *Config) setToken(token string, expiresAt, refreshIn int64) {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	c.CopilotToken, c.ExpiresAt, c.RefreshIn = token, expiresAt, refreshIn
+}
+
+// credentials returns the config's tokens
+func (c *Config) credentials() *Credentials {
+	c.tokenMutex.RLock()
+	defer c.tokenMutex.RUnlock()
+	return &Credentials{
+		GitHubToken:  c.GitHubToken,
+		CopilotToken: c.CopilotToken,
+		ExpiresAt:    c.ExpiresAt,
+		RefreshIn:    c.RefreshIn,
+	}
+}
+
+// LoadCredentials replaces the config's tokens with those held by store. An empty
+// store leaves the tokens untouched, so tokens still in config.json keep working
+// until the next save moves them.
+func (c *Config) LoadCredentials(store CredentialStore) error {
+	creds, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if creds == nil || (creds.GitHubToken == "" && creds.CopilotToken == "") {
+		return nil
+	}
+	c.GitHubToken = creds.GitHubToken
+	c.CopilotToken = creds.CopilotToken
+	c.ExpiresAt = creds.ExpiresAt
+	c.RefreshIn = creds.RefreshIn
+	return nil
+}
+
+func (c *Config) validateTokenStore() error {
+	switch c.TokenStore {
+	case "", tokenStoreFile, tokenStoreKeychain:
+		return nil
+	default:
+		return NewValidationError("token_store", c.TokenStore, fmt.Sprintf("must be %q or %q", tokenStoreFile, tokenStoreKeychain), nil)
+	}
+}
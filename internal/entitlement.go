@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// notEntitledMessage tells the user what to do when the account has no Copilot access
+const notEntitledMessage = "this account does not have Copilot access; check the subscription at https://github.com/settings/copilot or authenticate with an account that has one"
+
+// ErrNotEntitled is wrapped by errors for a GitHub account without a Copilot seat
+var ErrNotEntitled = errors.New("copilot not entitled")
+
+// notEntitledMarkers are lowercase fragments of the error bodies GitHub and the Copilot
+// API return for accounts without Copilot access
+var notEntitledMarkers = [][]byte{
+	[]byte("no_copilot_access"),
+	[]byte("not_entitled"),
+	[]byte("not entitled"),
+	[]byte("not have access to github copilot"),
+	[]byte("not have access to copilot"),
+	[]byte("copilot is not enabled"),
+}
+
+// maxEntitlementBody bounds how much of an error body is inspected
+const maxEntitlementBody = 64 * 1024
+
+// isNotEntitledBody reports whether an error body names a missing Copilot entitlement
+func isNotEntitledBody(body []byte) bool {
+	lower := bytes.ToLower(body)
+	for _, marker := range notEntitledMarkers {
+		if bytes.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenExchangeNotEntitled reports whether a failed Copilot token exchange means the
+// account has no Copilot access: GitHub answers 404 for such accounts, or 403 with an
+// entitlement error
+func tokenExchangeNotEntitled(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return true
+	case http.StatusForbidden:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxEntitlementBody))
+		return isNotEntitledBody(body)
+	default:
+		return false
+	}
+}
+
+// newNotEntitledError returns the AuthenticationError for a missing Copilot entitlement
+func newNotEntitledError(status int) *AuthenticationError {
+	return NewAuthError(notEntitledMessage, fmt.Errorf("%w (HTTP %d)", ErrNotEntitled, status))
+}
@@ -2,8 +2,28 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"syscall"
+)
+
+// Process exit codes reported by the CLI for each error class
+const (
+	ExitOK         = 0
+	ExitFailure    = 1 // unclassified failure
+	ExitAuth       = 2 // AuthenticationError
+	ExitNetwork    = 3 // NetworkError or transport failure
+	ExitConfig     = 4 // ConfigurationError
+	ExitValidation = 5 // ValidationError (invalid arguments)
+	ExitProxy      = 6 // ProxyError
+	ExitNoCopilot  = 7 // ErrNotEntitled: the GitHub account has no Copilot access
 )
 
 type (
@@ -140,6 +160,88 @@ func WriteHTTPErrorWithDetails(w http.ResponseWriter, statusCode int, errorType,
 		message, errorType, statusCode, details)
 }
 
+// WriteUpstreamNetworkError writes a 502 JSON error for a failed upstream connection.
+// Only a fixed description of the failure class reaches the client; callers log the
+// full error under the same request ID.
+func WriteUpstreamNetworkError(w http.ResponseWriter, requestID string, err error) {
+	body := map[string]interface{}{
+		"error": map[string]interface{}{
+			"message":    "Failed to reach the Copilot API: " + DescribeNetworkError(err),
+			"type":       "upstream_network_error",
+			"code":       http.StatusBadGateway,
+			"request_id": requestID,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// WriteNotEntitledError writes a 403 JSON error for an account without Copilot access
+func WriteNotEntitledError(w http.ResponseWriter) {
+	body := map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": notEntitledMessage,
+			"type":    "copilot_not_entitled",
+			"code":    http.StatusForbidden,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// WriteStreamError ends an SSE response whose upstream stream failed part way: an
+// error event, then the [DONE] terminator so clients stop waiting. midEvent closes
+// an event the upstream cut off first.
+func WriteStreamError(w io.Writer, midEvent bool, err error) error {
+	body, marshalErr := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": "Upstream stream interrupted: " + DescribeNetworkError(err),
+			"type":    "upstream_stream_error",
+			"code":    http.StatusBadGateway,
+		},
+	})
+	if marshalErr != nil {
+		return marshalErr
+	}
+	var b bytes.Buffer
+	if midEvent {
+		b.WriteString("\n\n")
+	}
+	fmt.Fprintf(&b, "event: error\ndata: %s\n\ndata: [DONE]\n\n", body)
+	_, writeErr := w.Write(b.Bytes())
+	return writeErr
+}
+
+// DescribeNetworkError returns a short, client-safe description of a transport error
+func DescribeNetworkError(err error) string {
+	var (
+		dnsErr      *net.DNSError
+		certErr     *tls.CertificateVerificationError
+		unknownCA   x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		recordErr   tls.RecordHeaderError
+		netErr      net.Error
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return fmt.Sprintf("DNS lookup failed for %s", dnsErr.Name)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset by peer"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection closed unexpectedly"
+	case errors.As(err, &certErr), errors.As(err, &unknownCA), errors.As(err, &hostnameErr), errors.As(err, &recordErr):
+		return "TLS handshake failed"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "request timed out"
+	default:
+		return "request failed"
+	}
+}
+
 // WriteAuthenticationError ...
 func WriteAuthenticationError(w http.ResponseWriter) {
 	WriteHTTPError(w, http.StatusUnauthorized, "Authentication required")
@@ -155,6 +257,22 @@ func WriteValidationError(w http.ResponseWriter, message string) {
 	WriteHTTPError(w, http.StatusBadRequest, message)
 }
 
+// WriteRequestValidationError writes a 400 JSON error naming the request field that
+// failed validation
+func WriteRequestValidationError(w http.ResponseWriter, err *ValidationError) {
+	body := map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": err.Message,
+			"type":    "validation_error",
+			"param":   err.Field,
+			"code":    http.StatusBadRequest,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
 // WriteInternalError ...
 func WriteInternalError(w http.ResponseWriter) {
 	WriteHTTPError(w, http.StatusInternalServerError, "Internal server error")
@@ -199,3 +317,40 @@ func IsProxyError(err error) bool {
 	_, ok := err.(*ProxyError)
 	return ok
 }
+
+// ExitCode maps an error to the CLI exit code for its class. Wrapped errors are
+// inspected; a NetworkError takes precedence over the authentication or
+// configuration step it happened in, since retrying may succeed. Untyped
+// transport errors are reported as network failures.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var (
+		networkErr    *NetworkError
+		netErr        net.Error
+		authErr       *AuthenticationError
+		configErr     *ConfigurationError
+		validationErr *ValidationError
+		proxyErr      *ProxyError
+	)
+	switch {
+	case errors.Is(err, ErrNotEntitled):
+		return ExitNoCopilot
+	case errors.As(err, &networkErr):
+		return ExitNetwork
+	case errors.As(err, &authErr):
+		return ExitAuth
+	case errors.As(err, &configErr):
+		return ExitConfig
+	case errors.As(err, &validationErr):
+		return ExitValidation
+	case errors.As(err, &proxyErr):
+		return ExitProxy
+	case errors.As(err, &netErr):
+		return ExitNetwork
+	default:
+		return ExitFailure
+	}
+}
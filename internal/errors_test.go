@@ -1,8 +1,14 @@
 package internal
 
 import (
+	"context"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"syscall"
 	"testing"
 )
 
@@ -195,3 +201,45 @@ func (m *mockResponseWriter) Write(b []byte) (int, error) {
 func (m *mockResponseWriter) WriteHeader(statusCode int) {
 	m.status = statusCode
 }
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, ExitOK},
+		{"untyped", errors.New("boom"), ExitFailure},
+		{"auth", NewAuthError("msg", nil), ExitAuth},
+		{"network", NewNetworkError("op", "url", "msg", nil), ExitNetwork},
+		{"config", NewConfigError("f", "v", "msg", nil), ExitConfig},
+		{"validation", NewValidationError("f", "v", "msg", nil), ExitValidation},
+		{"proxy", NewProxyError("op", "msg", nil), ExitProxy},
+		{"config wrapping validation", NewConfigError("f", "v", "msg", NewValidationError("f", "v", "msg", nil)), ExitConfig},
+		{"auth wrapping network", NewAuthError("msg", fmt.Errorf("step: %w", NewNetworkError("op", "url", "msg", nil))), ExitNetwork},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("%s: expected exit code %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestDescribeNetworkError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "example.com"}, "DNS lookup failed for example.com"},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, "connection refused"},
+		{&net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, "connection reset by peer"},
+		{fmt.Errorf("wrapped: %w", x509.UnknownAuthorityError{}), "TLS handshake failed"},
+		{context.DeadlineExceeded, "request timed out"},
+		{errors.New("boom"), "request failed"},
+	}
+	for _, tt := range tests {
+		if got := DescribeNetworkError(tt.err); got != tt.want {
+			t.Errorf("DescribeNetworkError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
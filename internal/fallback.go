@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// fallbackModelHeader tells clients their request was answered by fallback_model
+const fallbackModelHeader = "X-Fallback-Model"
+
+// modelUnavailableMarkers are lowercase fragments of the error bodies the Copilot API
+// returns for a model it cannot serve right now
+var modelUnavailableMarkers = [][]byte{
+	[]byte("model_not_supported"),
+	[]byte("model_not_found"),
+	[]byte("model_not_available"),
+	[]byte("model is not supported"),
+	[]byte("model is not available"),
+	[]byte("model not found"),
+	[]byte("model is unavailable"),
+}
+
+// isModelUnavailable reports whether an upstream error response says the requested
+// model is unavailable: a 400 or 404 naming it in the body
+func isModelUnavailable(status int, body []byte) bool {
+	if status != http.StatusBadRequest && status != http.StatusNotFound {
+		return false
+	}
+	lower := bytes.ToLower(body)
+	for _, marker := range modelUnavailableMarkers {
+		if bytes.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackOnUnavailableModel resends a request once with fallback_model when the
+// upstream answered that its model is unavailable. preq then names the fallback model;
+// the response to continue with is returned, with the fallback model when it was used
+// ("" otherwise).
+func (s *ProxyService) fallbackOnUnavailableModel(req *http.Request, preq *proxyRequest, resp *http.Response, current *seat) (*http.Response, string, error) {
+	if s.config.FallbackModel == "" || resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusNotFound {
+		return resp, "", nil
+	}
+	fallback := NormalizeModel(s.config.FallbackModel, s.config.Live().ModelAliases)
+	model := preq.model()
+	if model == "" || model == fallback {
+		return resp, "", nil
+	}
+
+	errorBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(errorBody))
+	if err != nil || !isModelUnavailable(resp.StatusCode, errorBody) {
+		return resp, "", nil
+	}
+
+	if err := preq.set("model", fallback); err != nil {
+		return resp, "", nil
+	}
+	Warn("Model unavailable upstream, retrying with the fallback model", "model", model, "fallback", fallback, "status", resp.StatusCode)
+	fallbackResp, err := s.makeRequestWithRetry(req, preq.bytes(), current)
+	if err != nil {
+		return nil, "", err
+	}
+	return fallbackResp, fallback, nil
+}
+
+func (c *Config) validateFallbackModel() error {
+	if c.FallbackModel == "" {
+		return nil
+	}
+	live := c.Live()
+	if !isModelAllowed(NormalizeModel(c.FallbackModel, live.ModelAliases), live.AllowedModels, live.ModelAliases) {
+		return NewValidationError("fallback_model", c.FallbackModel, "must be one of allowed_models", nil)
+	}
+	return nil
+}
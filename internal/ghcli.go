@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+)
+
+// ghCommand is the GitHub CLI binary used by auth --gh; replaced in tests
+var ghCommand = "gh"
+
+// ghAuthToken returns the token the GitHub CLI is logged in to github.com with, as
+// printed by `gh auth token` (gh 2.17 or later). gh reads it from its own config or
+// the OS keychain, so this works wherever `gh auth login` has been run.
+func ghAuthToken(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, ghCommand, "auth", "token", "--hostname", "github.com")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return "", NewAuthError("GitHub CLI (gh) not found; install it from https://cli.github.com, or run 'auth' without --gh for the device flow", err)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", NewAuthError("cannot read a token from the GitHub CLI; run 'gh auth login' first, or run 'auth' without --gh for the device flow", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", NewAuthError("the GitHub CLI returned no token; run 'gh auth login' first", nil)
+	}
+	return token, nil
+}
@@ -4,8 +4,14 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"net/http"
+	"os"
 	"runtime"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -19,6 +25,9 @@ const (
 	goroutineCritical  = 5000
 	bytesToMB          = 1024 * 1024
 	percentMultiplier  = 100
+
+	// Reported as the service when service_name is not configured
+	defaultServiceName = "github-copilot-svcs"
 )
 
 // HealthStatus represents the overall health status
@@ -47,6 +56,7 @@ type HealthCheck struct {
 type HealthResponse struct {
 	Status    HealthStatus           `json:"status"`
 	Service   string                 `json:"service"`
+	Instance  string                 `json:"instance,omitempty"`
 	Version   string                 `json:"version,omitempty"`
 	Timestamp time.Time              `json:"timestamp"`
 	Uptime    time.Duration          `json:"uptime"`
@@ -86,18 +96,29 @@ type HealthChecker struct {
 	httpClient *http.Client
 	version    string
 	checks     []HealthCheckFunc
+
+	// serviceName and instanceID identify this deployment in responses
+	serviceName string
+	instanceID  string
+
+	// readinessChecks gate /readyz: whether the server can serve proxy traffic now
+	readinessChecks []HealthCheckFunc
 }
 
 // HealthCheckFunc represents a health check function
 type HealthCheckFunc func(ctx context.Context) HealthCheck
 
 // NewHealthChecker creates a new health checker
-func NewHealthChecker(httpClient *http.Client, version string) *HealthChecker {
+func NewHealthChecker(httpClient *http.Client, version string, opts ...func(*HealthChecker)) *HealthChecker {
 	hc := &HealthChecker{
-		startTime:  time.Now(),
-		httpClient: httpClient,
-		version:    version,
-		checks:     make([]HealthCheckFunc, 0),
+		startTime:   time.Now(),
+		httpClient:  httpClient,
+		version:     version,
+		checks:      make([]HealthCheckFunc, 0),
+		serviceName: defaultServiceName,
+	}
+	for _, opt := range opts {
+		opt(hc)
 	}
 
 	// Add default health checks
@@ -107,21 +128,47 @@ func NewHealthChecker(httpClient *http.Client, version string) *HealthChecker {
 	return hc
 }
 
+// WithServiceIdentity reports the configured service name and instance ID; an empty
+// name keeps the default
+func WithServiceIdentity(serviceName, instanceID string) func(*HealthChecker) {
+	return func(h *HealthChecker) {
+		if serviceName != "" {
+			h.serviceName = serviceName
+		}
+		h.instanceID = instanceID
+	}
+}
+
 // AddCheck adds a health check function
 // AddCheck adds a health check function.
 func (h *HealthChecker) AddCheck(check HealthCheckFunc) {
 	h.checks = append(h.checks, check)
 }
 
+// AddReadinessCheck adds a check that must not be unhealthy for /readyz to report ready
+func (h *HealthChecker) AddReadinessCheck(check HealthCheckFunc) {
+	h.readinessChecks = append(h.readinessChecks, check)
+}
+
 // CheckHealth performs all health checks and returns the overall status.
 func (h *HealthChecker) CheckHealth(ctx context.Context) *HealthResponse {
+	return h.runChecks(ctx, h.checks)
+}
+
+// CheckReadiness performs the readiness checks and returns the overall status
+func (h *HealthChecker) CheckReadiness(ctx context.Context) *HealthResponse {
+	return h.runChecks(ctx, h.readinessChecks)
+}
+
+// runChecks runs checkFuncs and combines their results with the system metrics
+func (h *HealthChecker) runChecks(ctx context.Context, checkFuncs []HealthCheckFunc) *HealthResponse {
 	start := time.Now()
 
 	// Run all checks
-	checks := make([]HealthCheck, 0, len(h.checks))
+	checks := make([]HealthCheck, 0, len(checkFuncs))
 	overallStatus := StatusHealthy
 
-	for _, checkFunc := range h.checks {
+	for _, checkFunc := range checkFuncs {
 		check := checkFunc(ctx)
 		checks = append(checks, check)
 
@@ -138,7 +185,8 @@ func (h *HealthChecker) CheckHealth(ctx context.Context) *HealthResponse {
 
 	response := &HealthResponse{
 		Status:    overallStatus,
-		Service:   "github-copilot-svcs",
+		Service:   h.serviceName,
+		Instance:  h.instanceID,
 		Version:   h.version,
 		Timestamp: time.Now(),
 		Uptime:    time.Since(h.startTime),
@@ -152,13 +200,23 @@ func (h *HealthChecker) CheckHealth(ctx context.Context) *HealthResponse {
 	return response
 }
 
-// Handler ...
+// Handler serves the liveness report (/health)
 func (h *HealthChecker) Handler() http.HandlerFunc {
+	return h.handler(h.CheckHealth)
+}
+
+// ReadinessHandler serves the readiness report (/readyz): 503 until every readiness
+// check passes, e.g. while no usable token exists
+func (h *HealthChecker) ReadinessHandler() http.HandlerFunc {
+	return h.handler(h.CheckReadiness)
+}
+
+func (h *HealthChecker) handler(check func(context.Context) *HealthResponse) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
 		defer cancel()
 
-		health := h.CheckHealth(ctx)
+		health := check(ctx)
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -254,6 +312,103 @@ func (h *HealthChecker) checkGoroutines(_ context.Context) HealthCheck {
 	}
 }
 
+// ConfigFileCheck returns a check that the config file is readable and parseable and that
+// the Copilot token exists and is not expired. An empty path is resolved with GetConfigPath
+// on each run. A token close to expiry, or an expired one that can be refreshed with the
+// stored GitHub token, is degraded rather than unhealthy so idle servers stay healthy.
+func ConfigFileCheck(cfg *Config, path string) HealthCheckFunc {
+	return func(_ context.Context) HealthCheck {
+		start := time.Now()
+		check := HealthCheck{Name: "config", Details: map[string]interface{}{}}
+		finish := func(status HealthStatus, message string) HealthCheck {
+			check.Status = status
+			check.Message = message
+			check.Duration = time.Since(start)
+			check.LastChecked = time.Now()
+			return check
+		}
+
+		configPath := path
+		if configPath == "" {
+			configPath, _ = GetConfigPath()
+		}
+		if configPath != "" {
+			check.Details["config_file"] = configPath
+			data, err := os.ReadFile(configPath)
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				// Tokens may come from the environment alone
+				check.Details["config_file_present"] = false
+			case err != nil:
+				return finish(StatusUnhealthy, fmt.Sprintf("Config file unreadable (%s)", describeFSError(err)))
+			default:
+				var parsed map[string]interface{}
+				if err := json.Unmarshal(data, &parsed); err != nil {
+					return finish(StatusUnhealthy, "Config file is not valid JSON")
+				}
+			}
+		}
+
+		token, expiresAt := cfg.Token()
+		if token == "" {
+			return finish(StatusUnhealthy, "No Copilot token; run 'auth' to authenticate")
+		}
+
+		expiresIn := expiresAt - time.Now().Unix()
+		check.Details["token_expires_in_seconds"] = expiresIn
+		switch {
+		case expiresIn <= 0 && cfg.GitHubToken == "":
+			return finish(StatusUnhealthy, "Copilot token expired and no GitHub token to refresh it")
+		case expiresIn <= 0:
+			return finish(StatusDegraded, "Copilot token expired; it will be refreshed on the next request")
+		case expiresIn <= int64(tokenRefreshThreshold/time.Second):
+			return finish(StatusDegraded, "Copilot token expires soon")
+		default:
+			return finish(StatusHealthy, "Config and token valid")
+		}
+	}
+}
+
+// UpstreamCheck returns a readiness check on the upstream: reach must succeed, and the
+// circuit breakers must not be open, as an open circuit means the Copilot API is failing
+// or unreachable. With groups set, the state of each model group's breaker is reported
+// in the details, and a check where only some groups are open names them.
+func UpstreamCheck(reach func(context.Context) error, state func() CircuitBreakerState, groups func() map[string]CircuitBreakerState) HealthCheckFunc {
+	return func(ctx context.Context) HealthCheck {
+		start := time.Now()
+		check := HealthCheck{Name: "upstream", Status: StatusHealthy, Message: "Upstream reachable; circuit breakers closed"}
+		if err := reach(ctx); err != nil {
+			check.Status, check.Message = StatusUnhealthy, "Upstream not reached yet: "+err.Error()
+			check.Duration = time.Since(start)
+			check.LastChecked = time.Now()
+			return check
+		}
+		var open []string
+		if groups != nil {
+			check.Details = make(map[string]interface{})
+			for group, groupState := range groups() {
+				check.Details[group] = groupState.String()
+				if groupState == CircuitOpen {
+					open = append(open, group)
+				}
+			}
+			sort.Strings(open)
+		}
+		switch state() {
+		case CircuitOpen:
+			check.Status, check.Message = StatusUnhealthy, "Upstream failing; circuit breaker open"
+		case CircuitHalfOpen:
+			check.Status, check.Message = StatusDegraded, "Upstream recovering; circuit breaker half-open"
+			if len(open) > 0 {
+				check.Message = "Upstream failing for " + strings.Join(open, ", ") + "; circuit breaker open"
+			}
+		}
+		check.Duration = time.Since(start)
+		check.LastChecked = time.Now()
+		return check
+	}
+}
+
 // collectSystemMetrics collects system metrics and returns a SystemMetrics struct.
 // collectSystemMetrics collects system metrics and returns a SystemMetrics struct.
 func (h *HealthChecker) collectSystemMetrics() SystemMetrics {
@@ -0,0 +1,74 @@
+package internal_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/privapps/github-copilot-svcs/internal"
+)
+
+func TestConfigFileCheck(t *testing.T) {
+	writeConfig := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name        string
+		config      string
+		copilot     string
+		github      string
+		expiresIn   time.Duration
+		wantStatus  internal.HealthStatus
+		missingFile bool
+	}{
+		{name: "healthy", config: `{"port":8081}`, copilot: "token", expiresIn: time.Hour, wantStatus: internal.StatusHealthy},
+		{name: "soon to expire", config: `{"port":8081}`, copilot: "token", expiresIn: time.Minute, wantStatus: internal.StatusDegraded},
+		{name: "expired but refreshable", config: `{}`, copilot: "token", github: "gh", expiresIn: -time.Minute, wantStatus: internal.StatusDegraded},
+		{name: "expired without GitHub token", config: `{}`, copilot: "token", expiresIn: -time.Minute, wantStatus: internal.StatusUnhealthy},
+		{name: "missing token", config: `{"port":8081}`, wantStatus: internal.StatusUnhealthy},
+		{name: "corrupted file", config: `{"port":`, copilot: "token", expiresIn: time.Hour, wantStatus: internal.StatusUnhealthy},
+		{name: "no file with token from environment", missingFile: true, copilot: "token", expiresIn: time.Hour, wantStatus: internal.StatusHealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "absent.json")
+			if !tt.missingFile {
+				path = writeConfig(t, tt.config)
+			}
+			cfg := &internal.Config{CopilotToken: tt.copilot, GitHubToken: tt.github}
+			if tt.copilot != "" {
+				cfg.ExpiresAt = time.Now().Add(tt.expiresIn).Unix()
+			}
+
+			check := internal.ConfigFileCheck(cfg, path)(context.Background())
+			if check.Name != "config" {
+				t.Errorf("Expected check name config, got %q", check.Name)
+			}
+			if check.Status != tt.wantStatus {
+				t.Errorf("Expected status %s, got %s (%s)", tt.wantStatus, check.Status, check.Message)
+			}
+		})
+	}
+}
+
+func TestHealthHandlerReportsConfigCheck(t *testing.T) {
+	checker := internal.NewHealthChecker(http.DefaultClient, "test")
+	checker.AddCheck(internal.ConfigFileCheck(&internal.Config{}, filepath.Join(t.TempDir(), "config.json")))
+
+	w := httptest.NewRecorder()
+	checker.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", http.NoBody))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 without a token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// How long the healthcheck command waits for /health
+const healthcheckTimeout = 5 * time.Second
+
+// handleHealthcheck queries /health on the locally configured listener and fails unless
+// it answers 200, so a container HEALTHCHECK can run the binary itself
+func handleHealthcheck(ctx context.Context) error {
+	cfg, err := LoadConfig(true)
+	if err != nil {
+		return NewConfigError("config_file", "", "failed to load config", err)
+	}
+	// auto_port may have moved the server off the configured port
+	if cfg.AutoPort {
+		if port, ok := readBoundPort(""); ok {
+			cfg.Port = port
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthcheckTimeout)
+	defer cancel()
+
+	url := localBaseURL(cfg) + "/health"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return NewNetworkError("healthcheck", url, "failed to create request", err)
+	}
+	client, err := healthcheckClient(cfg)
+	if err != nil {
+		return NewConfigError("tls", "", "cannot load the healthcheck client certificate", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return NewNetworkError("healthcheck", url, "health endpoint unreachable", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			Warn("Error closing response body", "error", err)
+		}
+	}()
+
+	var health HealthResponse
+	_ = json.NewDecoder(resp.Body).Decode(&health)
+	if resp.StatusCode != http.StatusOK {
+		return NewProxyError("healthcheck", fmt.Sprintf("service is %s (HTTP %d)", health.Status, resp.StatusCode), nil)
+	}
+	fmt.Println(health.Status)
+	return nil
+}
+
+// healthcheckClient dials the configured Unix socket when there is one. The server's own
+// certificate is not verified: it is often self-signed, and only liveness is checked.
+// With client_ca_file set it presents healthcheck_cert_file, or the server certificate.
+func healthcheckClient(cfg *Config) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true} //nolint:gosec // local liveness probe of our own listener
+	if cfg.TLSEnabled() && cfg.TLS.ClientCAFile != "" {
+		certFile, keyFile := cfg.TLS.HealthcheckCertFile, cfg.TLS.HealthcheckKeyFile
+		if certFile == "" {
+			certFile, keyFile = cfg.TLS.CertFile, cfg.TLS.KeyFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := &http.Transport{
+		Proxy:           nil,
+		TLSClientConfig: tlsConfig,
+	}
+	if path, ok := unixSocketPath(cfg.Host); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,61 @@
+package internal
+
+import "sync"
+
+// sizeBuckets are the upper bounds in bytes of the request/response size histograms
+var sizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// Histogram counts observations into fixed buckets
+type Histogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram with cumulative bucket counts
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64 // cumulative, one per bound followed by +Inf
+	Sum    float64
+	Count  uint64
+}
+
+// NewHistogram creates a histogram with the given ascending bucket upper bounds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// Snapshot returns the current bucket counts
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	snapshot := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    h.sum,
+		Count:  h.count,
+	}
+	var cumulative uint64
+	for i, c := range h.counts {
+		cumulative += c
+		snapshot.Counts[i] = cumulative
+	}
+	return snapshot
+}
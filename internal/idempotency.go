@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdempotencyWindow = 60 // seconds
+
+	// Client header naming a request that must not be sent upstream twice
+	idempotencyKeyHeader = "Idempotency-Key"
+	// Response header marking a replayed first result
+	idempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// IdempotencyStore remembers the first successful response for each idempotency key
+// for a short window, so a client retrying after a lost response gets that result
+// instead of a second, separately billed completion. Requests with a key already in
+// flight wait for it to finish.
+type IdempotencyStore struct {
+	cache *ResponseCache
+
+	mutex    sync.Mutex
+	inFlight map[string]chan struct{}
+}
+
+// NewIdempotencyStore creates a store keeping results for window
+func NewIdempotencyStore(maxEntries int, window time.Duration) *IdempotencyStore {
+	if window <= 0 {
+		window = defaultIdempotencyWindow * time.Second
+	}
+	return &IdempotencyStore{
+		cache:    NewResponseCache(maxEntries, window),
+		inFlight: make(map[string]chan struct{}),
+	}
+}
+
+// begin returns the stored response for key, or claims the key for the caller and
+// returns a release function to call once the request is done. If another request
+// holds the key, begin waits for it; should it fail, the caller takes over.
+func (st *IdempotencyStore) begin(ctx context.Context, key string) (*cachedResponse, func(), error) {
+	for {
+		if entry, ok := st.cache.get(key); ok {
+			return entry, nil, nil
+		}
+
+		st.mutex.Lock()
+		wait, busy := st.inFlight[key]
+		if !busy {
+			done := make(chan struct{})
+			st.inFlight[key] = done
+			st.mutex.Unlock()
+			return nil, func() {
+				st.mutex.Lock()
+				delete(st.inFlight, key)
+				st.mutex.Unlock()
+				close(done)
+			}, nil
+		}
+		st.mutex.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// store keeps a successful response for replay
+func (st *IdempotencyStore) store(key string, status int, header http.Header, body []byte) {
+	st.cache.set(key, status, header, body)
+}
+
+// idempotencyKey returns the dedup key for r: from the Idempotency-Key header, or
+// derived from the request body when idempotency.derive_keys is set. It is empty
+// when the request should not be deduplicated. Keys are scoped to the client, so one
+// client can never be replayed another's response.
+func (s *ProxyService) idempotencyKey(r *http.Request, upstreamPath string, body []byte) string {
+	if s.idempotency == nil {
+		return ""
+	}
+	client := idempotencyClient(r)
+	if key := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader)); key != "" {
+		return requestKey(r.Method, upstreamPath, []byte(client+"\nkey:"+key))
+	}
+	if s.config.Idempotency.DeriveKeys {
+		return requestKey(r.Method, upstreamPath, append([]byte(client+"\nbody:"), body...))
+	}
+	return ""
+}
+
+// idempotencyClient identifies the sender of r: the API key it presented, else its IP.
+// Keys only end up hashed into the dedup key.
+func idempotencyClient(r *http.Request) string {
+	if key := presentedAPIKey(r); key != "" {
+		return "api-key:" + key
+	}
+	return "ip:" + getClientIP(r)
+}
+
+// recordingResponseWriter keeps a copy of the response body, streamed or not
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *recordingResponseWriter) Write(data []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(data)
+	return rw.ResponseWriter.Write(data)
+}
+
+// Flush forwards to the underlying writer so streams are not held back
+func (rw *recordingResponseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// writeIdempotentReplay replays the first result for a repeated idempotency key
+func writeIdempotentReplay(w http.ResponseWriter, entry *cachedResponse) error {
+	w.Header().Set(idempotentReplayedHeader, "true")
+	return writeCachedResponse(w, entry)
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	keychainService = "github-copilot-svcs"
+	keychainAccount = "credentials"
+
+	// Exit status of `security find-generic-password` when no item matches
+	macKeychainNotFound = 44
+)
+
+// keychainCredentialStore keeps tokens in the OS keychain through the platform CLI:
+// `security` on macOS and `secret-tool` (libsecret) elsewhere. Credentials are
+// stored as a single base64-encoded JSON item.
+type keychainCredentialStore struct {
+	goos string
+	run  func(name string, stdin string, args ...string) ([]byte, error)
+}
+
+func newKeychainCredentialStore() *keychainCredentialStore {
+	return &keychainCredentialStore{goos: runtime.GOOS, run: runKeychainCommand}
+}
+
+// runKeychainCommand runs a keychain CLI, feeding stdin and returning stdout
+func runKeychainCommand(name string, stdin string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		return out, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// Load reads credentials from the keychain
+func (s *keychainCredentialStore) Load() (*Credentials, error) {
+	var (
+		out []byte
+		err error
+	)
+	switch s.goos {
+	case "darwin":
+		out, err = s.run("security", "", "find-generic-password", "-s", keychainService, "-a", keychainAccount, "-w")
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == macKeychainNotFound {
+			return &Credentials{}, nil
+		}
+	case "windows":
+		return nil, NewConfigError("token_store", tokenStoreKeychain, "keychain storage is not supported on Windows", nil)
+	default:
+		out, err = s.run("secret-tool", "", "lookup", "service", keychainService, "account", keychainAccount)
+		// secret-tool exits non-zero without output when nothing is stored
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(bytes.TrimSpace(out)) == 0 {
+			return &Credentials{}, nil
+		}
+	}
+	if err != nil {
+		return nil, NewConfigError("token_store", tokenStoreKeychain, "cannot read credentials from keychain", err)
+	}
+
+	encoded := strings.TrimSpace(string(out))
+	if encoded == "" {
+		return &Credentials{}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, NewConfigError("token_store", tokenStoreKeychain, "malformed keychain item", err)
+	}
+	creds := &Credentials{}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, NewConfigError("token_store", tokenStoreKeychain, "malformed keychain item", err)
+	}
+	return creds, nil
+}
+
+// Save writes credentials to the keychain, replacing any existing item. The secret
+// is passed on stdin so it never appears in the process list.
+func (s *keychainCredentialStore) Save(creds *Credentials) error {
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	switch s.goos {
+	case "darwin":
+		// `security -i` reads commands from stdin
+		command := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", keychainService, keychainAccount, encoded)
+		_, err = s.run("security", command, "-i")
+	case "windows":
+		return NewConfigError("token_store", tokenStoreKeychain, "keychain storage is not supported on Windows", nil)
+	default:
+		_, err = s.run("secret-tool", encoded, "store", "--label=GitHub Copilot credentials",
+			"service", keychainService, "account", keychainAccount)
+	}
+	if err != nil {
+		return NewConfigError("token_store", tokenStoreKeychain, "cannot write credentials to keychain", err)
+	}
+	return nil
+}
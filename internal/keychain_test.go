@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+// fakeKeychain records keychain CLI invocations and stores the last secret written
+type fakeKeychain struct {
+	secret string
+	calls  []string
+}
+
+func (f *fakeKeychain) run(name string, stdin string, args ...string) ([]byte, error) {
+	f.calls = append(f.calls, name+" "+strings.Join(args, " "))
+	switch {
+	case name == "secret-tool" && args[0] == "store":
+		f.secret = stdin
+	case name == "secret-tool" && args[0] == "lookup":
+		return []byte(f.secret), nil
+	case name == "security" && len(args) == 1 && args[0] == "-i":
+		fields := strings.Fields(stdin)
+		f.secret = fields[len(fields)-1]
+	case name == "security":
+		return []byte(f.secret + "\n"), nil
+	}
+	return nil, nil
+}
+
+func TestKeychainCredentialStoreRoundTrip(t *testing.T) {
+	for _, goos := range []string{"linux", "darwin"} {
+		t.Run(goos, func(t *testing.T) {
+			fake := &fakeKeychain{}
+			store := &keychainCredentialStore{goos: goos, run: fake.run}
+
+			empty, err := store.Load()
+			if err != nil || empty.CopilotToken != "" {
+				t.Fatalf("expected empty credentials, got %+v (%v)", empty, err)
+			}
+
+			want := &Credentials{GitHubToken: "gh", CopilotToken: "cp", ExpiresAt: 10, RefreshIn: 5}
+			if err := store.Save(want); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			for _, call := range fake.calls {
+				if strings.Contains(call, fake.secret) {
+					t.Errorf("secret passed as a command argument: %s", call)
+				}
+			}
+
+			got, err := store.Load()
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if *got != *want {
+				t.Errorf("expected %+v, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestKeychainCredentialStoreUnsupported(t *testing.T) {
+	store := &keychainCredentialStore{goos: "windows", run: (&fakeKeychain{}).run}
+	if _, err := store.Load(); !IsConfigurationError(err) {
+		t.Errorf("expected configuration error, got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Host prefix selecting a Unix domain socket, as unix:///path/to.sock or unix:/path
+	unixSocketPrefix = "unix:"
+
+	// Sockets are only for local clients of the same user
+	unixSocketPerm = 0o600
+
+	// With auto_port, how many ports from the configured one are tried
+	autoPortAttempts = 10
+
+	// With auto_port, the port bound is recorded next to the config file for the
+	// healthcheck command
+	boundPortFileName = "bound.port"
+)
+
+// unixSocketPath returns the socket path when host names a Unix domain socket
+func unixSocketPath(host string) (string, bool) {
+	path, ok := strings.CutPrefix(host, unixSocketPrefix)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimPrefix(path, "//"), true
+}
+
+// listenHost returns host without IPv6 brackets, so "[::1]" and "::1" both bind ::1
+func listenHost(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// tcpListenAddress returns the host:port the server binds to; an empty host binds
+// every interface
+func tcpListenAddress(host string, port int) string {
+	if port == 0 {
+		port = defaultServerPort
+	}
+	return net.JoinHostPort(listenHost(host), strconv.Itoa(port))
+}
+
+// validateHost checks that host is an IP address, a hostname or a Unix socket path
+func (c *Config) validateHost() error {
+	if c.Host == "" {
+		return nil
+	}
+	if path, ok := unixSocketPath(c.Host); ok {
+		if path == "" {
+			return NewValidationError("host", c.Host, "unix socket path must not be empty", nil)
+		}
+		return nil
+	}
+	host := listenHost(c.Host)
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if strings.ContainsAny(host, ":/[] \t") {
+		return NewValidationError("host", c.Host, "must be an IP address, a hostname or unix:///path/to.sock", nil)
+	}
+	return nil
+}
+
+// listen opens the server's listener: a Unix domain socket for a unix: host, TCP otherwise
+func (s *Server) listen() (net.Listener, error) {
+	path, ok := unixSocketPath(s.config.Host)
+	if !ok {
+		return s.listenTCP()
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is unlinked when the listener closes on shutdown
+	listener.(*net.UnixListener).SetUnlinkOnClose(true)
+	if err := os.Chmod(path, unixSocketPerm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// listenTCP binds the configured port. With auto_port, a port in use moves on to the
+// following ones; the configured port is left as it is, so it is never saved over.
+func (s *Server) listenTCP() (net.Listener, error) {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err == nil || !s.config.AutoPort || !errors.Is(err, syscall.EADDRINUSE) {
+		return listener, err
+	}
+
+	configured := s.config.Port
+	if configured == 0 {
+		configured = defaultServerPort
+	}
+	for port := configured + 1; port < configured+autoPortAttempts && port <= maxPortNumber; port++ {
+		addr := tcpListenAddress(s.config.Host, port)
+		listener, portErr := net.Listen("tcp", addr)
+		if errors.Is(portErr, syscall.EADDRINUSE) {
+			continue
+		}
+		if portErr != nil {
+			return nil, portErr
+		}
+		Info("Configured port in use, listening on the next free port", "configured", configured, "port", port)
+		s.httpServer.Addr = addr
+		return listener, nil
+	}
+	return nil, fmt.Errorf("ports %d-%d are all in use: %w", configured, min(configured+autoPortAttempts-1, maxPortNumber), err)
+}
+
+// boundConfig returns the config to show clients: with auto_port, a copy carrying the
+// port actually bound, as Config.Port keeps the configured one
+func (s *Server) boundConfig() *Config {
+	tcpAddr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || tcpAddr.Port == s.config.Port {
+		return s.config
+	}
+	bound, err := s.config.clone()
+	if err != nil {
+		return s.config
+	}
+	bound.Port = tcpAddr.Port
+	return bound
+}
+
+// boundPortPath returns the file recording the bound port of a server using configPath,
+// or "" when the config path cannot be determined
+func boundPortPath(configPath string) string {
+	if configPath == "" {
+		var err error
+		if configPath, err = GetConfigPath(); err != nil {
+			return ""
+		}
+	}
+	return filepath.Join(filepath.Dir(configPath), boundPortFileName)
+}
+
+// recordBoundPort writes the TCP port the server listens on, so the healthcheck command
+// finds a port chosen by auto_port. Failures are only logged.
+func (s *Server) recordBoundPort(addr net.Addr) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	path := boundPortPath(s.configPath)
+	if !ok || path == "" {
+		return
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(tcpAddr.Port)+"\n"), configFilePerm); err != nil {
+		Warn("Failed to record the bound port", "file", path, "error", err)
+	}
+}
+
+// removeBoundPort deletes the file written by recordBoundPort on shutdown
+func (s *Server) removeBoundPort() {
+	if path := boundPortPath(s.configPath); path != "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			Warn("Failed to remove the bound port file", "file", path, "error", err)
+		}
+	}
+}
+
+// readBoundPort returns the port recorded by a running auto_port server
+func readBoundPort(configPath string) (int, bool) {
+	path := boundPortPath(configPath)
+	if path == "" {
+		return 0, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || port <= 0 || port > maxPortNumber {
+		return 0, false
+	}
+	return port, true
+}
+
+// removeStaleSocket deletes a socket file left behind by a process that did not shut
+// down cleanly. Any other file at path is left alone, and a socket still accepting
+// connections is in use.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	Debug("Removing stale socket", "path", path)
+	return os.Remove(path)
+}
+
+// serve runs the HTTP server on listener, with TLS when configured. With a client CA
+// bundle, connections without a certificate it verifies fail the TLS handshake.
+func (s *Server) serve(listener net.Listener) error {
+	if !s.config.TLSEnabled() {
+		return s.httpServer.Serve(listener)
+	}
+	if s.config.TLS.ClientCAFile != "" {
+		pool, err := loadCertPool(s.config.TLS.ClientCAFile)
+		if err != nil {
+			listener.Close()
+			return NewConfigError("tls.client_ca_file", s.config.TLS.ClientCAFile, "invalid CA bundle", err)
+		}
+		s.httpServer.TLSConfig.ClientCAs = pool
+		s.httpServer.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return s.httpServer.ServeTLS(listener, s.config.TLS.CertFile, s.config.TLS.KeyFile)
+}
+
+// loadCertPool reads a PEM bundle of certificates into a pool, for trusting client
+// certificates or upstream CAs
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// endpointURL returns the URL clients use for path on this server
+func endpointURL(cfg *Config, path string) string {
+	if socket, ok := unixSocketPath(cfg.Host); ok {
+		return fmt.Sprintf("%s%s (unix socket %s)", localBaseURL(cfg), path, socket)
+	}
+	return localBaseURL(cfg) + path
+}
+
+// localBaseURL returns the scheme and address a local client connects to: localhost
+// when the server listens on all interfaces or on a Unix socket
+func localBaseURL(cfg *Config) string {
+	scheme := "http"
+	if cfg.TLSEnabled() {
+		scheme = "https"
+	}
+	if _, ok := unixSocketPath(cfg.Host); ok {
+		return scheme + "://localhost"
+	}
+	host := listenHost(cfg.Host)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s://%s", scheme, tcpListenAddress(host, cfg.Port))
+}
@@ -2,16 +2,26 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // DenseTextHandler outputs only values, space-separated, in a fixed order.
 type DenseTextHandler struct {
 	level slog.Level
+
+	// out overrides os.Stdout, which is otherwise looked up on every write
+	out io.Writer
+	// closed holds the output found gone (broken pipe, closed file); records for
+	// it are dropped until the output changes
+	closed atomic.Pointer[io.Writer]
 }
 
 // Enabled reports whether the handler is enabled for the given level.
@@ -19,8 +29,18 @@ func (h *DenseTextHandler) Enabled(_ context.Context, level slog.Level) bool {
 	return level >= h.level
 }
 
-// Handle formats the log record as dense values and writes to stdout.
+// Handle formats the log record as dense values and writes to stdout. If stdout
+// has gone away, e.g. the reader of a pipe exited, later records are dropped
+// instead of failing every log call.
 func (h *DenseTextHandler) Handle(_ context.Context, r slog.Record) error {
+	out := h.out
+	if out == nil {
+		out = os.Stdout
+	}
+	if closed := h.closed.Load(); closed != nil && *closed == out {
+		return nil
+	}
+
 	var b strings.Builder
 	b.WriteString(r.Time.Format(time.RFC3339))
 	b.WriteString(" ")
@@ -38,10 +58,23 @@ func (h *DenseTextHandler) Handle(_ context.Context, r slog.Record) error {
 		return true
 	})
 	b.WriteString("\n")
-	_, err := os.Stdout.WriteString(b.String())
+
+	_, err := io.WriteString(out, b.String())
+	if err != nil && isClosedOutput(err) {
+		if previous := h.closed.Swap(&out); previous == nil || *previous != out {
+			fmt.Fprintf(os.Stderr, "Log output closed (%v); discarding further log messages\n", err)
+		}
+		return nil
+	}
 	return err
 }
 
+// isClosedOutput reports whether a write failed because the output can never be
+// written again
+func isClosedOutput(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, os.ErrClosed)
+}
+
 // WithAttrs returns the handler unchanged (attrs unused).
 func (h *DenseTextHandler) WithAttrs(_ []slog.Attr) slog.Handler { return h }
 
@@ -55,6 +88,10 @@ const (
 // Logger wraps slog.Logger for structured logging
 type Logger struct {
 	*slog.Logger
+	level slog.Level
+
+	// redaction is how message content in logged bodies is hidden (see redactBody)
+	redaction string
 }
 
 // NewLogger creates a new logger with the specified level
@@ -74,18 +111,41 @@ func NewLogger(level string) *Logger {
 	}
 
 	handler := &DenseTextHandler{level: logLevel}
-	return &Logger{slog.New(handler)}
+	return &Logger{Logger: slog.New(handler), level: logLevel, redaction: RedactHash}
+}
+
+// Level returns the minimum level the logger writes
+func (l *Logger) Level() slog.Level {
+	return l.level
+}
+
+// LevelName returns the logger level in LOG_LEVEL form (debug, info, warn, error)
+func (l *Logger) LevelName() string {
+	return strings.ToLower(l.level.String())
 }
 
 var logger *Logger
 
-// Init initializes the global logger from environment variable
-func Init() {
+// Init initializes the global logger from the LOG_LEVEL environment variable.
+// A non-empty levelOverride (e.g. from --verbose/--quiet) takes precedence.
+func Init(levelOverride ...string) {
 	logLevel := os.Getenv("LOG_LEVEL")
+	if len(levelOverride) > 0 && levelOverride[0] != "" {
+		logLevel = levelOverride[0]
+	}
 	if logLevel == "" {
 		logLevel = defaultLogLevel
 	}
 	logger = NewLogger(logLevel)
+
+	mode, unknown := redactionMode()
+	logger.redaction = mode
+	if unknown {
+		Warn("Unknown LOG_REDACTION, hashing message content", "value", os.Getenv("LOG_REDACTION"))
+	}
+	if mode == RedactOff {
+		Warn("LOG_UNSAFE is set: prompts and model output are logged in full")
+	}
 }
 
 // Debug logs a debug message
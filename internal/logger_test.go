@@ -1,7 +1,12 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
 	"testing"
+	"time"
 )
 
 func TestNewLogger(t *testing.T) {
@@ -10,3 +15,88 @@ func TestNewLogger(t *testing.T) {
 		t.Error("NewLogger returned nil")
 	}
 }
+
+func TestInitLevelOverride(t *testing.T) {
+	original := logger
+	defer func() { logger = original }()
+
+	t.Setenv("LOG_LEVEL", "warn")
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected slog.Level
+	}{
+		{name: "env var without flags", args: []string{"run"}, expected: slog.LevelWarn},
+		{name: "verbose", args: []string{"-v", "run"}, expected: slog.LevelDebug},
+		{name: "long verbose after command", args: []string{"run", "--verbose"}, expected: slog.LevelDebug},
+		{name: "quiet", args: []string{"-q", "models"}, expected: slog.LevelError},
+		{name: "last flag wins", args: []string{"--quiet", "status", "-v"}, expected: slog.LevelDebug},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, level := ParseGlobalFlags(tt.args)
+			Init(level)
+			if got := GetLogger().Level(); got != tt.expected {
+				t.Errorf("Expected level %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// countingWriter counts writes and fails each one with err
+type countingWriter struct {
+	writes int
+	err    error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, w.err
+}
+
+func TestDenseTextHandlerClosedOutput(t *testing.T) {
+	record := slog.NewRecord(time.Now(), slog.LevelInfo, "message", 0)
+
+	t.Run("closed pipe switches to discarding", func(t *testing.T) {
+		r, w := io.Pipe()
+		_ = r.Close()
+		h := &DenseTextHandler{level: slog.LevelInfo, out: w}
+
+		for i := 0; i < 3; i++ {
+			if err := h.Handle(context.Background(), record); err != nil {
+				t.Fatalf("Handle call %d: expected no error once the output is closed, got %v", i, err)
+			}
+		}
+		if closed := h.closed.Load(); closed == nil || *closed != io.Writer(w) {
+			t.Error("Expected the handler to discard output after a closed pipe")
+		}
+	})
+
+	t.Run("stops writing after the first failure", func(t *testing.T) {
+		out := &countingWriter{err: io.ErrClosedPipe}
+		logger := slog.New(&DenseTextHandler{level: slog.LevelInfo, out: out})
+		for i := 0; i < 5; i++ {
+			logger.Info("message", "i", i)
+		}
+		if out.writes != 1 {
+			t.Errorf("Expected a single write attempt, got %d", out.writes)
+		}
+	})
+
+	t.Run("other errors are returned", func(t *testing.T) {
+		diskFull := errors.New("no space left on device")
+		out := &countingWriter{err: diskFull}
+		h := &DenseTextHandler{level: slog.LevelInfo, out: out}
+
+		for i := 0; i < 2; i++ {
+			if err := h.Handle(context.Background(), record); !errors.Is(err, diskFull) {
+				t.Errorf("Expected the write error, got %v", err)
+			}
+		}
+		if out.writes != 2 {
+			t.Errorf("Expected transient errors to keep retrying, got %d writes", out.writes)
+		}
+	})
+}
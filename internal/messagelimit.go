@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// What happens to a chat request with more than max_messages messages
+const (
+	maxMessagesReject   = "reject"   // Answer 400 (default)
+	maxMessagesTruncate = "truncate" // Drop the oldest non-system messages
+)
+
+// enforceMaxMessages applies max_messages to a chat request body: it is rejected, or its
+// oldest messages are dropped. System and developer messages are always kept, as is the
+// latest message; tool results whose call was dropped go too, as the upstream rejects them.
+// A request that cannot be truncated is rejected.
+func (s *ProxyService) enforceMaxMessages(req *proxyRequest) error {
+	limit := s.config.MaxMessages
+	if limit <= 0 {
+		return nil
+	}
+	messages, err := req.messageList()
+	if err != nil || len(messages) <= limit {
+		return nil
+	}
+
+	tooMany := NewValidationError("messages", len(messages), fmt.Sprintf("at most %d messages are allowed", limit), nil)
+	if s.config.MaxMessagesMode != maxMessagesTruncate {
+		Warn("Rejected chat request with too many messages", "messages", len(messages), "max_messages", limit)
+		return tooMany
+	}
+
+	roles := make([]string, len(messages))
+	system := 0
+	for i, raw := range messages {
+		var message struct {
+			Role string `json:"role"`
+		}
+		_ = json.Unmarshal(raw, &message)
+		roles[i] = message.Role
+		if systemRoles[message.Role] {
+			system++
+		}
+	}
+	keep := max(limit-system, 1)
+
+	// Walk back from the newest message to find where the kept conversation starts
+	start, kept := len(messages), 0
+	for start > 0 && kept < keep {
+		start--
+		if !systemRoles[roles[start]] {
+			kept++
+		}
+	}
+	for start < len(messages)-1 && roles[start] == "tool" {
+		start++
+	}
+
+	truncated := make([]json.RawMessage, 0, limit)
+	for i, raw := range messages {
+		if systemRoles[roles[i]] || i >= start {
+			truncated = append(truncated, raw)
+		}
+	}
+	if err := req.setMessages(truncated); err != nil {
+		Warn("Rejected chat request with too many messages, as truncating it failed", "messages", len(messages), "max_messages", limit, "error", err)
+		return tooMany
+	}
+	Warn("Truncated chat request to max_messages", "messages", len(messages), "kept", len(truncated), "max_messages", limit)
+	return nil
+}
+
+func (c *Config) validateMaxMessages() error {
+	if c.MaxMessages < 0 {
+		return NewValidationError("max_messages", c.MaxMessages, "must not be negative", nil)
+	}
+	switch c.MaxMessagesMode {
+	case "", maxMessagesReject, maxMessagesTruncate:
+		return nil
+	default:
+		return NewValidationError("max_messages_mode", c.MaxMessagesMode, "must be reject or truncate", nil)
+	}
+}
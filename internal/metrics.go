@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric family types
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// MetricRegistry holds metric families and renders them in the Prometheus text or
+// OpenMetrics format. Families are written in registration order. Registering an
+// invalid or duplicate name panics, as it is a programming error.
+type MetricRegistry struct {
+	mutex    sync.RWMutex
+	families []*metricFamily
+	names    map[string]bool
+}
+
+// metricFamily is one named metric with its samples collected at render time
+type metricFamily struct {
+	name       string
+	help       string
+	metricType string
+	collect    func() []metricPoint
+}
+
+// metricPoint is one labeled value of a family; histograms carry a snapshot instead
+type metricPoint struct {
+	labels    []labelPair
+	value     float64
+	histogram *HistogramSnapshot
+}
+
+type labelPair struct {
+	name  string
+	value string
+}
+
+// NewMetricRegistry creates an empty registry
+func NewMetricRegistry() *MetricRegistry {
+	return &MetricRegistry{names: make(map[string]bool)}
+}
+
+func (r *MetricRegistry) register(name, help, metricType string, labelNames []string, collect func() []metricPoint) {
+	if !metricNamePattern.MatchString(name) {
+		panic(fmt.Sprintf("invalid metric name %q", name))
+	}
+	for _, label := range labelNames {
+		if !labelNamePattern.MatchString(label) || strings.HasPrefix(label, "__") || label == "le" {
+			panic(fmt.Sprintf("invalid label name %q for metric %s", label, name))
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.names[name] = true
+	r.families = append(r.families, &metricFamily{name: name, help: help, metricType: metricType, collect: collect})
+}
+
+// CounterFunc registers a counter whose value is read from fn at render time
+func (r *MetricRegistry) CounterFunc(name, help string, fn func() float64) {
+	r.register(name, help, metricCounter, nil, func() []metricPoint {
+		return []metricPoint{{value: fn()}}
+	})
+}
+
+// GaugeFunc registers a gauge whose value is read from fn at render time
+func (r *MetricRegistry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, help, metricGauge, nil, func() []metricPoint {
+		return []metricPoint{{value: fn()}}
+	})
+}
+
+// LabeledGaugeFunc registers a gauge with one label whose values are read from fn at
+// render time, keyed by label value
+func (r *MetricRegistry) LabeledGaugeFunc(name, help, labelName string, fn func() map[string]float64) {
+	r.register(name, help, metricGauge, []string{labelName}, func() []metricPoint {
+		values := fn()
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		points := make([]metricPoint, 0, len(keys))
+		for _, key := range keys {
+			points = append(points, metricPoint{labels: []labelPair{{name: labelName, value: key}}, value: values[key]})
+		}
+		return points
+	})
+}
+
+// HistogramFunc registers a histogram whose snapshot is read from fn at render time
+func (r *MetricRegistry) HistogramFunc(name, help string, fn func() HistogramSnapshot) {
+	r.register(name, help, metricHistogram, nil, func() []metricPoint {
+		snapshot := fn()
+		return []metricPoint{{histogram: &snapshot}}
+	})
+}
+
+// NewCounter registers a counter with the given label names
+func (r *MetricRegistry) NewCounter(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{series: newMetricSeries(labelNames)}
+	r.register(name, help, metricCounter, labelNames, c.series.points)
+	return c
+}
+
+// NewGauge registers a gauge with the given label names
+func (r *MetricRegistry) NewGauge(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{series: newMetricSeries(labelNames)}
+	r.register(name, help, metricGauge, labelNames, g.series.points)
+	return g
+}
+
+// NewHistogram registers a histogram with the given bucket bounds and label names
+func (r *MetricRegistry) NewHistogram(name, help string, bounds []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{labelNames: labelNames, bounds: bounds, histograms: make(map[string]*labeledHistogram)}
+	r.register(name, help, metricHistogram, labelNames, h.points)
+	return h
+}
+
+// metricSeries stores one value per combination of label values
+type metricSeries struct {
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]*seriesValue
+}
+
+type seriesValue struct {
+	labels []labelPair
+	value  float64
+}
+
+func newMetricSeries(labelNames []string) *metricSeries {
+	return &metricSeries{labelNames: labelNames, values: make(map[string]*seriesValue)}
+}
+
+// update applies f to the value for labelValues, creating it at 0
+func (s *metricSeries) update(labelValues []string, f func(float64) float64) {
+	key, labels := seriesKey(s.labelNames, labelValues)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		v = &seriesValue{labels: labels}
+		s.values[key] = v
+	}
+	v.value = f(v.value)
+}
+
+func (s *metricSeries) get(labelValues []string) float64 {
+	key, _ := seriesKey(s.labelNames, labelValues)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, ok := s.values[key]; ok {
+		return v.value
+	}
+	return 0
+}
+
+// points returns the series sorted by label values, so output is stable
+func (s *metricSeries) points() []metricPoint {
+	s.mutex.Lock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	points := make([]metricPoint, 0, len(keys))
+	for _, key := range keys {
+		v := s.values[key]
+		points = append(points, metricPoint{labels: v.labels, value: v.value})
+	}
+	s.mutex.Unlock()
+	return points
+}
+
+// seriesKey pairs label values with their names; a wrong number of values panics
+func seriesKey(labelNames, labelValues []string) (string, []labelPair) {
+	if len(labelValues) != len(labelNames) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(labelNames), len(labelValues)))
+	}
+	labels := make([]labelPair, len(labelNames))
+	for i, name := range labelNames {
+		labels[i] = labelPair{name: name, value: labelValues[i]}
+	}
+	return strings.Join(labelValues, "\xff"), labels
+}
+
+// CounterVec is a monotonically increasing value per label combination
+type CounterVec struct {
+	series *metricSeries
+}
+
+// Add increases the counter for labelValues by delta; negative deltas are ignored
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.series.update(labelValues, func(v float64) float64 { return v + delta })
+}
+
+// Inc increases the counter for labelValues by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the counter for labelValues
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	return c.series.get(labelValues)
+}
+
+// GaugeVec is a value per label combination that can go up and down
+type GaugeVec struct {
+	series *metricSeries
+}
+
+// Set replaces the gauge for labelValues
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.series.update(labelValues, func(float64) float64 { return value })
+}
+
+// Add changes the gauge for labelValues by delta
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.series.update(labelValues, func(v float64) float64 { return v + delta })
+}
+
+// Value returns the gauge for labelValues
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	return g.series.get(labelValues)
+}
+
+// HistogramVec is a Histogram per label combination
+type HistogramVec struct {
+	labelNames []string
+	bounds     []float64
+	mutex      sync.Mutex
+	histograms map[string]*labeledHistogram
+}
+
+type labeledHistogram struct {
+	labels    []labelPair
+	histogram *Histogram
+}
+
+// Observe records v for labelValues
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.histogram(labelValues).Observe(v)
+}
+
+// Snapshot returns the histogram for labelValues
+func (h *HistogramVec) Snapshot(labelValues ...string) HistogramSnapshot {
+	return h.histogram(labelValues).Snapshot()
+}
+
+func (h *HistogramVec) histogram(labelValues []string) *Histogram {
+	key, labels := seriesKey(h.labelNames, labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entry, ok := h.histograms[key]
+	if !ok {
+		entry = &labeledHistogram{labels: labels, histogram: NewHistogram(h.bounds)}
+		h.histograms[key] = entry
+	}
+	return entry.histogram
+}
+
+func (h *HistogramVec) points() []metricPoint {
+	h.mutex.Lock()
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]*labeledHistogram, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, h.histograms[key])
+	}
+	h.mutex.Unlock()
+
+	points := make([]metricPoint, 0, len(entries))
+	for _, entry := range entries {
+		snapshot := entry.histogram.Snapshot()
+		points = append(points, metricPoint{labels: entry.labels, histogram: &snapshot})
+	}
+	return points
+}
+
+// Write renders every family, stopping at the first write error. OpenMetrics names
+// counter families without the _total suffix, requires it on samples and ends the
+// exposition with # EOF.
+func (r *MetricRegistry) Write(w io.Writer, openMetrics bool) error {
+	r.mutex.RLock()
+	families := append([]*metricFamily(nil), r.families...)
+	r.mutex.RUnlock()
+
+	var b strings.Builder
+	for _, family := range families {
+		writeFamily(&b, family, openMetrics)
+	}
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeFamily(b *strings.Builder, family *metricFamily, openMetrics bool) {
+	name, sampleName := family.name, family.name
+	if openMetrics && family.metricType == metricCounter {
+		name = strings.TrimSuffix(family.name, "_total")
+		sampleName = name + "_total"
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(family.help), name, family.metricType)
+
+	for _, point := range family.collect() {
+		if point.histogram == nil {
+			writeSample(b, sampleName, point.labels, point.value)
+			continue
+		}
+		snapshot := point.histogram
+		for i, bound := range snapshot.Bounds {
+			writeSample(b, name+"_bucket", withLabel(point.labels, "le", formatMetricValue(bound)), float64(snapshot.Counts[i]))
+		}
+		writeSample(b, name+"_bucket", withLabel(point.labels, "le", "+Inf"), float64(snapshot.Counts[len(snapshot.Bounds)]))
+		writeSample(b, name+"_sum", point.labels, snapshot.Sum)
+		writeSample(b, name+"_count", point.labels, float64(snapshot.Count))
+	}
+}
+
+func writeSample(b *strings.Builder, name string, labels []labelPair, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", label.name, escapeLabelValue(label.value))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatMetricValue(value))
+	b.WriteByte('\n')
+}
+
+// withLabel returns labels plus one more pair, leaving labels untouched
+func withLabel(labels []labelPair, name, value string) []labelPair {
+	out := make([]labelPair, 0, len(labels)+1)
+	out = append(out, labels...)
+	return append(out, labelPair{name: name, value: value})
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// formatMetricValue renders a sample value, with the exposition spelling of infinities
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+}
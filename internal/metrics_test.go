@@ -0,0 +1,349 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	expositionSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})? (\S+)$`)
+	expositionTypes  = map[string]bool{"counter": true, "gauge": true, "histogram": true, "summary": true, "untyped": true}
+)
+
+// validateExposition checks text against the Prometheus text format, or OpenMetrics when
+// openMetrics is set: HELP and TYPE precede each family's samples, samples belong to
+// the family they follow, label values are properly escaped, values are numbers and
+// histogram buckets are cumulative and end in +Inf.
+func validateExposition(text string, openMetrics bool) error {
+	if !strings.HasSuffix(text, "\n") {
+		return fmt.Errorf("exposition does not end with a newline")
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if openMetrics {
+		if lines[len(lines)-1] != "# EOF" {
+			return fmt.Errorf("OpenMetrics exposition does not end with # EOF")
+		}
+		lines = lines[:len(lines)-1]
+	}
+
+	var (
+		family, familyType string
+		helped, typed      = map[string]bool{}, map[string]bool{}
+		seen               = map[string]bool{}
+		lastBucket         = map[string]float64{}
+		infBucket          = map[string]float64{}
+	)
+	for i, line := range lines {
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d %q: %s", i+1, line, fmt.Sprintf(format, args...))
+		}
+		switch {
+		case line == "":
+			return fail("empty line")
+		case strings.HasPrefix(line, "# HELP "):
+			parts := strings.SplitN(strings.TrimPrefix(line, "# HELP "), " ", 2)
+			if len(parts) != 2 || !metricNamePattern.MatchString(parts[0]) {
+				return fail("malformed HELP")
+			}
+			if err := checkEscapes(parts[1]); err != nil {
+				return fail("%v", err)
+			}
+			if helped[parts[0]] {
+				return fail("second HELP for %s", parts[0])
+			}
+			helped[parts[0]] = true
+		case strings.HasPrefix(line, "# TYPE "):
+			parts := strings.Split(strings.TrimPrefix(line, "# TYPE "), " ")
+			if len(parts) != 2 || !metricNamePattern.MatchString(parts[0]) || !expositionTypes[parts[1]] {
+				return fail("malformed TYPE")
+			}
+			if typed[parts[0]] {
+				return fail("second TYPE for %s", parts[0])
+			}
+			typed[parts[0]] = true
+			family, familyType = parts[0], parts[1]
+		case strings.HasPrefix(line, "#"):
+			return fail("unexpected comment")
+		default:
+			m := expositionSample.FindStringSubmatch(line)
+			if m == nil {
+				return fail("malformed sample")
+			}
+			name, rawLabels, rawValue := m[1], m[2], m[3]
+			if family == "" {
+				return fail("sample before any TYPE")
+			}
+			if !sampleBelongsTo(name, family, familyType, openMetrics) {
+				return fail("sample %s does not belong to %s family %s", name, familyType, family)
+			}
+			labels, err := parseExpositionLabels(rawLabels)
+			if err != nil {
+				return fail("%v", err)
+			}
+			value, err := strconv.ParseFloat(rawValue, 64)
+			if err != nil {
+				return fail("%v", err)
+			}
+			key := name + "{" + rawLabels + "}"
+			if seen[key] {
+				return fail("duplicate sample")
+			}
+			seen[key] = true
+
+			if name == family+"_bucket" {
+				le, ok := labels["le"]
+				if !ok {
+					return fail("bucket without le label")
+				}
+				delete(labels, "le")
+				series := family + fmt.Sprint(labels)
+				if value < lastBucket[series] {
+					return fail("bucket counts are not cumulative")
+				}
+				lastBucket[series] = value
+				if le == "+Inf" {
+					infBucket[series] = value
+				}
+			}
+			if name == family+"_count" && familyType == "histogram" {
+				series := family + fmt.Sprint(labels)
+				inf, ok := infBucket[series]
+				if !ok || inf != value {
+					return fail("histogram count %v does not match its +Inf bucket", value)
+				}
+			}
+		}
+	}
+	for name := range typed {
+		if !helped[name] {
+			return fmt.Errorf("family %s has TYPE but no HELP", name)
+		}
+	}
+	return nil
+}
+
+func sampleBelongsTo(name, family, familyType string, openMetrics bool) bool {
+	switch familyType {
+	case "histogram":
+		return name == family+"_bucket" || name == family+"_sum" || name == family+"_count"
+	case "counter":
+		if openMetrics {
+			return name == family+"_total"
+		}
+		return name == family
+	default:
+		return name == family
+	}
+}
+
+// parseExpositionLabels parses name="value" pairs, rejecting invalid escapes
+func parseExpositionLabels(raw string) (map[string]string, error) {
+	labels := map[string]string{}
+	for raw != "" {
+		eq := strings.Index(raw, `="`)
+		if eq < 0 || !labelNamePattern.MatchString(raw[:eq]) {
+			return nil, fmt.Errorf("malformed label in %q", raw)
+		}
+		name := raw[:eq]
+		rest := raw[eq+2:]
+
+		var value strings.Builder
+		end := -1
+		for i := 0; i < len(rest); i++ {
+			c := rest[i]
+			if c == '\\' {
+				if i+1 >= len(rest) {
+					return nil, fmt.Errorf("dangling escape in label %s", name)
+				}
+				switch rest[i+1] {
+				case '\\', '"':
+					value.WriteByte(rest[i+1])
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					return nil, fmt.Errorf("invalid escape \\%c in label %s", rest[i+1], name)
+				}
+				i++
+				continue
+			}
+			if c == '"' {
+				end = i
+				break
+			}
+			if c == '\n' {
+				return nil, fmt.Errorf("raw newline in label %s", name)
+			}
+			value.WriteByte(c)
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated value for label %s", name)
+		}
+		if _, dup := labels[name]; dup {
+			return nil, fmt.Errorf("duplicate label %s", name)
+		}
+		labels[name] = value.String()
+
+		raw = rest[end+1:]
+		if raw != "" {
+			if raw[0] != ',' {
+				return nil, fmt.Errorf("expected ',' after label %s", name)
+			}
+			raw = raw[1:]
+		}
+	}
+	return labels, nil
+}
+
+// checkEscapes rejects HELP text with escapes other than \\ and \n
+func checkEscapes(text string) error {
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			continue
+		}
+		if i+1 >= len(text) {
+			return fmt.Errorf("dangling escape")
+		}
+		switch text[i+1] {
+		case '\\', 'n':
+		default:
+			return fmt.Errorf("invalid escape \\%c", text[i+1])
+		}
+		i++
+	}
+	return nil
+}
+
+func TestMetricRegistryExposition(t *testing.T) {
+	r := NewMetricRegistry()
+	requests := r.NewCounter("test_requests_total", "Requests by route\nand \\ method", "route", "method")
+	inFlight := r.NewGauge("test_in_flight", "Requests in flight", "route")
+	latency := r.NewHistogram("test_latency_seconds", "Request latency", []float64{0.1, 1}, "route")
+	r.CounterFunc("test_uptime_seconds", "Uptime", func() float64 { return 12.5 })
+	r.GaugeFunc("test_temperature", "A gauge that can be negative", func() float64 { return -3 })
+	r.HistogramFunc("test_sizes", "Unlabeled histogram", func() HistogramSnapshot {
+		h := NewHistogram([]float64{10})
+		h.Observe(5)
+		h.Observe(50)
+		return h.Snapshot()
+	})
+
+	tricky := "a \"quoted\" \\path\\ with\nnewline"
+	requests.Inc("/v1/chat", "POST")
+	requests.Add(2, tricky, "GET")
+	requests.Add(-5, tricky, "GET") // counters never decrease
+	inFlight.Set(3, "/v1/chat")
+	inFlight.Add(-1, "/v1/chat")
+	latency.Observe(0.05, "/v1/chat")
+	latency.Observe(0.5, "/v1/chat")
+	latency.Observe(5, tricky)
+
+	if got := requests.Value(tricky, "GET"); got != 2 {
+		t.Errorf("Expected counter value 2 after a negative Add, got %v", got)
+	}
+	if got := inFlight.Value("/v1/chat"); got != 2 {
+		t.Errorf("Expected gauge value 2, got %v", got)
+	}
+	if got := latency.Snapshot("/v1/chat").Count; got != 2 {
+		t.Errorf("Expected 2 latency observations, got %d", got)
+	}
+
+	for _, openMetrics := range []bool{false, true} {
+		var b strings.Builder
+		if err := r.Write(&b, openMetrics); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		text := b.String()
+		if err := validateExposition(text, openMetrics); err != nil {
+			t.Errorf("Invalid exposition (openMetrics=%v): %v\n%s", openMetrics, err, text)
+		}
+
+		wants := []string{
+			`# HELP test_latency_seconds Request latency` + "\n",
+			`test_in_flight{route="/v1/chat"} 2` + "\n",
+			`test_latency_seconds_bucket{route="/v1/chat",le="0.1"} 1` + "\n",
+			`test_latency_seconds_bucket{route="/v1/chat",le="+Inf"} 2` + "\n",
+			`test_temperature -3` + "\n",
+			`test_sizes_count 2` + "\n",
+			`test_requests_total{route="a \"quoted\" \\path\\ with\nnewline",method="GET"} 2` + "\n",
+		}
+		if openMetrics {
+			wants = append(wants, "# HELP test_requests Requests by route\\nand \\\\ method\n", "# TYPE test_requests counter\n")
+		} else {
+			wants = append(wants, "# HELP test_requests_total Requests by route\\nand \\\\ method\n", "# TYPE test_requests_total counter\n")
+		}
+		for _, want := range wants {
+			if !strings.Contains(text, want) {
+				t.Errorf("Expected %q in exposition (openMetrics=%v), got:\n%s", want, openMetrics, text)
+			}
+		}
+	}
+}
+
+func TestMetricRegistryRejectsInvalidRegistrations(t *testing.T) {
+	tests := map[string]func(r *MetricRegistry){
+		"invalid metric name": func(r *MetricRegistry) { r.GaugeFunc("test-gauge", "", func() float64 { return 0 }) },
+		"invalid label name":  func(r *MetricRegistry) { r.NewCounter("test_total", "", "bad-label") },
+		"reserved le label":   func(r *MetricRegistry) { r.NewHistogram("test_seconds", "", []float64{1}, "le") },
+		"duplicate name": func(r *MetricRegistry) {
+			r.NewGauge("test_gauge", "")
+			r.NewGauge("test_gauge", "")
+		},
+		"wrong label count": func(r *MetricRegistry) { r.NewCounter("test_total", "", "route").Inc() },
+	}
+	for name, register := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected a panic")
+				}
+			}()
+			register(NewMetricRegistry())
+		})
+	}
+}
+
+func TestMetricsHandlerExposition(t *testing.T) {
+	requestBytes := NewHistogram(sizeBuckets)
+	requestBytes.Observe(2048)
+	metrics := &Metrics{
+		upstreamInFlight: func() int64 { return 2 },
+		activeStreams:    func() int64 { return 1 },
+		workerQueueDepth: func() int64 { return 0 },
+		workerActive:     func() int64 { return 3 },
+		workerJobs:       func() int64 { return 42 },
+		circuitState:     func() CircuitBreakerState { return CircuitHalfOpen },
+		requestBytes:     requestBytes.Snapshot,
+		responseBytes:    NewHistogram(sizeBuckets).Snapshot,
+	}
+	handler := metrics.MetricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+
+	for _, accept := range []string{"", "application/openmetrics-text; version=1.0.0"} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(w, req)
+
+		text := w.Body.String()
+		if err := validateExposition(text, accept != ""); err != nil {
+			t.Errorf("Invalid /metrics exposition (Accept %q): %v\n%s", accept, err, text)
+		}
+		for _, want := range []string{
+			"github_copilot_worker_jobs_total 42\n",
+			"github_copilot_circuit_breaker_state 2\n",
+			"github_copilot_responses_total{code=\"4xx\"} 1\n",
+			"github_copilot_request_bytes_bucket{le=\"4096\"} 1\n",
+		} {
+			if !strings.Contains(text, want) {
+				t.Errorf("Expected %q in /metrics (Accept %q), got:\n%s", want, accept, text)
+			}
+		}
+	}
+}
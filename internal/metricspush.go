@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics push backends selectable with metrics.push.backend
+const (
+	metricsPushStatsD = "statsd"
+	metricsPushOTLP   = "otlp"
+
+	defaultMetricsPushInterval = 10 // seconds
+	defaultStatsDPrefix        = "github_copilot"
+	otlpServiceName            = "github-copilot-svcs"
+)
+
+// MetricsSnapshot is a point-in-time copy of the server metrics
+type MetricsSnapshot struct {
+	Time              time.Time
+	RequestsTotal     int64
+	RequestsDuration  float64 // seconds, cumulative
+	ActiveConnections int64
+	UpstreamInFlight  int64
+	CircuitState      CircuitBreakerState
+}
+
+// Snapshot returns the current metric values
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mutex.RLock()
+	snapshot := MetricsSnapshot{
+		Time:              time.Now(),
+		RequestsTotal:     m.RequestsTotal,
+		RequestsDuration:  m.RequestsDuration,
+		ActiveConnections: m.ActiveConnections,
+	}
+	m.mutex.RUnlock()
+
+	if m.upstreamInFlight != nil {
+		snapshot.UpstreamInFlight = m.upstreamInFlight()
+	}
+	if m.circuitState != nil {
+		snapshot.CircuitState = m.circuitState()
+	}
+	return snapshot
+}
+
+// MetricsExporter pushes metrics snapshots to an external backend
+type MetricsExporter interface {
+	Export(ctx context.Context, snapshot MetricsSnapshot) error
+	Close() error
+}
+
+// NewMetricsExporter returns the exporter configured in metrics.push, or nil when pushing is disabled
+func NewMetricsExporter(cfg *Config, httpClient *http.Client) (MetricsExporter, error) {
+	push := cfg.Metrics.Push
+	switch push.Backend {
+	case "":
+		return nil, nil
+	case metricsPushStatsD:
+		return NewStatsDExporter(push.Endpoint, push.Prefix)
+	case metricsPushOTLP:
+		return NewOTLPExporter(push.Endpoint, httpClient), nil
+	default:
+		return nil, NewConfigError("metrics.push.backend", push.Backend, "unknown metrics push backend", nil)
+	}
+}
+
+// RunMetricsPush exports a snapshot every interval until ctx is canceled, then closes the exporter
+func RunMetricsPush(ctx context.Context, metrics *Metrics, exporter MetricsExporter, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultMetricsPushInterval * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer func() {
+		if err := exporter.Close(); err != nil {
+			Warn("Error closing metrics exporter", "error", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := exporter.Export(ctx, metrics.Snapshot()); err != nil {
+				Warn("Failed to push metrics", "error", err)
+			}
+		}
+	}
+}
+
+// StatsDExporter sends metrics as StatsD gauges over UDP. Counters are sent as their
+// cumulative value so a lost packet never skews totals.
+type StatsDExporter struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsDExporter creates an exporter sending to the StatsD daemon at addr (host:port)
+func NewStatsDExporter(addr, prefix string) (*StatsDExporter, error) {
+	if prefix == "" {
+		prefix = defaultStatsDPrefix
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, NewNetworkError("statsd_dial", addr, "cannot open StatsD connection", err)
+	}
+	return &StatsDExporter{conn: conn, prefix: prefix}, nil
+}
+
+// Export writes one datagram with a line per metric
+func (e *StatsDExporter) Export(_ context.Context, snapshot MetricsSnapshot) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s.requests_total:%d|g\n", e.prefix, snapshot.RequestsTotal)
+	fmt.Fprintf(&b, "%s.requests_duration_seconds:%f|g\n", e.prefix, snapshot.RequestsDuration)
+	fmt.Fprintf(&b, "%s.active_connections:%d|g\n", e.prefix, snapshot.ActiveConnections)
+	fmt.Fprintf(&b, "%s.upstream_in_flight:%d|g\n", e.prefix, snapshot.UpstreamInFlight)
+	fmt.Fprintf(&b, "%s.circuit_breaker_state:%d|g\n", e.prefix, snapshot.CircuitState)
+
+	if _, err := e.conn.Write([]byte(b.String())); err != nil {
+		return NewNetworkError("statsd_write", e.conn.RemoteAddr().String(), "cannot send metrics", err)
+	}
+	return nil
+}
+
+// Close closes the UDP connection
+func (e *StatsDExporter) Close() error {
+	return e.conn.Close()
+}
+
+// OTLPExporter posts metrics to an OTLP/HTTP collector using the JSON encoding
+type OTLPExporter struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// NewOTLPExporter creates an exporter posting to endpoint, e.g. http://collector:4318/v1/metrics
+func NewOTLPExporter(endpoint string, httpClient *http.Client) *OTLPExporter {
+	return &OTLPExporter{endpoint: endpoint, httpClient: httpClient}
+}
+
+// otlpValue is an OTLP attribute value
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpDataPoint is a NumberDataPoint; int64 values are strings in OTLP JSON
+type otlpDataPoint struct {
+	TimeUnixNano string   `json:"timeUnixNano"`
+	AsInt        string   `json:"asInt,omitempty"`
+	AsDouble     *float64 `json:"asDouble,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"` // 2 = cumulative
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Unit  string     `json:"unit,omitempty"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+}
+
+// Export posts the snapshot as an ExportMetricsServiceRequest
+func (e *OTLPExporter) Export(ctx context.Context, snapshot MetricsSnapshot) error {
+	ts := strconv.FormatInt(snapshot.Time.UnixNano(), 10)
+	intPoint := func(v int64) []otlpDataPoint {
+		return []otlpDataPoint{{TimeUnixNano: ts, AsInt: strconv.FormatInt(v, 10)}}
+	}
+	duration := snapshot.RequestsDuration
+
+	metrics := []otlpMetric{
+		{Name: "github_copilot.requests", Sum: &otlpSum{DataPoints: intPoint(snapshot.RequestsTotal), AggregationTemporality: 2, IsMonotonic: true}},
+		{Name: "github_copilot.requests.duration", Unit: "s", Sum: &otlpSum{DataPoints: []otlpDataPoint{{TimeUnixNano: ts, AsDouble: &duration}}, AggregationTemporality: 2, IsMonotonic: true}},
+		{Name: "github_copilot.active_connections", Gauge: &otlpGauge{DataPoints: intPoint(snapshot.ActiveConnections)}},
+		{Name: "github_copilot.upstream_in_flight", Gauge: &otlpGauge{DataPoints: intPoint(snapshot.UpstreamInFlight)}},
+		{Name: "github_copilot.circuit_breaker_state", Gauge: &otlpGauge{DataPoints: intPoint(int64(snapshot.CircuitState))}},
+	}
+	payload := map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{map[string]interface{}{"key": "service.name", "value": otlpValue{StringValue: otlpServiceName}}},
+			},
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   map[string]string{"name": otlpServiceName},
+				"metrics": metrics,
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return NewNetworkError("otlp_export", e.endpoint, "cannot send metrics", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			Warn("Error closing response body", "error", err)
+		}
+	}()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return NewNetworkError("otlp_export", e.endpoint, fmt.Sprintf("collector returned HTTP %d", resp.StatusCode), nil)
+	}
+	return nil
+}
+
+// Close is a no-op; the HTTP client is shared
+func (e *OTLPExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privapps/github-copilot-svcs/internal"
+)
+
+func TestStatsDExporter(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	exporter, err := internal.NewStatsDExporter(listener.LocalAddr().String(), "copilot")
+	if err != nil {
+		t.Fatalf("NewStatsDExporter failed: %v", err)
+	}
+
+	metrics := &internal.Metrics{RequestsTotal: 7, RequestsDuration: 1.5, ActiveConnections: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		internal.RunMetricsPush(ctx, metrics, exporter, 20*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	buf := make([]byte, 1024)
+	if err := listener.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected a StatsD datagram: %v", err)
+	}
+
+	got := strings.Split(strings.TrimSpace(string(buf[:n])), "\n")
+	want := []string{
+		"copilot.requests_total:7|g",
+		"copilot.requests_duration_seconds:1.500000|g",
+		"copilot.active_connections:2|g",
+		"copilot.upstream_in_flight:0|g",
+		"copilot.circuit_breaker_state:0|g",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected StatsD lines\nwant: %q\n got: %q", want, got)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var received map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("invalid OTLP payload: %v", err)
+		}
+	}))
+	defer collector.Close()
+
+	exporter := internal.NewOTLPExporter(collector.URL+"/v1/metrics", collector.Client())
+	snapshot := internal.MetricsSnapshot{Time: time.Unix(1, 0), RequestsTotal: 3}
+	if err := exporter.Export(context.Background(), snapshot); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	body, _ := json.Marshal(received)
+	for _, want := range []string{`"github_copilot.requests"`, `"asInt":"3"`, `"timeUnixNano":"1000000000"`, `"stringValue":"github-copilot-svcs"`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected %s in payload %s", want, body)
+		}
+	}
+}
+
+func TestNewMetricsExporterDisabledByDefault(t *testing.T) {
+	cfg := createServerTestConfig()
+	exporter, err := internal.NewMetricsExporter(cfg, http.DefaultClient)
+	if err != nil || exporter != nil {
+		t.Errorf("expected no exporter by default, got %v (%v)", exporter, err)
+	}
+}
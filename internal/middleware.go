@@ -5,10 +5,16 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/subtle"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +24,15 @@ const (
 	statusClientError = 400
 )
 
+// Response header identifying the deployment that answered
+const servedByHeader = "X-Served-By"
+
+// Request header size limits
+const (
+	minHeaderBytes      = 1024
+	maxHeaderBytesLimit = 16 << 20
+)
+
 // LoggingResponseWriter wraps http.ResponseWriter to capture response data and status code.
 type LoggingResponseWriter struct {
 	http.ResponseWriter
@@ -48,10 +63,23 @@ func (lrw *LoggingResponseWriter) Write(body []byte) (int, error) {
 
 // Hijack ...
 func (lrw *LoggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	if hijacker, ok := lrw.ResponseWriter.(http.Hijacker); ok {
-		return hijacker.Hijack()
+	conn, buf, err := http.NewResponseController(lrw.ResponseWriter).Hijack()
+	if err == nil {
+		lrw.statusCode = http.StatusSwitchingProtocols
 	}
-	return nil, nil, http.ErrNotSupported
+	return conn, buf, err
+}
+
+// Flush sends buffered data to the client, so streamed responses are not held back
+func (lrw *LoggingResponseWriter) Flush() {
+	if flusher, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (lrw *LoggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
 }
 
 // StatusCode ...
@@ -64,10 +92,32 @@ func (lrw *LoggingResponseWriter) Body() []byte {
 	return lrw.body.Bytes()
 }
 
+// upstreamTimingContextKey holds the *upstreamTiming of a request logged by LoggingMiddleware
+type upstreamTimingContextKey struct{}
+
+// upstreamTiming is the time a request spent waiting on upstream calls. The proxy records
+// it on a worker goroutine, which may outlive a timed-out handler, so it is atomic.
+type upstreamTiming struct {
+	nanos    atomic.Int64
+	recorded atomic.Bool
+}
+
+// recordUpstreamTime adds d to the upstream time of the request ctx belongs to
+func recordUpstreamTime(ctx context.Context, d time.Duration) {
+	if timing, ok := ctx.Value(upstreamTimingContextKey{}).(*upstreamTiming); ok {
+		timing.nanos.Add(int64(d))
+		timing.recorded.Store(true)
+	}
+}
+
 // LoggingMiddleware logs HTTP requests and responses, including status code and duration.
+// Proxied requests also log upstream_ms, the part of duration_ms spent waiting on the
+// Copilot API, which tells its latency apart from queuing and our own processing.
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		timing := &upstreamTiming{}
+		r = r.WithContext(context.WithValue(r.Context(), upstreamTimingContextKey{}, timing))
 
 		// Create logging response writer
 		lrw := NewLoggingResponseWriter(w)
@@ -107,6 +157,9 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 			"response_size", responseSize,
 			"remote_addr", getClientIP(r),
 		}
+		if timing.recorded.Load() {
+			logArgs = append(logArgs, "upstream_ms", time.Duration(timing.nanos.Load()).Milliseconds())
+		}
 
 		// Log response with appropriate level
 		switch {
@@ -120,7 +173,7 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 
 		// Log response body for debugging if it's small and there was an error
 		if statusCode >= 400 && responseSize > 0 && responseSize < 1024 {
-			Debug("HTTP Response Body", "body", string(lrw.Body()))
+			Debug("HTTP Response Body", "body", redactBody(lrw.Body()))
 		}
 	})
 }
@@ -144,21 +197,64 @@ func RecoveryMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// maxHeaderBytes returns the configured request header limit, defaulting to 1 MiB
+func maxHeaderBytes(config *Config) int {
+	if config.MaxHeaderBytes > 0 {
+		return config.MaxHeaderBytes
+	}
+	return http.DefaultMaxHeaderBytes
+}
+
+// HeaderSizeMiddleware rejects requests whose headers exceed max_header_bytes with a
+// 431 before they are handled. http.Server enforces the same limit while reading, but
+// with some slack and not for HTTP/2 header lists decoded below it.
+func HeaderSizeMiddleware(config *Config) func(http.Handler) http.Handler {
+	limit := maxHeaderBytes(config)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if size := requestHeaderSize(r); size > limit {
+				Warn("Rejected request with oversized headers", "url", r.URL.Path, "header_bytes", size, "limit", limit, "remote_addr", getClientIP(r))
+				WriteHTTPError(w, http.StatusRequestHeaderFieldsTooLarge, "request headers too large")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestHeaderSize approximates the wire size of r's request line and headers
+func requestHeaderSize(r *http.Request) int {
+	size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + len(r.Host) + len("  \r\nHost: \r\n")
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(value) + len(": \r\n")
+		}
+	}
+	return size
+}
+
 // CORSMiddleware ...
 func CORSMiddleware(config *Config) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The admin API is never shared with other origins, whatever cors allows
+			if isAdminPath(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			origin := r.Header.Get("Origin")
+			cors := config.Live().CORS
 
 			// Set CORS headers based on configuration
-			if len(config.CORS.AllowedOrigins) > 0 {
-				if containsOrigin(config.CORS.AllowedOrigins, origin) || containsOrigin(config.CORS.AllowedOrigins, "*") {
+			if len(cors.AllowedOrigins) > 0 {
+				if containsOrigin(cors.AllowedOrigins, origin) || containsOrigin(cors.AllowedOrigins, "*") {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
 				}
 			}
 
-			if len(config.CORS.AllowedHeaders) > 0 {
-				w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.CORS.AllowedHeaders, ", "))
+			if len(cors.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
 			}
 
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
@@ -175,6 +271,43 @@ func CORSMiddleware(config *Config) func(http.Handler) http.Handler {
 	}
 }
 
+// RequireAPIKey rejects requests that don't present the configured API key,
+// either as a bearer token or via the X-API-Key header.
+func RequireAPIKey(config *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasValidAPIKey(config, r) {
+			Warn("Rejected request without valid API key", "url", r.URL.Path, "remote_addr", getClientIP(r))
+			WriteAuthenticationError(w)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HopByHopMiddleware removes hop-by-hop headers (RFC 7230 section 6.1) from incoming
+// requests so handlers never act on or forward them. WebSocket handshakes keep the
+// Connection and Upgrade headers they consist of.
+func HopByHopMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrade := isWebSocketUpgrade(r)
+		var stripped []string
+		for key := range hopByHopHeaderSet(r.Header) {
+			if upgrade && (key == "Connection" || key == "Upgrade") {
+				continue
+			}
+			if _, ok := r.Header[key]; ok {
+				r.Header.Del(key)
+				stripped = append(stripped, key)
+			}
+		}
+		if len(stripped) > 0 {
+			sort.Strings(stripped)
+			Debug("Stripped hop-by-hop request headers", "url", r.URL.Path, "headers", stripped)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // SecurityHeadersMiddleware ...
 func SecurityHeadersMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -193,6 +326,29 @@ func SecurityHeadersMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// ServedByMiddleware sets an X-Served-By header naming the service and, when
+// configured, the instance that answered the request
+func ServedByMiddleware(config *Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(servedByHeader, servedBy(config))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// servedBy formats the X-Served-By value, e.g. "copilot-eu; instance=eu-1"
+func servedBy(config *Config) string {
+	name := config.ServiceName
+	if name == "" {
+		name = defaultServiceName
+	}
+	if config.InstanceID == "" {
+		return name
+	}
+	return name + "; instance=" + config.InstanceID
+}
+
 // TimeoutMiddleware sets a timeout for HTTP requests using http.TimeoutHandler.
 func TimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -200,11 +356,13 @@ func TimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
 	}
 }
 
-// CompressionResponseWriter wraps http.ResponseWriter to handle compression
+// CompressionResponseWriter wraps http.ResponseWriter to handle compression. Event
+// streams and responses that are already encoded are sent uncompressed.
 type CompressionResponseWriter struct {
 	http.ResponseWriter
-	gzipWriter *gzip.Writer
-	compressed bool
+	gzipWriter  *gzip.Writer
+	compressed  bool
+	wroteHeader bool
 }
 
 // NewCompressionResponseWriter creates a new compression response writer
@@ -227,24 +385,55 @@ func NewCompressionResponseWriter(w http.ResponseWriter, r *http.Request) *Compr
 
 // WriteHeader handles the status code and sets compression headers if needed
 func (crw *CompressionResponseWriter) WriteHeader(statusCode int) {
+	if crw.wroteHeader {
+		return
+	}
+	crw.wroteHeader = true
+	h := crw.ResponseWriter.Header()
+	// Compressed SSE would only reach the client once the gzip writer fills a block
+	if crw.compressed && (isEventStream(h.Get("Content-Type")) || h.Get("Content-Encoding") != "") {
+		crw.compressed = false
+	}
 	if crw.compressed {
-		crw.ResponseWriter.Header().Set("Content-Encoding", "gzip")
-		crw.ResponseWriter.Header().Set("Vary", "Accept-Encoding")
+		h.Set("Content-Encoding", "gzip")
+		h.Set("Vary", "Accept-Encoding")
+		h.Del("Content-Length")
 	}
 	crw.ResponseWriter.WriteHeader(statusCode)
 }
 
 // Write writes data, compressing if enabled
 func (crw *CompressionResponseWriter) Write(data []byte) (int, error) {
+	if !crw.wroteHeader {
+		crw.WriteHeader(http.StatusOK)
+	}
 	if crw.compressed {
 		return crw.gzipWriter.Write(data)
 	}
 	return crw.ResponseWriter.Write(data)
 }
 
+// Flush sends the data compressed so far, then flushes the underlying writer
+func (crw *CompressionResponseWriter) Flush() {
+	if !crw.wroteHeader {
+		crw.WriteHeader(http.StatusOK)
+	}
+	if crw.compressed {
+		_ = crw.gzipWriter.Flush()
+	}
+	if flusher, ok := crw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (crw *CompressionResponseWriter) Unwrap() http.ResponseWriter {
+	return crw.ResponseWriter
+}
+
 // Close closes the gzip writer if compression is enabled
 func (crw *CompressionResponseWriter) Close() error {
-	if crw.compressed {
+	if crw.compressed && crw.wroteHeader {
 		return crw.gzipWriter.Close()
 	}
 	return nil
@@ -281,30 +470,169 @@ func CompressionMiddleware() func(http.Handler) http.Handler {
 	}
 }
 
-// Helper functions
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (proxy)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP in the chain
-		if idx := strings.Index(xff, ","); idx != -1 {
-			return strings.TrimSpace(xff[:idx])
+// clientIPContextKey holds the client address resolved by ClientIPMiddleware
+type clientIPContextKey struct{}
+
+// ClientIPMiddleware resolves the client address once per request. X-Forwarded-For and
+// X-Real-IP are only honored when the immediate peer is in trusted_proxies; otherwise
+// the connection's RemoteAddr is used, so clients cannot spoof their address.
+func ClientIPMiddleware(config *Config) func(http.Handler) http.Handler {
+	trusted := parseTrustedProxies(config.TrustedProxies)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := resolveClientIP(r, trusted)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip)))
+		})
+	}
+}
+
+// parseTrustedProxy parses a CIDR or a single IP address
+func parseTrustedProxy(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseTrustedProxies parses the configured entries, skipping invalid ones
+// (rejected by config validation)
+func parseTrustedProxies(entries []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if prefix, err := parseTrustedProxy(strings.TrimSpace(entry)); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+func isTrustedProxy(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
 		}
-		return strings.TrimSpace(xff)
+	}
+	return false
+}
+
+// resolveClientIP returns the client address for r. Behind trusted proxies it walks
+// X-Forwarded-For from the right and returns the first hop that is not itself trusted.
+func resolveClientIP(r *http.Request, trusted []netip.Prefix) string {
+	client := remoteIP(r)
+	if !isTrustedProxy(client, trusted) {
+		return client
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				// A malformed hop can't be attributed; keep the last verified address
+				return client
+			}
+			client = hop
+			if !isTrustedProxy(hop, trusted) {
+				break
+			}
+		}
+		return client
 	}
 
 	// Check X-Real-IP header (nginx)
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return strings.TrimSpace(xri)
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+		if _, err := netip.ParseAddr(xri); err == nil {
+			return xri
+		}
 	}
+	return client
+}
 
-	// Fall back to RemoteAddr
+// remoteIP returns the host part of the connection's remote address
+func remoteIP(r *http.Request) string {
 	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 		return ip
 	}
-
 	return r.RemoteAddr
 }
 
+// Helper functions
+func getClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	// Without ClientIPMiddleware no proxy is trusted
+	return remoteIP(r)
+}
+
+// ConcurrencyLimitMiddleware caps the requests each client IP may have in flight at
+// rate_limit.max_concurrent, so one client holding many streams open cannot take every
+// worker and stream slot. Requests over the cap get 429 with a Retry-After header.
+func ConcurrencyLimitMiddleware(config *Config) func(http.Handler) http.Handler {
+	limit := config.RateLimit.MaxConcurrent
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		var (
+			mutex  sync.Mutex
+			active = make(map[string]int)
+		)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := getClientIP(r)
+			mutex.Lock()
+			if active[ip] >= limit {
+				mutex.Unlock()
+				Warn("Rejected request over the per-client concurrency limit", "url", r.URL.Path, "remote_addr", ip, "limit", limit)
+				w.Header().Set(retryAfterHeader, "1")
+				WriteHTTPError(w, http.StatusTooManyRequests, "too many concurrent requests")
+				return
+			}
+			active[ip]++
+			mutex.Unlock()
+
+			defer func() {
+				mutex.Lock()
+				if active[ip]--; active[ip] == 0 {
+					delete(active, ip)
+				}
+				mutex.Unlock()
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasValidAPIKey(config *Config, r *http.Request) bool {
+	if config.APIKey == "" {
+		return false
+	}
+	key := presentedAPIKey(r)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(config.APIKey)) == 1
+}
+
+// presentedAPIKey returns the API key a client sent in X-API-Key or as a bearer token
+func presentedAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
 func containsOrigin(origins []string, origin string) bool {
 	for _, o := range origins {
 		if o == origin || o == "*" {
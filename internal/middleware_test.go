@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientIPMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    []string
+		remoteAddr string
+		xff        []string
+		realIP     string
+		want       string
+	}{
+		{
+			name:       "default trusts no proxy",
+			remoteAddr: "203.0.113.7:4321",
+			xff:        []string{"1.2.3.4"},
+			realIP:     "5.6.7.8",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "untrusted peer cannot spoof forwarded headers",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "203.0.113.7:4321",
+			xff:        []string{"1.2.3.4"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted peer forwards client address",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.1.2.3:4321",
+			xff:        []string{"198.51.100.9"},
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "spoofed leftmost hop is ignored behind trusted proxies",
+			trusted:    []string{"10.0.0.0/8", "192.0.2.1"},
+			remoteAddr: "10.1.2.3:4321",
+			xff:        []string{"1.2.3.4, 198.51.100.9", "192.0.2.1"},
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "trusted peer with X-Real-IP",
+			trusted:    []string{"127.0.0.1"},
+			remoteAddr: "127.0.0.1:4321",
+			realIP:     "198.51.100.9",
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "malformed hop falls back to last verified address",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.1.2.3:4321",
+			xff:        []string{"not-an-ip"},
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "IPv6 peer in trusted range",
+			trusted:    []string{"fd00::/8"},
+			remoteAddr: "[fd00::1]:4321",
+			xff:        []string{"2001:db8::5"},
+			want:       "2001:db8::5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := ClientIPMiddleware(&Config{TrustedProxies: tt.trusted})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = getClientIP(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/health", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("Expected client IP %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	valid := &Config{TrustedProxies: []string{"10.0.0.0/8", "127.0.0.1", "::1", "fd00::/8"}}
+	if err := valid.validateTrustedProxies(); err != nil {
+		t.Errorf("Expected valid trusted proxies, got %v", err)
+	}
+
+	invalid := &Config{TrustedProxies: []string{"10.0.0.0/8", "proxy.local"}}
+	if err := invalid.validateTrustedProxies(); err == nil {
+		t.Error("Expected an error for a non-IP trusted proxy")
+	}
+}
+
+func TestHopByHopMiddleware(t *testing.T) {
+	var got http.Header
+	handler := HopByHopMiddleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+
+	t.Run("strips hop-by-hop headers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", http.NoBody)
+		req.Header.Set("Connection", "keep-alive, X-Client-Hop")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+		req.Header.Set("Te", "trailers")
+		req.Header.Set("Trailer", "X-Checksum")
+		req.Header.Set("Upgrade", "h2c")
+		req.Header.Set("X-Client-Hop", "1")
+		req.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, key := range []string{"Connection", "Keep-Alive", "Proxy-Authorization", "Te", "Trailer", "Upgrade", "X-Client-Hop"} {
+			if v := got.Get(key); v != "" {
+				t.Errorf("Expected %s to be stripped, got %q", key, v)
+			}
+		}
+		if got.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected end-to-end headers to be kept, got %v", got)
+		}
+	})
+
+	t.Run("WebSocket handshake keeps Connection and Upgrade", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, chatWebSocketRoute, http.NoBody)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if got.Get("Connection") != "Upgrade" || got.Get("Upgrade") != "websocket" {
+			t.Errorf("Expected the upgrade headers to be kept, got %v", got)
+		}
+		if got.Get("Proxy-Authorization") != "" {
+			t.Error("Expected Proxy-Authorization to be stripped")
+		}
+	})
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	const busyIP = "203.0.113.7"
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	cfg := &Config{}
+	cfg.RateLimit.MaxConcurrent = 2
+	handler := ConcurrencyLimitMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if getClientIP(r) == busyIP {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Hold the busy client's share of requests open
+	var wg sync.WaitGroup
+	for range cfg.RateLimit.MaxConcurrent {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := serve(busyIP); w.Code != http.StatusOK {
+				t.Errorf("Expected requests within the limit to succeed, got %d", w.Code)
+			}
+		}()
+		<-entered
+	}
+
+	w := serve(busyIP)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 over the limit, got %d", w.Code)
+	}
+	if w.Header().Get(retryAfterHeader) == "" {
+		t.Error("Expected a Retry-After header on a throttled request")
+	}
+	if w := serve("198.51.100.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected another client to be unaffected, got %d", w.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	go func() { <-entered }()
+	if w := serve(busyIP); w.Code != http.StatusOK {
+		t.Errorf("Expected the client to be admitted once its requests finished, got %d", w.Code)
+	}
+}
+
+func TestLoggingMiddlewareUpstreamTime(t *testing.T) {
+	const upstreamDelay = 50 * time.Millisecond
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(upstreamDelay)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1","object":"chat.completion","choices":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	original := logger
+	t.Cleanup(func() { logger = original })
+	var logs bytes.Buffer
+	logger = &Logger{Logger: slog.New(slog.NewTextHandler(&logs, nil)), level: slog.LevelInfo}
+
+	cfg := &Config{CopilotToken: "test-token", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	SetDefaultHeaders(cfg)
+	SetDefaultCORS(cfg)
+	SetDefaultTimeouts(cfg)
+	workerPool := NewWorkerPool(2)
+	t.Cleanup(workerPool.Stop)
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		target, _ := url.Parse(upstream.URL)
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	proxy := NewProxyService(cfg, client, NewAuthService(client), workerPool)
+
+	serve := func(handler http.Handler) string {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodPost, chatCompletionsRoute, strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		w := httptest.NewRecorder()
+		LoggingMiddleware(handler).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, `msg="HTTP Response"`) {
+				return line
+			}
+		}
+		t.Fatalf("Expected a response log, got:\n%s", logs.String())
+		return ""
+	}
+	field := func(line, name string) int64 {
+		t.Helper()
+		match := regexp.MustCompile(`\b` + name + `=(\d+)`).FindStringSubmatch(line)
+		if match == nil {
+			t.Fatalf("Expected %s in %s", name, line)
+		}
+		value, _ := strconv.ParseInt(match[1], 10, 64)
+		return value
+	}
+
+	line := serve(proxy.Handler())
+	duration, upstreamMS := field(line, "duration_ms"), field(line, "upstream_ms")
+	if upstreamMS < upstreamDelay.Milliseconds() || upstreamMS > duration {
+		t.Errorf("Expected %dms <= upstream_ms <= duration_ms, got upstream_ms=%d duration_ms=%d", upstreamDelay.Milliseconds(), upstreamMS, duration)
+	}
+
+	// Requests that never go upstream log no upstream time
+	line = serve(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	if strings.Contains(line, "upstream_ms") {
+		t.Errorf("Expected no upstream_ms without an upstream call, got %s", line)
+	}
+}
@@ -2,9 +2,13 @@
 package internal
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,10 +16,18 @@ import (
 	"github.com/privapps/github-copilot-svcs/pkg/transform"
 )
 
-var (
-	cachedModels *transform.ModelList
-	modelsMutex  sync.RWMutex
-	modelsLoaded bool
+const (
+	modelsDevURL     = "https://models.dev/api.json"
+	copilotModelsURL = copilotAPIBase + "/models"
+
+	// models.dev is a third party; bound each attempt so a slow response can't
+	// hold up model listing, and retry once for transient TLS/network errors
+	modelsDevTimeout    = 10 * time.Second
+	modelsDevAttempts   = 2
+	modelsDevRetryDelay = 500 * time.Millisecond
+
+	// Loaded model lists are reloaded after models_cache_ttl, so new models show up
+	defaultModelsCacheTTL = 3600 // seconds
 )
 
 // ModelsDevResponse represents the structure from models.dev API
@@ -29,12 +41,81 @@ type ModelsDevResponse map[string]struct {
 	} `json:"models"`
 }
 
-// FetchFromModelsDev fetches models from models.dev API as fallback
+// FetchFromModelsDev fetches models from models.dev API as fallback. Each attempt is
+// limited to modelsDevTimeout (or the client's timeout, if shorter); network errors,
+// timeouts and 5xx responses are retried once.
 func FetchFromModelsDev(httpClient *http.Client) (*transform.ModelList, error) {
-	resp, err := httpClient.Get("https://models.dev/api.json")
+	return FetchFromModelsDevWithContext(context.Background(), httpClient)
+}
+
+// FetchFromModelsDevWithContext is FetchFromModelsDev bounded by ctx; no retry is made
+// once ctx is done.
+func FetchFromModelsDevWithContext(ctx context.Context, httpClient *http.Client) (*transform.ModelList, error) {
+	var (
+		providers ModelsDevResponse
+		retryable bool
+		err       error
+	)
+	for attempt := 1; attempt <= modelsDevAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(retryBackoff(modelsDevRetryDelay, attempt-1, 0)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		providers, retryable, err = fetchModelsDev(ctx, httpClient)
+		if err == nil || !retryable || ctx.Err() != nil {
+			break
+		}
+		Debug("models.dev request failed", "attempt", attempt, "error", err)
+	}
 	if err != nil {
 		return nil, err
 	}
+
+	// Extract GitHub Copilot models
+	copilotProvider, exists := providers["github-copilot"]
+	if !exists {
+		return nil, NewValidationError("provider", "github-copilot", "provider not found in models.dev response", nil)
+	}
+
+	var models []transform.Model
+	for modelID, modelInfo := range copilotProvider.Models {
+		ownedBy := modelInfo.OwnedBy
+		if ownedBy == "" {
+			ownedBy = detectOwner(modelInfo.Name)
+		}
+
+		models = append(models, transform.Model{
+			ID:          modelID,
+			Object:      "model",
+			Created:     time.Now().Unix(),
+			OwnedBy:     ownedBy,
+			ReleaseDate: modelInfo.ReleaseDate,
+		})
+	}
+
+	return &transform.ModelList{
+		Object: "list",
+		Data:   models,
+	}, nil
+}
+
+// fetchModelsDev makes one bounded request to models.dev and reports whether a
+// failure is worth retrying
+func fetchModelsDev(parent context.Context, httpClient *http.Client) (ModelsDevResponse, bool, error) {
+	ctx, cancel := context.WithTimeout(parent, modelsDevTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, modelsDevURL, http.NoBody)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, true, NewNetworkError("fetch_models", modelsDevURL, "request failed", err)
+	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
 			Warn("Error closing response body", "error", err)
@@ -42,39 +123,84 @@ func FetchFromModelsDev(httpClient *http.Client) (*transform.ModelList, error) {
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, NewNetworkError("fetch_models", "https://models.dev/api.json", fmt.Sprintf("API returned HTTP %d", resp.StatusCode), nil)
+		return nil, resp.StatusCode >= http.StatusInternalServerError,
+			NewNetworkError("fetch_models", modelsDevURL, fmt.Sprintf("API returned HTTP %d", resp.StatusCode), nil)
 	}
 
 	var providers ModelsDevResponse
 	if err := json.NewDecoder(resp.Body).Decode(&providers); err != nil {
+		// A body cut off by the timeout is transient; malformed JSON is not
+		if ctx.Err() != nil {
+			return nil, true, NewNetworkError("fetch_models", modelsDevURL, "reading response timed out", err)
+		}
+		return nil, false, err
+	}
+	return providers, false, nil
+}
+
+// copilotModelsResponse represents the structure from the Copilot models API
+type copilotModelsResponse struct {
+	Data []struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Vendor string `json:"vendor"`
+	} `json:"data"`
+}
+
+// FetchFromCopilotAPI fetches the model list from the GitHub Copilot API using the configured token
+func FetchFromCopilotAPI(httpClient *http.Client, cfg *Config) (*transform.ModelList, error) {
+	return FetchFromCopilotAPIWithContext(context.Background(), httpClient, cfg)
+}
+
+// FetchFromCopilotAPIWithContext is FetchFromCopilotAPI bounded by ctx
+func FetchFromCopilotAPIWithContext(ctx context.Context, httpClient *http.Client, cfg *Config) (*transform.ModelList, error) {
+	token, _ := cfg.Token()
+	if token == "" {
+		return nil, NewAuthError("no Copilot token available for models API", nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, copilotModelsURL, http.NoBody)
+	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	headers := cfg.Live().Headers
+	req.Header.Set("User-Agent", headers.UserAgent)
+	req.Header.Set("Editor-Version", headers.EditorVersion)
+	req.Header.Set("Editor-Plugin-Version", headers.EditorPluginVersion)
+	req.Header.Set("Copilot-Integration-Id", headers.CopilotIntegrationID)
 
-	// Extract GitHub Copilot models
-	copilotProvider, exists := providers["github-copilot"]
-	if !exists {
-		return nil, NewValidationError("provider", "github-copilot", "provider not found in models.dev response", nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			Warn("Error closing response body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewNetworkError("fetch_models", copilotModelsURL, fmt.Sprintf("API returned HTTP %d", resp.StatusCode), nil)
 	}
 
-	var models []transform.Model
-	for modelID, modelInfo := range copilotProvider.Models {
-		ownedBy := modelInfo.OwnedBy
+	var copilotModels copilotModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&copilotModels); err != nil {
+		return nil, err
+	}
+	if len(copilotModels.Data) == 0 {
+		return nil, NewValidationError("data", "", "no models in Copilot API response", nil)
+	}
+
+	models := make([]transform.Model, 0, len(copilotModels.Data))
+	for _, m := range copilotModels.Data {
+		ownedBy := strings.ToLower(m.Vendor)
 		if ownedBy == "" {
-			// Determine owner based on model name
-			switch {
-			case containsAny(modelInfo.Name, []string{"claude", "anthropic"}):
-				ownedBy = "anthropic"
-			case containsAny(modelInfo.Name, []string{"gpt", "o1", "o3", "o4", "openai"}):
-				ownedBy = "openai"
-			case containsAny(modelInfo.Name, []string{"gemini", "google"}):
-				ownedBy = "google"
-			default:
-				ownedBy = "github-copilot"
-			}
+			ownedBy = detectOwner(m.ID)
 		}
-
 		models = append(models, transform.Model{
-			ID:      modelID,
+			ID:      m.ID,
 			Object:  "model",
 			Created: time.Now().Unix(),
 			OwnedBy: ownedBy,
@@ -87,6 +213,51 @@ func FetchFromModelsDev(httpClient *http.Client) (*transform.ModelList, error) {
 	}, nil
 }
 
+// sortModels orders a model list by ID, then owner, so every listing of the same models
+// is identical; models.dev returns them as a map in random order
+func sortModels(modelList *transform.ModelList) {
+	slices.SortStableFunc(modelList.Data, func(a, b transform.Model) int {
+		return cmp.Or(strings.Compare(a.ID, b.ID), strings.Compare(a.OwnedBy, b.OwnedBy))
+	})
+}
+
+// detectOwner determines the model owner based on the model name
+func detectOwner(name string) string {
+	switch {
+	case containsAny(name, []string{"claude", "anthropic"}):
+		return "anthropic"
+	case containsAny(name, []string{"gpt", "o1", "o3", "o4", "openai"}):
+		return "openai"
+	case containsAny(name, []string{"gemini", "google"}):
+		return "google"
+	default:
+		return "github-copilot"
+	}
+}
+
+// responseFormatsByOwner lists the response_format types each model family is known to
+// honor. Families not listed are not checked.
+var responseFormatsByOwner = map[string][]string{
+	"openai":    {transform.ResponseFormatText, transform.ResponseFormatJSONObject, transform.ResponseFormatJSONSchema},
+	"google":    {transform.ResponseFormatText, transform.ResponseFormatJSONObject, transform.ResponseFormatJSONSchema},
+	"anthropic": {transform.ResponseFormatText},
+}
+
+// responseFormatSupported reports whether model is known to honor the response format,
+// giving unknown models the benefit of the doubt
+func responseFormatSupported(model, format string) bool {
+	formats, known := responseFormatsByOwner[detectOwner(model)]
+	if !known {
+		return true
+	}
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
 // GetDefault returns a default list of models based on actual models.dev GitHub Copilot entries
 func GetDefault() []transform.Model {
 	return []transform.Model{
@@ -108,6 +279,35 @@ func GetDefault() []transform.Model {
 	}
 }
 
+// defaultModelAliases maps common client model names to their Copilot IDs
+var defaultModelAliases = map[string]string{
+	"gpt-4":             "gpt-4o",
+	"gpt-4-turbo":       "gpt-4o",
+	"claude-3-5-sonnet": "claude-3.5-sonnet",
+	"claude-3-7-sonnet": "claude-3.7-sonnet",
+	"claude-sonnet-4-0": "claude-sonnet-4",
+	"claude-opus-4-0":   "claude-opus-4",
+}
+
+// NormalizeModel maps a client model name to the Copilot model ID. Configured aliases
+// take precedence over the built-in ones, a vendor prefix such as "openai/" is
+// stripped, and unknown models are returned unchanged.
+func NormalizeModel(model string, aliases map[string]string) string {
+	if target, ok := aliases[model]; ok {
+		return target
+	}
+	if i := strings.LastIndex(model, "/"); i >= 0 {
+		model = model[i+1:]
+	}
+	if target, ok := aliases[model]; ok {
+		return target
+	}
+	if target, ok := defaultModelAliases[model]; ok {
+		return target
+	}
+	return model
+}
+
 // containsAny checks if text contains any of the substrings
 func containsAny(text string, substrings []string) bool {
 	textLower := strings.ToLower(text)
@@ -123,13 +323,39 @@ func containsAny(text string, substrings []string) bool {
 type ModelsService struct {
 	coalescingCache CoalescingCacheInterface
 	httpClient      *http.Client
+	config          *Config
+
+	clock        Clock
+	cachedModels *transform.ModelList
+	cachedAt     time.Time
+	generation   int // bumped whenever the cached list is replaced
+	modelsMutex  sync.RWMutex
 }
 
 // NewModelsService creates a new models service
-func NewModelsService(cache CoalescingCacheInterface, httpClient *http.Client) *ModelsService {
-	return &ModelsService{
+func NewModelsService(cache CoalescingCacheInterface, httpClient *http.Client, opts ...func(*ModelsService)) *ModelsService {
+	svc := &ModelsService{
 		coalescingCache: cache,
 		httpClient:      httpClient,
+		clock:           systemClock{},
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
+
+// WithModelsConfig sets the config whose Copilot token is used for the Copilot models API fallback.
+func WithModelsConfig(cfg *Config) func(*ModelsService) {
+	return func(s *ModelsService) {
+		s.config = cfg
+	}
+}
+
+// WithModelsClock sets the clock deciding when the cached model list expires
+func WithModelsClock(clock Clock) func(*ModelsService) {
+	return func(s *ModelsService) {
+		s.clock = clock
 	}
 }
 
@@ -137,54 +363,51 @@ func NewModelsService(cache CoalescingCacheInterface, httpClient *http.Client) *
 type CoalescingCacheInterface interface {
 	GetRequestKey(method, path string, body interface{}) string
 	CoalesceRequest(key string, fn func() interface{}) interface{}
-} // Handler returns an HTTP handler for the models endpoint.
-// Handler returns an HTTP handler for the models endpoint.
+}
+
+// Handler returns an HTTP handler for the models endpoint. Loading is bounded by
+// timeouts.models (proxy_context by default); a load that runs out of time answers 408
+// and is not cached.
 func (s *ModelsService) Handler() http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
-		// Use request coalescing for identical concurrent requests
-		requestKey := s.coalescingCache.GetRequestKey("GET", "/v1/models", nil)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.timeout())
+		defer cancel()
+
+		// Use request coalescing for identical concurrent requests. The key changes when
+		// the cached list expires or is replaced, so a coalesced result never outlives it.
+		requestKey := s.coalescingCache.GetRequestKey("GET", "/v1/models", []byte(s.cacheKey()))
 
 		result := s.coalescingCache.CoalesceRequest(requestKey, func() interface{} {
 			// Check cache first
-			modelsMutex.RLock()
-			if modelsLoaded && cachedModels != nil {
-				modelsMutex.RUnlock()
-				return cachedModels
+			if cached, _ := s.cached(); cached != nil {
+				return cached
 			}
-			modelsMutex.RUnlock()
 
-			// Load models if not cached
-			modelsMutex.Lock()
-			defer modelsMutex.Unlock()
+			// Load models if not cached or expired
+			s.modelsMutex.Lock()
+			defer s.modelsMutex.Unlock()
 
 			// Double-check in case another goroutine loaded while we waited
-			if modelsLoaded && cachedModels != nil {
-				return cachedModels
+			if s.freshLocked() {
+				return s.cachedModels
 			}
 
-			Info("Loading models for the first time...")
-
-			// Try models.dev API first (don't hit GitHub Copilot for models list)
-			modelList, err := FetchFromModelsDev(s.httpClient)
+			Info("Loading models...")
+			modelList, err := s.loadModels(ctx)
 			if err != nil {
-				Warn("Failed to fetch from models.dev, using default models", "error", err)
-
-				// Ultimate fallback to hardcoded models
-				modelList = &transform.ModelList{
-					Object: "list",
-					Data:   GetDefault(),
-				}
+				return err
 			}
-
-			// Cache the results
-			cachedModels = modelList
-			modelsLoaded = true
-
-			Info("Loaded and cached models", "count", len(modelList.Data))
+			s.storeLocked(modelList)
+			Info("Loaded and cached models", "count", len(modelList.Data), "ttl", s.cacheTTL())
 			return modelList
 		})
 
-		modelList := result.(*transform.ModelList)
+		modelList, ok := result.(*transform.ModelList)
+		if !ok {
+			Warn("Loading models timed out", "timeout", s.timeout(), "error", result)
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
 		Debug("Returning models", "count", len(modelList.Data))
 
 		w.Header().Set("Content-Type", "application/json")
@@ -194,3 +417,136 @@ func (s *ModelsService) Handler() http.HandlerFunc {
 		}
 	}
 }
+
+// RefreshHandler serves POST /admin/models/refresh, which reloads the models right away
+// and answers with the new list. It is protected like the other admin endpoints.
+func (s *ModelsService) RefreshHandler() http.HandlerFunc {
+	return RequireAdminAccess(s.adminConfig(), func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteHTTPError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), s.timeout())
+		defer cancel()
+
+		modelList, err := s.Refresh(ctx)
+		if err != nil {
+			Warn("Refreshing models timed out", "timeout", s.timeout(), "error", err)
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(modelList); err != nil {
+			Error("Error encoding models response", "error", err)
+		}
+	})
+}
+
+// Refresh reloads the models and replaces the cached list. The old list keeps being
+// served while the new one loads, and stays cached if ctx ends first.
+func (s *ModelsService) Refresh(ctx context.Context) (*transform.ModelList, error) {
+	modelList, err := s.loadModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.modelsMutex.Lock()
+	s.storeLocked(modelList)
+	s.modelsMutex.Unlock()
+	Info("Refreshed models cache", "count", len(modelList.Data))
+	return modelList, nil
+}
+
+// cached returns the cached list while it is fresh, nil otherwise
+func (s *ModelsService) cached() (*transform.ModelList, int) {
+	s.modelsMutex.RLock()
+	defer s.modelsMutex.RUnlock()
+	if s.freshLocked() {
+		return s.cachedModels, s.generation
+	}
+	return nil, s.generation
+}
+
+// cacheKey identifies the cached list and whether it is still fresh
+func (s *ModelsService) cacheKey() string {
+	cached, generation := s.cached()
+	if cached == nil {
+		return strconv.Itoa(generation) + "-stale"
+	}
+	return strconv.Itoa(generation)
+}
+
+// freshLocked reports whether the cached list is younger than the cache TTL
+func (s *ModelsService) freshLocked() bool {
+	return s.cachedModels != nil && s.clock.Now().Sub(s.cachedAt) < s.cacheTTL()
+}
+
+// storeLocked caches a loaded list in a stable order
+func (s *ModelsService) storeLocked(modelList *transform.ModelList) {
+	sortModels(modelList)
+	s.cachedModels = modelList
+	s.cachedAt = s.clock.Now()
+	s.generation++
+}
+
+// cacheTTL returns how long a loaded model list is served before it is reloaded
+func (s *ModelsService) cacheTTL() time.Duration {
+	if s.config != nil && s.config.ModelsCacheTTL > 0 {
+		return time.Duration(s.config.ModelsCacheTTL) * time.Second
+	}
+	return defaultModelsCacheTTL * time.Second
+}
+
+// adminConfig returns the config gating the admin endpoint; without one only loopback
+// clients are allowed
+func (s *ModelsService) adminConfig() *Config {
+	if s.config == nil {
+		return &Config{}
+	}
+	return s.config
+}
+
+// timeout returns the deadline for loading models
+func (s *ModelsService) timeout() time.Duration {
+	if s.config == nil {
+		return defaultProxyContextTimeout * time.Second
+	}
+	return routeTimeout(s.config, "/v1/models")
+}
+
+// loadModels tries models.dev, then the Copilot models API, then the hardcoded defaults.
+// It fails only when ctx is done, so a timed-out load is never cached as the defaults.
+func (s *ModelsService) loadModels(ctx context.Context) (*transform.ModelList, error) {
+	modelList, err := FetchFromModelsDevWithContext(ctx, s.httpClient)
+	if err == nil {
+		return modelList, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	Warn("Failed to fetch from models.dev, trying Copilot API", "error", err)
+
+	if s.config != nil && s.config.hasCopilotToken() {
+		modelList, err = FetchFromCopilotAPIWithContext(ctx, s.httpClient, s.config)
+		if err == nil {
+			return modelList, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		Warn("Failed to fetch from Copilot API, using default models", "error", err)
+	}
+
+	// Ultimate fallback to hardcoded models
+	return &transform.ModelList{
+		Object: "list",
+		Data:   GetDefault(),
+	}, nil
+}
+
+func (c *Config) validateModelsCacheTTL() error {
+	if c.ModelsCacheTTL < 0 {
+		return NewValidationError("models_cache_ttl", c.ModelsCacheTTL, "must not be negative", nil)
+	}
+	return nil
+}
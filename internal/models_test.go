@@ -2,10 +2,12 @@ package internal_test
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -211,6 +213,23 @@ func TestFetchFromModelsDev(t *testing.T) {
 		}
 	})
 
+	t.Run("carries release date", func(t *testing.T) {
+		testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"github-copilot":{"id":"github-copilot","models":{
+				"gpt-4":{"id":"gpt-4","name":"GPT-4","release_date":"2023-03-14","owned_by":"openai"}}}}`))
+		}))
+		defer testServer.Close()
+
+		modelList, err := internal.FetchFromModelsDev(newUpstreamClient(t, testServer))
+		if err != nil {
+			t.Fatalf("Expected successful fetch, got: %v", err)
+		}
+		if len(modelList.Data) != 1 || modelList.Data[0].ReleaseDate != "2023-03-14" {
+			t.Errorf("Expected gpt-4 with release date 2023-03-14, got %+v", modelList.Data)
+		}
+	})
+
 	t.Run("handles network error", func(t *testing.T) {
 		httpClient := &http.Client{Timeout: 1 * time.Millisecond} // Very short timeout
 
@@ -222,6 +241,64 @@ func TestFetchFromModelsDev(t *testing.T) {
 		// We don't fail the test since network conditions can vary
 	})
 
+	t.Run("gives up promptly on a hung server and falls back", func(t *testing.T) {
+		var attempts atomic.Int32
+		testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer testServer.Close()
+
+		httpClient := newUpstreamClient(t, testServer)
+		httpClient.Timeout = 100 * time.Millisecond
+
+		start := time.Now()
+		_, err := internal.FetchFromModelsDev(httpClient)
+		if err == nil {
+			t.Fatal("Expected an error from a server slower than the timeout")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected the fetch to give up promptly, took %v", elapsed)
+		}
+		if got := attempts.Load(); got != 2 {
+			t.Errorf("Expected one retry (2 attempts), got %d", got)
+		}
+
+		service := internal.NewModelsService(NewMockCoalescingCache(), httpClient)
+		w := httptest.NewRecorder()
+		service.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/models", http.NoBody))
+		var modelList transform.ModelList
+		if err := json.NewDecoder(w.Body).Decode(&modelList); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(modelList.Data) != len(internal.GetDefault()) {
+			t.Errorf("Expected the default models as fallback, got %d models", len(modelList.Data))
+		}
+	})
+
+	t.Run("retries a transient server error", func(t *testing.T) {
+		var attempts atomic.Int32
+		testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if attempts.Add(1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(`{"github-copilot":{"id":"github-copilot","models":{"gpt-4":{"id":"gpt-4","name":"GPT-4"}}}}`))
+		}))
+		defer testServer.Close()
+
+		modelList, err := internal.FetchFromModelsDev(newUpstreamClient(t, testServer))
+		if err != nil {
+			t.Fatalf("Expected the retry to succeed, got: %v", err)
+		}
+		if len(modelList.Data) != 1 || attempts.Load() != 2 {
+			t.Errorf("Expected 1 model after 2 attempts, got %d models after %d", len(modelList.Data), attempts.Load())
+		}
+	})
+
 	t.Run("handles non-200 status", func(t *testing.T) {
 		// Create a mock server that returns 404
 		testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
@@ -510,3 +587,353 @@ func TestCoalescingCacheIntegration(t *testing.T) {
 		t.Errorf("Expected cache CoalesceRequest to be called 3 times, got %d", cache.executeCount)
 	}
 }
+
+// newModelsStub serves models.dev and Copilot API responses based on the requested host
+func newModelsStub(t *testing.T, modelsDev, copilot http.HandlerFunc) (*httptest.Server, *int, *int) {
+	t.Helper()
+	var modelsDevCalls, copilotCalls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "models.dev":
+			modelsDevCalls++
+			modelsDev(w, r)
+		case "api.githubcopilot.com":
+			copilotCalls++
+			copilot(w, r)
+		default:
+			t.Errorf("unexpected host %q", r.Host)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &modelsDevCalls, &copilotCalls
+}
+
+func serveModelsList(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/v1/models", http.NoBody))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	return w
+}
+
+func decodeModelIDs(t *testing.T, w *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	var modelList transform.ModelList
+	if err := json.NewDecoder(w.Body).Decode(&modelList); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	ids := make(map[string]string, len(modelList.Data))
+	for _, m := range modelList.Data {
+		ids[m.ID] = m.OwnedBy
+	}
+	return ids
+}
+
+func TestModelsServiceHandler_FallbackTiers(t *testing.T) {
+	modelsDevOK := func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"github-copilot":{"id":"github-copilot","models":{"from-models-dev":{"id":"from-models-dev","name":"GPT dev"}}}}`))
+	}
+	modelsDevMissingProvider := func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"openai":{"id":"openai","models":{}}}`))
+	}
+	modelsDevDown := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	copilotOK := func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-copilot-token" {
+			t.Errorf("Expected Copilot token in Authorization header, got %q", got)
+		}
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"from-copilot","name":"Claude","vendor":"Anthropic"}]}`))
+	}
+	copilotDown := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	tests := []struct {
+		name          string
+		modelsDev     http.HandlerFunc
+		copilot       http.HandlerFunc
+		token         string
+		expectedModel string
+		expectedOwner string
+		copilotCalls  int
+	}{
+		{"models.dev succeeds", modelsDevOK, copilotOK, "test-copilot-token", "from-models-dev", "openai", 0},
+		{"missing provider falls back to Copilot API", modelsDevMissingProvider, copilotOK, "test-copilot-token", "from-copilot", "anthropic", 1},
+		{"models.dev down falls back to Copilot API", modelsDevDown, copilotOK, "test-copilot-token", "from-copilot", "anthropic", 1},
+		{"both down falls back to defaults", modelsDevDown, copilotDown, "test-copilot-token", "gpt-4o", "openai", 1},
+		{"no token skips Copilot API", modelsDevDown, copilotOK, "", "gpt-4o", "openai", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _, copilotCalls := newModelsStub(t, tt.modelsDev, tt.copilot)
+			cfg := createProxyTestConfig()
+			cfg.CopilotToken = tt.token
+
+			service := internal.NewModelsService(NewMockCoalescingCache(), newUpstreamClient(t, srv), internal.WithModelsConfig(cfg))
+			ids := decodeModelIDs(t, serveModelsList(t, service.Handler()))
+
+			owner, ok := ids[tt.expectedModel]
+			if !ok {
+				t.Fatalf("Expected model %q in response, got %v", tt.expectedModel, ids)
+			}
+			if owner != tt.expectedOwner {
+				t.Errorf("Expected owner %q for %q, got %q", tt.expectedOwner, tt.expectedModel, owner)
+			}
+			if *copilotCalls != tt.copilotCalls {
+				t.Errorf("Expected %d Copilot API calls, got %d", tt.copilotCalls, *copilotCalls)
+			}
+		})
+	}
+}
+
+func TestModelsServiceHandler_CachesFallbackResult(t *testing.T) {
+	srv, modelsDevCalls, copilotCalls := newModelsStub(t,
+		func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusBadGateway) },
+		func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(`{"data":[{"id":"from-copilot","vendor":"OpenAI"}]}`))
+		})
+
+	service := internal.NewModelsService(NewMockCoalescingCache(), newUpstreamClient(t, srv), internal.WithModelsConfig(createProxyTestConfig()))
+	handler := service.Handler()
+
+	for i := 0; i < 3; i++ {
+		if ids := decodeModelIDs(t, serveModelsList(t, handler)); ids["from-copilot"] == "" {
+			t.Fatalf("Request %d: expected cached Copilot API models, got %v", i, ids)
+		}
+	}
+	// The 502 from models.dev is retried once within the single load
+	if *modelsDevCalls != 2 || *copilotCalls != 1 {
+		t.Errorf("Expected a single load per tier, got models.dev=%d copilot=%d", *modelsDevCalls, *copilotCalls)
+	}
+}
+
+func TestModelsServiceHandler_StableOrder(t *testing.T) {
+	srv, _, _ := newModelsStub(t,
+		func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(`{"github-copilot":{"id":"github-copilot","models":{
+				"gpt-4o":{"id":"gpt-4o","name":"GPT-4o"},
+				"claude-sonnet-4":{"id":"claude-sonnet-4","name":"Claude Sonnet 4"},
+				"o3-mini":{"id":"o3-mini","name":"o3-mini"},
+				"gemini-2.5-pro":{"id":"gemini-2.5-pro","name":"Gemini 2.5 Pro"},
+				"gpt-4.1":{"id":"gpt-4.1","name":"GPT-4.1"}}}}`))
+		},
+		func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNotFound) })
+
+	expected := []string{"claude-sonnet-4", "gemini-2.5-pro", "gpt-4.1", "gpt-4o", "o3-mini"}
+	// A new service per request, so every listing is a fresh load rather than the cache
+	for i := 0; i < 10; i++ {
+		service := internal.NewModelsService(NewMockCoalescingCache(), newUpstreamClient(t, srv))
+		var modelList transform.ModelList
+		if err := json.NewDecoder(serveModelsList(t, service.Handler()).Body).Decode(&modelList); err != nil {
+			t.Fatalf("Failed to decode models: %v", err)
+		}
+		ids := make([]string, 0, len(modelList.Data))
+		for _, model := range modelList.Data {
+			ids = append(ids, model.ID)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Fatalf("Request %d: expected models in order %v, got %v", i, expected, ids)
+		}
+	}
+}
+
+func TestModelsServiceCacheExpiry(t *testing.T) {
+	served := atomic.Int32{}
+	srv, modelsDevCalls, _ := newModelsStub(t,
+		func(w http.ResponseWriter, _ *http.Request) {
+			id := "gpt-4o"
+			if served.Add(1) > 1 {
+				id = "gpt-5"
+			}
+			_, _ = w.Write([]byte(`{"github-copilot":{"id":"github-copilot","models":{"` + id + `":{"id":"` + id + `","name":"GPT"}}}}`))
+		},
+		func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNotFound) })
+
+	newService := func(t *testing.T, cfg *internal.Config) (*internal.ModelsService, *fakeClock) {
+		t.Helper()
+		served.Store(0)
+		*modelsDevCalls = 0
+		clock := &fakeClock{now: time.Unix(1700000000, 0)}
+		service := internal.NewModelsService(NewMockCoalescingCache(), newUpstreamClient(t, srv),
+			internal.WithModelsConfig(cfg), internal.WithModelsClock(clock))
+		if ids := decodeModelIDs(t, serveModelsList(t, service.Handler())); ids["gpt-4o"] == "" {
+			t.Fatalf("Expected the first load to list gpt-4o, got %v", ids)
+		}
+		return service, clock
+	}
+
+	t.Run("TTL expiry triggers a refetch", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.ModelsCacheTTL = 60
+		service, clock := newService(t, cfg)
+
+		clock.After(59 * time.Second)
+		if ids := decodeModelIDs(t, serveModelsList(t, service.Handler())); ids["gpt-4o"] == "" || *modelsDevCalls != 1 {
+			t.Fatalf("Expected the cached list before the TTL, got %v after %d loads", ids, *modelsDevCalls)
+		}
+		clock.After(2 * time.Second)
+		if ids := decodeModelIDs(t, serveModelsList(t, service.Handler())); ids["gpt-5"] == "" || *modelsDevCalls != 2 {
+			t.Errorf("Expected a reload after the TTL, got %v after %d loads", ids, *modelsDevCalls)
+		}
+	})
+
+	t.Run("refresh forces a refetch", func(t *testing.T) {
+		service, _ := newService(t, createProxyTestConfig())
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/models/refresh", http.NoBody)
+		req.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		service.RefreshHandler()(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if ids := decodeModelIDs(t, w); ids["gpt-5"] == "" {
+			t.Errorf("Expected the refreshed list in the response, got %v", ids)
+		}
+		if ids := decodeModelIDs(t, serveModelsList(t, service.Handler())); ids["gpt-5"] == "" || *modelsDevCalls != 2 {
+			t.Errorf("Expected the refreshed list to be served, got %v after %d loads", ids, *modelsDevCalls)
+		}
+	})
+
+	t.Run("refresh is protected", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.APIKey = "secret"
+		service, _ := newService(t, cfg)
+
+		tests := []struct {
+			name   string
+			method string
+			key    string
+			status int
+		}{
+			{"missing key", http.MethodPost, "", http.StatusUnauthorized},
+			{"wrong method", http.MethodGet, "secret", http.StatusMethodNotAllowed},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest(tt.method, "/admin/models/refresh", http.NoBody)
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			w := httptest.NewRecorder()
+			service.RefreshHandler()(w, req)
+			if w.Code != tt.status {
+				t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, w.Code)
+			}
+		}
+		if *modelsDevCalls != 1 {
+			t.Errorf("Expected rejected refreshes not to reload, got %d loads", *modelsDevCalls)
+		}
+	})
+}
+
+func TestEndpointTimeouts(t *testing.T) {
+	// slow answers after delay, or gives up when the request is canceled first
+	slow := func(delay time.Duration, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// Cancellation is only noticed once the body has been read
+			_, _ = io.Copy(io.Discard, r.Body)
+			select {
+			case <-time.After(delay):
+				_, _ = w.Write([]byte(body))
+			case <-r.Context().Done():
+			}
+		}
+	}
+
+	t.Run("models times out at its own deadline", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				slow(5*time.Second, `{}`)(w, r)
+				return
+			}
+			_, _ = w.Write([]byte(`{"github-copilot":{"id":"github-copilot","models":{"from-models-dev":{"id":"from-models-dev"}}}}`))
+		}))
+		defer srv.Close()
+		cfg := createProxyTestConfig()
+		cfg.CopilotToken = ""
+		cfg.Timeouts.Models = 1
+		service := internal.NewModelsService(internal.NewCoalescingCache(), newUpstreamClient(t, srv), internal.WithModelsConfig(cfg))
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		service.Handler()(w, httptest.NewRequest(http.MethodGet, "/v1/models", http.NoBody))
+		elapsed := time.Since(start)
+
+		if w.Code != http.StatusRequestTimeout {
+			t.Errorf("Expected status 408, got %d: %s", w.Code, w.Body.String())
+		}
+		if elapsed < time.Second || elapsed > 3*time.Second {
+			t.Errorf("Expected the load to stop at the 1s models deadline, took %v", elapsed)
+		}
+
+		// A timed-out load is not cached
+		if ids := decodeModelIDs(t, serveModelsList(t, service.Handler())); ids["from-models-dev"] == "" {
+			t.Errorf("Expected the next request to load models again, got %v", ids)
+		}
+	})
+
+	t.Run("chat uses its own deadline", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			chat       int
+			delay      time.Duration
+			wantStatus int
+		}{
+			{name: "short models timeout leaves chat alone", delay: 1200 * time.Millisecond, wantStatus: http.StatusOK},
+			{name: "chat timeout applies", chat: 1, delay: 5 * time.Second, wantStatus: http.StatusRequestTimeout},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				upstream := httptest.NewServer(slow(tt.delay, `{"id":"1"}`))
+				defer upstream.Close()
+
+				cfg := createProxyTestConfig()
+				cfg.Timeouts.Models = 1
+				cfg.Timeouts.Chat = tt.chat
+				proxy := newTestProxyService(t, cfg, upstream)
+
+				start := time.Now()
+				w := httptest.NewRecorder()
+				proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody)))
+				if w.Code != tt.wantStatus {
+					t.Errorf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+				}
+				if elapsed := time.Since(start); elapsed > 3*time.Second {
+					t.Errorf("Expected the request to finish within its deadline, took %v", elapsed)
+				}
+			})
+		}
+	})
+}
+
+func TestNormalizeModel(t *testing.T) {
+	configured := map[string]string{"my-fast-model": "o4-mini", "gpt-4": "gpt-4.1"}
+
+	tests := []struct {
+		name     string
+		model    string
+		aliases  map[string]string
+		expected string
+	}{
+		{name: "built-in alias", model: "gpt-4", expected: "gpt-4o"},
+		{name: "configured alias", model: "my-fast-model", aliases: configured, expected: "o4-mini"},
+		{name: "configured alias overrides built-in", model: "gpt-4", aliases: configured, expected: "gpt-4.1"},
+		{name: "vendor prefix stripped", model: "openai/gpt-4.1", expected: "gpt-4.1"},
+		{name: "vendor prefix stripped then aliased", model: "anthropic/claude-3-5-sonnet", expected: "claude-3.5-sonnet"},
+		{name: "unknown model passes through", model: "some-new-model", expected: "some-new-model"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := internal.NormalizeModel(tt.model, tt.aliases); got != tt.expected {
+				t.Errorf("NormalizeModel(%q) = %q, want %q", tt.model, got, tt.expected)
+			}
+		})
+	}
+}
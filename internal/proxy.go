@@ -4,23 +4,31 @@ package internal
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
 )
 
 const (
-	copilotAPIBase      = "https://api.githubcopilot.com"
-	chatCompletionsPath = "/chat/completions"
+	copilotAPIBase       = "https://api.githubcopilot.com"
+	chatCompletionsPath  = "/chat/completions"
+	chatCompletionsRoute = "/v1/chat/completions"
 
 	// Retry configuration for chat completions
-	maxChatRetries     = 3
 	baseChatRetryDelay = 1 // seconds
 
 	// Circuit breaker configuration
@@ -28,14 +36,86 @@ const (
 
 	// Request configuration
 	maxRequestBodySize  = 5 * 1024 * 1024 // 5MB
-	streamingBufferSize = 1024
+	streamingBufferSize = 1024            // default for proxy.stream_buffer_size
+	minStreamBufferSize = 256
+	maxStreamBufferSize = 1024 * 1024
+	copyBufferSize      = 32 * 1024 // default for proxy.copy_buffer_size
+	minCopyBufferSize   = 1024
+	maxCopyBufferSize   = 1024 * 1024
+
+	// Upstream Accept-Encoding policies for proxy.accept_encoding
+	acceptEncodingAuto     = "auto"     // gzip for regular responses, identity for streams
+	acceptEncodingGzip     = "gzip"     // transport negotiates gzip and decompresses
+	acceptEncodingIdentity = "identity" // never compressed
+
+	// Responses above this size are logged as warnings unless metrics.large_response_bytes is set
+	defaultLargeResponseBytes = 1024 * 1024 // 1MB
 
 	// Status code ranges
 	statusCodeServerError     = 500
 	statusCodeTooManyRequests = 429
 	statusCodeRequestTimeout  = 408
+
+	// Client header used to select the upstream Openai-Intent
+	copilotIntentHeader = "X-Copilot-Intent"
+
+	// Client header replacing the request's model, e.g. for A/B tests behind a fixed client
+	overrideModelHeader = "X-Override-Model"
+
+	// Client header used to override the proxy context timeout for a single request
+	upstreamTimeoutHeader = "X-Upstream-Timeout-Seconds"
+
+	// Correlates a client request with server logs; generated when absent
+	requestIDHeader = "X-Request-ID"
 )
 
+// hopByHopHeaders are connection-specific headers that a proxy must not forward (RFC 7230)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// hopByHopHeaderSet returns the hop-by-hop headers of h: the fixed set plus any header
+// its Connection header names
+func hopByHopHeaderSet(h http.Header) map[string]bool {
+	set := make(map[string]bool, len(hopByHopHeaders))
+	for _, key := range hopByHopHeaders {
+		set[key] = true
+	}
+	for _, value := range h.Values("Connection") {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				set[http.CanonicalHeaderKey(key)] = true
+			}
+		}
+	}
+	return set
+}
+
+// defaultDeniedRequestHeaders are never forwarded, whatever request_headers.deny adds:
+// client credentials stay local, and the upstream encoding is negotiated by the
+// transport per proxy.accept_encoding
+var defaultDeniedRequestHeaders = []string{"Authorization", "Cookie", "X-Api-Key", "Accept-Encoding"}
+
+// defaultDeniedResponseHeaders are always dropped from upstream responses, whatever
+// response_headers.deny adds: upstream cookies must not reach clients
+var defaultDeniedResponseHeaders = []string{"Set-Cookie"}
+
+// knownOpenaiIntents lists the Openai-Intent values accepted from clients
+var knownOpenaiIntents = map[string]bool{
+	"conversation-panel":  true,
+	"conversation-inline": true,
+	"conversation-edits":  true,
+	"conversation-agent":  true,
+	"conversation-other":  true,
+}
+
 const (
 	// ProxyCBStateClosed indicates the circuit breaker is closed.
 	ProxyCBStateClosed = 0
@@ -53,7 +133,7 @@ const (
 	CircuitClosed CircuitBreakerState = iota
 	// CircuitOpen rejects all requests
 	CircuitOpen
-	// CircuitHalfOpen allows limited requests through
+	// CircuitHalfOpen allows a single trial request through
 	CircuitHalfOpen
 )
 
@@ -64,6 +144,14 @@ type CircuitBreaker struct {
 	state           CircuitBreakerState
 	timeout         time.Duration
 	mutex           sync.RWMutex
+
+	// disabled admits every request; failures are still counted for State
+	disabled bool
+
+	// probing is set while the half-open trial request is in flight; probeID
+	// identifies it so a stale release cannot free a newer probe's slot
+	probing bool
+	probeID uint64
 }
 
 // CoalescingCache handles request coalescing for identical requests with TTL
@@ -81,12 +169,41 @@ type cacheEntry struct {
 
 // ProxyService provides proxy functionality
 type ProxyService struct {
-	config         *Config
-	httpClient     *http.Client
-	authService    *AuthService
-	workerPool     WorkerPoolInterface
-	circuitBreaker *CircuitBreaker
-	bufferPool     *sync.Pool
+	config          *Config
+	httpClient      *http.Client
+	authService     *AuthService
+	workerPool      WorkerPoolInterface
+	circuitBreakers *circuitBreakerSet
+	bufferPool      *sync.Pool
+
+	// upstreamSlots is a counting semaphore limiting concurrent upstream requests;
+	// nil when unlimited
+	upstreamSlots    chan struct{}
+	upstreamInFlight atomic.Int64
+
+	// streamSlots caps concurrent streaming requests, which hold a worker for their
+	// whole duration, so short requests keep flowing; nil when unlimited
+	streamSlots   chan struct{}
+	activeStreams atomic.Int64
+
+	// responseCache stores deterministic completions; nil unless enabled
+	responseCache *ResponseCache
+
+	// idempotency replays results for repeated Idempotency-Keys; nil unless enabled
+	idempotency *IdempotencyStore
+
+	// rateLimiter enforces rate_limit per client; nil unless enabled
+	rateLimiter *RateLimiter
+
+	// usage counts requests and tokens for the stats command; nil unless stats.enabled
+	usage *UsageRecorder
+
+	// seats rotates chat requests across several Copilot seats; nil with a single token
+	seats *SeatPool
+
+	// Body sizes of proxied chat requests and responses
+	requestBytes  *Histogram
+	responseBytes *Histogram
 }
 
 // WorkerPoolInterface interface for background processing
@@ -94,6 +211,12 @@ type WorkerPoolInterface interface {
 	Submit(job func())
 }
 
+// contextSubmitter is implemented by worker pools whose Submit can give up waiting for
+// room in a full queue
+type contextSubmitter interface {
+	SubmitContext(ctx context.Context, job func()) error
+}
+
 // responseWrapper tracks if headers have been sent
 type responseWrapper struct {
 	http.ResponseWriter
@@ -115,21 +238,34 @@ func NewCoalescingCache() *CoalescingCache {
 
 // GetRequestKey generates a cache key for request coalescing
 func (cc *CoalescingCache) GetRequestKey(method, url string, body interface{}) string {
+	bodyBytes, _ := body.([]byte)
+	return requestKey(method, url, bodyBytes)
+}
+
+// requestKey returns the SHA-256 of method, URL and body as a hex string
+func requestKey(method, url string, body []byte) string {
 	h := sha256.New()
 	h.Write([]byte(method))
 	h.Write([]byte(url))
-	if body != nil {
-		if bodyBytes, ok := body.([]byte); ok {
-			h.Write(bodyBytes)
-		}
-	}
+	h.Write(body)
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// CoalesceRequest executes a function only once for identical concurrent requests with caching
+// CoalesceRequest executes a function only once for identical concurrent requests with
+// caching; a result that is an error is shared with waiting requests but not cached
 func (cc *CoalescingCache) CoalesceRequest(key string, fn func() interface{}) interface{} {
 	cc.mutex.Lock()
 
+	// Check if request is already in progress
+	if entry, exists := cc.requests[key]; exists && entry.waiting != nil {
+		waiting := entry.waiting
+		cc.mutex.Unlock()
+		// Wait for the existing request to complete; only one waiter receives the
+		// value, the rest see the channel closed, so all read the stored result
+		<-waiting
+		return entry.result
+	}
+
 	// Check if we have a cached result that's still valid
 	if entry, exists := cc.requests[key]; exists {
 		if time.Since(entry.timestamp) < cc.ttl {
@@ -140,13 +276,6 @@ func (cc *CoalescingCache) CoalesceRequest(key string, fn func() interface{}) in
 		delete(cc.requests, key)
 	}
 
-	// Check if request is already in progress
-	if entry, exists := cc.requests[key]; exists && entry.waiting != nil {
-		cc.mutex.Unlock()
-		// Wait for the existing request to complete
-		return <-entry.waiting
-	}
-
 	// Create new entry for this request
 	entry := &cacheEntry{
 		waiting:   make(chan interface{}, 1),
@@ -166,6 +295,16 @@ func (cc *CoalescingCache) CoalesceRequest(key string, fn func() interface{}) in
 	entry.waiting <- result
 	close(entry.waiting)
 
+	// Errors go to the requests that waited for them but are not cached
+	if _, failed := result.(error); failed {
+		cc.mutex.Lock()
+		if cc.requests[key] == entry {
+			delete(cc.requests, key)
+		}
+		cc.mutex.Unlock()
+		return result
+	}
+
 	// Clean up the waiting channel after a short delay
 	go func() {
 		time.Sleep(100 * time.Millisecond)
@@ -198,52 +337,232 @@ func (cc *CoalescingCache) cleanup() {
 
 // NewProxyService creates a new proxy service
 func NewProxyService(cfg *Config, httpClient *http.Client, authService *AuthService, workerPool WorkerPoolInterface) *ProxyService {
-	circuitBreaker := &CircuitBreaker{
-		state:   CircuitClosed,
-		timeout: time.Duration(cfg.Timeouts.CircuitBreaker) * time.Second,
+	circuitBreakers := newCircuitBreakerSet(time.Duration(cfg.Timeouts.CircuitBreaker)*time.Second, cfg.Debug.DisableCircuitBreaker)
+	if circuitBreakers.disabled {
+		Warn("Circuit breaker DISABLED: every request reaches the upstream, even while it is failing. Use for debugging only")
 	}
 
+	// Copy buffers for regular responses, sized once at startup
+	bufferSize := copyBufferSize
+	if cfg.Proxy.CopyBufferSize > 0 {
+		bufferSize = cfg.Proxy.CopyBufferSize
+	}
 	bufferPool := &sync.Pool{
 		New: func() interface{} {
-			return new(bytes.Buffer)
+			buf := make([]byte, bufferSize)
+			return &buf
 		},
 	}
 
+	var upstreamSlots chan struct{}
+	if cfg.MaxConcurrentUpstream > 0 {
+		upstreamSlots = make(chan struct{}, cfg.MaxConcurrentUpstream)
+	}
+
+	var streamSlots chan struct{}
+	if cfg.MaxConcurrentStreams > 0 {
+		streamSlots = make(chan struct{}, cfg.MaxConcurrentStreams)
+	}
+
+	var responseCache *ResponseCache
+	if cfg.ResponseCache.Enabled {
+		responseCache = NewResponseCache(cfg.ResponseCache.MaxEntries, time.Duration(cfg.ResponseCache.TTL)*time.Second)
+	}
+
+	var idempotency *IdempotencyStore
+	if cfg.Idempotency.Enabled {
+		idempotency = NewIdempotencyStore(cfg.Idempotency.MaxEntries, time.Duration(cfg.Idempotency.Window)*time.Second)
+	}
+
+	var rateLimiter *RateLimiter
+	if cfg.RateLimit.RequestsPerMinute > 0 {
+		rateLimiter = NewRateLimiter(cfg.RateLimit.RequestsPerMinute, cfg.RateLimit.Burst)
+	}
+
 	return &ProxyService{
-		config:         cfg,
-		httpClient:     httpClient,
-		authService:    authService,
-		workerPool:     workerPool,
-		circuitBreaker: circuitBreaker,
-		bufferPool:     bufferPool,
+		config:          cfg,
+		httpClient:      httpClient,
+		authService:     authService,
+		workerPool:      workerPool,
+		circuitBreakers: circuitBreakers,
+		bufferPool:      bufferPool,
+		upstreamSlots:   upstreamSlots,
+		streamSlots:     streamSlots,
+		responseCache:   responseCache,
+		idempotency:     idempotency,
+		rateLimiter:     rateLimiter,
+		seats:           NewSeatPool(cfg, httpClient, authService),
+		requestBytes:    NewHistogram(sizeBuckets),
+		responseBytes:   NewHistogram(sizeBuckets),
 	}
 }
 
+// UpstreamInFlight returns the number of upstream requests currently in progress
+func (s *ProxyService) UpstreamInFlight() int64 {
+	return s.upstreamInFlight.Load()
+}
+
+// ActiveStreams returns the number of streaming requests currently in progress
+func (s *ProxyService) ActiveStreams() int64 {
+	return s.activeStreams.Load()
+}
+
+// RequestBytes returns the histogram of proxied request body sizes
+func (s *ProxyService) RequestBytes() HistogramSnapshot {
+	return s.requestBytes.Snapshot()
+}
+
+// ResponseBytes returns the histogram of proxied response body sizes
+func (s *ProxyService) ResponseBytes() HistogramSnapshot {
+	return s.responseBytes.Snapshot()
+}
+
+// CircuitState returns the aggregate state of the upstream circuit breakers
+func (s *ProxyService) CircuitState() CircuitBreakerState {
+	return s.circuitBreakers.State()
+}
+
+// WorstCircuitState returns the most severe state of any model group's circuit breaker
+func (s *ProxyService) WorstCircuitState() CircuitBreakerState {
+	return s.circuitBreakers.Worst()
+}
+
+// CircuitStates returns the state of each model group's circuit breaker
+func (s *ProxyService) CircuitStates() map[string]CircuitBreakerState {
+	return s.circuitBreakers.States()
+}
+
+// queueWaitTimeout returns how long a request may wait for a worker; zero is unbounded
+func (s *ProxyService) queueWaitTimeout() time.Duration {
+	return time.Duration(s.config.Live().Timeouts.QueueWait) * time.Second
+}
+
+// submitJob hands job to the worker pool, giving up once ctx is done if the pool
+// supports it. It reports whether the job was queued.
+func (s *ProxyService) submitJob(ctx context.Context, job func()) bool {
+	if pool, ok := s.workerPool.(contextSubmitter); ok {
+		return pool.SubmitContext(ctx, job) == nil
+	}
+	s.workerPool.Submit(job)
+	return true
+}
+
+// acquireUpstream takes an upstream slot, waiting up to the configured acquire timeout.
+// The returned function releases the slot.
+func (s *ProxyService) acquireUpstream(ctx context.Context) (func(), error) {
+	release := func() { s.upstreamInFlight.Add(-1) }
+	if s.upstreamSlots == nil {
+		s.upstreamInFlight.Add(1)
+		return release, nil
+	}
+
+	wait := time.Duration(s.config.Live().Timeouts.UpstreamAcquire) * time.Second
+	if wait <= 0 {
+		wait = defaultUpstreamAcquire * time.Second
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case s.upstreamSlots <- struct{}{}:
+		s.upstreamInFlight.Add(1)
+		return func() {
+			release()
+			<-s.upstreamSlots
+		}, nil
+	case <-timer.C:
+		Warn("Upstream concurrency limit reached", "limit", cap(s.upstreamSlots), "waited", wait)
+		return nil, fmt.Errorf("%w after waiting %s", errUpstreamLimit, wait)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireStream claims a streaming slot without waiting: when the limit is reached the
+// request fails fast with errStreamLimit. The returned function releases the slot.
+func (s *ProxyService) acquireStream() (func(), error) {
+	if s.streamSlots != nil {
+		select {
+		case s.streamSlots <- struct{}{}:
+		default:
+			Warn("Streaming limit reached", "limit", cap(s.streamSlots))
+			return nil, errStreamLimit
+		}
+	}
+	s.activeStreams.Add(1)
+	return func() {
+		s.activeStreams.Add(-1)
+		if s.streamSlots != nil {
+			<-s.streamSlots
+		}
+	}, nil
+}
+
+// isStreamingRequest reports whether a chat request asks for a streamed response
+func isStreamingRequest(body []byte) bool {
+	var req struct {
+		Stream bool `json:"stream"`
+	}
+	return json.Unmarshal(body, &req) == nil && req.Stream
+}
+
 // Handler returns an HTTP handler for the proxy endpoint
 func (s *ProxyService) Handler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if s.handlePreflight(w, r) {
+			return
+		}
+
 		// Create context with extended timeout for long-lived streaming responses
-		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(s.config.Timeouts.ProxyContext)*time.Second)
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout(r))
 		defer cancel()
 
-		// Check circuit breaker
-		if !s.circuitBreaker.canExecute() {
-			Warn("Circuit breaker is open, rejecting request")
-			http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		// Limit request body size
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+
+		upstreamPath, req, err := s.readProxyRequest(r)
+		if err != nil {
+			Error("Rejected proxy request", "error", err)
+			writeProxyError(w, r, err)
 			return
 		}
 
-		// Limit request body size
-		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		// Check the breaker before taking a worker, so an open circuit fails fast even
+		// when the pool is busy. The probe is held until the worker is done.
+		group := s.breakerGroup(r, req)
+		breaker := s.circuitBreakers.get(group)
+		allowed, probe := breaker.canExecute()
+		if !allowed {
+			Warn("Circuit breaker is open, rejecting request", "group", group)
+			writeProxyError(w, r, errCircuitOpen)
+			return
+		}
+		defer breaker.endProbe(probe)
 
 		// Use a response wrapper to track if headers have been sent
 		respWrapper := &responseWrapper{ResponseWriter: w, headersSent: false}
 
-		// Create a done channel to track completion
+		// Create a done channel to track completion; started is claimed by the worker
+		// that picks the job up, or by the handler when it gives up on the queue
 		done := make(chan error, 1)
+		var started atomic.Bool
+		picked := make(chan struct{})
+
+		// Bound the wait for a worker when timeouts.queue_wait is set
+		var queueExpired <-chan struct{}
+		submitCtx := ctx
+		if queueWait := s.queueWaitTimeout(); queueWait > 0 {
+			queueCtx, cancelQueue := context.WithTimeout(ctx, queueWait)
+			defer cancelQueue()
+			queueExpired, submitCtx = queueCtx.Done(), queueCtx
+		}
 
 		// Submit request to worker pool
-		s.workerPool.Submit(func() {
+		submitted := s.submitJob(submitCtx, func() {
+			if !started.CompareAndSwap(false, true) {
+				return
+			}
+			close(picked)
 			defer func() {
 				if recovery := recover(); recovery != nil {
 					Error("Worker panic recovered", "panic", recovery)
@@ -251,9 +570,22 @@ func (s *ProxyService) Handler() http.HandlerFunc {
 				}
 			}()
 
-			err := s.processProxyRequest(ctx, respWrapper, r)
+			err := s.processProxyRequest(ctx, respWrapper, r, upstreamPath, req)
 			done <- err
 		})
+		if queueExpired != nil {
+			if submitted {
+				select {
+				case <-picked:
+				case <-queueExpired:
+				}
+			}
+			if ctx.Err() == nil && started.CompareAndSwap(false, true) {
+				Warn("Request not picked up by a worker in time", "queue_wait", s.queueWaitTimeout())
+				http.Error(w, "Service busy: no worker available", http.StatusServiceUnavailable)
+				return
+			}
+		}
 
 		// Wait for worker to complete or context timeout
 		select {
@@ -262,22 +594,16 @@ func (s *ProxyService) Handler() http.HandlerFunc {
 				Error("Worker error", "error", err)
 				// Only write error if headers haven't been sent
 				if !respWrapper.headersSent {
-					switch {
-					case strings.Contains(err.Error(), "authentication error"):
-						http.Error(w, err.Error(), http.StatusUnauthorized)
-					case strings.Contains(err.Error(), "token validation failed"):
-						http.Error(w, err.Error(), http.StatusUnauthorized)
-					case strings.Contains(err.Error(), "bad request"):
-						http.Error(w, err.Error(), http.StatusBadRequest)
-					case strings.Contains(err.Error(), "method not allowed"):
-						http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-					default:
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-					}
+					writeProxyError(w, r, err)
 				}
 			}
 		case <-ctx.Done():
 			Warn("Request timeout in worker pool")
+			// The upstream call shares ctx and is being aborted; wait for the worker so it
+			// never writes to the response after this handler returns
+			if !started.CompareAndSwap(false, true) {
+				<-done
+			}
 			// Only write timeout error if headers haven't been sent
 			if !respWrapper.headersSent {
 				http.Error(w, "Request timeout", http.StatusRequestTimeout)
@@ -286,6 +612,163 @@ func (s *ProxyService) Handler() http.HandlerFunc {
 	}
 }
 
+// writeProxyError answers a failed proxy request with the status matching err
+func writeProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		networkErr    *NetworkError
+		validationErr *ValidationError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Request timeout", http.StatusRequestTimeout)
+	case errors.Is(err, ErrNotEntitled):
+		WriteNotEntitledError(w)
+	case errors.Is(err, errNoUpstreamRoute):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errCircuitOpen):
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+	case errors.Is(err, errModelNotAllowed):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errUnsupportedMediaType):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, errRateLimited):
+		WriteRateLimitError(w)
+	case errors.Is(err, errStreamLimit), errors.Is(err, errUpstreamLimit):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errFirstByteTimeout):
+		Error("Upstream sent no response headers in time", "request_id", requestIDFor(r), "error", err)
+		WriteHTTPError(w, http.StatusGatewayTimeout, "upstream did not start responding in time")
+	case errors.As(err, &validationErr):
+		WriteRequestValidationError(w, validationErr)
+	case errors.As(err, &networkErr):
+		requestID := requestIDFor(r)
+		Error("Upstream network error", "request_id", requestID, "error", err)
+		w.Header().Set(requestIDHeader, requestID)
+		WriteUpstreamNetworkError(w, requestID, err)
+	case strings.Contains(err.Error(), "authentication error"):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case strings.Contains(err.Error(), "token validation failed"):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case strings.Contains(err.Error(), "bad request"):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case strings.Contains(err.Error(), "method not allowed"):
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var (
+	// errNoUpstreamRoute is returned for client paths without an upstream mapping
+	errNoUpstreamRoute = errors.New("no upstream route")
+	// errModelNotAllowed is returned for models outside allowed_models
+	errModelNotAllowed = errors.New("model not allowed")
+	// errUpstreamLimit is returned when no max_concurrent_upstream slot frees up within
+	// timeouts.upstream_acquire
+	errUpstreamLimit = errors.New("upstream concurrency limit reached")
+	// errStreamLimit is returned when max_concurrent_streams streams are already open
+	errStreamLimit = errors.New("streaming limit reached")
+	// errUnsupportedMediaType is returned for a Content-Type outside proxy.allowed_content_types
+	errUnsupportedMediaType = errors.New("unsupported media type")
+	// errFirstByteTimeout is returned when a streamed request gets no response headers
+	// within timeouts.first_byte
+	errFirstByteTimeout = errors.New("no upstream response headers before the first-byte deadline")
+)
+
+// defaultUpstreamRoutes maps client paths served by the buffered handler to Copilot API
+// paths; proxy.routes adds to and overrides these
+var defaultUpstreamRoutes = map[string]string{
+	chatCompletionsRoute: chatCompletionsPath,
+}
+
+// upstreamPath returns the Copilot API path for a client request path
+func (s *ProxyService) upstreamPath(route string) (string, bool) {
+	if path, ok := s.config.Proxy.Routes[route]; ok {
+		return path, true
+	}
+	path, ok := defaultUpstreamRoutes[route]
+	return path, ok
+}
+
+// requestIDFor returns the client's X-Request-ID or a new random ID
+func requestIDFor(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// handlePreflight answers a CORS preflight without touching the worker pool, the token or
+// the upstream. CORSMiddleware normally answers it first; this covers proxy handlers
+// mounted without the middleware.
+func (s *ProxyService) handlePreflight(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	s.setCORSHeaders(w.Header())
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// setCORSHeaders adds the configured CORS headers to h
+func (s *ProxyService) setCORSHeaders(h http.Header) {
+	cors := s.config.Live().CORS
+	if len(cors.AllowedOrigins) > 0 {
+		h.Set("Access-Control-Allow-Origin", strings.Join(cors.AllowedOrigins, ", "))
+	}
+	if len(cors.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+	}
+}
+
+// routeTimeout returns the deadline for requests to path: timeouts.chat or
+// timeouts.models when set for that endpoint, proxy_context otherwise
+func routeTimeout(cfg *Config, path string) time.Duration {
+	cfg = cfg.Live()
+	seconds := cfg.Timeouts.ProxyContext
+	switch {
+	case path == "/v1/chat/completions" && cfg.Timeouts.Chat > 0:
+		seconds = cfg.Timeouts.Chat
+	case path == "/v1/models" && cfg.Timeouts.Models > 0:
+		seconds = cfg.Timeouts.Models
+	}
+	if seconds <= 0 {
+		seconds = defaultProxyContextTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// requestTimeout returns the route's timeout, honoring a per-request override header
+// clamped to the configured maximum
+func (s *ProxyService) requestTimeout(r *http.Request) time.Duration {
+	timeout := routeTimeout(s.config, r.URL.Path)
+
+	value := r.Header.Get(upstreamTimeoutHeader)
+	if value == "" {
+		return timeout
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 1 {
+		Debug("Ignoring invalid upstream timeout override", "value", value)
+		return timeout
+	}
+
+	maxSeconds := s.config.Live().Timeouts.MaxProxyContext
+	if maxSeconds <= 0 {
+		maxSeconds = defaultMaxProxyContext
+	}
+	if seconds > maxSeconds {
+		Warn("Upstream timeout override exceeds maximum, clamping", "requested", seconds, "max", maxSeconds)
+		seconds = maxSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func (rw *responseWrapper) WriteHeader(statusCode int) {
 	if !rw.headersSent {
 		rw.headersSent = true
@@ -300,30 +783,63 @@ func (rw *responseWrapper) Write(data []byte) (int, error) {
 	return rw.ResponseWriter.Write(data)
 }
 
-func (cb *CircuitBreaker) canExecute() bool {
-	cb.mutex.RLock()
-	defer cb.mutex.RUnlock()
-
-	// No metrics to update for circuit breaker state changes
+// Flush forwards to the client connection so streamed chunks are not held back
+func (rw *responseWrapper) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
 
-	if cb.state == CircuitClosed {
-		return true
+// canExecute reports whether a request may reach the upstream. Once the open timeout
+// has passed, exactly one trial request is admitted until its outcome closes or
+// re-opens the circuit. The trial gets a non-zero probe ID, which the caller passes
+// to endProbe when the request finishes.
+func (cb *CircuitBreaker) canExecute() (bool, uint64) {
+	if cb.disabled {
+		return true, 0
 	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
 
-	if cb.state == CircuitOpen {
-		if time.Since(cb.lastFailureTime) > cb.timeout {
-			cb.mutex.RUnlock()
-			cb.mutex.Lock()
-			cb.state = CircuitHalfOpen
-			cb.mutex.Unlock()
-			cb.mutex.RLock()
-			return true
+	switch cb.state {
+	case CircuitClosed:
+		return true, 0
+	case CircuitOpen:
+		if time.Since(cb.lastFailureTime) <= cb.timeout {
+			return false, 0
 		}
-		return false
+		cb.state = CircuitHalfOpen
 	}
 
-	// CircuitHalfOpen
-	return true
+	// CircuitHalfOpen: fast-fail everything but the single probe
+	if cb.probing {
+		return false, 0
+	}
+	cb.probing = true
+	cb.probeID++
+	return true, cb.probeID
+}
+
+// endProbe frees the half-open slot if the probe finished without recording an
+// upstream outcome (e.g. an invalid request or a client cancellation), so the next
+// request can probe instead. It is a no-op for id 0 and for resolved probes.
+func (cb *CircuitBreaker) endProbe(id uint64) {
+	if id == 0 {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.probing && cb.probeID == id {
+		cb.probing = false
+	}
+}
+
+// State returns the current circuit breaker state
+func (cb *CircuitBreaker) State() CircuitBreakerState {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+	return cb.state
 }
 
 func (cb *CircuitBreaker) onSuccess() {
@@ -332,6 +848,7 @@ func (cb *CircuitBreaker) onSuccess() {
 
 	cb.failureCount = 0
 	cb.state = CircuitClosed
+	cb.probing = false
 }
 
 func (cb *CircuitBreaker) onFailure() {
@@ -340,18 +857,29 @@ func (cb *CircuitBreaker) onFailure() {
 
 	cb.failureCount++
 	cb.lastFailureTime = time.Now()
+	cb.probing = false
 
-	if cb.failureCount >= circuitBreakerFailureThreshold {
+	// A failed probe re-opens the circuit straight away
+	if cb.state == CircuitHalfOpen || cb.failureCount >= circuitBreakerFailureThreshold {
 		cb.state = CircuitOpen
 	}
 }
 
-func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	Debug("Starting proxy request", "method", r.Method, "path", r.URL.Path)
-
+// readProxyRequest checks the method, route and Content-Type of a proxy request and
+// reads and decodes its body, returning the upstream path
+func (s *ProxyService) readProxyRequest(r *http.Request) (string, *proxyRequest, error) {
 	// Validate method
 	if r.Method != http.MethodPost {
-		return fmt.Errorf("method not allowed: %s", r.Method)
+		return "", nil, fmt.Errorf("method not allowed: %s", r.Method)
+	}
+
+	upstreamPath, ok := s.upstreamPath(r.URL.Path)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", errNoUpstreamRoute, r.URL.Path)
+	}
+
+	if err := s.checkContentType(r); err != nil {
+		return "", nil, err
 	}
 
 	// Read the request body
@@ -360,69 +888,186 @@ func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseW
 		Error("Error reading request body", "error", err)
 		// Check for "http: request body too large" error and return 413
 		if strings.Contains(err.Error(), "http: request body too large") {
-			return fmt.Errorf("payload too large: %w", err)
+			return "", nil, fmt.Errorf("payload too large: %w", err)
 		}
-		return fmt.Errorf("bad request: failed to read request body: %w", err)
+		return "", nil, fmt.Errorf("bad request: failed to read request body: %w", err)
 	}
-	defer func() {
-		if err := r.Body.Close(); err != nil {
-			Warn("Error closing request body", "error", err)
+	if err := r.Body.Close(); err != nil {
+		Warn("Error closing request body", "error", err)
+	}
+
+	req, err := parseProxyRequest(body)
+	if err != nil {
+		return "", nil, err
+	}
+	return upstreamPath, req, nil
+}
+
+// breakerGroup returns the circuit breaker group of the model a request will be sent
+// with: X-Override-Model, else the body's model, else default_model
+func (s *ProxyService) breakerGroup(r *http.Request, req *proxyRequest) string {
+	model := strings.TrimSpace(r.Header.Get(overrideModelHeader))
+	if model == "" {
+		model = strings.TrimSpace(req.model())
+	}
+	if model == "" {
+		model = s.config.DefaultModel
+	}
+	return modelGroup(NormalizeModel(model, s.config.Live().ModelAliases))
+}
+
+func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, upstreamPath string, preq *proxyRequest) error {
+	Debug("Starting proxy request", "method", r.Method, "path", r.URL.Path)
+
+	// The job may have waited in the worker queue past the request deadline
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.requestBytes.Observe(float64(len(preq.raw)))
+
+	// Count response bytes, streamed or not, once the request is answered
+	counter := &countingResponseWriter{ResponseWriter: w}
+	w = counter
+	defer s.observeResponseSize(counter)
+
+	// Reject malformed chat requests before they cost an upstream call
+	if upstreamPath == chatCompletionsPath {
+		s.applyDefaultModel(r, preq)
+		if err := validateChatBody(r, preq); err != nil {
+			return err
 		}
-	}()
+		if err := s.enforceMaxMessages(preq); err != nil {
+			return err
+		}
+	}
 
-	// Basic body validation (for demonstration: consider empty body an error)
-	if len(body) == 0 {
-		return fmt.Errorf("bad request: empty request body")
+	if err := s.checkRateLimit(w, r, preq.stringField("user")); err != nil {
+		return err
 	}
 
-	// Strict JSON validation before authentication
-	var js json.RawMessage
-	if jsonErr := json.Unmarshal(body, &js); jsonErr != nil {
-		return fmt.Errorf("bad request: invalid JSON: %w", jsonErr)
+	s.captureRequest(r, preq.raw)
+
+	if err := s.resolveRequestModel(r, preq); err != nil {
+		return err
+	}
+	s.applySamplingDefaults(preq)
+	s.applyDefaultSystemPrompt(preq)
+	warnUnsupportedResponseFormat(preq)
+
+	// Every edit is in; the body is encoded once for the cache keys and the upstream
+	body := preq.bytes()
+	stream := preq.stream()
+
+	// Serve deterministic completions from the response cache when enabled
+	var cacheKey string
+	if s.responseCache != nil && isCacheableCompletion(preq) {
+		cacheKey = requestKey(r.Method, upstreamPath, body)
+		if entry, ok := s.responseCache.get(cacheKey); ok {
+			Debug("Serving completion from response cache")
+			return writeCachedResponse(w, entry)
+		}
+	}
+
+	// A retried request whose first attempt already completed gets that result
+	// instead of a second upstream completion
+	var recorder *recordingResponseWriter
+	idemKey := s.idempotencyKey(r, upstreamPath, body)
+	if idemKey != "" {
+		entry, release, err := s.idempotency.begin(ctx, idemKey)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			Debug("Replaying response for repeated idempotency key")
+			return writeIdempotentReplay(w, entry)
+		}
+		defer release()
+		recorder = &recordingResponseWriter{ResponseWriter: w}
+		w = recorder
+	}
+
+	// Count requests that go upstream; cached and replayed answers cost nothing
+	if s.usage != nil {
+		tap := &usageResponseWriter{ResponseWriter: w}
+		w = tap
+		// preq names the model that answered, which may be fallback_model
+		defer func() { s.usage.Record(preq.model(), tap.failed(), tap.usage()) }()
+	}
+
+	// Long-lived streams are capped separately from the worker pool
+	if stream {
+		releaseStream, err := s.acquireStream()
+		if err != nil {
+			return err
+		}
+		defer releaseStream()
 	}
 
 	// Ensure we have a valid token before making the request
-	if tokenErr := s.authService.EnsureValidToken(s.config); tokenErr != nil {
-		Error("Failed to ensure valid token", "error", tokenErr)
-		return NewAuthError("token validation failed", tokenErr)
+	current, token, err := s.acquireToken()
+	if err != nil {
+		return err
 	}
 
 	// Create new request to GitHub Copilot
-	targetURL := copilotAPIBase + chatCompletionsPath
+	targetURL := copilotAPIBase + upstreamPath
 	Debug("Sending request to target", "url", targetURL, "body_length", len(body))
 
 	// Debug: Log the request body for troubleshooting
 	if len(body) < 1000 { // Only log small requests to avoid flooding logs
-		Debug("Request body", "body", string(body))
+		Debug("Request body", "body", redactBody(body))
 	}
 
+	if s.config.Debug.TraceUpstream {
+		ctx = withUpstreamTracing(ctx, requestIDFor(r))
+	}
 	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, bytes.NewBuffer(body))
 	if err != nil {
 		Error("Error creating request", "error", err)
 		return NewProxyError("create_request", "failed to create proxy request", err)
 	}
 
-	// Set headers
-	req.Header.Set("Authorization", "Bearer "+s.config.CopilotToken)
+	// Set headers; the injected ones replace any forwarded client header of the same name
+	s.forwardRequestHeaders(req.Header, r.Header)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", s.config.Headers.UserAgent)
-	req.Header.Set("Editor-Version", s.config.Headers.EditorVersion)
-	req.Header.Set("Editor-Plugin-Version", s.config.Headers.EditorPluginVersion)
-	req.Header.Set("Copilot-Integration-Id", s.config.Headers.CopilotIntegrationID)
-	req.Header.Set("Openai-Intent", s.config.Headers.OpenaiIntent)
-	req.Header.Set("X-Initiator", s.config.Headers.XInitiator)
+	setUpstreamHeaders(req.Header, s.config, token, s.resolveIntent(r))
+	if s.upstreamIdentityEncoding(stream) {
+		// An explicit header also turns off the transport's transparent gzip, which
+		// would otherwise hold stream chunks in the decompressor
+		req.Header.Set("Accept-Encoding", acceptEncodingIdentity)
+	}
 
 	// Debug: Log the final headers being sent
-	authPrefix := s.config.CopilotToken
+	authPrefix := token
 	if len(authPrefix) > 10 {
 		authPrefix = authPrefix[:10] + "..."
 	}
-	Debug("Request headers", "authorization_prefix", authPrefix, "user_agent", s.config.Headers.UserAgent)
+	Debug("Request headers", "authorization_prefix", authPrefix, "user_agent", s.config.Live().Headers.UserAgent)
 
-	resp, err := s.makeRequestWithRetry(req, body)
+	releaseUpstream, err := s.acquireUpstream(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseUpstream()
+
+	// Time until the response headers, retries and fallback included; a non-streamed
+	// completion only sends them once it has been generated
+	upstreamStart := time.Now()
+	resp, err := s.makeRequestWithRetry(req, body, current)
+	var fallback string
+	if err == nil {
+		resp, fallback, err = s.fallbackOnUnavailableModel(req, preq, resp, current)
+		body = preq.bytes()
+	}
+	recordUpstreamTime(ctx, time.Since(upstreamStart))
 	if err != nil {
-		s.circuitBreaker.onFailure()
+		if ctx.Err() != nil {
+			// Canceled or timed out locally; not an upstream failure
+			Debug("Upstream request canceled", "error", err)
+			return ctx.Err()
+		}
+		s.circuitBreakers.get(modelGroup(preq.model())).onFailure()
 		Error("Error making request after retries", "error", err)
 		return NewNetworkError("proxy_request", targetURL, "failed to complete request after retries", err)
 	}
@@ -432,11 +1077,13 @@ func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseW
 		}
 	}()
 
-	// Update circuit breaker based on response
+	// Each model group has its own breaker, so one failing backend leaves the others up.
+	// The outcome counts against the model that answered, which may be fallback_model.
+	breaker := s.circuitBreakers.get(modelGroup(preq.model()))
 	if resp.StatusCode < statusCodeServerError {
-		s.circuitBreaker.onSuccess()
+		breaker.onSuccess()
 	} else {
-		s.circuitBreaker.onFailure()
+		breaker.onFailure()
 	}
 
 	Debug("Received response", "status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"))
@@ -449,10 +1096,14 @@ func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseW
 			resp.Body = io.NopCloser(bytes.NewBuffer(errorRespBody))
 			// Only log small error responses to avoid flooding logs
 			if len(errorRespBody) < 500 {
-				Debug("Error response body", "status", resp.StatusCode, "body", string(errorRespBody))
+				Debug("Error response body", "status", resp.StatusCode, "body", redactBody(errorRespBody))
 			} else {
 				Debug("Error response body", "status", resp.StatusCode, "body_length", len(errorRespBody))
 			}
+			if resp.StatusCode == http.StatusForbidden && isNotEntitledBody(errorRespBody) {
+				Error("Copilot API rejected the account", "error", notEntitledMessage)
+				return newNotEntitledError(resp.StatusCode)
+			}
 		} else {
 			// If reading failed, try to put the original body back (though it might be consumed)
 			// This is best effort since we can't recreate the original body
@@ -460,37 +1111,420 @@ func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseW
 		}
 	}
 
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+	// Models that cannot stream may answer a streamed request with one JSON completion
+	var transcoded []byte
+	if needsStreamTranscoding(upstreamPath, stream, resp) {
+		if transcoded, err = transcodeToStream(resp, includeStreamUsage(preq)); err != nil {
+			Error("Error reading non-streamed response", "error", err)
+			return NewNetworkError("proxy_request", targetURL, "failed to read upstream response", err)
 		}
 	}
 
+	// Copy response headers, dropping hop-by-hop and denied headers
+	s.copyResponseHeaders(w.Header(), resp.Header)
+	if transcoded != nil {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Del("Content-Length")
+	}
+
 	// Add configurable CORS headers
-	if len(s.config.CORS.AllowedOrigins) > 0 {
-		w.Header().Set("Access-Control-Allow-Origin", strings.Join(s.config.CORS.AllowedOrigins, ", "))
+	s.setCORSHeaders(w.Header())
+
+	if fallback != "" {
+		w.Header().Set(fallbackModelHeader, fallback)
 	}
-	if len(s.config.CORS.AllowedHeaders) > 0 {
-		w.Header().Set("Access-Control-Allow-Headers", strings.Join(s.config.CORS.AllowedHeaders, ", "))
+	if cacheKey != "" {
+		w.Header().Set(responseCacheHeader, "MISS")
 	}
 
 	// Copy status code
 	w.WriteHeader(resp.StatusCode)
 
+	if transcoded != nil {
+		if _, err := w.Write(transcoded); err != nil {
+			Error("Error writing converted stream", "error", err)
+			return err
+		}
+	} else if s.streamReconnects() > 0 && upstreamPath == chatCompletionsPath && resp.StatusCode == http.StatusOK && isEventStream(resp.Header.Get("Content-Type")) {
+		if err := s.handleReconnectingStream(w, req, body, current, resp); err != nil {
+			return err
+		}
+	} else if err := s.writeResponseBody(w, resp, cacheKey); err != nil {
+		return err
+	}
+
+	if recorder != nil && recorder.status >= http.StatusOK && recorder.status < http.StatusMultipleChoices {
+		header := recorder.Header().Clone()
+		header.Del(responseCacheHeader)
+		s.idempotency.store(idemKey, recorder.status, header, recorder.body.Bytes())
+	}
+	return nil
+}
+
+// writeResponseBody copies the upstream body to the client, caching it when cacheKey is set
+func (s *ProxyService) writeResponseBody(w http.ResponseWriter, resp *http.Response, cacheKey string) error {
+	streaming := isEventStream(resp.Header.Get("Content-Type"))
+	if cacheKey != "" && resp.StatusCode == http.StatusOK && !streaming {
+		return s.handleCachedResponse(w, resp, cacheKey)
+	}
+
 	// Handle streaming vs regular responses
-	if resp.Header.Get("Content-Type") == "text/event-stream" {
+	if streaming {
 		return s.handleStreamingResponse(w, resp)
 	}
 	return s.handleRegularResponse(w, resp)
 }
 
+// isEventStream reports whether contentType is SSE, ignoring parameters such as charset
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// countingResponseWriter counts the body bytes written to the client
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written     int64
+	wroteHeader bool
+}
+
+func (cw *countingResponseWriter) WriteHeader(statusCode int) {
+	cw.wroteHeader = true
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *countingResponseWriter) Write(data []byte) (int, error) {
+	cw.wroteHeader = true
+	n, err := cw.ResponseWriter.Write(data)
+	cw.written += int64(n)
+	return n, err
+}
+
+// Flush forwards to the underlying writer so streams are not held back
+func (cw *countingResponseWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// observeResponseSize records the response size and warns about unusually large
+// responses, which usually mean a runaway generation
+func (s *ProxyService) observeResponseSize(cw *countingResponseWriter) {
+	if !cw.wroteHeader {
+		return
+	}
+	s.responseBytes.Observe(float64(cw.written))
+
+	threshold := int64(s.config.Metrics.LargeResponseBytes)
+	if threshold == 0 {
+		threshold = defaultLargeResponseBytes
+	}
+	if cw.written > threshold {
+		Warn("Large response", "bytes", cw.written, "threshold", threshold)
+	}
+}
+
+// upstreamIdentityEncoding reports whether the upstream request should ask for an
+// uncompressed response, per proxy.accept_encoding. Otherwise Accept-Encoding is left
+// to the transport, which requests gzip and decompresses transparently.
+func (s *ProxyService) upstreamIdentityEncoding(stream bool) bool {
+	switch s.config.Proxy.AcceptEncoding {
+	case acceptEncodingGzip:
+		return false
+	case acceptEncodingIdentity:
+		return true
+	default:
+		return stream
+	}
+}
+
+// streamBufferSize returns the configured read size for streamed responses
+func (s *ProxyService) streamBufferSize() int {
+	if s.config.Proxy.StreamBufferSize > 0 {
+		return s.config.Proxy.StreamBufferSize
+	}
+	return streamingBufferSize
+}
+
+// copyResponseHeaders copies upstream response headers to the client. Hop-by-hop
+// headers and Set-Cookie are always removed; the rest are filtered by the configured
+// allow/deny lists.
+func (s *ProxyService) copyResponseHeaders(dst, src http.Header) {
+	filter := s.config.Live().ResponseHeaders
+	skip := hopByHopHeaderSet(src)
+	for _, deny := range [][]string{defaultDeniedResponseHeaders, filter.Deny} {
+		for _, h := range deny {
+			skip[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	var allow map[string]bool
+	if len(filter.Allow) > 0 {
+		allow = make(map[string]bool, len(filter.Allow))
+		for _, h := range filter.Allow {
+			allow[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	for key, values := range src {
+		if skip[key] || (allow != nil && !allow[key]) {
+			Debug("Dropping upstream response header", "header", key)
+			continue
+		}
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// forwardRequestHeaders copies the client headers named in request_headers.forward to
+// an upstream request. Hop-by-hop headers, those listed in Connection, the built-in
+// denylist and request_headers.deny are never copied, so client credentials stay local.
+func (s *ProxyService) forwardRequestHeaders(dst, src http.Header) {
+	filter := s.config.Live().RequestHeaders
+	forward := filter.Forward
+	if len(forward) == 0 {
+		return
+	}
+	all := false
+	allow := make(map[string]bool, len(forward))
+	for _, h := range forward {
+		if h == "*" {
+			all = true
+		}
+		allow[http.CanonicalHeaderKey(h)] = true
+	}
+
+	skip := hopByHopHeaderSet(src)
+	for _, deny := range [][]string{defaultDeniedRequestHeaders, filter.Deny} {
+		for _, h := range deny {
+			skip[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	for key, values := range src {
+		if skip[key] || !all && !allow[key] {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// defaultAllowedContentTypes are accepted when proxy.allowed_content_types is unset
+var defaultAllowedContentTypes = []string{"application/json"}
+
+// checkContentType rejects a request whose Content-Type is not one of
+// proxy.allowed_content_types. Parameters such as charset are ignored. A request without
+// the header is accepted, as its body must be JSON anyway. Passthrough routes forward
+// any type, e.g. multipart uploads, and are not checked.
+func (s *ProxyService) checkContentType(r *http.Request) error {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return nil
+	}
+	allowed := s.config.Proxy.AllowedContentTypes
+	if len(allowed) == 0 {
+		allowed = defaultAllowedContentTypes
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err == nil && slices.ContainsFunc(allowed, func(t string) bool { return strings.EqualFold(t, mediaType) }) {
+		return nil
+	}
+	Warn("Rejected request with unsupported Content-Type", "content_type", header, "allowed", allowed)
+	return fmt.Errorf("%w: %s", errUnsupportedMediaType, header)
+}
+
+// validateChatBody checks the shape of a chat completion request: a JSON object with
+// a model string and a non-empty messages array. Unknown fields are left to the
+// upstream. An X-Override-Model header stands in for a missing model.
+func validateChatBody(r *http.Request, req *proxyRequest) error {
+	if !req.isObject() {
+		return NewValidationError("body", "", "request body must be a JSON object", nil)
+	}
+
+	var model string
+	if _, err := req.decode("model", &model); err != nil {
+		return NewValidationError("model", string(req.fields["model"]), "model must be a string", nil)
+	}
+	if strings.TrimSpace(model) == "" && strings.TrimSpace(r.Header.Get(overrideModelHeader)) == "" {
+		return NewValidationError("model", model, "model is required", nil)
+	}
+
+	if !req.has("messages") {
+		return NewValidationError("messages", nil, "messages is required", nil)
+	}
+	messages, err := req.messageList()
+	if err != nil || messages == nil {
+		return NewValidationError("messages", string(req.fields["messages"]), "messages must be an array", nil)
+	}
+	if len(messages) == 0 {
+		return NewValidationError("messages", "[]", "messages must not be empty", nil)
+	}
+	return nil
+}
+
+// applyDefaultModel fills in default_model for a chat request whose model is missing,
+// empty or only whitespace. A non-string model is left for validateChatBody to reject.
+func (s *ProxyService) applyDefaultModel(r *http.Request, req *proxyRequest) {
+	if s.config.DefaultModel == "" || strings.TrimSpace(r.Header.Get(overrideModelHeader)) != "" || !req.isObject() {
+		return
+	}
+	var model string
+	if _, err := req.decode("model", &model); err != nil || strings.TrimSpace(model) != "" {
+		return
+	}
+	if err := req.set("model", s.config.DefaultModel); err != nil {
+		return
+	}
+	Info("Request has no model, using the default model", "model", s.config.DefaultModel)
+}
+
+// resolveRequestModel rewrites the model field of a JSON request body to its Copilot
+// ID, after applying an X-Override-Model header, and enforces allowed_models. The
+// body is left unchanged when it has no string model or needs no rewrite.
+func (s *ProxyService) resolveRequestModel(r *http.Request, req *proxyRequest) error {
+	if !req.isObject() {
+		return nil
+	}
+	model := req.model()
+
+	requested := model
+	if override := strings.TrimSpace(r.Header.Get(overrideModelHeader)); override != "" {
+		Info("Overriding request model", "from", requested, "to", override)
+		model = override
+	}
+	if model == "" {
+		return nil
+	}
+
+	live := s.config.Live()
+	normalized := NormalizeModel(model, live.ModelAliases)
+	if !isModelAllowed(normalized, live.AllowedModels, live.ModelAliases) {
+		return fmt.Errorf("%w: %s", errModelNotAllowed, normalized)
+	}
+	if normalized == requested {
+		return nil
+	}
+
+	if err := req.set("model", normalized); err != nil {
+		return nil
+	}
+	Info("Rewrote request model", "from", requested, "to", normalized)
+	return nil
+}
+
+// warnUnsupportedResponseFormat logs a warning when a chat request asks for a
+// response_format its model is not known to support. The request is sent unchanged.
+func warnUnsupportedResponseFormat(req *proxyRequest) {
+	format := transform.ResponseFormatType(req.fields["response_format"])
+	if format == "" || responseFormatSupported(req.model(), format) {
+		return
+	}
+	Warn("Model may not support the requested response format", "model", req.model(), "response_format", format)
+}
+
+// systemRoles are the message roles carrying instructions; a conversation with one of
+// them already has a system prompt
+var systemRoles = map[string]bool{"system": true, "developer": true}
+
+// applyDefaultSystemPrompt prepends default_system_prompt as a system message to a chat
+// request that has no system or developer message. The other messages and fields are
+// forwarded verbatim.
+func (s *ProxyService) applyDefaultSystemPrompt(req *proxyRequest) {
+	if s.config.DefaultSystemPrompt == "" {
+		return
+	}
+	messages, err := req.messageList()
+	if err != nil || len(messages) == 0 {
+		return
+	}
+	for _, raw := range messages {
+		var message struct {
+			Role string `json:"role"`
+		}
+		if json.Unmarshal(raw, &message) == nil && systemRoles[message.Role] {
+			return
+		}
+	}
+
+	system, err := json.Marshal(transform.ChatCompletionMessage{Role: "system", Content: s.config.DefaultSystemPrompt})
+	if err != nil {
+		return
+	}
+	if err := req.setMessages(append([]json.RawMessage{system}, messages...)); err != nil {
+		return
+	}
+	Debug("Injected the default system prompt")
+}
+
+// applySamplingDefaults adds default_temperature and default_top_p to a chat request
+// that leaves them out; values the client sent, including null, are kept as they are
+func (s *ProxyService) applySamplingDefaults(req *proxyRequest) {
+	if s.config.DefaultTemperature == nil && s.config.DefaultTopP == nil {
+		return
+	}
+	if !req.has("messages") {
+		return
+	}
+	defaults := map[string]*float64{
+		"temperature": s.config.DefaultTemperature,
+		"top_p":       s.config.DefaultTopP,
+	}
+
+	changed := false
+	for name, value := range defaults {
+		if req.has(name) || value == nil {
+			continue
+		}
+		if req.set(name, *value) == nil {
+			changed = true
+		}
+	}
+	if changed {
+		Debug("Applied default sampling parameters")
+	}
+}
+
+// setUpstreamHeaders sets the credentials and editor headers sent with every Copilot
+// API request the proxy makes on a client's behalf
+func setUpstreamHeaders(h http.Header, cfg *Config, token, intent string) {
+	h.Set("Authorization", "Bearer "+token)
+	h.Set("Accept", "application/json")
+	headers := cfg.Live().Headers
+	h.Set("User-Agent", headers.UserAgent)
+	h.Set("Editor-Version", headers.EditorVersion)
+	h.Set("Editor-Plugin-Version", headers.EditorPluginVersion)
+	h.Set("Copilot-Integration-Id", headers.CopilotIntegrationID)
+	h.Set("Openai-Intent", intent)
+	h.Set("X-Initiator", headers.XInitiator)
+}
+
+// resolveIntent returns the Openai-Intent for the request, honoring a known
+// client-supplied X-Copilot-Intent and falling back to the configured default.
+func (s *ProxyService) resolveIntent(r *http.Request) string {
+	intent := strings.ToLower(strings.TrimSpace(r.Header.Get(copilotIntentHeader)))
+	defaultIntent := s.config.Live().Headers.OpenaiIntent
+	if intent == "" {
+		return defaultIntent
+	}
+	if !knownOpenaiIntents[intent] {
+		Debug("Unknown client intent, using default", "intent", intent, "default", defaultIntent)
+		return defaultIntent
+	}
+	return intent
+}
+
 func (s *ProxyService) handleStreamingResponse(w http.ResponseWriter, resp *http.Response) error {
 	Debug("Starting streaming response copy")
 
 	if flusher, ok := w.(http.Flusher); ok {
-		// Copy in chunks and flush periodically for better streaming
-		buf := make([]byte, streamingBufferSize)
+		// Copy in chunks and flush each one; larger buffers mean fewer writes
+		// for fast models at the cost of a little latency
+		buf := make([]byte, s.streamBufferSize())
+		// Whether the client has seen a complete event so far, for a clean terminator
+		atBoundary := true
 		for {
 			n, readErr := resp.Body.Read(buf)
 			if n > 0 {
@@ -500,6 +1534,7 @@ func (s *ProxyService) handleStreamingResponse(w http.ResponseWriter, resp *http
 					return writeErr
 				}
 				flusher.Flush()
+				atBoundary = bytes.HasSuffix(buf[:n], []byte("\n\n"))
 			}
 			if readErr == io.EOF {
 				Debug("Streaming response completed successfully")
@@ -507,6 +1542,8 @@ func (s *ProxyService) handleStreamingResponse(w http.ResponseWriter, resp *http
 			}
 			if readErr != nil {
 				Error("Error reading streaming response", "error", readErr)
+				terminateStream(w, resp, !atBoundary, readErr)
+				flusher.Flush()
 				return readErr
 			}
 		}
@@ -515,22 +1552,52 @@ func (s *ProxyService) handleStreamingResponse(w http.ResponseWriter, resp *http
 		_, err := io.Copy(w, resp.Body)
 		if err != nil {
 			Error("Error copying streaming response", "error", err)
+			terminateStream(w, resp, true, err)
 			return err
 		}
 	}
 	return nil
 }
 
+// terminateStream ends a stream the upstream broke off with an error event and [DONE],
+// unless the client itself went away
+func terminateStream(w io.Writer, resp *http.Response, midEvent bool, err error) {
+	if resp.Request != nil && resp.Request.Context().Err() != nil {
+		return
+	}
+	if writeErr := WriteStreamError(w, midEvent, err); writeErr != nil {
+		Debug("Failed to write stream terminator", "error", writeErr)
+	}
+}
+
+// handleCachedResponse reads the full upstream body, stores it in the response cache and
+// writes it to the client
+func (s *ProxyService) handleCachedResponse(w http.ResponseWriter, resp *http.Response, key string) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		Error("Error reading response for cache", "error", err)
+		return err
+	}
+
+	header := w.Header().Clone()
+	header.Del(responseCacheHeader)
+	s.responseCache.set(key, resp.StatusCode, header, body)
+
+	if _, err := w.Write(body); err != nil {
+		Error("Error copying response", "error", err)
+		return err
+	}
+	return nil
+}
+
 func (s *ProxyService) handleRegularResponse(w http.ResponseWriter, resp *http.Response) error {
 	Debug("Starting regular response copy")
 
-	// Use buffer pool for regular responses
-	buf := s.bufferPool.Get().(*bytes.Buffer)
-	buf.Reset()
+	// Copy through a pooled buffer instead of allocating one per response
+	buf := s.bufferPool.Get().(*[]byte)
 	defer s.bufferPool.Put(buf)
 
-	// Use the buffer for copying (not an empty slice)
-	_, err := io.CopyBuffer(w, resp.Body, buf.Bytes())
+	_, err := io.CopyBuffer(w, resp.Body, *buf)
 	if err != nil {
 		Error("Error copying response", "error", err)
 		return err
@@ -540,11 +1607,63 @@ func (s *ProxyService) handleRegularResponse(w http.ResponseWriter, resp *http.R
 	return nil
 }
 
-func (s *ProxyService) makeRequestWithRetry(req *http.Request, body []byte) (*http.Response, error) {
+// doUpstream sends one upstream attempt, logging its connection timings when the
+// request is traced (debug.trace_upstream)
+func (s *ProxyService) doUpstream(req *http.Request, body []byte) (*http.Response, error) {
+	req, trace := traceUpstream(req)
+	resp, err := s.doUpstreamWithDeadline(req, body)
+	trace.log(req, err)
+	return resp, err
+}
+
+// doUpstreamWithDeadline sends req. A streamed request must receive response headers
+// within timeouts.first_byte, so a stuck upstream fails fast; the overall request
+// deadline then covers the body, however long the generation runs. Buffered responses
+// only send headers once complete, so they are not bounded this way.
+func (s *ProxyService) doUpstreamWithDeadline(req *http.Request, body []byte) (*http.Response, error) {
+	timeout := time.Duration(s.config.Live().Timeouts.FirstByte) * time.Second
+	if timeout <= 0 || !isStreamingRequest(body) {
+		return s.httpClient.Do(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(timeout, func() { cancel(errFirstByteTimeout) })
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if fired := !timer.Stop(); fired || err != nil {
+		if err == nil {
+			// The deadline passed just as the headers arrived; the body is already canceled
+			closeBody(resp)
+		}
+		cancel(nil)
+		if errors.Is(context.Cause(ctx), errFirstByteTimeout) {
+			return nil, NewNetworkError("first_byte", req.URL.String(), fmt.Sprintf("no response headers within %s", timeout), errFirstByteTimeout)
+		}
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+	return resp, nil
+}
+
+// cancelOnClose releases a response's request context when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// makeRequestWithRetry sends req, retrying transient failures. With a seat pool,
+// current is the seat req is authorized for; a 429 moves the request to another seat.
+func (s *ProxyService) makeRequestWithRetry(req *http.Request, body []byte, current *seat) (*http.Response, error) {
 	var lastResp *http.Response
 	var lastErr error
 
-	for attempt := 1; attempt <= maxChatRetries; attempt++ {
+	maxAttempts := retryAttempts(s.config)
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
 		// Create a new request for each attempt with the original context
 		retryReq, err := http.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), bytes.NewBuffer(body))
 		if err != nil {
@@ -558,18 +1677,22 @@ func (s *ProxyService) makeRequestWithRetry(req *http.Request, body []byte) (*ht
 			}
 		}
 
-		Debug("Making request attempt", "attempt", attempt, "max_attempts", maxChatRetries)
+		Debug("Making request attempt", "attempt", attempt, "max_attempts", maxAttempts)
 
-		resp, err := s.httpClient.Do(retryReq)
+		resp, err := s.doUpstream(retryReq, body)
 		if err != nil {
 			lastErr = err
-			if attempt == maxChatRetries {
-				Error("Request failed after max attempts", "attempts", maxChatRetries, "error", err)
+			if req.Context().Err() != nil {
+				// The caller gave up; retrying would only hold the connection open
+				return nil, err
+			}
+			if attempt == maxAttempts {
+				Error("Request failed after max attempts", "attempts", maxAttempts, "error", err)
 				return nil, err
 			}
 
 			// Context-aware waiting instead of blocking sleep
-			waitTime := time.Duration(baseChatRetryDelay*attempt*attempt) * time.Second
+			waitTime := retryBackoff(baseChatRetryDelay*time.Second, attempt, retryMaxDelay(s.config))
 			Warn("Request failed, retrying", "attempt", attempt, "wait_time", waitTime, "error", err)
 
 			timer := time.NewTimer(waitTime)
@@ -596,13 +1719,26 @@ func (s *ProxyService) makeRequestWithRetry(req *http.Request, body []byte) (*ht
 			Warn("Failed to close response body during retry", "error", closeErr)
 		}
 
-		if attempt == maxChatRetries {
-			Warn("Request failed after max attempts", "attempts", maxChatRetries, "status", resp.StatusCode)
+		switched := false
+		if current != nil && resp.StatusCode == statusCodeTooManyRequests {
+			var next *seat
+			next, switched = s.rotateSeat(req, current, resp.Header.Get("Retry-After"))
+			current = next
+		}
+
+		if attempt == maxAttempts {
+			Warn("Request failed after max attempts", "attempts", maxAttempts, "status", resp.StatusCode)
 			return resp, nil // Return the last response even if it failed
 		}
 
+		// Another seat can take the request right away
+		if switched {
+			Debug("Retrying on another Copilot seat", "seat", current.index, "attempt", attempt)
+			continue
+		}
+
 		// Context-aware waiting for status code retries
-		waitTime := time.Duration(baseChatRetryDelay*attempt*attempt) * time.Second
+		waitTime := retryBackoff(baseChatRetryDelay*time.Second, attempt, retryMaxDelay(s.config))
 		Warn("Request failed, retrying", "status", resp.StatusCode, "attempt", attempt, "wait_time", waitTime)
 
 		timer := time.NewTimer(waitTime)
@@ -618,6 +1754,37 @@ func (s *ProxyService) makeRequestWithRetry(req *http.Request, body []byte) (*ht
 	return lastResp, lastErr
 }
 
+// acquireToken returns a valid Copilot token for an upstream request. With a seat pool
+// it also returns the seat the token belongs to; otherwise the seat is nil.
+func (s *ProxyService) acquireToken() (*seat, string, error) {
+	if s.seats != nil {
+		st, token, err := s.seats.acquire()
+		if err != nil {
+			Error("Failed to ensure valid token", "error", err)
+			return nil, "", NewAuthError("token validation failed", err)
+		}
+		return st, token, nil
+	}
+	if err := s.authService.EnsureValidToken(s.config); err != nil {
+		Error("Failed to ensure valid token", "error", err)
+		return nil, "", NewAuthError("token validation failed", err)
+	}
+	token, _ := s.config.Token()
+	return nil, token, nil
+}
+
+// rotateSeat puts a rate-limited seat on cooldown and re-authorizes req for the
+// next available seat, reporting whether it switched
+func (s *ProxyService) rotateSeat(req *http.Request, current *seat, retryAfter string) (*seat, bool) {
+	s.seats.markRateLimited(current, retryAfter)
+	next, token, err := s.seats.acquire()
+	if err != nil || next == current {
+		return current, false
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return next, true
+}
+
 func (s *ProxyService) isRetriableError(statusCode int, err error) bool {
 	if err != nil {
 		return true // Network errors are retriable
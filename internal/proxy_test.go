@@ -0,0 +1,3113 @@
+package internal_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/privapps/github-copilot-svcs/internal"
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
+)
+
+// rewriteTransport sends every request to the test server regardless of its host
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (rt *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newUpstreamClient returns an HTTP client that routes upstream calls to srv
+func newUpstreamClient(t testing.TB, srv *httptest.Server) *http.Client {
+	t.Helper()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse test server URL: %v", err)
+	}
+	return &http.Client{Timeout: 10 * time.Second, Transport: &rewriteTransport{target: target}}
+}
+
+// createProxyTestConfig returns a config with a valid, non-expiring Copilot token
+func createProxyTestConfig() *internal.Config {
+	cfg := &internal.Config{
+		Port:         8081,
+		CopilotToken: "test-copilot-token",
+		ExpiresAt:    time.Now().Add(time.Hour).Unix(),
+	}
+	internal.SetDefaultHeaders(cfg)
+	internal.SetDefaultCORS(cfg)
+	internal.SetDefaultTimeouts(cfg)
+	return cfg
+}
+
+// newTestProxyService builds a proxy service whose upstream calls go to srv
+func newTestProxyService(t testing.TB, cfg *internal.Config, srv *httptest.Server) *internal.ProxyService {
+	t.Helper()
+	client := newUpstreamClient(t, srv)
+	workerPool := internal.NewWorkerPool(2)
+	t.Cleanup(workerPool.Stop)
+	return internal.NewProxyService(cfg, client, internal.NewAuthService(client), workerPool)
+}
+
+const testChatBody = `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+
+func TestProxyService_OpenaiIntent(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientIntent string
+		expected     string
+	}{
+		{name: "client intent forwarded", clientIntent: "conversation-panel", expected: "conversation-panel"},
+		{name: "no client intent uses default", clientIntent: "", expected: "conversation-edits"},
+		{name: "unknown intent falls back to default", clientIntent: "made-up-intent", expected: "conversation-edits"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotIntent string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotIntent = r.Header.Get("Openai-Intent")
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+			if tt.clientIntent != "" {
+				req.Header.Set("X-Copilot-Intent", tt.clientIntent)
+			}
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if gotIntent != tt.expected {
+				t.Errorf("Expected upstream Openai-Intent %q, got %q", tt.expected, gotIntent)
+			}
+		})
+	}
+}
+
+func TestProxyService_ResponseHeaderFiltering(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Github-Request-Id", "abc123")
+		w.Header().Set("X-Request-Id", "req-1")
+		_, _ = w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer upstream.Close()
+
+	send := func(t *testing.T, cfg *internal.Config) http.Header {
+		t.Helper()
+		proxy := newTestProxyService(t, cfg, upstream)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w.Header()
+	}
+
+	t.Run("default denylist and hop-by-hop headers", func(t *testing.T) {
+		headers := send(t, createProxyTestConfig())
+
+		for _, denied := range []string{"Set-Cookie", "Keep-Alive", "Proxy-Authenticate"} {
+			if v := headers.Get(denied); v != "" {
+				t.Errorf("Expected %s to be dropped, got %q", denied, v)
+			}
+		}
+		for _, allowed := range []string{"Content-Type", "X-Github-Request-Id", "X-Request-Id"} {
+			if headers.Get(allowed) == "" {
+				t.Errorf("Expected %s to pass through", allowed)
+			}
+		}
+	})
+
+	t.Run("configured denylist", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.ResponseHeaders.Deny = []string{"x-github-request-id"}
+		headers := send(t, cfg)
+
+		if headers.Get("X-Github-Request-Id") != "" {
+			t.Error("Expected configured denied header to be dropped")
+		}
+		if headers.Get("Set-Cookie") != "" {
+			t.Error("Expected Set-Cookie to be dropped along with the configured headers")
+		}
+		if headers.Get("X-Request-Id") == "" {
+			t.Error("Expected X-Request-Id to pass through")
+		}
+	})
+
+	t.Run("configured allowlist", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.ResponseHeaders.Allow = []string{"Content-Type", "Keep-Alive"}
+		headers := send(t, cfg)
+
+		if headers.Get("Content-Type") == "" {
+			t.Error("Expected allowed Content-Type to pass through")
+		}
+		if headers.Get("X-Request-Id") != "" {
+			t.Error("Expected header outside the allowlist to be dropped")
+		}
+		if headers.Get("Keep-Alive") != "" {
+			t.Error("Expected hop-by-hop header to be dropped even when allowed")
+		}
+	})
+}
+
+func TestProxyService_UpstreamTimeoutOverride(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(1500 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer upstream.Close()
+
+	send := func(t *testing.T, cfg *internal.Config, override string) int {
+		t.Helper()
+		proxy := newTestProxyService(t, cfg, upstream)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+		if override != "" {
+			req.Header.Set("X-Upstream-Timeout-Seconds", override)
+		}
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("header within bounds extends the deadline", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.Timeouts.ProxyContext = 1
+		cfg.Timeouts.MaxProxyContext = 5
+
+		if code := send(t, cfg, "3"); code != http.StatusOK {
+			t.Errorf("Expected extended request to succeed, got status %d", code)
+		}
+	})
+
+	t.Run("header over the cap is clamped", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.Timeouts.ProxyContext = 1
+		cfg.Timeouts.MaxProxyContext = 1
+
+		if code := send(t, cfg, "60"); code == http.StatusOK {
+			t.Error("Expected clamped request to time out")
+		}
+	})
+
+	t.Run("invalid header is ignored", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.Timeouts.ProxyContext = 1
+
+		if code := send(t, cfg, "soon"); code == http.StatusOK {
+			t.Error("Expected request to use the configured timeout")
+		}
+	})
+}
+
+// errorTransport fails every request with err
+type errorTransport struct {
+	err error
+}
+
+func (et errorTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, et.err
+}
+
+func TestProxyService_UpstreamNetworkErrors(t *testing.T) {
+	// A server that is closed immediately gives a real connection-refused address
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL, _ := url.Parse(closed.URL)
+	closed.Close()
+
+	tests := []struct {
+		name      string
+		transport http.RoundTripper
+		want      string
+	}{
+		{
+			name: "DNS failure",
+			transport: errorTransport{err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{
+				Err: "no such host", Name: "api.githubcopilot.com", Server: "10.0.0.53:53", IsNotFound: true,
+			}}},
+			want: "DNS lookup failed for api.githubcopilot.com",
+		},
+		{
+			name:      "connection refused",
+			transport: &rewriteTransport{target: closedURL},
+			want:      "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			cfg := createProxyTestConfig()
+			cfg.Retry.MaxDelay = 1
+			client := &http.Client{Transport: tt.transport}
+			workerPool := internal.NewWorkerPool(1)
+			t.Cleanup(workerPool.Stop)
+			proxy := internal.NewProxyService(cfg, client, internal.NewAuthService(client), workerPool)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("Expected status 502, got %d: %s", w.Code, w.Body.String())
+			}
+			var body struct {
+				Error struct {
+					Message   string `json:"message"`
+					Type      string `json:"type"`
+					RequestID string `json:"request_id"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Expected a JSON error body, got %q: %v", w.Body.String(), err)
+			}
+			if body.Error.Type != "upstream_network_error" {
+				t.Errorf("Expected type upstream_network_error, got %q", body.Error.Type)
+			}
+			if !strings.Contains(body.Error.Message, tt.want) {
+				t.Errorf("Expected message to contain %q, got %q", tt.want, body.Error.Message)
+			}
+			if body.Error.RequestID == "" || w.Header().Get("X-Request-ID") != body.Error.RequestID {
+				t.Errorf("Expected matching request IDs, header %q body %q", w.Header().Get("X-Request-ID"), body.Error.RequestID)
+			}
+			// Internal addresses and credentials must not leak to the client
+			for _, secret := range []string{cfg.CopilotToken, closedURL.Host, "10.0.0.53"} {
+				if strings.Contains(w.Body.String(), secret) {
+					t.Errorf("Response leaks %q: %s", secret, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// countingWorkerPool runs jobs inline and counts them
+type countingWorkerPool struct {
+	jobs atomic.Int32
+}
+
+func (p *countingWorkerPool) Submit(job func()) {
+	p.jobs.Add(1)
+	job()
+}
+
+func TestProxyService_CircuitBreakerDisabled(t *testing.T) {
+	const requests = 10
+	tests := []struct {
+		name          string
+		disabled      bool
+		upstreamCalls int32
+	}{
+		{"enabled breaker opens after repeated failures", false, 5},
+		{"disabled breaker sends every request upstream", true, requests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				calls.Add(1)
+				http.Error(w, `{"error":{"message":"upstream exploded"}}`, http.StatusInternalServerError)
+			}))
+			t.Cleanup(upstream.Close)
+
+			cfg := createProxyTestConfig()
+			cfg.Retry.MaxAttempts = 1
+			cfg.Debug.DisableCircuitBreaker = tt.disabled
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			rejected := 0
+			for i := 0; i < requests; i++ {
+				w := httptest.NewRecorder()
+				proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody)))
+				if w.Code == http.StatusServiceUnavailable {
+					rejected++
+				}
+			}
+
+			if got := calls.Load(); got != tt.upstreamCalls {
+				t.Errorf("Expected %d upstream calls, got %d", tt.upstreamCalls, got)
+			}
+			if want := requests - int(tt.upstreamCalls); rejected != want {
+				t.Errorf("Expected %d requests rejected by the breaker, got %d", want, rejected)
+			}
+		})
+	}
+}
+
+func TestProxyService_CircuitBreakerPerModelGroup(t *testing.T) {
+	var claudeCalls, gptCalls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if strings.HasPrefix(req.Model, "claude") {
+			claudeCalls.Add(1)
+			http.Error(w, `{"error":{"message":"upstream exploded"}}`, http.StatusInternalServerError)
+			return
+		}
+		gptCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1","choices":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := createProxyTestConfig()
+	cfg.Retry.MaxAttempts = 1
+	proxy := newTestProxyService(t, cfg, upstream)
+
+	send := func(body string) int {
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+		return w.Code
+	}
+	const claudeBody = `{"model":"claude-opus-4","messages":[{"role":"user","content":"hi"}]}`
+
+	for i := 0; i < 8; i++ {
+		send(claudeBody)
+	}
+	if got := claudeCalls.Load(); got != 5 {
+		t.Errorf("Expected the claude breaker to open after 5 failures, got %d upstream calls", got)
+	}
+	if code := send(claudeBody); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from the open claude breaker, got %d", code)
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := send(testChatBody); code != http.StatusOK {
+			t.Fatalf("Expected gpt-4o to be served while the claude breaker is open, got %d", code)
+		}
+	}
+	if got := gptCalls.Load(); got != 3 {
+		t.Errorf("Expected 3 gpt-4o upstream calls, got %d", got)
+	}
+
+	states := proxy.CircuitStates()
+	if states["anthropic"] != internal.CircuitOpen {
+		t.Errorf("Expected the anthropic breaker open, got %v", states["anthropic"])
+	}
+	if states["openai"] != internal.CircuitClosed {
+		t.Errorf("Expected the openai breaker closed, got %v", states["openai"])
+	}
+	if got := proxy.CircuitState(); got != internal.CircuitHalfOpen {
+		t.Errorf("Expected a half-open aggregate while only some groups are open, got %v", got)
+	}
+	if got := proxy.WorstCircuitState(); got != internal.CircuitOpen {
+		t.Errorf("Expected the worst state to be open while any group is open, got %v", got)
+	}
+}
+
+func TestProxyService_CircuitBreakerBeforeWorkerPool(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		http.Error(w, `{"error":{"message":"upstream exploded"}}`, http.StatusInternalServerError)
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := createProxyTestConfig()
+	cfg.Retry.MaxAttempts = 1
+	workerPool := internal.NewWorkerPool(1)
+	t.Cleanup(workerPool.Stop)
+	client := newUpstreamClient(t, upstream)
+	proxy := internal.NewProxyService(cfg, client, internal.NewAuthService(client), workerPool)
+	send := func() int {
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody)))
+		return w.Code
+	}
+	for i := 0; i < 5; i++ {
+		send()
+	}
+
+	// With the only worker busy, an open breaker still answers right away
+	release := make(chan struct{})
+	defer close(release)
+	busy := make(chan struct{})
+	workerPool.Submit(func() {
+		close(busy)
+		<-release
+	})
+	<-busy
+
+	codes := make(chan int, 1)
+	go func() { codes <- send() }()
+	select {
+	case code := <-codes:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 from the open breaker, got %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the open breaker to reject the request without waiting for a worker")
+	}
+}
+
+func TestProxyService_CircuitBreakerCountsFallbackModel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(req.Model, "claude") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"message":"The requested model is not supported.","code":"model_not_supported"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":{"message":"upstream exploded"}}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := createProxyTestConfig()
+	cfg.Retry.MaxAttempts = 1
+	cfg.FallbackModel = "gpt-4o"
+	proxy := newTestProxyService(t, cfg, upstream)
+	const claudeBody = `{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(claudeBody)))
+	}
+
+	states := proxy.CircuitStates()
+	if states["openai"] != internal.CircuitOpen {
+		t.Errorf("Expected the failing fallback to open the openai breaker, got %v", states["openai"])
+	}
+	if states["anthropic"] != internal.CircuitClosed {
+		t.Errorf("Expected the anthropic breaker to stay closed, got %v", states["anthropic"])
+	}
+}
+
+func TestProxyService_QueueWaitTimeout(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		upstreamCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1","choices":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := createProxyTestConfig()
+	cfg.Timeouts.QueueWait = 1
+
+	// Occupy the only worker so the request waits in the queue
+	workerPool := internal.NewWorkerPool(1)
+	t.Cleanup(workerPool.Stop)
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	workerPool.Submit(func() {
+		close(busy)
+		<-release
+	})
+	<-busy
+
+	client := newUpstreamClient(t, upstream)
+	proxy := internal.NewProxyService(cfg, client, internal.NewAuthService(client), workerPool)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody)))
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the queue wait expires, got %d", w.Code)
+	}
+	if elapsed < time.Second || elapsed > 2*time.Second {
+		t.Errorf("Expected the 503 after the 1s queue wait, well before proxy_context; took %v", elapsed)
+	}
+
+	// The abandoned job must not reach the upstream once a worker frees up
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for workerPool.JobsProcessed() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := workerPool.JobsProcessed(); got != 2 {
+		t.Fatalf("Expected both jobs to finish, got %d", got)
+	}
+	if got := upstreamCalls.Load(); got != 0 {
+		t.Errorf("Expected no upstream call for the timed-out request, got %d", got)
+	}
+}
+
+func TestProxyService_PreflightShortCircuit(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		upstreamCalls.Add(1)
+	}))
+	defer upstream.Close()
+
+	// No tokens: any token validation would fail the request with 401
+	cfg := createProxyTestConfig()
+	cfg.CopilotToken = ""
+	cfg.ExpiresAt = 0
+
+	client := newUpstreamClient(t, upstream)
+	pool := &countingWorkerPool{}
+	proxy := internal.NewProxyService(cfg, client, internal.NewAuthService(client), pool)
+
+	handlers := map[string]http.HandlerFunc{
+		"buffered":      proxy.Handler(),
+		"reverse_proxy": proxy.ReverseProxyHandler(),
+		"passthrough":   proxy.PassthroughHandler(),
+	}
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "/v1/chat/completions", http.NoBody)
+			req.Header.Set("Origin", "https://example.com")
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "POST") {
+				t.Errorf("Expected POST in Access-Control-Allow-Methods, got %q", got)
+			}
+		})
+	}
+
+	if n := pool.jobs.Load(); n != 0 {
+		t.Errorf("Expected no worker pool jobs, got %d", n)
+	}
+	if n := upstreamCalls.Load(); n != 0 {
+		t.Errorf("Expected no upstream calls, got %d", n)
+	}
+}
+
+func TestProxyService_CancelsUpstreamOnTimeout(t *testing.T) {
+	var calls atomic.Int32
+	canceled := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// Draining the body lets the server notice the client closing the connection
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(10 * time.Second):
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"id":"late"}`))
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := createProxyTestConfig()
+	cfg.Timeouts.ProxyContext = 1
+	cfg.MaxConcurrentUpstream = 1
+	proxy := newTestProxyService(t, cfg, upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+	w := httptest.NewRecorder()
+	start := time.Now()
+	proxy.Handler().ServeHTTP(w, req)
+
+	if n := proxy.UpstreamInFlight(); n != 0 {
+		t.Errorf("Expected the worker to finish before the handler returned, %d upstream calls in flight", n)
+	}
+
+	if w.Code != http.StatusRequestTimeout {
+		t.Errorf("Expected status 408, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected handler to return promptly after the timeout, took %v", elapsed)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the upstream request to be canceled")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected a canceled request not to be retried, got %d upstream calls", n)
+	}
+}
+
+func TestProxyService_ResponseCache(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprintf(w, "data: {\"n\":%d}\n\n", n)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"n":%d}`, n)
+	}))
+	defer upstream.Close()
+
+	send := func(t *testing.T, proxy *internal.ProxyService, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	const deterministic = `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+
+	t.Run("identical deterministic request is served from cache", func(t *testing.T) {
+		calls.Store(0)
+		cfg := createProxyTestConfig()
+		cfg.ResponseCache.Enabled = true
+		proxy := newTestProxyService(t, cfg, upstream)
+
+		first := send(t, proxy, deterministic)
+		second := send(t, proxy, deterministic)
+
+		if got := first.Header().Get("X-Proxy-Cache"); got != "MISS" {
+			t.Errorf("Expected first response to be a cache miss, got %q", got)
+		}
+		if got := second.Header().Get("X-Proxy-Cache"); got != "HIT" {
+			t.Errorf("Expected second response to be a cache hit, got %q", got)
+		}
+		if first.Body.String() != second.Body.String() {
+			t.Errorf("Expected cached body %q, got %q", first.Body.String(), second.Body.String())
+		}
+		if got := second.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("Expected cached Content-Type application/json, got %q", got)
+		}
+		if n := calls.Load(); n != 1 {
+			t.Errorf("Expected 1 upstream call, got %d", n)
+		}
+	})
+
+	t.Run("entries expire after the TTL", func(t *testing.T) {
+		calls.Store(0)
+		cfg := createProxyTestConfig()
+		cfg.ResponseCache.Enabled = true
+		cfg.ResponseCache.TTL = 1
+		proxy := newTestProxyService(t, cfg, upstream)
+
+		send(t, proxy, deterministic)
+		time.Sleep(1100 * time.Millisecond)
+		w := send(t, proxy, deterministic)
+
+		if got := w.Header().Get("X-Proxy-Cache"); got != "MISS" {
+			t.Errorf("Expected expired entry to miss, got %q", got)
+		}
+		if n := calls.Load(); n != 2 {
+			t.Errorf("Expected 2 upstream calls, got %d", n)
+		}
+	})
+
+	t.Run("streaming and non-zero temperature bypass the cache", func(t *testing.T) {
+		calls.Store(0)
+		cfg := createProxyTestConfig()
+		cfg.ResponseCache.Enabled = true
+		proxy := newTestProxyService(t, cfg, upstream)
+
+		bodies := []string{
+			`{"model":"gpt-4o","temperature":0,"stream":true,"messages":[{"role":"user","content":"hi"}]}`,
+			`{"model":"gpt-4o","temperature":0.7,"messages":[{"role":"user","content":"hi"}]}`,
+			testChatBody,
+		}
+		for _, body := range bodies {
+			for i := 0; i < 2; i++ {
+				if got := send(t, proxy, body).Header().Get("X-Proxy-Cache"); got != "" {
+					t.Errorf("Expected no cache header for %s, got %q", body, got)
+				}
+			}
+		}
+		if n := calls.Load(); n != int32(2*len(bodies)) {
+			t.Errorf("Expected %d upstream calls, got %d", 2*len(bodies), n)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		calls.Store(0)
+		proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+
+		send(t, proxy, deterministic)
+		send(t, proxy, deterministic)
+		if n := calls.Load(); n != 2 {
+			t.Errorf("Expected 2 upstream calls, got %d", n)
+		}
+	})
+}
+
+func TestProxyService_ReverseProxyMatchesBufferedHandler(t *testing.T) {
+	type upstreamCall struct {
+		path, auth, intent, userAgent, apiKey string
+		body                                  string
+	}
+	var calls []upstreamCall
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		calls = append(calls, upstreamCall{
+			path:      r.URL.Path,
+			auth:      r.Header.Get("Authorization"),
+			intent:    r.Header.Get("Openai-Intent"),
+			userAgent: r.Header.Get("User-Agent"),
+			apiKey:    r.Header.Get("X-API-Key"),
+			body:      string(body),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Request-Id", "req-1")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion"}`))
+	}))
+	defer upstream.Close()
+
+	proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+	handlers := map[string]http.HandlerFunc{
+		"buffered":      proxy.Handler(),
+		"reverse_proxy": proxy.ReverseProxyHandler(),
+	}
+
+	results := make(map[string]*httptest.ResponseRecorder)
+	for _, name := range []string{"buffered", "reverse_proxy"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "client-secret")
+		req.Header.Set("X-Copilot-Intent", "conversation-agent")
+		w := httptest.NewRecorder()
+		handlers[name].ServeHTTP(w, req)
+		results[name] = w
+	}
+
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 upstream calls, got %d", len(calls))
+	}
+	if calls[0] != calls[1] {
+		t.Errorf("Upstream requests differ:\nbuffered:      %+v\nreverse_proxy: %+v", calls[0], calls[1])
+	}
+	if calls[1].path != "/chat/completions" || calls[1].auth != "Bearer test-copilot-token" || calls[1].intent != "conversation-agent" {
+		t.Errorf("Unexpected upstream request: %+v", calls[1])
+	}
+	if calls[1].apiKey != "" {
+		t.Error("Expected client credentials not to be forwarded upstream")
+	}
+	if calls[1].body != testChatBody {
+		t.Errorf("Expected body %q, got %q", testChatBody, calls[1].body)
+	}
+
+	buffered, reverse := results["buffered"], results["reverse_proxy"]
+	if buffered.Code != reverse.Code {
+		t.Errorf("Status differs: buffered %d, reverse_proxy %d", buffered.Code, reverse.Code)
+	}
+	if buffered.Body.String() != reverse.Body.String() {
+		t.Errorf("Body differs:\nbuffered:      %s\nreverse_proxy: %s", buffered.Body.String(), reverse.Body.String())
+	}
+	for _, header := range []string{"Content-Type", "X-Request-Id", "Set-Cookie", "Access-Control-Allow-Origin"} {
+		if b, r := buffered.Header().Get(header), reverse.Header().Get(header); b != r {
+			t.Errorf("Header %s differs: buffered %q, reverse_proxy %q", header, b, r)
+		}
+	}
+}
+
+func TestProxyService_ReverseProxyStreaming(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{"data: {\"id\":\"1\"}\n\n", "data: [DONE]\n\n"} {
+			_, _ = w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+	w := httptest.NewRecorder()
+	proxy.ReverseProxyHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if got := w.Body.String(); got != "data: {\"id\":\"1\"}\n\ndata: [DONE]\n\n" {
+		t.Errorf("Unexpected stream body %q", got)
+	}
+	if !w.Flushed {
+		t.Error("Expected streamed response to be flushed")
+	}
+}
+
+// assertStreamsThroughServer checks that the first event an upstream flushes reaches a
+// client of the full server, middleware included, while the upstream stream is still
+// open. The client is a default one, so it asks for gzip.
+func assertStreamsThroughServer(t *testing.T, cfg *internal.Config, contentType string) {
+	t.Helper()
+	const firstEvent = "data: {\"id\":\"1\"}\n"
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write([]byte(firstEvent + "\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		_, _ = w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+
+	t.Setenv("COPILOT_SVCS_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+	proxy := httptest.NewServer(internal.NewServer(cfg, newUpstreamClient(t, upstream)).Handler())
+	t.Cleanup(proxy.Close)
+
+	req, err := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if resp.Uncompressed {
+		t.Error("Expected the event stream not to be gzipped")
+	}
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != firstEvent {
+			t.Errorf("Expected the first event %q, got %q", firstEvent, line)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the first event before the upstream finished the stream")
+	}
+}
+
+func TestServer_StreamsThroughMiddleware(t *testing.T) {
+	assertStreamsThroughServer(t, createProxyTestConfig(), "text/event-stream")
+}
+
+func TestProxyService_StreamingWithCharset(t *testing.T) {
+	payload := streamPayload(3)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		_, _ = w.Write(payload)
+	}))
+	defer upstream.Close()
+
+	proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if !w.Flushed {
+		t.Error("Expected the stream to take the flushing path")
+	}
+	if got := w.Body.String(); got != string(payload) {
+		t.Errorf("Unexpected stream body %q", got)
+	}
+
+	t.Run("flushes through the server", func(t *testing.T) {
+		assertStreamsThroughServer(t, createProxyTestConfig(), "Text/Event-Stream; charset=utf-8")
+	})
+}
+
+func TestProxyService_StreamInterrupted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		// One whole event and half of the next, then the connection drops
+		chunk := "data: {\"id\":\"1\"}\n\ndata: {\"id\""
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n", len(chunk), chunk)
+		_ = buf.Flush()
+		_ = conn.Close()
+	}))
+	defer upstream.Close()
+
+	proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "data: {\"id\":\"1\"}\n\n") {
+		t.Errorf("Expected the events received before the reset to be forwarded, got %q", body)
+	}
+	if !strings.Contains(body, "\n\nevent: error\ndata: {\"error\":") {
+		t.Errorf("Expected a synthetic error event after the cut-off event, got %q", body)
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("Expected the stream to end with [DONE], got %q", body)
+	}
+}
+
+func TestProxyService_StreamReconnect(t *testing.T) {
+	const streamBody = `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	var continued []byte
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack failed: %v", err)
+				return
+			}
+			// Two whole events and half of a third, then the connection drops
+			chunk := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello\"}}]}\n\n" +
+				"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\" wor\"}}]}\n\ndata: {\"cho"
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n", len(chunk), chunk)
+			_ = buf.Flush()
+			_ = conn.Close()
+			return
+		}
+		continued, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"ld\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	cfg := createProxyTestConfig()
+	cfg.Proxy.StreamReconnects = 1
+	proxy := newTestProxyService(t, cfg, upstream)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(streamBody))
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+
+	if requests != 2 {
+		t.Fatalf("Expected one continuation request, got %d upstream requests", requests)
+	}
+	var request struct {
+		Messages []struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(continued, &request); err != nil {
+		t.Fatalf("Invalid continuation body %q: %v", continued, err)
+	}
+	if n := len(request.Messages); n != 2 || request.Messages[1].Role != "assistant" || request.Messages[1].Content != "Hello wor" {
+		t.Errorf("Expected the partial reply appended as an assistant message, got %+v", request.Messages)
+	}
+
+	body := w.Body.String()
+	if strings.Contains(body, "event: error") || strings.Contains(body, `{"cho`+"\n") {
+		t.Errorf("Expected no error event or partial event after a successful continuation, got %q", body)
+	}
+	for _, content := range []string{`"Hello"`, `" wor"`, `"ld"`} {
+		if !strings.Contains(body, content) {
+			t.Errorf("Expected %s in the stream, got %q", content, body)
+		}
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("Expected the continued stream to end with [DONE], got %q", body)
+	}
+
+	t.Run("gives up when the continuation adds nothing", func(t *testing.T) {
+		attempts := 0
+		dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			attempts++
+			w.Header().Set("Content-Type", "text/event-stream")
+			if attempts == 1 {
+				_, _ = io.WriteString(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\n")
+			}
+		}))
+		defer dropping.Close()
+
+		cfg := createProxyTestConfig()
+		cfg.Proxy.StreamReconnects = 3
+		proxy := newTestProxyService(t, cfg, dropping)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(streamBody))
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+
+		if attempts != 2 {
+			t.Errorf("Expected a single continuation before giving up, got %d upstream requests", attempts)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "event: error") || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+			t.Errorf("Expected the stream to end with an error event and [DONE], got %q", body)
+		}
+	})
+
+	t.Run("does not continue for a client that cannot be written to", func(t *testing.T) {
+		attempts := 0
+		dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			attempts++
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\n")
+		}))
+		defer dropping.Close()
+
+		cfg := createProxyTestConfig()
+		cfg.Proxy.StreamReconnects = 3
+		proxy := newTestProxyService(t, cfg, dropping)
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(streamBody))
+		proxy.Handler().ServeHTTP(&failingWriter{ResponseRecorder: httptest.NewRecorder()}, req)
+
+		if attempts != 1 {
+			t.Errorf("Expected no continuation after a client write error, got %d upstream requests", attempts)
+		}
+	})
+}
+
+// failingWriter accepts headers but fails every body write, like a gone client
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w *failingWriter) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestProxyService_NotEntitled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":{"message":"You are not entitled to use Copilot","code":"not_entitled"}}`))
+	}))
+	defer upstream.Close()
+
+	proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected a JSON error, got %q", w.Body.String())
+	}
+	if body.Error.Type != "copilot_not_entitled" || !strings.Contains(body.Error.Message, "does not have Copilot access") {
+		t.Errorf("Expected an actionable not-entitled error, got %+v", body.Error)
+	}
+}
+
+func TestProxyService_UpstreamAcceptEncoding(t *testing.T) {
+	const streamBody = `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name     string
+		policy   string
+		body     string
+		wantGzip bool
+	}{
+		{name: "regular request allows gzip", body: testChatBody, wantGzip: true},
+		{name: "streaming request disables compression", body: streamBody, wantGzip: false},
+		{name: "gzip policy compresses streams", policy: "gzip", body: streamBody, wantGzip: true},
+		{name: "identity policy disables compression", policy: "identity", body: testChatBody, wantGzip: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			want, contentType := `{"id":"1"}`, "application/json"
+			if tt.body == streamBody {
+				want, contentType = "data: [DONE]\n\n", "text/event-stream"
+			}
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", contentType)
+				_, _ = w.Write([]byte(want))
+			}))
+			defer upstream.Close()
+
+			cfg := createProxyTestConfig()
+			cfg.Proxy.AcceptEncoding = tt.policy
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if gzip := strings.Contains(got, "gzip"); gzip != tt.wantGzip {
+				t.Errorf("Expected gzip accepted %v, got Accept-Encoding %q", tt.wantGzip, got)
+			}
+			if w.Body.String() != want {
+				t.Errorf("Expected an uncompressed body for the client, got %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestProxyService_MaxConcurrentUpstream(t *testing.T) {
+	received := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		received <- struct{}{}
+		<-unblock
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer upstream.Close()
+
+	cfg := createProxyTestConfig()
+	cfg.MaxConcurrentUpstream = 1
+	cfg.Timeouts.UpstreamAcquire = 1
+	proxy := newTestProxyService(t, cfg, upstream)
+
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Occupy the only upstream slot
+	first := make(chan int, 1)
+	go func() { first <- send() }()
+	<-received
+
+	if got := proxy.UpstreamInFlight(); got != 1 {
+		t.Errorf("Expected 1 in-flight upstream request, got %d", got)
+	}
+
+	t.Run("request over the limit is rejected after waiting", func(t *testing.T) {
+		if code := send(); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503, got %d", code)
+		}
+	})
+
+	t.Run("queued request proceeds once a slot frees up", func(t *testing.T) {
+		second := make(chan int, 1)
+		go func() { second <- send() }()
+
+		time.Sleep(200 * time.Millisecond)
+		close(unblock)
+
+		if code := <-first; code != http.StatusOK {
+			t.Errorf("Expected first request to succeed, got %d", code)
+		}
+		if code := <-second; code != http.StatusOK {
+			t.Errorf("Expected queued request to succeed, got %d", code)
+		}
+	})
+
+	if got := proxy.UpstreamInFlight(); got != 0 {
+		t.Errorf("Expected no in-flight upstream requests, got %d", got)
+	}
+}
+
+func TestProxyService_MaxConcurrentStreams(t *testing.T) {
+	streaming := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"stream":true`) {
+			streaming <- struct{}{}
+			<-unblock
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer upstream.Close()
+
+	cfg := createProxyTestConfig()
+	cfg.MaxConcurrentStreams = 1
+	proxy := newTestProxyService(t, cfg, upstream)
+
+	const streamBody = `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	send := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Hold the only stream slot open
+	first := make(chan int, 1)
+	go func() { first <- send(streamBody) }()
+	<-streaming
+
+	if got := proxy.ActiveStreams(); got != 1 {
+		t.Errorf("Expected 1 active stream, got %d", got)
+	}
+	if code := send(streamBody); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected stream over the limit to get 503, got %d", code)
+	}
+	if code := send(testChatBody); code != http.StatusOK {
+		t.Errorf("Expected non-streaming request to succeed, got %d", code)
+	}
+
+	close(unblock)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("Expected first stream to succeed, got %d", code)
+	}
+	if got := proxy.ActiveStreams(); got != 0 {
+		t.Errorf("Expected no active streams, got %d", got)
+	}
+}
+
+func TestProxyService_MultipartPassthrough(t *testing.T) {
+	var (
+		gotPath, gotContentType, gotFile, gotModel string
+		parseErr                                   error
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotContentType = r.Header.Get("Content-Type")
+		if parseErr = r.ParseMultipartForm(1 << 20); parseErr == nil {
+			gotModel = r.FormValue("model")
+			if file, _, err := r.FormFile("file"); err == nil {
+				data, _ := io.ReadAll(file)
+				gotFile = string(data)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"text":"hello"}`))
+	}))
+	defer upstream.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("model", "whisper-1"); err != nil {
+		t.Fatalf("failed to write field: %v", err)
+	}
+	part, err := form.CreateFormFile("file", "audio.wav")
+	if err != nil {
+		t.Fatalf("failed to create file part: %v", err)
+	}
+	_, _ = part.Write([]byte("RIFF-fake-audio"))
+	if err := form.Close(); err != nil {
+		t.Fatalf("failed to close form: %v", err)
+	}
+
+	proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+	req := httptest.NewRequest(http.MethodPost, "/v1/audio/transcriptions", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	proxy.PassthroughHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotPath != "/audio/transcriptions" {
+		t.Errorf("Expected upstream path /audio/transcriptions, got %q", gotPath)
+	}
+	if gotContentType != form.FormDataContentType() {
+		t.Errorf("Expected Content-Type %q with boundary, got %q", form.FormDataContentType(), gotContentType)
+	}
+	if parseErr != nil {
+		t.Fatalf("Upstream failed to parse multipart body: %v", parseErr)
+	}
+	if gotModel != "whisper-1" || gotFile != "RIFF-fake-audio" {
+		t.Errorf("Expected parts to arrive intact, got model=%q file=%q", gotModel, gotFile)
+	}
+	if w.Body.String() != `{"text":"hello"}` {
+		t.Errorf("Unexpected response body %q", w.Body.String())
+	}
+}
+
+func TestProxyService_ContentTypeAllowlist(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     []string
+		contentType string
+		passthrough bool
+		reverse     bool
+		wantStatus  int
+	}{
+		{name: "json with charset", contentType: "application/json; charset=utf-8", wantStatus: http.StatusOK},
+		{name: "no content type", contentType: "", wantStatus: http.StatusOK},
+		{name: "text rejected", contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "form rejected", contentType: "application/x-www-form-urlencoded", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "configured type accepted", allowed: []string{"application/json", "text/plain"}, contentType: "text/plain", wantStatus: http.StatusOK},
+		{name: "multipart passthrough exempt", contentType: "multipart/form-data; boundary=x", passthrough: true, wantStatus: http.StatusOK},
+		{name: "reverse proxy accepts json", contentType: "application/json", reverse: true, wantStatus: http.StatusOK},
+		{name: "reverse proxy rejects text", contentType: "text/plain", reverse: true, wantStatus: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				calls.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			cfg := createProxyTestConfig()
+			cfg.Proxy.AllowedContentTypes = tt.allowed
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			path, body, handler := "/v1/chat/completions", testChatBody, proxy.Handler()
+			if tt.reverse {
+				handler = proxy.ReverseProxyHandler()
+			}
+			if tt.passthrough {
+				path, body, handler = "/v1/audio/transcriptions", "--x\r\nContent-Disposition: form-data; name=\"model\"\r\n\r\nwhisper-1\r\n--x--\r\n", proxy.PassthroughHandler()
+			}
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			wantCalls := int32(0)
+			if tt.wantStatus == http.StatusOK {
+				wantCalls = 1
+			}
+			if got := calls.Load(); got != wantCalls {
+				t.Errorf("Expected %d upstream calls, got %d", wantCalls, got)
+			}
+		})
+	}
+}
+
+func TestProxyService_ModelNormalization(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		expected string
+	}{
+		{name: "aliased model rewritten", model: "gpt-4", expected: "gpt-4o"},
+		{name: "vendor prefix stripped", model: "openai/gpt-4.1", expected: "gpt-4.1"},
+		{name: "unknown model unchanged", model: "future-model-x", expected: "future-model-x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]interface{}
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&got)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+			body := `{"model":"` + tt.model + `","messages":[{"role":"user","content":"hi"}],"temperature":0.2}`
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got["model"] != tt.expected {
+				t.Errorf("Expected upstream model %q, got %v", tt.expected, got["model"])
+			}
+			if got["temperature"] != 0.2 || got["messages"] == nil {
+				t.Errorf("Expected other fields to be preserved, got %v", got)
+			}
+		})
+	}
+}
+
+func TestProxyService_OverrideModelHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		override   string
+		allowed    []string
+		wantStatus int
+		wantModel  string
+	}{
+		{name: "override rewrites the model", override: "claude-sonnet-4", wantStatus: http.StatusOK, wantModel: "claude-sonnet-4"},
+		{name: "override is normalized", override: "openai/gpt-4", wantStatus: http.StatusOK, wantModel: "gpt-4o"},
+		{name: "no override keeps the client model", wantStatus: http.StatusOK, wantModel: "gpt-4o"},
+		{name: "override inside the allowlist", override: "o4-mini", allowed: []string{"gpt-4o", "o4-mini"}, wantStatus: http.StatusOK, wantModel: "o4-mini"},
+		{name: "override outside the allowlist", override: "claude-opus-4", allowed: []string{"gpt-4o", "o4-mini"}, wantStatus: http.StatusForbidden},
+		{name: "client model outside the allowlist", allowed: []string{"o4-mini"}, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]interface{}
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&got)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			cfg := createProxyTestConfig()
+			cfg.AllowedModels = tt.allowed
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+			if tt.override != "" {
+				req.Header.Set("X-Override-Model", tt.override)
+			}
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				if got != nil {
+					t.Errorf("Expected no upstream request, got %v", got)
+				}
+				return
+			}
+			if got["model"] != tt.wantModel {
+				t.Errorf("Expected upstream model %q, got %v", tt.wantModel, got["model"])
+			}
+			if got["messages"] == nil {
+				t.Errorf("Expected other fields to be preserved, got %v", got)
+			}
+		})
+	}
+}
+
+func TestProxyService_SamplingDefaults(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		wantTemperature interface{}
+		wantTopP        interface{}
+	}{
+		{name: "defaults fill omitted parameters", body: testChatBody, wantTemperature: 0.2, wantTopP: 0.9},
+		{
+			name:            "explicit client values are untouched",
+			body:            `{"model":"gpt-4o","temperature":1.5,"top_p":0.5,"messages":[{"role":"user","content":"hi"}]}`,
+			wantTemperature: 1.5, wantTopP: 0.5,
+		},
+		{
+			name:            "explicit zero temperature is kept",
+			body:            `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`,
+			wantTemperature: 0.0, wantTopP: 0.9,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]interface{}
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&got)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			temperature, topP := 0.2, 0.9
+			cfg := createProxyTestConfig()
+			cfg.DefaultTemperature = &temperature
+			cfg.DefaultTopP = &topP
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got["temperature"] != tt.wantTemperature {
+				t.Errorf("Expected temperature %v, got %v", tt.wantTemperature, got["temperature"])
+			}
+			if got["top_p"] != tt.wantTopP {
+				t.Errorf("Expected top_p %v, got %v", tt.wantTopP, got["top_p"])
+			}
+			if got["messages"] == nil {
+				t.Errorf("Expected other fields to be preserved, got %v", got)
+			}
+		})
+	}
+}
+
+func TestProxyService_ChatBodyValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantParam  string
+	}{
+		{name: "valid body passes through", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"vendor_field":true}`, wantStatus: http.StatusOK},
+		{name: "missing messages", body: `{"model":"gpt-4o"}`, wantStatus: http.StatusBadRequest, wantParam: "messages"},
+		{name: "empty messages", body: `{"model":"gpt-4o","messages":[]}`, wantStatus: http.StatusBadRequest, wantParam: "messages"},
+		{name: "empty model", body: `{"model":"","messages":[{"role":"user","content":"hi"}]}`, wantStatus: http.StatusBadRequest, wantParam: "model"},
+		{name: "whitespace model", body: `{"model":"  \t","messages":[{"role":"user","content":"hi"}]}`, wantStatus: http.StatusBadRequest, wantParam: "model"},
+		{name: "non-string model", body: `{"model":4,"messages":[{"role":"user","content":"hi"}]}`, wantStatus: http.StatusBadRequest, wantParam: "model"},
+		{name: "not an object", body: `[1,2]`, wantStatus: http.StatusBadRequest, wantParam: "body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamCalls atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamCalls.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK {
+				if upstreamCalls.Load() != 1 {
+					t.Errorf("Expected the request to be forwarded once, got %d upstream calls", upstreamCalls.Load())
+				}
+				return
+			}
+
+			if upstreamCalls.Load() != 0 {
+				t.Errorf("Expected no upstream call for an invalid body, got %d", upstreamCalls.Load())
+			}
+			var envelope struct {
+				Error struct {
+					Message string `json:"message"`
+					Type    string `json:"type"`
+					Param   string `json:"param"`
+					Code    int    `json:"code"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("Expected a JSON error envelope, got %q: %v", w.Body.String(), err)
+			}
+			if envelope.Error.Type != "validation_error" || envelope.Error.Code != http.StatusBadRequest {
+				t.Errorf("Expected a validation_error with code 400, got %+v", envelope.Error)
+			}
+			if envelope.Error.Param != tt.wantParam || envelope.Error.Message == "" {
+				t.Errorf("Expected a message about %q, got %+v", tt.wantParam, envelope.Error)
+			}
+		})
+	}
+}
+
+func TestProxyService_DefaultModel(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		model string
+	}{
+		{name: "empty model", body: `{"model":"","messages":[{"role":"user","content":"hi"}]}`, model: "claude-sonnet-4"},
+		{name: "whitespace model", body: `{"model":"   ","messages":[{"role":"user","content":"hi"}]}`, model: "claude-sonnet-4"},
+		{name: "missing model", body: `{"messages":[{"role":"user","content":"hi"}]}`, model: "claude-sonnet-4"},
+		{name: "model given", body: testChatBody, model: "gpt-4o"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotModel string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Model string `json:"model"`
+				}
+				_ = json.NewDecoder(r.Body).Decode(&req)
+				gotModel = req.Model
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			cfg := createProxyTestConfig()
+			cfg.DefaultModel = "claude-sonnet-4"
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body)))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if gotModel != tt.model {
+				t.Errorf("Expected upstream model %q, got %q", tt.model, gotModel)
+			}
+		})
+	}
+}
+
+func TestProxyService_DefaultSystemPrompt(t *testing.T) {
+	const policy = "Answer politely."
+	userMessage := `{"role":"user","content":[{"type":"text","text":"hi"}],"name":"alice"}`
+	tests := []struct {
+		name     string
+		messages string
+		want     string
+	}{
+		{
+			name:     "injected when absent",
+			messages: `[` + userMessage + `]`,
+			want:     `[{"role":"system","content":"` + policy + `"},` + userMessage + `]`,
+		},
+		{
+			name:     "kept when a system message exists",
+			messages: `[` + userMessage + `,{"role":"system","content":"Be terse."}]`,
+			want:     `[` + userMessage + `,{"role":"system","content":"Be terse."}]`,
+		},
+		{
+			name:     "kept when a developer message exists",
+			messages: `[{"role":"developer","content":"Be terse."},` + userMessage + `]`,
+			want:     `[{"role":"developer","content":"Be terse."},` + userMessage + `]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				Messages json.RawMessage `json:"messages"`
+				Tools    json.RawMessage `json:"tools"`
+			}
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&got)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			cfg := createProxyTestConfig()
+			cfg.DefaultSystemPrompt = policy
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			body := `{"model":"gpt-4o","messages":` + tt.messages + `,"tools":[{"type":"function","function":{"name":"f"}}]}`
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			if string(got.Messages) != tt.want {
+				t.Errorf("Expected messages %s, got %s", tt.want, got.Messages)
+			}
+			if string(got.Tools) != `[{"type":"function","function":{"name":"f"}}]` {
+				t.Errorf("Expected other fields to be forwarded verbatim, got tools %s", got.Tools)
+			}
+		})
+	}
+}
+
+func TestProxyService_RequestBodyEdits(t *testing.T) {
+	var got []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer upstream.Close()
+	send := func(t *testing.T, cfg *internal.Config, body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		newTestProxyService(t, cfg, upstream).Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	t.Run("an untouched body is forwarded byte for byte", func(t *testing.T) {
+		body := `{ "messages": [{"role":"user","content":"hi"}],  "model": "gpt-4o" }`
+		send(t, createProxyTestConfig(), body)
+		if string(got) != body {
+			t.Errorf("Expected the body unchanged, got %s", got)
+		}
+	})
+
+	t.Run("every step's edits reach the upstream", func(t *testing.T) {
+		temperature := 0.2
+		cfg := createProxyTestConfig()
+		cfg.DefaultModel = "gpt-4o"
+		cfg.DefaultSystemPrompt = "Answer politely."
+		cfg.DefaultTemperature = &temperature
+		cfg.MaxMessages = 2
+		cfg.MaxMessagesMode = "truncate"
+		send(t, cfg, `{"messages":[{"role":"user","content":"first"},{"role":"assistant","content":"ok"},{"role":"user","content":"latest"}]}`)
+
+		want := `{"messages":[{"role":"system","content":"Answer politely."},{"role":"assistant","content":"ok"},{"role":"user","content":"latest"}],` +
+			`"model":"gpt-4o","temperature":0.2}`
+		if string(got) != want {
+			t.Errorf("Expected upstream body %s, got %s", want, got)
+		}
+	})
+}
+
+func TestProxyService_MaxMessages(t *testing.T) {
+	const (
+		system   = `{"role":"system","content":"Be terse."}`
+		first    = `{"role":"user","content":"first"}`
+		call     = `{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]}`
+		result   = `{"role":"tool","tool_call_id":"call_1","content":"42"}`
+		answer   = `{"role":"assistant","content":"It is 42."}`
+		question = `{"role":"user","content":"latest"}`
+	)
+	messages := `[` + strings.Join([]string{system, first, call, result, answer, question}, ",") + `]`
+	tests := []struct {
+		name       string
+		limit      int
+		mode       string
+		wantStatus int
+		want       string
+	}{
+		{name: "within the limit", limit: 6, mode: "reject", wantStatus: http.StatusOK, want: messages},
+		{name: "rejected", limit: 4, mode: "", wantStatus: http.StatusBadRequest},
+		{
+			name:       "truncated keeping the system and latest messages",
+			limit:      3,
+			mode:       "truncate",
+			wantStatus: http.StatusOK,
+			want:       `[` + system + `,` + answer + `,` + question + `]`,
+		},
+		{
+			name:       "truncated without orphaned tool results",
+			limit:      4,
+			mode:       "truncate",
+			wantStatus: http.StatusOK,
+			want:       `[` + system + `,` + answer + `,` + question + `]`,
+		},
+		{
+			name:       "the latest message is always kept",
+			limit:      1,
+			mode:       "truncate",
+			wantStatus: http.StatusOK,
+			want:       `[` + system + `,` + question + `]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				Messages json.RawMessage `json:"messages"`
+			}
+			calls := 0
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				_ = json.NewDecoder(r.Body).Decode(&got)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			cfg := createProxyTestConfig()
+			cfg.MaxMessages = tt.limit
+			cfg.MaxMessagesMode = tt.mode
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			body := `{"model":"gpt-4o","messages":` + messages + `}`
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				if calls != 0 {
+					t.Errorf("Expected no upstream call for a rejected request, got %d", calls)
+				}
+				if !strings.Contains(w.Body.String(), `"param":"messages"`) {
+					t.Errorf("Expected the error to name the messages parameter, got %s", w.Body.String())
+				}
+				return
+			}
+			if string(got.Messages) != tt.want {
+				t.Errorf("Expected messages %s, got %s", tt.want, got.Messages)
+			}
+		})
+	}
+}
+
+func TestPlainTextHandler(t *testing.T) {
+	const (
+		jsonBody   = `{"id":"1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"Hello, world!"},"finish_reason":"stop"}]}`
+		streamBody = "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"\"}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello, \"}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"world!\"}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+			"data: [DONE]\n\n"
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accept := r.Header.Get("Accept"); strings.Contains(accept, "text/plain") {
+			t.Errorf("Expected the text/plain Accept header not to reach the upstream, got %q", accept)
+		}
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case strings.Contains(string(body), `"model":"o3-mini"`):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"message":"bad request"}}`))
+		case strings.Contains(string(body), `"stream":true`):
+			w.Header().Set("Content-Type", "Text/Event-Stream; charset=utf-8")
+			flusher := w.(http.Flusher)
+			for _, event := range strings.SplitAfter(streamBody, "\n\n") {
+				_, _ = w.Write([]byte(event))
+				flusher.Flush()
+			}
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(jsonBody))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	handler := internal.PlainTextHandler(newTestProxyService(t, createProxyTestConfig(), upstream).Handler())
+
+	tests := []struct {
+		name        string
+		target      string
+		accept      string
+		body        string
+		status      int
+		contentType string
+		want        string
+	}{
+		{"streaming to text", "/v1/chat/completions?format=text", "", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`, http.StatusOK, "text/plain; charset=utf-8", "Hello, world!"},
+		{"non-streaming to text", "/v1/chat/completions?format=text", "", testChatBody, http.StatusOK, "text/plain; charset=utf-8", "Hello, world!"},
+		{"Accept header selects text", "/v1/chat/completions", "text/plain", testChatBody, http.StatusOK, "text/plain; charset=utf-8", "Hello, world!"},
+		{"JSON by default", "/v1/chat/completions", "", testChatBody, http.StatusOK, "application/json", jsonBody},
+		{"errors pass through", "/v1/chat/completions?format=text", "", `{"model":"o3-mini","messages":[{"role":"user","content":"hi"}]}`, http.StatusBadRequest, "application/json", `{"error":{"message":"bad request"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Expected Content-Type %q, got %q", tt.contentType, got)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("Expected body %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProxyService_SeatRotation(t *testing.T) {
+	// newSeatUpstream serves Copilot token exchanges (cp-<github token>) and chat
+	// completions, counting chat requests per Copilot token
+	newSeatUpstream := func(t *testing.T, limited string) (*httptest.Server, func() map[string]int) {
+		t.Helper()
+		var mu sync.Mutex
+		seen := map[string]int{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/copilot_internal/v2/token" {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = fmt.Fprintf(w, `{"token":"cp-%s","expires_at":%d,"refresh_in":1500}`,
+					strings.TrimPrefix(r.Header.Get("Authorization"), "token "), time.Now().Add(time.Hour).Unix())
+				return
+			}
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			mu.Lock()
+			seen[token]++
+			mu.Unlock()
+			if token == limited {
+				w.Header().Set("Retry-After", "120")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		}))
+		t.Cleanup(srv.Close)
+		return srv, func() map[string]int {
+			mu.Lock()
+			defer mu.Unlock()
+			out := map[string]int{}
+			for k, v := range seen {
+				out[k] = v
+			}
+			return out
+		}
+	}
+
+	send := func(t *testing.T, proxy *internal.ProxyService) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	t.Run("requests rotate across seats", func(t *testing.T) {
+		upstream, seen := newSeatUpstream(t, "")
+		cfg := createProxyTestConfig()
+		cfg.GitHubTokens = []string{"gh-b", "gh-c"}
+		proxy := newTestProxyService(t, cfg, upstream)
+
+		for i := 0; i < 6; i++ {
+			send(t, proxy)
+		}
+
+		want := map[string]int{"test-copilot-token": 2, "cp-gh-b": 2, "cp-gh-c": 2}
+		if got := seen(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected requests spread as %v, got %v", want, got)
+		}
+	})
+
+	t.Run("rate limited seat is skipped", func(t *testing.T) {
+		upstream, seen := newSeatUpstream(t, "cp-gh-b")
+		cfg := createProxyTestConfig()
+		cfg.GitHubTokens = []string{"gh-b", "gh-c"}
+		proxy := newTestProxyService(t, cfg, upstream)
+
+		for i := 0; i < 6; i++ {
+			send(t, proxy)
+		}
+
+		got := seen()
+		if got["cp-gh-b"] != 1 {
+			t.Errorf("Expected the rate-limited seat to be tried once, got %d", got["cp-gh-b"])
+		}
+		if got["test-copilot-token"]+got["cp-gh-c"] != 6 {
+			t.Errorf("Expected the remaining seats to serve all 6 requests, got %v", got)
+		}
+	})
+
+	t.Run("reverse proxy uses seats and skips a rate-limited one", func(t *testing.T) {
+		upstream, seen := newSeatUpstream(t, "cp-gh-b")
+		cfg := createProxyTestConfig()
+		cfg.GitHubTokens = []string{"gh-b", "gh-c"}
+		proxy := newTestProxyService(t, cfg, upstream)
+		handler := proxy.ReverseProxyHandler()
+
+		limited := 0
+		for i := 0; i < 6; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code == http.StatusTooManyRequests {
+				limited++
+			}
+		}
+
+		// The streamed body cannot be replayed, so the 429 reaches the client once
+		got := seen()
+		if got["cp-gh-b"] != 1 || limited != 1 {
+			t.Errorf("Expected the rate-limited seat to be tried once, got %d tries and %d 429s", got["cp-gh-b"], limited)
+		}
+		if got["test-copilot-token"]+got["cp-gh-c"] != 5 || got["cp-gh-c"] == 0 {
+			t.Errorf("Expected the other seats to serve the remaining requests, got %v", got)
+		}
+	})
+
+	t.Run("single token uses the configured token", func(t *testing.T) {
+		upstream, seen := newSeatUpstream(t, "")
+		proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+
+		send(t, proxy)
+		send(t, proxy)
+
+		if want := map[string]int{"test-copilot-token": 2}; !reflect.DeepEqual(seen(), want) {
+			t.Errorf("Expected %v, got %v", want, seen())
+		}
+	})
+}
+
+func TestProxyService_StreamTranscoding(t *testing.T) {
+	const completion = `{"id":"c1","object":"chat.completion","created":1,"model":"o1",` +
+		`"choices":[{"index":0,"message":{"role":"assistant","content":"Hello!"},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`
+	tests := []struct {
+		name      string
+		stream    bool
+		options   string
+		response  string
+		wantType  string
+		wantEvent string
+		wantUsage int
+	}{
+		{name: "streamed request gets SSE", stream: true, response: completion, wantType: "text/event-stream"},
+		{name: "usage is sent when asked for", stream: true, options: `,"stream_options":{"include_usage":true}`, response: completion, wantType: "text/event-stream", wantUsage: 12},
+		{name: "non-completion becomes an error event", stream: true, response: `{"unexpected":true}`, wantType: "text/event-stream", wantEvent: "event: error"},
+		{name: "non-streamed request gets JSON", stream: false, response: completion, wantType: "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = io.WriteString(w, tt.response)
+			}))
+			defer upstream.Close()
+			proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+
+			body := fmt.Sprintf(`{"model":"o1","stream":%t%s,"messages":[{"role":"user","content":"hi"}]}`, tt.stream, tt.options)
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Fatalf("Expected Content-Type %s, got %q", tt.wantType, got)
+			}
+			if !tt.stream {
+				if w.Body.String() != completion {
+					t.Errorf("Expected the JSON response unchanged, got %s", w.Body.String())
+				}
+				return
+			}
+
+			if !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+				t.Errorf("Expected the stream to end with [DONE], got %q", w.Body.String())
+			}
+			if tt.wantEvent != "" {
+				if !strings.Contains(w.Body.String(), tt.wantEvent) {
+					t.Errorf("Expected %q in the stream, got %q", tt.wantEvent, w.Body.String())
+				}
+				return
+			}
+			resp, err := transform.AggregateChatStream(w.Body)
+			if err != nil {
+				t.Fatalf("Expected a valid chat stream, got %v", err)
+			}
+			if len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "Hello!" || resp.Choices[0].FinishReason != "stop" || resp.Usage.TotalTokens != tt.wantUsage {
+				t.Errorf("Expected the completion to be carried by the stream, got %+v", resp)
+			}
+		})
+	}
+}
+
+func TestProxyService_LegacyCompletions(t *testing.T) {
+	var gotBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = io.ReadAll(r.Body)
+		if strings.Contains(string(gotBody), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":null}]}`+"\n\n")
+			_, _ = io.WriteString(w, "data: [DONE]\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"c1","object":"chat.completion","created":1,"model":"gpt-4o",`+
+			`"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}],`+
+			`"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+	}))
+	defer upstream.Close()
+
+	proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		proxy.CompletionsHandler().ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("prompt is sent as a user message and the response is translated", func(t *testing.T) {
+		w := send(`{"model":"gpt-4o","prompt":"Say hi"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if want := `"messages":[{"role":"user","content":"Say hi"}]`; !strings.Contains(string(gotBody), want) {
+			t.Errorf("Expected upstream body to contain %s, got %s", want, gotBody)
+		}
+
+		var resp map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Expected JSON response, got %q", w.Body.String())
+		}
+		choice := resp["choices"].([]interface{})[0].(map[string]interface{})
+		if resp["object"] != "text_completion" || choice["text"] != "Hi" || choice["finish_reason"] != "stop" {
+			t.Errorf("Expected legacy completion, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("streamed chunks are translated", func(t *testing.T) {
+		w := send(`{"model":"gpt-4o","prompt":"Say hi","stream":true}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		want := `data: {"id":"c1","object":"text_completion","created":1,"model":"gpt-4o","choices":[{"text":"Hi","index":0,"logprobs":null,"finish_reason":null}]}` +
+			"\n\ndata: [DONE]\n\n"
+		if w.Body.String() != want {
+			t.Errorf("Unexpected stream\nwant: %q\n got: %q", want, w.Body.String())
+		}
+	})
+
+	t.Run("batched prompts are rejected", func(t *testing.T) {
+		if w := send(`{"model":"gpt-4o","prompt":["a","b"]}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestProxyService_ResponseFormat(t *testing.T) {
+	const responseFormat = `{"type":"json_schema","json_schema":{"name":"answer","strict":true,"schema":{"type":"object","properties":{"value":{"type":"integer"}}}}}`
+	tests := []struct {
+		name     string
+		model    string
+		wantWarn bool
+	}{
+		{name: "supported by the model", model: "gpt-4o"},
+		{name: "unsupported by the model", model: "claude-sonnet-4", wantWarn: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]json.RawMessage
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&got)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":"1"}`))
+			}))
+			defer upstream.Close()
+
+			proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+			body := `{"model":"` + tt.model + `","messages":[{"role":"user","content":"hi"}],"response_format":` + responseFormat + `}`
+
+			internal.Init("warn")
+			t.Cleanup(func() { internal.Init("error") })
+			logs := captureProxyStdout(t, func() {
+				req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+				w := httptest.NewRecorder()
+				proxy.Handler().ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+			})
+
+			if string(got["response_format"]) != responseFormat {
+				t.Errorf("Expected response_format forwarded unchanged, got %s", got["response_format"])
+			}
+			if warned := strings.Contains(logs, "may not support the requested response format"); warned != tt.wantWarn {
+				t.Errorf("Expected warning %v, got logs:\n%s", tt.wantWarn, logs)
+			}
+		})
+	}
+}
+
+func TestProxyService_BodySizeMetrics(t *testing.T) {
+	response := `{"content":"` + strings.Repeat("x", 2000) + `"}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, response)
+	}))
+	defer upstream.Close()
+
+	cfg := createProxyTestConfig()
+	cfg.Metrics.LargeResponseBytes = 1000
+	proxy := newTestProxyService(t, cfg, upstream)
+
+	internal.Init("warn")
+	t.Cleanup(func() { internal.Init("error") })
+	logs := captureProxyStdout(t, func() {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	requests := proxy.RequestBytes()
+	if requests.Count != 1 || requests.Sum != float64(len(testChatBody)) || requests.Counts[0] != 1 {
+		t.Errorf("Expected one %d-byte request in the first bucket, got %+v", len(testChatBody), requests)
+	}
+	responses := proxy.ResponseBytes()
+	if responses.Count != 1 || responses.Sum != float64(len(response)) {
+		t.Errorf("Expected one %d-byte response, got %+v", len(response), responses)
+	}
+	// 2KB lands in the 4KB bucket, not the 1KB one
+	if responses.Counts[0] != 0 || responses.Counts[1] != 1 {
+		t.Errorf("Expected the response in the 4KB bucket, got %v", responses.Counts)
+	}
+	if !strings.Contains(logs, "Large response") {
+		t.Errorf("Expected a large-response warning, got logs:\n%s", logs)
+	}
+}
+
+// captureProxyStdout returns what f writes to stdout, where the logger writes
+func captureProxyStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	f()
+	_ = w.Close()
+	return <-out
+}
+
+// newStreamingUpstream serves payload as an SSE response in 100-byte writes
+func newStreamingUpstream(tb testing.TB, payload []byte) *httptest.Server {
+	tb.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		for rest := payload; len(rest) > 0; {
+			n := min(100, len(rest))
+			_, _ = w.Write(rest[:n])
+			flusher.Flush()
+			rest = rest[n:]
+		}
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// streamPayload builds n SSE chunk events
+func streamPayload(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"token %d\"}}]}\n\n", i)
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return b.Bytes()
+}
+
+func TestProxyService_StreamBufferSize(t *testing.T) {
+	payload := streamPayload(2000)
+	upstream := newStreamingUpstream(t, payload)
+
+	for _, size := range []int{0, 256, 1024, 8192, 65536} {
+		t.Run(fmt.Sprintf("buffer %d", size), func(t *testing.T) {
+			cfg := createProxyTestConfig()
+			cfg.Proxy.StreamBufferSize = size
+			proxy := newTestProxyService(t, cfg, upstream)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+			w := httptest.NewRecorder()
+			proxy.Handler().ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			if !bytes.Equal(w.Body.Bytes(), payload) {
+				t.Errorf("Expected the complete %d-byte stream, got %d bytes", len(payload), w.Body.Len())
+			}
+			if !w.Flushed {
+				t.Error("Expected streamed chunks to be flushed")
+			}
+		})
+	}
+
+	t.Run("flushes through the server", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.Proxy.StreamBufferSize = 65536
+		assertStreamsThroughServer(t, cfg, "text/event-stream")
+	})
+}
+
+// writeCountingRecorder counts writes to the client, each of which is a socket write in production
+type writeCountingRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *writeCountingRecorder) Write(data []byte) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.Write(data)
+}
+
+func BenchmarkProxyService_StreamBufferSize(b *testing.B) {
+	upstream := newStreamingUpstream(b, streamPayload(5000))
+
+	for _, size := range []int{1024, 4096, 8192, 32768} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			cfg := createProxyTestConfig()
+			cfg.Proxy.StreamBufferSize = size
+			handler := newTestProxyService(b, cfg, upstream).Handler()
+
+			writes := 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+				w := &writeCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+				handler.ServeHTTP(w, req)
+				writes += w.writes
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestProxyService_IdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n := calls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"n":%d}`, n)
+	}))
+	defer upstream.Close()
+
+	send := func(t *testing.T, proxy *internal.ProxyService, key string, from ...func(*http.Request)) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		for _, f := range from {
+			f(req)
+		}
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+	newProxy := func(t *testing.T, enabled bool) *internal.ProxyService {
+		cfg := createProxyTestConfig()
+		cfg.Idempotency.Enabled = enabled
+		return newTestProxyService(t, cfg, upstream)
+	}
+
+	t.Run("repeated key within the window replays the first result", func(t *testing.T) {
+		calls.Store(0)
+		proxy := newProxy(t, true)
+
+		first := send(t, proxy, "retry-1")
+		second := send(t, proxy, "retry-1")
+
+		if got := calls.Load(); got != 1 {
+			t.Errorf("Expected 1 upstream call, got %d", got)
+		}
+		if second.Body.String() != first.Body.String() {
+			t.Errorf("Expected replayed body %q, got %q", first.Body.String(), second.Body.String())
+		}
+		if second.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("Expected the replay to be marked with Idempotent-Replayed")
+		}
+	})
+
+	t.Run("concurrent requests with one key share a single upstream call", func(t *testing.T) {
+		calls.Store(0)
+		proxy := newProxy(t, true)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				send(t, proxy, "retry-2")
+			}()
+		}
+		wg.Wait()
+
+		if got := calls.Load(); got != 1 {
+			t.Errorf("Expected 1 upstream call, got %d", got)
+		}
+	})
+
+	t.Run("different keys are sent separately", func(t *testing.T) {
+		calls.Store(0)
+		proxy := newProxy(t, true)
+
+		send(t, proxy, "a")
+		send(t, proxy, "b")
+		send(t, proxy, "")
+
+		if got := calls.Load(); got != 3 {
+			t.Errorf("Expected 3 upstream calls, got %d", got)
+		}
+	})
+
+	t.Run("keys are scoped to the client", func(t *testing.T) {
+		calls.Store(0)
+		proxy := newProxy(t, true)
+		fromIP := func(addr string) func(*http.Request) {
+			return func(r *http.Request) { r.RemoteAddr = addr }
+		}
+		withAPIKey := func(key string) func(*http.Request) {
+			return func(r *http.Request) { r.Header.Set("X-API-Key", key) }
+		}
+
+		send(t, proxy, "shared", fromIP("10.0.0.1:1000"))
+		send(t, proxy, "shared", fromIP("10.0.0.1:2000"))
+		send(t, proxy, "shared", fromIP("10.0.0.2:1000"))
+		send(t, proxy, "shared", fromIP("10.0.0.1:1000"), withAPIKey("key-a"))
+		send(t, proxy, "shared", fromIP("10.0.0.3:1000"), withAPIKey("key-a"))
+		send(t, proxy, "shared", fromIP("10.0.0.1:1000"), withAPIKey("key-b"))
+
+		// One call per client: 10.0.0.1, 10.0.0.2, key-a and key-b
+		if got := calls.Load(); got != 4 {
+			t.Errorf("Expected 4 upstream calls, got %d", got)
+		}
+	})
+
+	t.Run("disabled ignores the header", func(t *testing.T) {
+		calls.Store(0)
+		proxy := newProxy(t, false)
+
+		send(t, proxy, "retry-3")
+		send(t, proxy, "retry-3")
+
+		if got := calls.Load(); got != 2 {
+			t.Errorf("Expected 2 upstream calls, got %d", got)
+		}
+	})
+}
+
+func TestProxyService_CaptureRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1"}`))
+	}))
+	defer upstream.Close()
+
+	dir := filepath.Join(t.TempDir(), "captures")
+	cfg := createProxyTestConfig()
+	cfg.Debug.CaptureDir = dir
+	proxy := newTestProxyService(t, cfg, upstream)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+	req.Header.Set("Authorization", "Bearer client-secret")
+	req.Header.Set("X-Copilot-Intent", "conversation-panel")
+	w := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "request-*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one capture file, got %v (%v)", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "client-secret") {
+		t.Errorf("Expected credentials to be left out of the capture, got:\n%s", data)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Capture is not JSON: %v", err)
+	}
+	for _, field := range []string{"captured_at", "method", "path", "headers", "body"} {
+		if _, ok := raw[field]; !ok {
+			t.Errorf("Expected capture field %q, got:\n%s", field, data)
+		}
+	}
+
+	captured, err := internal.LoadCapturedRequest(files[0])
+	if err != nil {
+		t.Fatalf("LoadCapturedRequest failed: %v", err)
+	}
+	if captured.Method != http.MethodPost || captured.Path != "/v1/chat/completions" {
+		t.Errorf("Expected POST /v1/chat/completions, got %s %s", captured.Method, captured.Path)
+	}
+	if captured.CapturedAt.IsZero() {
+		t.Error("Expected a capture timestamp")
+	}
+	if captured.Headers["X-Copilot-Intent"] != "conversation-panel" {
+		t.Errorf("Expected client headers to be kept, got %v", captured.Headers)
+	}
+	var body bytes.Buffer
+	if err := json.Compact(&body, captured.Body); err != nil || body.String() != testChatBody {
+		t.Errorf("Expected the client body %s, got %s", testChatBody, captured.Body)
+	}
+}
+
+func TestProxyService_UpstreamRoutes(t *testing.T) {
+	var gotPath atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath.Store(r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list"}`))
+	}))
+	defer upstream.Close()
+
+	cfg := createProxyTestConfig()
+	cfg.Proxy.Routes = map[string]string{"/v1/embeddings": "/embeddings"}
+	proxy := newTestProxyService(t, cfg, upstream)
+
+	send := func(path string) *httptest.ResponseRecorder {
+		gotPath.Store("")
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(testChatBody)))
+		return w
+	}
+
+	t.Run("mapped path", func(t *testing.T) {
+		if w := send("/v1/embeddings"); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := gotPath.Load(); got != "/embeddings" {
+			t.Errorf("Expected upstream path /embeddings, got %v", got)
+		}
+	})
+
+	t.Run("default chat mapping", func(t *testing.T) {
+		if w := send("/v1/chat/completions"); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := gotPath.Load(); got != "/chat/completions" {
+			t.Errorf("Expected upstream path /chat/completions, got %v", got)
+		}
+	})
+
+	t.Run("unmapped path", func(t *testing.T) {
+		w := send("/v1/unknown")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := gotPath.Load(); got != "" {
+			t.Errorf("Expected no upstream request, got one to %v", got)
+		}
+	})
+
+	t.Run("server registers mapped routes", func(t *testing.T) {
+		handler := internal.NewServer(cfg, newUpstreamClient(t, upstream)).Handler()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(testChatBody)))
+		if w.Code != http.StatusOK || gotPath.Load() != "/embeddings" {
+			t.Errorf("Expected /v1/embeddings to be proxied to /embeddings, got %d to %v", w.Code, gotPath.Load())
+		}
+	})
+}
+
+// wsDial opens a WebSocket connection to a test server URL
+func wsDial(t *testing.T, serverURL string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	fmt.Fprintf(conn, "GET /v1/chat/ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Failed to read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected Sec-WebSocket-Accept %q", got)
+	}
+	return conn, br
+}
+
+// wsWriteFrame sends one masked client frame
+func wsWriteFrame(t *testing.T, conn net.Conn, op byte, payload []byte) {
+	t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+}
+
+// wsReadFrame reads one unmasked server frame
+func wsReadFrame(t *testing.T, br *bufio.Reader) (op byte, payload []byte) {
+	t.Helper()
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(br, head); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		ext := make([]byte, 2)
+		_, _ = io.ReadFull(br, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatalf("Failed to read frame payload: %v", err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+func TestProxyService_ChatWebSocket(t *testing.T) {
+	const wsText, wsClose = 0x1, 0x8
+	chunks := []string{
+		`{"choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+	}
+
+	t.Run("streams chunks and closes cleanly", func(t *testing.T) {
+		var gotBody atomic.Value
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			gotBody.Store(string(body))
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, chunk := range chunks {
+				fmt.Fprintf(w, "data: %s\n\n", chunk)
+				w.(http.Flusher).Flush()
+			}
+			_, _ = w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer upstream.Close()
+		proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+		// The metrics writer has to be unwrapped to reach the connection
+		metrics := &internal.Metrics{}
+		srv := httptest.NewServer(metrics.MetricsMiddleware(internal.LoggingMiddleware(proxy.ChatWebSocketHandler())))
+		defer srv.Close()
+
+		conn, br := wsDial(t, srv.URL)
+		wsWriteFrame(t, conn, wsText, []byte(testChatBody))
+
+		for _, want := range append(chunks, "[DONE]") {
+			op, payload := wsReadFrame(t, br)
+			if op != wsText || string(payload) != want {
+				t.Fatalf("Expected text frame %s, got op %d %q", want, op, payload)
+			}
+		}
+		op, payload := wsReadFrame(t, br)
+		if op != wsClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != 1000 {
+			t.Fatalf("Expected a normal close frame, got op %d %v", op, payload)
+		}
+		wsWriteFrame(t, conn, wsClose, payload[:2])
+
+		if body, _ := gotBody.Load().(string); !strings.Contains(body, `"stream":true`) {
+			t.Errorf("Expected the upstream request to stream, got %s", body)
+		}
+	})
+
+	t.Run("client close cancels the upstream", func(t *testing.T) {
+		canceled := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: %s\n\n", chunks[0])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			close(canceled)
+		}))
+		defer upstream.Close()
+		proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+		srv := httptest.NewServer(internal.LoggingMiddleware(proxy.ChatWebSocketHandler()))
+		defer srv.Close()
+
+		conn, br := wsDial(t, srv.URL)
+		wsWriteFrame(t, conn, wsText, []byte(testChatBody))
+		if op, payload := wsReadFrame(t, br); op != wsText || string(payload) != chunks[0] {
+			t.Fatalf("Expected the first chunk, got op %d %q", op, payload)
+		}
+
+		wsWriteFrame(t, conn, wsClose, []byte{0x03, 0xE8})
+		if op, _ := wsReadFrame(t, br); op != wsClose {
+			t.Errorf("Expected the close to be acknowledged, got op %d", op)
+		}
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the upstream request to be canceled")
+		}
+	})
+
+	t.Run("idle clients are closed after server_read", func(t *testing.T) {
+		upstream := httptest.NewServer(http.NotFoundHandler())
+		defer upstream.Close()
+		cfg := createProxyTestConfig()
+		cfg.Timeouts.ServerRead = 1
+		proxy := newTestProxyService(t, cfg, upstream)
+		srv := httptest.NewServer(proxy.ChatWebSocketHandler())
+		defer srv.Close()
+
+		conn, br := wsDial(t, srv.URL)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if op, _ := wsReadFrame(t, br); op != wsClose {
+			t.Errorf("Expected a close frame, got op %d", op)
+		}
+	})
+
+	t.Run("cross-origin upgrades are rejected", func(t *testing.T) {
+		upstream := httptest.NewServer(http.NotFoundHandler())
+		defer upstream.Close()
+		cfg := createProxyTestConfig()
+		cfg.CORS.AllowedOrigins = []string{"https://app.example.com"}
+		proxy := newTestProxyService(t, cfg, upstream)
+
+		tests := []struct {
+			origin    string
+			forbidden bool
+		}{
+			{"", false},
+			{"http://proxy.local", false},
+			{"https://app.example.com", false},
+			{"https://evil.example.com", true},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodGet, "http://proxy.local/v1/chat/ws", http.NoBody)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			proxy.ChatWebSocketHandler().ServeHTTP(w, req)
+			// The recorder cannot be hijacked, so accepted upgrades stop with a 500
+			if forbidden := w.Code == http.StatusForbidden; forbidden != tt.forbidden {
+				t.Errorf("Origin %q: expected forbidden=%v, got %d", tt.origin, tt.forbidden, w.Code)
+			}
+		}
+	})
+
+	t.Run("plain requests are rejected", func(t *testing.T) {
+		upstream := httptest.NewServer(http.NotFoundHandler())
+		defer upstream.Close()
+		proxy := newTestProxyService(t, createProxyTestConfig(), upstream)
+		w := httptest.NewRecorder()
+		proxy.ChatWebSocketHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/chat/ws", http.NoBody))
+		if w.Code != http.StatusUpgradeRequired {
+			t.Errorf("Expected 426, got %d", w.Code)
+		}
+	})
+}
+
+func TestProxyService_RequestHeaderForwarding(t *testing.T) {
+	var got atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		got.Store(r.Header.Clone())
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer upstream.Close()
+
+	send := func(t *testing.T, forward, deny []string, reverse bool) http.Header {
+		t.Helper()
+		cfg := createProxyTestConfig()
+		cfg.RequestHeaders.Forward = forward
+		cfg.RequestHeaders.Deny = deny
+		proxy := newTestProxyService(t, cfg, upstream)
+		handler := proxy.Handler()
+		if reverse {
+			handler = proxy.ReverseProxyHandler()
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(testChatBody))
+		req.Header.Set("Authorization", "Bearer client-secret")
+		req.Header.Set("Cookie", "session=client")
+		req.Header.Set("X-Api-Key", "proxy-key")
+		req.Header.Set("Accept-Encoding", "br")
+		req.Header.Set("X-Trace-Tag", "abc")
+		req.Header.Set("X-Other", "1")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return got.Load().(http.Header)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		name := "buffered"
+		if reverse {
+			name = "reverse proxy"
+		}
+		t.Run(name, func(t *testing.T) {
+			h := send(t, []string{"*"}, nil, reverse)
+			if auth := h.Get("Authorization"); auth != "Bearer test-copilot-token" {
+				t.Errorf("Expected the injected Copilot token, got %q", auth)
+			}
+			for _, denied := range []string{"Cookie", "X-Api-Key", "X-Hop"} {
+				if v := h.Get(denied); v != "" {
+					t.Errorf("Expected %s to stay local, got %q", denied, v)
+				}
+			}
+			if v := h.Get("Accept-Encoding"); strings.Contains(v, "br") {
+				t.Errorf("Expected the client's Accept-Encoding to be dropped, got %q", v)
+			}
+			if v := h.Get("X-Trace-Tag"); v != "abc" {
+				t.Errorf("Expected X-Trace-Tag to be forwarded, got %q", v)
+			}
+
+			// A configured denylist adds to the built-in one
+			h = send(t, []string{"*"}, []string{"X-Trace-Tag"}, reverse)
+			for _, denied := range []string{"X-Trace-Tag", "Cookie", "X-Api-Key"} {
+				if v := h.Get(denied); v != "" {
+					t.Errorf("Expected %s to stay local with a configured denylist, got %q", denied, v)
+				}
+			}
+			if v := h.Get("X-Other"); v != "1" {
+				t.Errorf("Expected X-Other to be forwarded, got %q", v)
+			}
+
+			if v := send(t, nil, nil, reverse).Get("X-Trace-Tag"); v != "" {
+				t.Errorf("Expected no client headers to be forwarded by default, got %q", v)
+			}
+		})
+	}
+}
+
+func TestProxyService_FirstByteTimeout(t *testing.T) {
+	const streamBody = `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	newProxy := func(t *testing.T, upstream *httptest.Server) *internal.ProxyService {
+		cfg := createProxyTestConfig()
+		cfg.Timeouts.FirstByte = 1
+		cfg.Retry.MaxAttempts = 1
+		return newTestProxyService(t, cfg, upstream)
+	}
+
+	t.Run("slow headers time out", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer upstream.Close()
+		proxy := newProxy(t, upstream)
+
+		started := time.Now()
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(streamBody)))
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("Expected 504, got %d: %s", w.Code, w.Body.String())
+		}
+		if elapsed := time.Since(started); elapsed > 3*time.Second {
+			t.Errorf("Expected the first-byte deadline to abort after about 1s, took %v", elapsed)
+		}
+	})
+
+	t.Run("slow body keeps streaming", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":"Hel"}}]}` + "\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(1500 * time.Millisecond)
+			_, _ = w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}` + "\n\ndata: [DONE]\n\n"))
+		}))
+		defer upstream.Close()
+		proxy := newProxy(t, upstream)
+
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(streamBody)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if body := w.Body.String(); !strings.Contains(body, `"content":"lo"`) || !strings.Contains(body, "[DONE]") {
+			t.Errorf("Expected the whole stream past the first-byte deadline, got %s", body)
+		}
+	})
+}
+
+func TestProxyService_RateLimitPerUser(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer upstream.Close()
+
+	cfg := createProxyTestConfig()
+	cfg.RateLimit.RequestsPerMinute = 1
+	cfg.RateLimit.PerUser = true
+	handler := newTestProxyService(t, cfg, upstream).Handler()
+
+	send := func(user, remoteAddr string) *httptest.ResponseRecorder {
+		body := testChatBody
+		if user != "" {
+			body = `{"model":"gpt-4o","user":"` + user + `","messages":[{"role":"user","content":"hi"}]}`
+		}
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	steps := []struct {
+		name       string
+		user       string
+		remoteAddr string
+		expected   int
+	}{
+		{name: "first request for alice", user: "alice", remoteAddr: "10.0.0.1:1000", expected: http.StatusOK},
+		{name: "alice from another IP shares her bucket", user: "alice", remoteAddr: "10.0.0.2:1000", expected: http.StatusTooManyRequests},
+		{name: "bob has his own bucket on the same IP", user: "bob", remoteAddr: "10.0.0.1:1000", expected: http.StatusOK},
+		{name: "no user falls back to the IP", remoteAddr: "10.0.0.1:1000", expected: http.StatusOK},
+		{name: "same IP without user is limited", remoteAddr: "10.0.0.1:1001", expected: http.StatusTooManyRequests},
+		{name: "another IP without user", remoteAddr: "10.0.0.3:1000", expected: http.StatusOK},
+	}
+	for _, step := range steps {
+		w := send(step.user, step.remoteAddr)
+		if w.Code != step.expected {
+			t.Fatalf("%s: expected %d, got %d: %s", step.name, step.expected, w.Code, w.Body.String())
+		}
+		if step.expected == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: expected a Retry-After header", step.name)
+		}
+	}
+
+	t.Run("per_user off keys on the IP", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.RateLimit.RequestsPerMinute = 1
+		handler = newTestProxyService(t, cfg, upstream).Handler()
+		if w := send("alice", "10.0.0.1:1000"); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w := send("bob", "10.0.0.1:1000"); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("Expected 429 for a second user on the same IP, got %d", w.Code)
+		}
+	})
+
+	t.Run("reverse proxy is limited by IP", func(t *testing.T) {
+		cfg := createProxyTestConfig()
+		cfg.RateLimit.RequestsPerMinute = 1
+		handler = newTestProxyService(t, cfg, upstream).ReverseProxyHandler()
+		if w := send("alice", "10.0.0.1:1000"); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		w := send("bob", "10.0.0.1:1000")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("Expected 429 with Retry-After for a second request from the IP, got %d", w.Code)
+		}
+		if w := send("alice", "10.0.0.2:1000"); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for another IP, got %d", w.Code)
+		}
+	})
+}
+
+func TestProxyService_FallbackModel(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		models []string
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		models = append(models, req.Model)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Model {
+		case "gpt-4o":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"message":"The requested model is not supported.","code":"model_not_supported"}}`))
+		case "bad-request":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"message":"messages must not be empty"}}`))
+		default:
+			_, _ = w.Write([]byte(`{"id":"1","model":"` + req.Model + `"}`))
+		}
+	}))
+	defer upstream.Close()
+
+	send := func(t *testing.T, fallback, model string) (*httptest.ResponseRecorder, []string) {
+		t.Helper()
+		mu.Lock()
+		models = nil
+		mu.Unlock()
+		cfg := createProxyTestConfig()
+		cfg.FallbackModel = fallback
+		body := `{"model":"` + model + `","messages":[{"role":"user","content":"hi"}]}`
+		w := httptest.NewRecorder()
+		newTestProxyService(t, cfg, upstream).Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+		mu.Lock()
+		defer mu.Unlock()
+		return w, append([]string(nil), models...)
+	}
+
+	t.Run("unavailable model is retried with the fallback", func(t *testing.T) {
+		w, sent := send(t, "claude-sonnet-4", "gpt-4o")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Fallback-Model"); got != "claude-sonnet-4" {
+			t.Errorf("Expected X-Fallback-Model: claude-sonnet-4, got %q", got)
+		}
+		if !strings.Contains(w.Body.String(), `"model":"claude-sonnet-4"`) {
+			t.Errorf("Expected the fallback model's response, got %s", w.Body.String())
+		}
+		if !reflect.DeepEqual(sent, []string{"gpt-4o", "claude-sonnet-4"}) {
+			t.Errorf("Expected one request per model, got %v", sent)
+		}
+	})
+
+	t.Run("without fallback the error is returned", func(t *testing.T) {
+		w, sent := send(t, "", "gpt-4o")
+		if w.Code != http.StatusBadRequest || len(sent) != 1 {
+			t.Errorf("Expected the upstream 400 after one request, got %d after %v", w.Code, sent)
+		}
+		if !strings.Contains(w.Body.String(), "model_not_supported") {
+			t.Errorf("Expected the upstream error body, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("other client errors are not retried", func(t *testing.T) {
+		w, sent := send(t, "claude-sonnet-4", "bad-request")
+		if w.Code != http.StatusBadRequest || len(sent) != 1 {
+			t.Errorf("Expected the upstream 400 after one request, got %d after %v", w.Code, sent)
+		}
+		if w.Header().Get("X-Fallback-Model") != "" {
+			t.Error("Expected no fallback annotation")
+		}
+	})
+}
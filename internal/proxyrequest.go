@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// proxyRequest is the JSON body of a proxied request, decoded once. Each processing
+// step reads and edits its top-level fields, and bytes encodes the result a single
+// time before the upstream call. A body no step changed is sent byte for byte.
+type proxyRequest struct {
+	raw    []byte
+	fields map[string]json.RawMessage // nil unless the body is a JSON object
+
+	// messages is decoded on first use; the chat steps all work on it
+	messages        []json.RawMessage
+	messagesDecoded bool
+	messagesErr     error
+
+	edited  bool
+	encoded []byte
+}
+
+// parseProxyRequest decodes a request body, rejecting an empty body or invalid JSON.
+// Valid JSON that is not an object is accepted with no fields, for the upstream to judge.
+func parseProxyRequest(body []byte) (*proxyRequest, error) {
+	if len(body) == 0 {
+		return nil, fmt.Errorf("bad request: empty request body")
+	}
+	req := &proxyRequest{raw: body}
+	if err := json.Unmarshal(body, &req.fields); err != nil {
+		// Unmarshal checks the syntax of the whole input before decoding, so a type
+		// error means well-formed JSON of another kind
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("bad request: invalid JSON: %w", err)
+		}
+		req.fields = nil
+	}
+	return req, nil
+}
+
+// isObject reports whether the body is a JSON object
+func (p *proxyRequest) isObject() bool {
+	return p.fields != nil
+}
+
+// has reports whether the top-level field name is present, even as null
+func (p *proxyRequest) has(name string) bool {
+	_, ok := p.fields[name]
+	return ok
+}
+
+// decode unmarshals the top-level field name into v and reports whether it is present
+func (p *proxyRequest) decode(name string, v interface{}) (bool, error) {
+	raw, ok := p.fields[name]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// stringField returns the top-level string field name, "" when it is missing or not a string
+func (p *proxyRequest) stringField(name string) string {
+	var value string
+	if _, err := p.decode(name, &value); err != nil {
+		return ""
+	}
+	return value
+}
+
+// model returns the model named in the body
+func (p *proxyRequest) model() string {
+	return p.stringField("model")
+}
+
+// stream reports whether the body asks for a streamed response
+func (p *proxyRequest) stream() bool {
+	var stream bool
+	_, err := p.decode("stream", &stream)
+	return err == nil && stream
+}
+
+// messageList returns the decoded messages array; nil when it is missing
+func (p *proxyRequest) messageList() ([]json.RawMessage, error) {
+	if !p.messagesDecoded {
+		p.messagesDecoded = true
+		_, p.messagesErr = p.decode("messages", &p.messages)
+	}
+	return p.messages, p.messagesErr
+}
+
+// set replaces the top-level field name with value
+func (p *proxyRequest) set(name string, value interface{}) error {
+	if p.fields == nil {
+		return fmt.Errorf("request body is not a JSON object")
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	p.fields[name] = encoded
+	p.edited, p.encoded = true, nil
+	return nil
+}
+
+// setMessages replaces the messages array
+func (p *proxyRequest) setMessages(messages []json.RawMessage) error {
+	if err := p.set("messages", messages); err != nil {
+		return err
+	}
+	p.messages, p.messagesDecoded, p.messagesErr = messages, true, nil
+	return nil
+}
+
+// bytes returns the body to send upstream, encoding the edited fields once
+func (p *proxyRequest) bytes() []byte {
+	if !p.edited {
+		return p.raw
+	}
+	if p.encoded == nil {
+		encoded, err := json.Marshal(p.fields)
+		if err != nil {
+			// RawMessage fields came out of valid JSON, so this cannot happen in practice
+			Warn("Failed to encode the edited request body, sending it unchanged", "error", err)
+			return p.raw
+		}
+		p.encoded = encoded
+	}
+	return p.encoded
+}
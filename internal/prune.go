@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// Artifacts untouched for this long are considered expired
+	pruneMaxAge = 7 * 24 * time.Hour
+
+	// prune only reports unless given --delete; --dry-run is accepted for clarity
+	pruneDeleteFlag = "--delete"
+	pruneDryRunFlag = "--dry-run"
+)
+
+// pruneArtifacts are the files prune may remove from the config directory: only names
+// this program writes, each with the reason reported and the age it must reach first.
+// The models cache lives in memory, so it leaves nothing behind.
+var pruneArtifacts = []struct {
+	pattern string
+	reason  string
+	minAge  time.Duration
+}{
+	// The stats writer renames its temporary file into place on every save, so one
+	// older than the longest save interval was left behind by a crash
+	{statsFileName + "-*.tmp", "leftover temporary file", 2 * maxLongTimeout * time.Second},
+	// The config directory check removes its probe right away
+	{writeCheckPattern, "leftover write probe", pruneMaxAge},
+}
+
+// PruneCandidate is a stale file prune would remove
+type PruneCandidate struct {
+	Path    string
+	Reason  string
+	Size    int64
+	ModTime time.Time
+}
+
+// findPruneCandidates lists expired artifacts next to the config file. The config file
+// itself and any file still holding tokens are never candidates.
+func findPruneCandidates(configPath string, now time.Time) ([]PruneCandidate, error) {
+	dir := filepath.Dir(configPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, NewConfigError("config_dir", dir, "cannot read config directory", err)
+	}
+	active, _ := os.Stat(configPath)
+
+	var candidates []PruneCandidate
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		reason, minAge := pruneReason(entry.Name())
+		if reason == "" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < minAge {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if active != nil && os.SameFile(active, info) {
+			continue
+		}
+		if holdsCredentials(path) {
+			Debug("Keeping file with credentials", "file", path)
+			continue
+		}
+		candidates = append(candidates, PruneCandidate{Path: path, Reason: reason, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Path < candidates[j].Path })
+	return candidates, nil
+}
+
+// pruneReason returns why a file name is prunable and how old it must be, or "" when
+// prune must leave it alone
+func pruneReason(name string) (string, time.Duration) {
+	for _, artifact := range pruneArtifacts {
+		if ok, _ := filepath.Match(artifact.pattern, name); ok {
+			return artifact.reason, artifact.minAge
+		}
+	}
+	return "", 0
+}
+
+// holdsCredentials reports whether path is a JSON file with a GitHub or Copilot token,
+// such as a backup of the config file
+func holdsCredentials(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var creds Credentials
+	if json.Unmarshal(data, &creds) != nil {
+		return false
+	}
+	return creds.GitHubToken != "" || creds.CopilotToken != ""
+}
+
+func handlePrune(args []string) error {
+	remove := false
+	for _, arg := range args {
+		switch arg {
+		case pruneDeleteFlag:
+			remove = true
+		case pruneDryRunFlag:
+			remove = false
+		default:
+			return NewValidationError("flag", arg, "usage: prune [--dry-run|--delete]", nil)
+		}
+	}
+
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return NewConfigError("config_path", "", "failed to get config path", err)
+	}
+	candidates, err := findPruneCandidates(configPath, time.Now())
+	if err != nil {
+		return err
+	}
+	return pruneFiles(os.Stdout, candidates, remove)
+}
+
+// pruneFiles reports candidates and, when remove is set, deletes them
+func pruneFiles(out io.Writer, candidates []PruneCandidate, remove bool) error {
+	if len(candidates) == 0 {
+		fmt.Fprintln(out, "Nothing to prune")
+		return nil
+	}
+
+	var total int64
+	for _, c := range candidates {
+		fmt.Fprintf(out, "%s (%s, %d bytes, last modified %s)\n", c.Path, c.Reason, c.Size, c.ModTime.Format("2006-01-02"))
+		total += c.Size
+	}
+	if !remove {
+		fmt.Fprintf(out, "Would remove %d files (%d bytes); run 'prune %s' to remove them\n", len(candidates), total, pruneDeleteFlag)
+		return nil
+	}
+
+	for _, c := range candidates {
+		if err := os.Remove(c.Path); err != nil {
+			return NewConfigError("prune", c.Path, fmt.Sprintf("cannot remove file (%s)", describeFSError(err)), err)
+		}
+	}
+	fmt.Fprintf(out, "Removed %d files (%d bytes)\n", len(candidates), total)
+	return nil
+}
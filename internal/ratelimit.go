@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How often buckets that have refilled completely are dropped
+	rateLimitSweepInterval = time.Minute
+
+	// Response header telling a limited client when to retry
+	retryAfterHeader = "Retry-After"
+)
+
+// errRateLimited is returned when a client's request rate exceeds rate_limit
+var errRateLimited = errors.New("rate limit exceeded")
+
+// RateLimiter is a token bucket per client key: each bucket holds up to burst
+// requests and refills at the configured rate
+type RateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mutex     sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing requestsPerMinute per key, with bursts of
+// up to burst requests (0 = requestsPerMinute)
+func NewRateLimiter(requestsPerMinute, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = requestsPerMinute
+	}
+	return &RateLimiter{
+		rate:      float64(requestsPerMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*rateBucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// allow takes a token from key's bucket. When it is empty, allow reports how long
+// until the next token is available.
+func (l *RateLimiter) allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, which behave exactly like a new
+// bucket, so keys seen once do not accumulate
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey returns the bucket key for a request: user, the body's OpenAI "user"
+// field, with rate_limit.per_user, the client IP otherwise
+func (s *ProxyService) rateLimitKey(r *http.Request, user string) string {
+	if s.config.RateLimit.PerUser && user != "" {
+		return "user:" + user
+	}
+	return "ip:" + getClientIP(r)
+}
+
+// checkRateLimit rejects the request with errRateLimited, and a Retry-After header,
+// when its client has used up its bucket
+func (s *ProxyService) checkRateLimit(w http.ResponseWriter, r *http.Request, user string) error {
+	if s.rateLimiter == nil {
+		return nil
+	}
+	key := s.rateLimitKey(r, user)
+	ok, wait := s.rateLimiter.allow(key)
+	if ok {
+		return nil
+	}
+	Warn("Rate limit exceeded", "key", key, "retry_after", wait)
+	w.Header().Set(retryAfterHeader, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return errRateLimited
+}
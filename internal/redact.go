@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Log redaction modes for request and response bodies, selected with LOG_REDACTION
+const (
+	RedactHash     = "hash"     // Replace content with its length and a short SHA-256 (default)
+	RedactTruncate = "truncate" // Keep the first redactTruncateRunes characters of content
+	RedactOff      = "off"      // Log content in full; only with LOG_UNSAFE=true
+
+	redactTruncateRunes = 32
+	redactHashBytes     = 6
+)
+
+// redactedKeys name JSON fields holding prompts or model output. Strings anywhere below
+// them are redacted; the surrounding structure and other fields are kept.
+var redactedKeys = map[string]bool{
+	"content":           true,
+	"text":              true,
+	"prompt":            true,
+	"input":             true,
+	"arguments":         true,
+	"refusal":           true,
+	"reasoning_content": true,
+	"image_url":         true,
+}
+
+// redactionMode returns the body redaction mode: off with LOG_UNSAFE=true, otherwise
+// LOG_REDACTION, falling back to hash for unset or unknown values
+func redactionMode() (mode string, unknown bool) {
+	if unsafe, _ := strconv.ParseBool(os.Getenv("LOG_UNSAFE")); unsafe {
+		return RedactOff, false
+	}
+	switch mode := strings.ToLower(os.Getenv("LOG_REDACTION")); mode {
+	case "", RedactHash:
+		return RedactHash, false
+	case RedactTruncate:
+		return RedactTruncate, false
+	default:
+		return RedactHash, true
+	}
+}
+
+// redactBody returns body as it may be logged under the logger's redaction mode
+func redactBody(body []byte) string {
+	mode := RedactHash
+	if logger != nil {
+		mode = logger.redaction
+	}
+	return redactBodyMode(body, mode)
+}
+
+// redactBodyMode redacts the message content of a JSON body. Bodies that are not JSON,
+// such as event streams, are redacted as a whole.
+func redactBodyMode(body []byte, mode string) string {
+	if mode == RedactOff {
+		return string(body)
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return redactString(string(body), mode)
+	}
+	redacted, err := json.Marshal(redactValue(v, false, mode))
+	if err != nil {
+		return redactString(string(body), mode)
+	}
+	return string(redacted)
+}
+
+// redactValue walks a decoded JSON value, redacting strings below a redacted key
+func redactValue(v interface{}, sensitive bool, mode string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = redactValue(field, sensitive || redactedKeys[key], mode)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item, sensitive, mode)
+		}
+		return v
+	case string:
+		if sensitive {
+			return redactString(v, mode)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// redactString replaces s with a marker that still tells entries apart: its length and a
+// short hash, or its beginning
+func redactString(s string, mode string) string {
+	if s == "" {
+		return s
+	}
+	if mode == RedactTruncate {
+		runes := []rune(s)
+		if len(runes) <= redactTruncateRunes {
+			return s
+		}
+		return fmt.Sprintf("%s…[%d chars]", string(runes[:redactTruncateRunes]), len(runes))
+	}
+	sum := sha256.Sum256([]byte(s))
+	return fmt.Sprintf("[redacted len=%d sha256=%s]", len(s), hex.EncodeToString(sum[:redactHashBytes]))
+}
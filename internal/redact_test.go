@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs initializes the global logger at debug level from the environment and
+// returns the buffer it writes to
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	original := logger
+	t.Cleanup(func() { logger = original })
+
+	Init("debug")
+	var buf bytes.Buffer
+	logger.Logger = slog.New(&DenseTextHandler{level: slog.LevelDebug, out: &buf})
+	return &buf
+}
+
+func TestRedactBody(t *testing.T) {
+	const secret = "my password is hunter2, please keep it between us"
+	body := `{"model":"gpt-4o","temperature":0.2,"messages":[` +
+		`{"role":"user","content":"` + secret + `"},` +
+		`{"role":"user","content":[{"type":"text","text":"` + secret + `"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]},` +
+		`{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{\"q\":\"hunter2\"}"}}]}]}`
+
+	t.Run("hash keeps structure and metadata", func(t *testing.T) {
+		redacted := redactBodyMode([]byte(body), RedactHash)
+		if strings.Contains(redacted, "hunter2") || strings.Contains(redacted, "base64") {
+			t.Fatalf("Expected message content to be redacted, got %s", redacted)
+		}
+		var decoded struct {
+			Model       string  `json:"model"`
+			Temperature float64 `json:"temperature"`
+			Messages    []struct {
+				Role      string          `json:"role"`
+				Content   json.RawMessage `json:"content"`
+				ToolCalls []struct {
+					Function struct {
+						Name string `json:"name"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"messages"`
+		}
+		if err := json.Unmarshal([]byte(redacted), &decoded); err != nil {
+			t.Fatalf("Expected redacted body to stay JSON: %v", err)
+		}
+		if decoded.Model != "gpt-4o" || decoded.Temperature != 0.2 || len(decoded.Messages) != 3 {
+			t.Errorf("Expected metadata to be kept, got %s", redacted)
+		}
+		if decoded.Messages[2].ToolCalls[0].Function.Name != "lookup" {
+			t.Errorf("Expected the tool name to be kept, got %s", redacted)
+		}
+		if !strings.Contains(redacted, "[redacted len=49 sha256=") {
+			t.Errorf("Expected a length and hash marker, got %s", redacted)
+		}
+	})
+
+	t.Run("truncate keeps the beginning", func(t *testing.T) {
+		redacted := redactBodyMode([]byte(body), RedactTruncate)
+		if strings.Contains(redacted, secret) {
+			t.Fatalf("Expected message content to be truncated, got %s", redacted)
+		}
+		if !strings.Contains(redacted, "my password is hunter2, please k…[49 chars]") {
+			t.Errorf("Expected the first characters of the content, got %s", redacted)
+		}
+	})
+
+	t.Run("non-JSON bodies are redacted whole", func(t *testing.T) {
+		stream := "data: {\"choices\":[{\"delta\":{\"content\":\"" + secret + "\"}}]}\n\n"
+		if redacted := redactBodyMode([]byte(stream), RedactHash); strings.Contains(redacted, "hunter2") {
+			t.Errorf("Expected the stream to be redacted, got %s", redacted)
+		}
+	})
+}
+
+func TestLoggingMiddlewareRedactsBodies(t *testing.T) {
+	const secret = "the launch code is 0000"
+	handler := LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"type":"invalid_request_error"},"echo":{"content":"` + secret + `"}}`))
+	}))
+	serve := func() {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{}`))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	t.Run("redacted by default", func(t *testing.T) {
+		t.Setenv("LOG_UNSAFE", "")
+		t.Setenv("LOG_REDACTION", "")
+		logs := captureLogs(t)
+		serve()
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("Expected message content to be redacted, got logs:\n%s", logs)
+		}
+		if !strings.Contains(logs.String(), "invalid_request_error") {
+			t.Errorf("Expected error metadata in logs, got:\n%s", logs)
+		}
+	})
+
+	t.Run("full content with LOG_UNSAFE", func(t *testing.T) {
+		t.Setenv("LOG_UNSAFE", "true")
+		logs := captureLogs(t)
+		serve()
+		if !strings.Contains(logs.String(), secret) {
+			t.Errorf("Expected message content with LOG_UNSAFE=true, got logs:\n%s", logs)
+		}
+	})
+}
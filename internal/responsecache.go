@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResponseCacheTTL        = 300 // seconds
+	defaultResponseCacheMaxEntries = 100
+
+	// Response header telling clients whether a completion was served from the cache
+	responseCacheHeader = "X-Proxy-Cache"
+)
+
+// ResponseCache is an in-memory LRU cache of completed non-streaming upstream responses
+type ResponseCache struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // front is most recently used
+}
+
+// cachedResponse is a stored upstream response
+type cachedResponse struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+// NewResponseCache creates a response cache holding up to maxEntries responses for ttl
+func NewResponseCache(maxEntries int, ttl time.Duration) *ResponseCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultResponseCacheMaxEntries
+	}
+	if ttl <= 0 {
+		ttl = defaultResponseCacheTTL * time.Second
+	}
+	return &ResponseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// get returns the cached response for key if present and not expired
+func (c *ResponseCache) get(key string) (*cachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedResponse)
+	if time.Since(entry.storedAt) >= c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+// set stores a response, evicting the least recently used entry when full
+func (c *ResponseCache) set(key string, status int, header http.Header, body []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := &cachedResponse{key: key, status: status, header: header, body: body, storedAt: time.Now()}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// isCacheableCompletion reports whether a chat completion request is deterministic and
+// non-streaming: temperature must be explicitly 0 and stream must not be set.
+func isCacheableCompletion(req *proxyRequest) bool {
+	var (
+		stream      bool
+		temperature *float64
+	)
+	if _, err := req.decode("stream", &stream); err != nil {
+		return false
+	}
+	if _, err := req.decode("temperature", &temperature); err != nil {
+		return false
+	}
+	return req.isObject() && !stream && temperature != nil && *temperature == 0
+}
+
+// writeCachedResponse replays a cached response to the client
+func writeCachedResponse(w http.ResponseWriter, entry *cachedResponse) error {
+	for key, values := range entry.header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.Header().Set(responseCacheHeader, "HIT")
+	w.WriteHeader(entry.status)
+	_, err := w.Write(entry.body)
+	return err
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// responseRewriter converts chat completion responses into another shape. Streams are
+// rewritten line by line as they arrive; other responses are buffered and converted
+// once complete. Error and encoded responses pass through unchanged.
+type responseRewriter struct {
+	http.ResponseWriter
+	// rewriteLines rewrites complete SSE lines; it may return nothing
+	rewriteLines func(lines []byte) []byte
+	// rewriteBody converts a complete response body and returns its Content-Type, or ""
+	// to keep the upstream one. On error the body is sent unchanged.
+	rewriteBody func(body []byte) ([]byte, string, error)
+	// streamContentType replaces the Content-Type of rewritten streams when set
+	streamContentType string
+
+	status      int
+	streaming   bool
+	passthrough bool
+	pending     []byte // buffered body, or a partial SSE line while streaming
+}
+
+func (rw *responseRewriter) WriteHeader(statusCode int) {
+	if rw.status != 0 {
+		return
+	}
+	rw.status = statusCode
+	h := rw.Header()
+	rw.passthrough = statusCode != http.StatusOK || h.Get("Content-Encoding") != ""
+	rw.streaming = isEventStream(h.Get("Content-Type"))
+	switch {
+	case rw.passthrough:
+		rw.ResponseWriter.WriteHeader(statusCode)
+	case rw.streaming:
+		if rw.streamContentType != "" {
+			h.Set("Content-Type", rw.streamContentType)
+		}
+		h.Del("Content-Length")
+		rw.ResponseWriter.WriteHeader(statusCode)
+	}
+}
+
+func (rw *responseRewriter) Write(data []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.passthrough {
+		return rw.ResponseWriter.Write(data)
+	}
+	rw.pending = append(rw.pending, data...)
+	if !rw.streaming {
+		return len(data), nil
+	}
+
+	// Rewrite complete lines; keep a trailing partial line for the next write
+	end := bytes.LastIndexByte(rw.pending, '\n')
+	if end < 0 {
+		return len(data), nil
+	}
+	out := rw.rewriteLines(rw.pending[:end+1])
+	rw.pending = append(rw.pending[:0], rw.pending[end+1:]...)
+	if len(out) > 0 {
+		if _, err := rw.ResponseWriter.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush sends streamed output to the client immediately
+func (rw *responseRewriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); (rw.streaming || rw.passthrough) && ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes whatever is still buffered once the chat handler has returned
+func (rw *responseRewriter) finish() {
+	if rw.status == 0 || rw.passthrough {
+		return
+	}
+	if rw.streaming {
+		if len(rw.pending) == 0 {
+			return
+		}
+		if out := rw.rewriteLines(rw.pending); len(out) > 0 {
+			if _, err := rw.ResponseWriter.Write(out); err != nil {
+				Warn("Error writing rewritten stream", "error", err)
+			}
+		}
+		return
+	}
+
+	body := rw.pending
+	if converted, contentType, err := rw.rewriteBody(body); err == nil {
+		body = converted
+		if contentType != "" {
+			rw.Header().Set("Content-Type", contentType)
+		}
+	} else {
+		Warn("Cannot convert the upstream chat response, returning it unchanged", "error", err)
+	}
+	rw.Header().Del("Content-Length")
+	rw.ResponseWriter.WriteHeader(rw.status)
+	if _, err := rw.ResponseWriter.Write(body); err != nil {
+		Warn("Error writing rewritten response", "error", err)
+	}
+}
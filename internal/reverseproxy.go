@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Proxy modes selectable with proxy.mode in the config
+const (
+	proxyModeBuffered = "buffered"
+	proxyModeReverse  = "reverse_proxy"
+
+	// Uploads such as audio files are larger than chat requests
+	maxPassthroughBodySize = 25 * 1024 * 1024 // 25MB
+)
+
+// upstreamAuthContextKey holds the *upstreamAuth of a reverse-proxied request
+type upstreamAuthContextKey struct{}
+
+// upstreamAuth is the Copilot token a reverse-proxied request is sent with, and the
+// seat it belongs to when several seats are configured
+type upstreamAuth struct {
+	seat  *seat
+	token string
+}
+
+// ReverseProxyHandler returns a chat completions handler built on httputil.ReverseProxy.
+// Unlike Handler it streams the request body upstream without buffering it, so requests
+// are not retried and body validation is left to the upstream API. The Content-Type is
+// checked against proxy.allowed_content_types as in buffered mode.
+func (s *ProxyService) ReverseProxyHandler() http.HandlerFunc {
+	proxy := s.newReverseProxy(func(*http.Request) string {
+		path, _ := s.upstreamPath(chatCompletionsRoute)
+		return path
+	})
+	serve := s.serveReverseProxy(proxy, maxRequestBodySize)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := s.checkContentType(r); err != nil {
+				writeProxyError(w, r, err)
+				return
+			}
+		}
+		serve(w, r)
+	}
+}
+
+// PassthroughHandler returns a handler that forwards a request to the same path upstream
+// (without the /v1 prefix), preserving the client's Content-Type and streaming the body as-is.
+// It is used for non-JSON routes such as multipart audio uploads.
+func (s *ProxyService) PassthroughHandler() http.HandlerFunc {
+	proxy := s.newReverseProxy(func(r *http.Request) string {
+		return strings.TrimPrefix(r.URL.Path, "/v1")
+	})
+	return s.serveReverseProxy(proxy, maxPassthroughBodySize)
+}
+
+// newReverseProxy builds a ReverseProxy to the Copilot API that rewrites the path with
+// upstreamPath, injects the configured Copilot headers and tracks upstream health.
+func (s *ProxyService) newReverseProxy(upstreamPath func(*http.Request) string) *httputil.ReverseProxy {
+	target, err := url.Parse(copilotAPIBase)
+	if err != nil {
+		// copilotAPIBase is a constant, so this only fails on a programming error
+		panic(err)
+	}
+	// Passthrough requests name no model; they share the default group's breaker
+	breaker := s.circuitBreakers.get(defaultBreakerGroup)
+
+	transport := s.httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			intent := s.resolveIntent(req)
+
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = upstreamPath(req)
+			req.URL.RawPath = ""
+			req.URL.RawQuery = ""
+			req.Host = target.Host
+
+			// Only send the headers the buffered handler sends, plus request_headers.forward;
+			// client credentials stay local.
+			// Content-Type is kept as-is so multipart boundaries survive.
+			contentType := req.Header.Get("Content-Type")
+			clientHeader := req.Header
+			req.Header = make(http.Header)
+			s.forwardRequestHeaders(req.Header, clientHeader)
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			req.Header.Set("Content-Type", contentType)
+			var token string
+			if auth, ok := req.Context().Value(upstreamAuthContextKey{}).(*upstreamAuth); ok {
+				token = auth.token
+			}
+			setUpstreamHeaders(req.Header, s.config, token, intent)
+			// A nil value stops ReverseProxy from adding X-Forwarded-For
+			req.Header["X-Forwarded-For"] = nil
+		},
+		Transport:     transport,
+		FlushInterval: -1, // Flush immediately for server-sent events
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode < statusCodeServerError {
+				breaker.onSuccess()
+			} else {
+				breaker.onFailure()
+			}
+			// The body is gone, so the request cannot move to another seat; later
+			// requests skip the rate-limited one
+			if auth, ok := resp.Request.Context().Value(upstreamAuthContextKey{}).(*upstreamAuth); ok &&
+				auth.seat != nil && resp.StatusCode == statusCodeTooManyRequests {
+				s.seats.markRateLimited(auth.seat, resp.Header.Get("Retry-After"))
+			}
+			Debug("Received response", "status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"))
+
+			filtered := make(http.Header, len(resp.Header))
+			s.copyResponseHeaders(filtered, resp.Header)
+			s.setCORSHeaders(filtered)
+			resp.Header = filtered
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				Warn("Request timeout in reverse proxy")
+				http.Error(w, "Request timeout", http.StatusRequestTimeout)
+				return
+			}
+			if errors.Is(err, context.Canceled) {
+				Debug("Client canceled reverse proxy request", "path", r.URL.Path)
+				return
+			}
+			breaker.onFailure()
+			requestID := requestIDFor(r)
+			Error("Error making reverse proxy request", "request_id", requestID, "error", err)
+			w.Header().Set(requestIDHeader, requestID)
+			WriteUpstreamNetworkError(w, requestID, err)
+		},
+	}
+}
+
+// serveReverseProxy wraps proxy with the timeout, circuit breaker, rate limit, token
+// and concurrency checks shared by all proxied endpoints.
+func (s *ProxyService) serveReverseProxy(proxy *httputil.ReverseProxy, maxBodySize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.handlePreflight(w, r) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout(r))
+		defer cancel()
+
+		breaker := s.circuitBreakers.get(defaultBreakerGroup)
+		allowed, probe := breaker.canExecute()
+		if !allowed {
+			Warn("Circuit breaker is open, rejecting request")
+			http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer breaker.endProbe(probe)
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed: "+r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+
+		// The body is streamed unread, so clients are keyed by IP only
+		if err := s.checkRateLimit(w, r, ""); err != nil {
+			WriteRateLimitError(w)
+			return
+		}
+
+		current, token, err := s.acquireToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx = context.WithValue(ctx, upstreamAuthContextKey{}, &upstreamAuth{seat: current, token: token})
+
+		releaseUpstream, err := s.acquireUpstream(ctx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			} else {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+		defer releaseUpstream()
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
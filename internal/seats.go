@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSeatCooldown is how long a seat is skipped after a 429 without Retry-After
+// or a failed token exchange
+const defaultSeatCooldown = 60 * time.Second
+
+// seat is one Copilot subscription that can serve upstream chat requests
+type seat struct {
+	index int
+	cfg   *Config
+	auth  *AuthService
+
+	// tokenMu serializes the token exchange for this seat
+	tokenMu sync.Mutex
+	// cooldownUntil is guarded by the pool mutex
+	cooldownUntil time.Time
+}
+
+// token returns a valid Copilot token for the seat, exchanging the GitHub token on first use
+func (st *seat) token() (string, error) {
+	st.tokenMu.Lock()
+	defer st.tokenMu.Unlock()
+
+	if token, _ := st.cfg.Token(); token == "" && st.cfg.GitHubToken != "" {
+		if err := st.auth.RefreshToken(st.cfg); err != nil {
+			return "", err
+		}
+	} else if err := st.auth.EnsureValidToken(st.cfg); err != nil {
+		return "", err
+	}
+	token, _ := st.cfg.Token()
+	return token, nil
+}
+
+// discardCredentialStore keeps extra seat tokens in memory only; they are
+// exchanged again from the GitHub token after a restart
+type discardCredentialStore struct{}
+
+func (discardCredentialStore) Load() (*Credentials, error) { return &Credentials{}, nil }
+func (discardCredentialStore) Save(*Credentials) error     { return nil }
+
+// SeatPool spreads upstream chat requests round-robin across several Copilot seats.
+// A seat that is rate limited is skipped until its cooldown ends.
+type SeatPool struct {
+	mu    sync.Mutex
+	seats []*seat
+	next  int
+	now   func() time.Time
+}
+
+// NewSeatPool builds a pool from the primary account plus cfg.GitHubTokens. It returns
+// nil when no extra tokens are configured, leaving the single-token path unchanged.
+func NewSeatPool(cfg *Config, httpClient *http.Client, primary *AuthService) *SeatPool {
+	if len(cfg.GitHubTokens) == 0 {
+		return nil
+	}
+
+	pool := &SeatPool{now: time.Now}
+	if cfg.GitHubToken != "" || cfg.CopilotToken != "" {
+		pool.seats = append(pool.seats, &seat{cfg: cfg, auth: primary})
+	}
+
+	seen := map[string]bool{cfg.GitHubToken: true}
+	for _, token := range cfg.GitHubTokens {
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+
+		seatCfg := &Config{GitHubToken: token}
+		seatCfg.Headers = cfg.Headers
+		seatCfg.Retry = cfg.Retry
+		pool.seats = append(pool.seats, &seat{
+			index: len(pool.seats),
+			cfg:   seatCfg,
+			auth:  NewAuthService(httpClient, WithCredentialStore(discardCredentialStore{})),
+		})
+	}
+	return pool
+}
+
+// Len returns the number of seats in the pool
+func (p *SeatPool) Len() int {
+	return len(p.seats)
+}
+
+// acquire returns the next usable seat and its Copilot token. Seats whose token
+// cannot be obtained are put on cooldown and the next one is tried.
+func (p *SeatPool) acquire() (*seat, string, error) {
+	lastErr := error(NewAuthError("no Copilot seats available", nil))
+	for _, st := range p.candidates() {
+		token, err := st.token()
+		if err != nil {
+			Warn("Copilot seat unavailable, skipping", "seat", st.index, "error", err)
+			p.cooldown(st, defaultSeatCooldown)
+			lastErr = err
+			continue
+		}
+		return st, token, nil
+	}
+	return nil, "", lastErr
+}
+
+// candidates lists the seats to try in order: ready seats in round-robin order,
+// then cooling seats by the time they recover, so requests still go out when
+// every seat is rate limited
+func (p *SeatPool) candidates() []*seat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.seats)
+	now := p.now()
+	var ready, cooling []*seat
+	for i := 0; i < n; i++ {
+		st := p.seats[(p.next+i)%n]
+		if now.Before(st.cooldownUntil) {
+			cooling = append(cooling, st)
+		} else {
+			ready = append(ready, st)
+		}
+	}
+	sort.SliceStable(cooling, func(i, j int) bool {
+		return cooling[i].cooldownUntil.Before(cooling[j].cooldownUntil)
+	})
+
+	// Continue the rotation after the seat this request will use
+	if len(ready) > 0 {
+		p.next = (ready[0].index + 1) % n
+	} else if n > 0 {
+		p.next = (p.next + 1) % n
+	}
+	return append(ready, cooling...)
+}
+
+// markRateLimited skips st for the upstream Retry-After delay, or the default cooldown
+func (p *SeatPool) markRateLimited(st *seat, retryAfter string) {
+	wait := defaultSeatCooldown
+	if secs, err := strconv.Atoi(strings.TrimSpace(retryAfter)); err == nil && secs > 0 {
+		wait = time.Duration(secs) * time.Second
+	}
+	Warn("Copilot seat rate limited, skipping it", "seat", st.index, "cooldown", wait)
+	p.cooldown(st, wait)
+}
+
+func (p *SeatPool) cooldown(st *seat, wait time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st.cooldownUntil = p.now().Add(wait)
+}
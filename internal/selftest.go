@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
+)
+
+const (
+	// run/start flag enabling the startup self-test
+	selfTestFlag = "--self-test"
+
+	// Model tried when neither default_model nor allowed_models names one
+	selfTestFallbackModel = "gpt-4o"
+
+	selfTestPrompt  = "say hi"
+	selfTestTimeout = 30 * time.Second
+
+	// How much of a failed response is quoted in the error
+	maxSelfTestErrorBody = 512
+)
+
+// WithSelfTest makes Start send one tiny chat completion through the server's own
+// middleware chain and worker pool before listening, and refuse to start if it fails
+func WithSelfTest() func(*Server) {
+	return func(s *Server) {
+		s.selfTest = true
+	}
+}
+
+// runSelfTest sends a real completion through the full handler chain and logs its
+// latency and token cost. Unlike warm-up, any failure is returned.
+func (s *Server) runSelfTest() error {
+	body, err := json.Marshal(map[string]interface{}{
+		"model":      selfTestModel(s.config),
+		"max_tokens": 5,
+		"messages":   []transform.ChatCompletionMessage{{Role: "user", Content: selfTestPrompt}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, chatCompletionsRoute, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.RequestURI = chatCompletionsRoute
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Host = "localhost"
+	req.Header.Set("Content-Type", "application/json")
+
+	w := &selfTestWriter{header: make(http.Header)}
+	started := time.Now()
+	s.httpServer.Handler.ServeHTTP(w, req)
+	latency := time.Since(started)
+
+	if w.status != http.StatusOK {
+		return fmt.Errorf("chat completion returned HTTP %d: %s", w.status, bytes.TrimSpace(w.body.Bytes()[:min(w.body.Len(), maxSelfTestErrorBody)]))
+	}
+	var resp transform.ChatCompletionResponse
+	if err := json.Unmarshal(w.body.Bytes(), &resp); err != nil {
+		return fmt.Errorf("chat completion is not valid JSON: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return fmt.Errorf("chat completion has no choices")
+	}
+
+	Info("Startup self-test passed",
+		"model", resp.Model,
+		"latency_ms", latency.Milliseconds(),
+		"prompt_tokens", resp.Usage.PromptTokens,
+		"completion_tokens", resp.Usage.CompletionTokens,
+		"total_tokens", resp.Usage.TotalTokens,
+	)
+	return nil
+}
+
+// selfTestModel picks a model the configuration accepts: default_model, else the first
+// of allowed_models
+func selfTestModel(cfg *Config) string {
+	switch {
+	case cfg.DefaultModel != "":
+		return cfg.DefaultModel
+	case len(cfg.AllowedModels) > 0:
+		return cfg.AllowedModels[0]
+	default:
+		return selfTestFallbackModel
+	}
+}
+
+// selfTestWriter records the self-test response
+type selfTestWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *selfTestWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *selfTestWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *selfTestWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
@@ -3,13 +3,18 @@ package internal
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -17,6 +22,8 @@ import (
 // Constants for timeout values
 const (
 	shutdownTimeout = 10 * time.Second
+	warmUpTimeout   = 10 * time.Second // Bound on the startup upstream warm-up request
+	probeTimeout    = 3 * time.Second  // Bound on a readiness probe of the upstream
 
 	// Optimized HTTP client configuration for better performance
 	maxIdleConns        = 200 // Increased for better connection reuse
@@ -31,15 +38,72 @@ type Metrics struct {
 	RequestsDuration  float64
 	ActiveConnections int64
 	mutex             sync.RWMutex
+
+	// registry renders the /metrics families. It is built when the middleware or
+	// handler is first created, so the callbacks below must be set before that.
+	registry     *MetricRegistry
+	registryOnce sync.Once
+
+	// responses counts responses per status class, 1xx through 5xx
+	responses *CounterVec
+
+	// upstreamInFlight reports in-flight upstream requests when set
+	upstreamInFlight func() int64
+
+	// activeStreams reports open streaming requests when set
+	activeStreams func() int64
+
+	// workerQueueDepth, workerActive and workerJobs report worker pool load when set
+	workerQueueDepth func() int64
+	workerActive     func() int64
+	workerJobs       func() int64
+
+	// circuitState reports the most severe upstream circuit breaker state when set, and
+	// circuitStates the state per model group
+	circuitState  func() CircuitBreakerState
+	circuitStates func() map[string]CircuitBreakerState
+
+	// requestBytes and responseBytes report the proxied body size histograms when set
+	requestBytes  func() HistogramSnapshot
+	responseBytes func() HistogramSnapshot
 }
 
 // Server represents the HTTP server and its dependencies
 type Server struct {
-	config     *Config
-	httpServer *http.Server
-	httpClient *http.Client
-	workerPool *WorkerPool
-	metrics    *Metrics
+	config      *Config
+	httpServer  *http.Server
+	httpClient  *http.Client
+	workerPool  *WorkerPool
+	metrics     *Metrics
+	authService *AuthService
+	stopPush    context.CancelFunc
+	stopUsage   context.CancelFunc
+	selfTest    bool
+
+	// usage persists request and token counters; nil unless stats.enabled
+	usage *UsageRecorder
+
+	// signals receives shutdown and reload signals while the server runs
+	signals chan os.Signal
+
+	// Shutdown runs once; stopped is closed when it has finished
+	stopOnce sync.Once
+	stopped  chan struct{}
+	stopErr  error
+
+	reasonMutex    sync.Mutex
+	shutdownReason ShutdownReason
+	shutdownSignal os.Signal
+
+	// upstreamReached is set once the Copilot API has answered a warm-up or probe
+	upstreamReached atomic.Bool
+
+	// addr is the address the listener is bound to, once listening
+	addrMutex sync.Mutex
+	addr      net.Addr
+
+	// For testability: override the config file reloaded on SIGHUP
+	configPath string
 }
 
 // WorkerPool handles background processing
@@ -48,6 +112,12 @@ type WorkerPool struct {
 	jobQueue chan func()
 	quit     chan bool
 	wg       sync.WaitGroup
+
+	// queued counts submitted jobs not yet picked up, including submitters blocked on a
+	// full queue; active counts running jobs and processed finished ones
+	queued    atomic.Int64
+	active    atomic.Int64
+	processed atomic.Int64
 }
 
 // NewWorkerPool creates a new worker pool with intelligent sizing
@@ -86,7 +156,7 @@ func (wp *WorkerPool) start() {
 			for {
 				select {
 				case job := <-wp.jobQueue:
-					job()
+					wp.run(job)
 				case <-wp.quit:
 					return
 				}
@@ -95,11 +165,51 @@ func (wp *WorkerPool) start() {
 	}
 }
 
+// run executes a dequeued job, keeping the load counters current even if it panics
+func (wp *WorkerPool) run(job func()) {
+	wp.queued.Add(-1)
+	wp.active.Add(1)
+	defer func() {
+		wp.active.Add(-1)
+		wp.processed.Add(1)
+	}()
+	job()
+}
+
 // Submit adds a job to the worker pool
 func (wp *WorkerPool) Submit(job func()) {
+	wp.queued.Add(1)
 	wp.jobQueue <- job
 }
 
+// SubmitContext adds a job to the worker pool, giving up with ctx's error if the queue
+// stays full until ctx is done
+func (wp *WorkerPool) SubmitContext(ctx context.Context, job func()) error {
+	wp.queued.Add(1)
+	select {
+	case wp.jobQueue <- job:
+		return nil
+	case <-ctx.Done():
+		wp.queued.Add(-1)
+		return ctx.Err()
+	}
+}
+
+// QueueDepth returns the number of submitted jobs waiting for a worker
+func (wp *WorkerPool) QueueDepth() int64 {
+	return wp.queued.Load()
+}
+
+// ActiveWorkers returns the number of workers running a job
+func (wp *WorkerPool) ActiveWorkers() int64 {
+	return wp.active.Load()
+}
+
+// JobsProcessed returns the number of jobs the pool has finished
+func (wp *WorkerPool) JobsProcessed() int64 {
+	return wp.processed.Load()
+}
+
 // Stop gracefully stops the worker pool
 func (wp *WorkerPool) Stop() {
 	close(wp.quit)
@@ -122,12 +232,64 @@ func CreateHTTPClient(cfg *Config) *http.Client {
 				KeepAlive: time.Duration(cfg.Timeouts.KeepAlive) * time.Second,
 			}).DialContext,
 			TLSHandshakeTimeout: time.Duration(cfg.Timeouts.TLSHandshake) * time.Second,
+			TLSClientConfig:     upstreamTLSConfig(cfg),
+			Proxy:               upstreamProxyFunc(cfg),
 		},
 	}
 }
 
+// upstreamProxyFunc picks the outbound proxy: upstream_proxy.url when set, otherwise the
+// proxy environment variables. Proxy credentials go in the URL, where the transport turns
+// them into a Proxy-Authorization header for both CONNECT and plain HTTP requests.
+func upstreamProxyFunc(cfg *Config) func(*http.Request) (*url.URL, error) {
+	if cfg.UpstreamProxy.URL == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL, err := url.Parse(cfg.UpstreamProxy.URL)
+	if err != nil {
+		err = NewConfigError("upstream_proxy.url", cfg.UpstreamProxy.URL, "invalid proxy URL", err)
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	if cfg.UpstreamProxy.Username != "" {
+		proxyURL.User = url.UserPassword(cfg.UpstreamProxy.Username, cfg.UpstreamProxy.Password)
+	}
+	return http.ProxyURL(proxyURL)
+}
+
+// upstreamTLSConfig returns the client TLS settings for outbound requests: the system
+// roots plus the CAs in upstream_tls.ca_files, or nil for the defaults
+func upstreamTLSConfig(cfg *Config) *tls.Config {
+	if len(cfg.UpstreamTLS.CAFiles) == 0 {
+		return nil
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		Warn("System certificate pool unavailable, trusting only upstream_tls.ca_files", "error", err)
+		roots = x509.NewCertPool()
+	}
+	for _, path := range cfg.UpstreamTLS.CAFiles {
+		data, err := os.ReadFile(path)
+		if err == nil && !roots.AppendCertsFromPEM(data) {
+			err = fmt.Errorf("no PEM certificates found in %s", path)
+		}
+		if err != nil {
+			Error("Failed to load upstream CA bundle", "file", path, "error", err)
+			continue
+		}
+		Debug("Trusting upstream CA bundle", "file", path)
+	}
+	return &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+}
+
+// WithServerConfigPath sets the config file the server reloads on SIGHUP.
+func WithServerConfigPath(path string) func(*Server) {
+	return func(s *Server) {
+		s.configPath = path
+	}
+}
+
 // NewServer creates a new server instance
-func NewServer(cfg *Config, httpClient *http.Client) *Server {
+func NewServer(cfg *Config, httpClient *http.Client, opts ...func(*Server)) *Server {
 	workerPool := NewWorkerPool(runtime.NumCPU() * workerMultiplier)
 
 	// Initialize metrics
@@ -138,19 +300,67 @@ func NewServer(cfg *Config, httpClient *http.Client) *Server {
 
 	// Create coalescing cache for models
 	coalescingCache := NewCoalescingCache()
-	modelsService := NewModelsService(coalescingCache, httpClient)
+	modelsService := NewModelsService(coalescingCache, httpClient, WithModelsConfig(cfg))
 
 	// Create proxy service
 	proxyService := NewProxyService(cfg, httpClient, authService, workerPool)
 
+	// Usage statistics continue the counters saved by earlier runs
+	var usage *UsageRecorder
+	if cfg.Stats.Enabled {
+		path, err := statsFilePath(cfg)
+		if err == nil {
+			usage, err = NewUsageRecorder(path)
+		}
+		if err != nil {
+			Warn("Usage statistics disabled", "file", path, "error", err)
+		}
+		proxyService.usage = usage
+	}
+	metrics.upstreamInFlight = proxyService.UpstreamInFlight
+	metrics.activeStreams = proxyService.ActiveStreams
+	metrics.workerQueueDepth = workerPool.QueueDepth
+	metrics.workerActive = workerPool.ActiveWorkers
+	metrics.workerJobs = workerPool.JobsProcessed
+	metrics.circuitState = proxyService.WorstCircuitState
+	metrics.circuitStates = proxyService.CircuitStates
+	metrics.requestBytes = proxyService.RequestBytes
+	metrics.responseBytes = proxyService.ResponseBytes
+
 	// Create health checker
-	healthChecker := NewHealthChecker(httpClient, "dev") // TODO: get version from build
+	healthChecker := NewHealthChecker(httpClient, "dev", WithServiceIdentity(cfg.ServiceName, cfg.InstanceID)) // TODO: get version from build
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/models", modelsService.Handler())
-	mux.HandleFunc("/v1/chat/completions", proxyService.Handler())
+	if cfg.Proxy.Mode == proxyModeReverse {
+		mux.HandleFunc("/v1/chat/completions", proxyService.ReverseProxyHandler())
+	} else {
+		mux.HandleFunc("/v1/chat/completions", PlainTextHandler(proxyService.Handler()))
+	}
+	mux.HandleFunc("/v1/completions", proxyService.CompletionsHandler())
+	if cfg.Proxy.WebSocket {
+		mux.HandleFunc(chatWebSocketRoute, proxyService.ChatWebSocketHandler())
+	}
+	for route := range cfg.Proxy.Routes {
+		if route != chatCompletionsRoute {
+			mux.HandleFunc(route, proxyService.Handler())
+		}
+	}
+	for _, route := range cfg.Proxy.PassthroughRoutes {
+		mux.HandleFunc(route, proxyService.PassthroughHandler())
+	}
 	mux.HandleFunc("/health", healthChecker.Handler())
-	mux.HandleFunc("/metrics", metrics.Handler()) // Add metrics endpoint
+	mux.HandleFunc("/readyz", healthChecker.ReadinessHandler())
+	if cfg.Metrics.RequireAPIKey {
+		mux.HandleFunc("/metrics", RequireAPIKey(cfg, metrics.Handler()))
+	} else {
+		mux.HandleFunc("/metrics", metrics.Handler()) // Add metrics endpoint
+	}
+
+	// Local admin API for reading and updating the live configuration
+	adminService := NewAdminService(cfg)
+	mux.HandleFunc("/admin/config", adminService.ConfigHandler())
+	mux.HandleFunc("/admin/models/refresh", modelsService.RefreshHandler())
 
 	// Add pprof endpoints for profiling
 	mux.HandleFunc("/debug/pprof/", http.DefaultServeMux.ServeHTTP)
@@ -159,21 +369,21 @@ func NewServer(cfg *Config, httpClient *http.Client) *Server {
 	mux.HandleFunc("/debug/pprof/symbol", http.DefaultServeMux.ServeHTTP)
 	mux.HandleFunc("/debug/pprof/trace", http.DefaultServeMux.ServeHTTP)
 
-	port := cfg.Port
-	if port == 0 {
-		port = 8081 // default port
-	}
-
 	// Build middleware chain
 	var handler http.Handler = mux
 
 	// Apply middleware in reverse order (last applied = first executed)
+	handler = HopByHopMiddleware(handler)
+	handler = ConcurrencyLimitMiddleware(cfg)(handler)
+	handler = HeaderSizeMiddleware(cfg)(handler)
 	handler = SecurityHeadersMiddleware(handler)
+	handler = ServedByMiddleware(cfg)(handler)
 	handler = CORSMiddleware(cfg)(handler)
 	handler = LoggingMiddleware(handler)
 	handler = RecoveryMiddleware(handler)
 	handler = CompressionMiddleware()(handler)   // Add compression for better performance
 	handler = metrics.MetricsMiddleware(handler) // Add metrics collection
+	handler = ClientIPMiddleware(cfg)(handler)   // Resolve the client address before logging
 	// Note: TimeoutMiddleware could be added here if needed per-request timeouts
 	// handler = TimeoutMiddleware(time.Duration(cfg.Timeouts.ProxyContext) * time.Second)(handler)
 
@@ -191,52 +401,333 @@ func NewServer(cfg *Config, httpClient *http.Client) *Server {
 	}
 
 	httpServer := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      handler,
-		ReadTimeout:  time.Duration(cfg.Timeouts.ServerRead) * time.Second,
-		WriteTimeout: time.Duration(cfg.Timeouts.ServerWrite) * time.Second,
-		IdleTimeout:  time.Duration(cfg.Timeouts.ServerIdle) * time.Second,
-		TLSConfig:    tlsConfig,
-		// Enable HTTP/2 support (empty map disables HTTP/1.1 fallback to HTTP/2)
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		Addr:           tcpListenAddress(cfg.Host, cfg.Port),
+		Handler:        handler,
+		ReadTimeout:    time.Duration(cfg.Timeouts.ServerRead) * time.Second,
+		WriteTimeout:   time.Duration(cfg.Timeouts.ServerWrite) * time.Second,
+		IdleTimeout:    time.Duration(cfg.Timeouts.ServerIdle) * time.Second,
+		MaxHeaderBytes: maxHeaderBytes(cfg),
+		TLSConfig:      tlsConfig, // Used when tls.cert_file/key_file are set; HTTP/2 is negotiated via ALPN
 	}
 
-	return &Server{
-		config:     cfg,
-		httpServer: httpServer,
-		httpClient: httpClient,
-		workerPool: workerPool,
-		metrics:    metrics,
+	srv := &Server{
+		config:      cfg,
+		httpServer:  httpServer,
+		httpClient:  httpClient,
+		workerPool:  workerPool,
+		metrics:     metrics,
+		authService: authService,
+		usage:       usage,
+		signals:     make(chan os.Signal, 1),
+		stopped:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(srv)
 	}
+	// /health only reports whether the process works; tokens and the upstream decide readiness
+	healthChecker.AddReadinessCheck(ConfigFileCheck(cfg, srv.configPath))
+	healthChecker.AddReadinessCheck(UpstreamCheck(srv.reachUpstream, proxyService.CircuitState, proxyService.CircuitStates))
+	return srv
+}
+
+// Reload re-reads the config file and publishes hot-reloadable settings (headers, CORS,
+// per-request timeouts, retry, response headers and model aliases) without restarting
+// the listener. Settings fixed at startup, such as server timeouts, need a restart.
+func (s *Server) Reload() error {
+	path := s.configPath
+	if path == "" {
+		var err error
+		if path, err = GetConfigPath(); err != nil {
+			return err
+		}
+	}
+	if err := s.config.ReloadFromFile(path); err != nil {
+		return err
+	}
+	Info("Configuration reloaded", "path", path)
+	return nil
+}
+
+// Handler returns the server's root HTTP handler including the middleware chain
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
 }
 
 // Start starts the HTTP server with graceful shutdown
 func (s *Server) Start() error {
 	s.setupGracefulShutdown()
 
-	port := s.config.Port
-	if port == 0 {
-		port = 8081
+	if s.config.Proxy.WarmUp {
+		s.warmUpUpstream()
+	}
+	if s.selfTest {
+		if err := s.runSelfTest(); err != nil {
+			Error("Startup self-test failed", "error", err)
+			return s.abort(ShutdownSelfTestFailed, NewProxyError("self_test", "startup self-test failed", err))
+		}
 	}
 
-	fmt.Printf("Starting GitHub Copilot proxy server on port %d...\n", port)
+	listener, err := s.listen()
+	if err != nil {
+		return s.abort(ShutdownListenFailed, NewProxyError("listen", "cannot listen on "+listenAddress(s.config), err))
+	}
+	if s.config.AutoPort {
+		s.recordBoundPort(listener.Addr())
+	}
+	s.addrMutex.Lock()
+	s.addr = listener.Addr()
+	s.addrMutex.Unlock()
+
+	bound := s.boundConfig()
+	fmt.Printf("Starting GitHub Copilot proxy server on %s...\n", listenAddress(bound))
 	fmt.Printf("Endpoints:\n")
-	fmt.Printf("  - Models: http://localhost:%d/v1/models\n", port)
-	fmt.Printf("  - Chat: http://localhost:%d/v1/chat/completions\n", port)
-	fmt.Printf("  - Health: http://localhost:%d/health\n", port)
+	fmt.Printf("  - Models: %s\n", endpointURL(bound, "/v1/models"))
+	fmt.Printf("  - Chat: %s\n", endpointURL(bound, "/v1/chat/completions"))
+	if s.config.Proxy.WebSocket {
+		fmt.Printf("  - Chat (WebSocket): %s\n", endpointURL(bound, chatWebSocketRoute))
+	}
+	fmt.Printf("  - Health: %s\n", endpointURL(bound, "/health"))
+	s.logStartupSummary()
 
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return fmt.Errorf("server failed: %v", err)
+	if s.config.Auth.BackgroundRefresh {
+		s.authService.StartBackgroundRefresh(context.Background(), s.config)
 	}
 
+	exporter, err := NewMetricsExporter(s.config, s.httpClient)
+	if err != nil {
+		Warn("Metrics push disabled", "error", err)
+	} else if exporter != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopPush = cancel
+		interval := time.Duration(s.config.Metrics.Push.Interval) * time.Second
+		go RunMetricsPush(ctx, s.metrics, exporter, interval)
+		Info("Pushing metrics", "backend", s.config.Metrics.Push.Backend, "endpoint", s.config.Metrics.Push.Endpoint)
+	}
+
+	if s.usage != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopUsage = cancel
+		go RunUsagePersist(ctx, s.usage, time.Duration(s.config.Stats.Interval)*time.Second)
+		Info("Recording usage statistics", "file", s.usage.path)
+	}
+
+	if err := s.serve(listener); err != nil && err != http.ErrServerClosed {
+		return s.abort(ShutdownServeFailed, NewProxyError("serve", "server failed", err))
+	}
+
+	// Serve returns as soon as shutdown begins; wait until in-flight requests drained
+	<-s.stopped
+	if s.stopErr != nil {
+		return NewProxyError("shutdown", "graceful shutdown failed", s.stopErr)
+	}
 	return nil
 }
 
-// Stop gracefully stops the server
+// warmUpUpstream sends a cheap request to the Copilot API so the TLS connection is
+// already in the pool when the first chat request arrives. Failures are only logged.
+func (s *Server) warmUpUpstream() {
+	ctx, cancel := context.WithTimeout(context.Background(), warmUpTimeout)
+	defer cancel()
+
+	started := time.Now()
+	status, err := s.probeUpstream(ctx)
+	if err != nil {
+		Warn("Upstream warm-up failed", "url", copilotModelsURL, "error", err)
+		return
+	}
+	Info("Upstream connection warmed up", "status", status, "duration", time.Since(started).Round(time.Millisecond))
+}
+
+// reachUpstream reports whether the Copilot API can be reached. Until a warm-up or an
+// earlier call has reached it, each call probes it; later calls rely on the circuit
+// breakers instead.
+func (s *Server) reachUpstream(ctx context.Context) error {
+	if s.upstreamReached.Load() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	_, err := s.probeUpstream(ctx)
+	return err
+}
+
+// probeUpstream sends a cheap request to the Copilot API and returns its status. Any
+// response, even an error status, shows the API is reachable.
+func (s *Server) probeUpstream(ctx context.Context) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, copilotModelsURL, http.NoBody)
+	if err != nil {
+		return 0, err
+	}
+	if token, _ := s.config.Token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("User-Agent", s.config.Live().Headers.UserAgent)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// Drain the body so the connection goes back to the pool
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	s.upstreamReached.Store(true)
+	return resp.StatusCode, nil
+}
+
+// logStartupSummary logs the resolved settings the server runs with. Secrets are never
+// included: API keys and tokens only show up as enabled features.
+func (s *Server) logStartupSummary() {
+	cfg := s.config
+	var timeouts []string
+	for _, timeout := range effectiveTimeouts(cfg) {
+		timeouts = append(timeouts, timeout.name+"="+timeout.value)
+	}
+	circuitBreaker := fmt.Sprintf("threshold=%d timeout=%ds", circuitBreakerFailureThreshold, cfg.Timeouts.CircuitBreaker)
+	if cfg.Debug.DisableCircuitBreaker {
+		circuitBreaker = "disabled"
+	}
+
+	var features []string
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"tls", cfg.TLSEnabled()},
+		{"client_certs", cfg.TLSEnabled() && cfg.TLS.ClientCAFile != ""},
+		{"upstream_ca", len(cfg.UpstreamTLS.CAFiles) > 0},
+		{"api_key_auth", cfg.APIKey != ""},
+		{"response_cache", cfg.ResponseCache.Enabled},
+		{"idempotency", cfg.Idempotency.Enabled},
+		{"upstream_limit", cfg.MaxConcurrentUpstream > 0},
+		{"stream_limit", cfg.MaxConcurrentStreams > 0},
+		{"rate_limit", cfg.RateLimit.RequestsPerMinute > 0},
+		{"rate_limit_per_user", cfg.RateLimit.PerUser},
+		{"per_client_limit", cfg.RateLimit.MaxConcurrent > 0},
+		{"background_refresh", cfg.Auth.BackgroundRefresh},
+		{"metrics_push", cfg.Metrics.Push.Backend != ""},
+		{"request_capture", cfg.Debug.CaptureDir != ""},
+		{"warm_up", cfg.Proxy.WarmUp},
+		{"stats", cfg.Stats.Enabled},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	enabled := "none"
+	if len(features) > 0 {
+		enabled = strings.Join(features, ",")
+	}
+
+	mode := cfg.Proxy.Mode
+	if mode == "" {
+		mode = proxyModeBuffered
+	}
+	upstreamProxy := "environment"
+	if cfg.UpstreamProxy.URL != "" {
+		upstreamProxy = "invalid"
+		if proxyURL, err := url.Parse(cfg.UpstreamProxy.URL); err == nil {
+			upstreamProxy = proxyURL.Redacted()
+		}
+	}
+
+	host, port := listenHost(cfg.Host), cfg.Port
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	if port == 0 {
+		port = defaultServerPort
+	}
+	// With auto_port the bound port can differ from the configured one
+	if tcpAddr, ok := s.Addr().(*net.TCPAddr); ok {
+		port = tcpAddr.Port
+	}
+
+	Info("Server configuration",
+		"listen", listenAddress(s.boundConfig()),
+		"host", host,
+		"port", port,
+		"workers", s.workerPool.workers,
+		"proxy_mode", mode,
+		"timeouts", strings.Join(timeouts, " "),
+		"circuit_breaker", circuitBreaker,
+		"features", enabled,
+		"upstream_proxy", upstreamProxy)
+}
+
+// ShutdownReason records why the server stopped
+type ShutdownReason string
+
+const (
+	ShutdownSignal         ShutdownReason = "signal"           // SIGINT or SIGTERM received
+	ShutdownStopped        ShutdownReason = "stopped"          // Stop called by the embedding program
+	ShutdownSelfTestFailed ShutdownReason = "self_test_failed" // --self-test failed before listening
+	ShutdownListenFailed   ShutdownReason = "listen_failed"    // the listener could not be opened
+	ShutdownServeFailed    ShutdownReason = "serve_failed"     // serving stopped with an error
+)
+
+// abnormal reports whether the server stopped because of a failure
+func (r ShutdownReason) abnormal() bool {
+	return r != ShutdownSignal && r != ShutdownStopped
+}
+
+// Addr returns the address the server listens on, or nil before it is listening
+func (s *Server) Addr() net.Addr {
+	s.addrMutex.Lock()
+	defer s.addrMutex.Unlock()
+	return s.addr
+}
+
+// ShutdownReason returns why the server stopped, or "" while it is running
+func (s *Server) ShutdownReason() ShutdownReason {
+	s.reasonMutex.Lock()
+	defer s.reasonMutex.Unlock()
+	return s.shutdownReason
+}
+
+// setShutdownReason records the first reason given; later ones are consequences of it
+func (s *Server) setShutdownReason(reason ShutdownReason, sig os.Signal) {
+	s.reasonMutex.Lock()
+	defer s.reasonMutex.Unlock()
+	if s.shutdownReason == "" {
+		s.shutdownReason = reason
+		s.shutdownSignal = sig
+	}
+}
+
+// abort shuts down a server that failed to start or serve and returns err
+func (s *Server) abort(reason ShutdownReason, err error) error {
+	s.setShutdownReason(reason, nil)
+	Error("Server stopping", "reason", reason, "error", err)
+	if stopErr := s.Stop(); stopErr != nil {
+		Error("Server shutdown error", "error", stopErr)
+	}
+	return err
+}
+
+// Stop gracefully stops the server. Only the first call shuts it down; later calls
+// return its result.
 func (s *Server) Stop() error {
+	s.setShutdownReason(ShutdownStopped, nil)
+	s.stopOnce.Do(func() {
+		s.stopErr = s.shutdown()
+		close(s.stopped)
+	})
+	return s.stopErr
+}
+
+func (s *Server) shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
+	signal.Stop(s.signals)
+	s.authService.StopBackgroundRefresh()
+	if s.stopPush != nil {
+		s.stopPush()
+	}
+	if s.stopUsage != nil {
+		s.stopUsage()
+	}
+
 	fmt.Println("Stopping worker pool...")
 	s.workerPool.Stop()
 	fmt.Println("Worker pool stopped.")
@@ -248,20 +739,56 @@ func (s *Server) Stop() error {
 		return err
 	}
 	fmt.Println("HTTP server shutdown complete.")
+	if s.config.AutoPort {
+		s.removeBoundPort()
+	}
 
+	// Requests are done, so this save holds every one of them
+	if s.usage != nil {
+		if err := s.usage.Save(); err != nil {
+			Error("Failed to save usage statistics", "file", s.usage.path, "error", err)
+		}
+	}
+
+	s.reasonMutex.Lock()
+	reason, sig := s.shutdownReason, s.shutdownSignal
+	s.reasonMutex.Unlock()
+	attrs := []any{"reason", reason}
+	if sig != nil {
+		attrs = append(attrs, "signal", sig.String())
+	}
+	if reason.abnormal() {
+		Error("Server stopped abnormally", attrs...)
+	} else {
+		Info("Server stopped", attrs...)
+	}
 	return nil
 }
 
 func (s *Server) setupGracefulShutdown() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(s.signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		<-c
-		fmt.Println("\nGracefully shutting down...")
+		for {
+			var sig os.Signal
+			select {
+			case sig = <-s.signals:
+			case <-s.stopped:
+				return
+			}
+			if sig == syscall.SIGHUP {
+				if err := s.Reload(); err != nil {
+					Error("Config reload failed, keeping current configuration", "error", err)
+				}
+				continue
+			}
 
-		if err := s.Stop(); err != nil {
-			Error("Server shutdown error", "error", err)
+			fmt.Println("\nGracefully shutting down...")
+			s.setShutdownReason(ShutdownSignal, sig)
+			if err := s.Stop(); err != nil {
+				Error("Server shutdown error", "error", err)
+			}
+			return
 		}
 	}()
 }
@@ -270,6 +797,7 @@ func (s *Server) setupGracefulShutdown() {
 
 // MetricsMiddleware adds request metrics collection
 func (m *Metrics) MetricsMiddleware(next http.Handler) http.Handler {
+	m.init()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
@@ -291,6 +819,9 @@ func (m *Metrics) MetricsMiddleware(next http.Handler) http.Handler {
 		m.RequestsDuration += duration
 		m.ActiveConnections--
 		m.mutex.Unlock()
+		if class := rw.statusCode / 100; class >= 1 && class <= 5 {
+			m.responses.Inc(fmt.Sprintf("%dxx", class))
+		}
 	})
 }
 
@@ -305,60 +836,103 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// Handler returns metrics in Prometheus format
-func (m *Metrics) Handler() http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
-		m.mutex.RLock()
-		requestsTotal := m.RequestsTotal
-		requestsDuration := m.RequestsDuration
-		activeConnections := m.ActiveConnections
-		m.mutex.RUnlock()
+// Flush sends buffered data to the client, so streamed responses are not held back
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
 
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+// Unwrap exposes the underlying writer to http.ResponseController, so WebSocket
+// upgrades can hijack the connection
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
 
-		// Write metrics in Prometheus format, checking for errors
-		if _, err := fmt.Fprintf(w, "# HELP github_copilot_requests_total Total number of requests\n"); err != nil {
-			return
-		}
-		if _, err := fmt.Fprintf(w, "# TYPE github_copilot_requests_total counter\n"); err != nil {
-			return
-		}
-		if _, err := fmt.Fprintf(w, "github_copilot_requests_total %d\n", requestsTotal); err != nil {
-			return
+// Content types for metrics exposition
+const (
+	prometheusTextContentType = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType    = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Handler returns metrics in Prometheus format, or OpenMetrics when the client asks for it
+func (m *Metrics) Handler() http.HandlerFunc {
+	m.init()
+	return func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			w.Header().Set("Content-Type", prometheusTextContentType)
 		}
+		_ = m.registry.Write(w, openMetrics)
+	}
+}
 
-		if _, err := fmt.Fprintf(w, "# HELP github_copilot_requests_duration_seconds Total duration of requests in seconds\n"); err != nil {
-			return
+// init registers the server metrics; callbacks that are not set are left out
+func (m *Metrics) init() {
+	m.registryOnce.Do(func() {
+		r := NewMetricRegistry()
+		r.CounterFunc("github_copilot_requests_total", "Total number of requests", m.locked(func() float64 { return float64(m.RequestsTotal) }))
+		r.CounterFunc("github_copilot_requests_duration_seconds", "Total duration of requests in seconds", m.locked(func() float64 { return m.RequestsDuration }))
+		r.GaugeFunc("github_copilot_active_connections", "Current number of active connections", m.locked(func() float64 { return float64(m.ActiveConnections) }))
+		r.CounterFunc("github_copilot_uptime_seconds", "Server uptime in seconds", func() float64 { return time.Since(startTime).Seconds() })
+		if m.upstreamInFlight != nil {
+			r.GaugeFunc("github_copilot_upstream_in_flight", "Current number of in-flight upstream requests", int64Metric(m.upstreamInFlight))
 		}
-		if _, err := fmt.Fprintf(w, "# TYPE github_copilot_requests_duration_seconds counter\n"); err != nil {
-			return
+		if m.activeStreams != nil {
+			r.GaugeFunc("github_copilot_active_streams", "Current number of streaming chat requests", int64Metric(m.activeStreams))
 		}
-		if _, err := fmt.Fprintf(w, "github_copilot_requests_duration_seconds %f\n", requestsDuration); err != nil {
-			return
+		if m.workerQueueDepth != nil {
+			r.GaugeFunc("github_copilot_worker_queue_depth", "Current number of requests waiting for a worker", int64Metric(m.workerQueueDepth))
 		}
-
-		if _, err := fmt.Fprintf(w, "# HELP github_copilot_active_connections Current number of active connections\n"); err != nil {
-			return
+		if m.workerActive != nil {
+			r.GaugeFunc("github_copilot_worker_active", "Current number of busy workers", int64Metric(m.workerActive))
 		}
-		if _, err := fmt.Fprintf(w, "# TYPE github_copilot_active_connections gauge\n"); err != nil {
-			return
+		if m.workerJobs != nil {
+			r.CounterFunc("github_copilot_worker_jobs_total", "Total number of jobs run by the worker pool", int64Metric(m.workerJobs))
 		}
-		if _, err := fmt.Fprintf(w, "github_copilot_active_connections %d\n", activeConnections); err != nil {
-			return
+		if m.circuitState != nil {
+			r.GaugeFunc("github_copilot_circuit_breaker_state", "Most severe upstream circuit breaker state of any model group (0=closed, 1=open, 2=half-open)", func() float64 { return float64(m.circuitState()) })
+		}
+		if m.circuitStates != nil {
+			r.LabeledGaugeFunc("github_copilot_circuit_breaker_group_state", "Upstream circuit breaker state per model group (0=closed, 1=open, 2=half-open)", "group", func() map[string]float64 {
+				states := m.circuitStates()
+				values := make(map[string]float64, len(states))
+				for group, state := range states {
+					values[group] = float64(state)
+				}
+				return values
+			})
 		}
 
-		// Add uptime metric
-		uptime := time.Since(startTime).Seconds()
-		if _, err := fmt.Fprintf(w, "# HELP github_copilot_uptime_seconds Server uptime in seconds\n"); err != nil {
-			return
+		m.responses = r.NewCounter("github_copilot_responses_total", "Total number of responses by status class", "code")
+		for class := 1; class <= 5; class++ {
+			m.responses.Add(0, fmt.Sprintf("%dxx", class))
 		}
-		if _, err := fmt.Fprintf(w, "# TYPE github_copilot_uptime_seconds counter\n"); err != nil {
-			return
+
+		if m.requestBytes != nil {
+			r.HistogramFunc("github_copilot_request_bytes", "Size of proxied request bodies in bytes", m.requestBytes)
 		}
-		if _, err := fmt.Fprintf(w, "github_copilot_uptime_seconds %f\n", uptime); err != nil {
-			return
+		if m.responseBytes != nil {
+			r.HistogramFunc("github_copilot_response_bytes", "Size of proxied response bodies in bytes, including streams", m.responseBytes)
 		}
+		m.registry = r
+	})
+}
+
+// locked returns f evaluated under the metrics read lock
+func (m *Metrics) locked(f func() float64) func() float64 {
+	return func() float64 {
+		m.mutex.RLock()
+		defer m.mutex.RUnlock()
+		return f()
 	}
 }
 
+// int64Metric adapts an integer callback to a metric value
+func int64Metric(f func() int64) func() float64 {
+	return func() float64 { return float64(f()) }
+}
+
 var startTime = time.Now()
@@ -0,0 +1,302 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
+)
+
+const (
+	// Usage statistics file, next to config.json unless stats.file is set
+	statsFileName = "stats.json"
+	statsFilePerm = 0o600
+	statsVersion  = 1
+
+	defaultStatsInterval = 60 // seconds
+
+	// Requests without a model in their body are counted under this name
+	unknownModel = "unknown"
+
+	// How much of the end of a response is kept to find its usage object
+	usageTailSize = 16 * 1024
+)
+
+// UsageCounters are the totals kept for all requests and for each model
+type UsageCounters struct {
+	Requests         int64 `json:"requests"`
+	Errors           int64 `json:"errors"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+func (c *UsageCounters) add(failed bool, usage *transform.ChatCompletionUsage) {
+	c.Requests++
+	if failed {
+		c.Errors++
+	}
+	if usage != nil {
+		c.PromptTokens += int64(usage.PromptTokens)
+		c.CompletionTokens += int64(usage.CompletionTokens)
+		c.TotalTokens += int64(usage.TotalTokens)
+	}
+}
+
+// UsageStats is the usage summary the server persists and the stats command prints.
+// Counters accumulate across restarts from Since until the file is removed.
+type UsageStats struct {
+	Version   int                      `json:"version"`
+	Since     time.Time                `json:"since"`
+	UpdatedAt time.Time                `json:"updated_at"`
+	Total     UsageCounters            `json:"total"`
+	Models    map[string]UsageCounters `json:"models"`
+}
+
+// UsageRecorder counts proxied chat requests and their token usage
+type UsageRecorder struct {
+	path string
+
+	mutex sync.Mutex
+	stats UsageStats
+	dirty bool
+}
+
+// statsFilePath returns where usage statistics are kept: stats.file, or stats.json in
+// the config directory
+func statsFilePath(cfg *Config) (string, error) {
+	if cfg.Stats.File != "" {
+		return cfg.Stats.File, nil
+	}
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(configPath), statsFileName), nil
+}
+
+// NewUsageRecorder creates a recorder persisting to path that continues the counters
+// already stored there; a missing file starts from zero
+func NewUsageRecorder(path string) (*UsageRecorder, error) {
+	stats, err := LoadUsageStats(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		stats = &UsageStats{Version: statsVersion, Since: time.Now().UTC(), Models: make(map[string]UsageCounters)}
+	} else if err != nil {
+		return nil, err
+	}
+	return &UsageRecorder{path: path, stats: *stats}, nil
+}
+
+// LoadUsageStats reads a usage statistics file written by the server
+func LoadUsageStats(path string) (*UsageStats, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var stats UsageStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, NewValidationError("file", path, "not a usage statistics file", err)
+	}
+	if stats.Version != statsVersion {
+		return nil, NewValidationError("version", stats.Version, fmt.Sprintf("unsupported usage statistics version (want %d)", statsVersion), nil)
+	}
+	if stats.Models == nil {
+		stats.Models = make(map[string]UsageCounters)
+	}
+	return &stats, nil
+}
+
+// Record counts one request to model; usage is nil when the response reported none
+func (u *UsageRecorder) Record(model string, failed bool, usage *transform.ChatCompletionUsage) {
+	if model == "" {
+		model = unknownModel
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.stats.Total.add(failed, usage)
+	counters := u.stats.Models[model]
+	counters.add(failed, usage)
+	u.stats.Models[model] = counters
+	u.dirty = true
+}
+
+// Snapshot returns a copy of the current counters
+func (u *UsageRecorder) Snapshot() UsageStats {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.snapshot()
+}
+
+func (u *UsageRecorder) snapshot() UsageStats {
+	stats := u.stats
+	stats.Models = make(map[string]UsageCounters, len(u.stats.Models))
+	for model, counters := range u.stats.Models {
+		stats.Models[model] = counters
+	}
+	return stats
+}
+
+// Save writes the counters when they changed since the last save. The file is
+// replaced atomically, so readers never see a partial write.
+func (u *UsageRecorder) Save() error {
+	u.mutex.Lock()
+	if !u.dirty {
+		u.mutex.Unlock()
+		return nil
+	}
+	u.stats.UpdatedAt = time.Now().UTC()
+	stats := u.snapshot()
+	u.dirty = false
+	u.mutex.Unlock()
+
+	if err := writeUsageStats(u.path, &stats); err != nil {
+		u.mutex.Lock()
+		u.dirty = true
+		u.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// writeUsageStats writes stats to a temporary file next to path and renames it
+func writeUsageStats(path string, stats *UsageStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), statsFileName+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Chmod(statsFilePerm); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// RunUsagePersist saves the counters every interval until ctx is canceled. The final
+// save happens on server shutdown, once in-flight requests are done.
+func RunUsagePersist(ctx context.Context, recorder *UsageRecorder, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultStatsInterval * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := recorder.Save(); err != nil {
+				Warn("Failed to save usage statistics", "file", recorder.path, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// usageResponseWriter keeps the status and the end of a proxied response, which holds
+// the usage object of both JSON and streamed chat completions
+type usageResponseWriter struct {
+	http.ResponseWriter
+	status int
+	tail   []byte
+}
+
+func (uw *usageResponseWriter) WriteHeader(statusCode int) {
+	if uw.status == 0 {
+		uw.status = statusCode
+	}
+	uw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (uw *usageResponseWriter) Write(data []byte) (int, error) {
+	if uw.status == 0 {
+		uw.status = http.StatusOK
+	}
+	uw.tail = append(uw.tail, data...)
+	if extra := len(uw.tail) - usageTailSize; extra > 0 {
+		uw.tail = append(uw.tail[:0], uw.tail[extra:]...)
+	}
+	return uw.ResponseWriter.Write(data)
+}
+
+// Flush forwards to the underlying writer so streams are not held back
+func (uw *usageResponseWriter) Flush() {
+	if flusher, ok := uw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// failed reports whether the request failed: nothing was written, so the handler
+// answers with an error, or the upstream returned one
+func (uw *usageResponseWriter) failed() bool {
+	return uw.status == 0 || uw.status >= http.StatusBadRequest
+}
+
+// usage returns the last non-null usage object of the response. Streams without
+// stream_options.include_usage have none.
+func (uw *usageResponseWriter) usage() *transform.ChatCompletionUsage {
+	key := []byte(`"usage"`)
+	tail := uw.tail
+	for {
+		i := bytes.LastIndex(tail, key)
+		if i < 0 {
+			return nil
+		}
+		rest := bytes.TrimLeft(tail[i+len(key):], " \t\r\n")
+		if rest, ok := bytes.CutPrefix(rest, []byte(":")); ok {
+			var usage *transform.ChatCompletionUsage
+			if json.NewDecoder(bytes.NewReader(rest)).Decode(&usage) == nil && usage != nil {
+				return usage
+			}
+		}
+		tail = tail[:i]
+	}
+}
+
+// printUsageStats renders stats as a table with one row per model and a total
+func printUsageStats(w io.Writer, stats *UsageStats) error {
+	fmt.Fprintf(w, "Usage since %s", stats.Since.Local().Format(time.DateTime))
+	if !stats.UpdatedAt.IsZero() {
+		fmt.Fprintf(w, " (updated %s)", stats.UpdatedAt.Local().Format(time.DateTime))
+	}
+	fmt.Fprint(w, "\n\n")
+
+	models := make([]string, 0, len(stats.Models))
+	for model := range stats.Models {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tREQUESTS\tERRORS\tPROMPT TOKENS\tCOMPLETION TOKENS\tTOTAL TOKENS")
+	row := func(name string, c UsageCounters) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", name, c.Requests, c.Errors, c.PromptTokens, c.CompletionTokens, c.TotalTokens)
+	}
+	for _, model := range models {
+		row(model, stats.Models[model])
+	}
+	row("TOTAL", stats.Total)
+	return tw.Flush()
+}
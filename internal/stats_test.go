@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
+)
+
+func TestUsageRecorderPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	recorder, err := NewUsageRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Record("gpt-4o", false, &transform.ChatCompletionUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15})
+	recorder.Record("gpt-4o", true, nil)
+	recorder.Record("", false, nil)
+	if err := recorder.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	t.Run("file format", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			t.Fatalf("Stats file is not JSON: %v", err)
+		}
+		for _, key := range []string{"version", "since", "updated_at", "total", "models"} {
+			if _, ok := raw[key]; !ok {
+				t.Errorf("Expected key %q in %s", key, data)
+			}
+		}
+		model := raw["models"].(map[string]interface{})["gpt-4o"].(map[string]interface{})
+		want := map[string]interface{}{"requests": 2.0, "errors": 1.0, "prompt_tokens": 10.0, "completion_tokens": 5.0, "total_tokens": 15.0}
+		if !reflect.DeepEqual(model, want) {
+			t.Errorf("Expected gpt-4o counters %v, got %v", want, model)
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != statsFilePerm {
+			t.Errorf("Expected mode %o, got %v (%v)", statsFilePerm, info.Mode().Perm(), err)
+		}
+	})
+
+	t.Run("a new recorder continues the saved counters", func(t *testing.T) {
+		resumed, err := NewUsageRecorder(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resumed.Record("gpt-4o", false, &transform.ChatCompletionUsage{PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2})
+		stats := resumed.Snapshot()
+		if stats.Total != (UsageCounters{Requests: 4, Errors: 1, PromptTokens: 11, CompletionTokens: 6, TotalTokens: 17}) {
+			t.Errorf("Unexpected totals %+v", stats.Total)
+		}
+		if stats.Models[unknownModel].Requests != 1 {
+			t.Errorf("Expected a request without model under %q, got %+v", unknownModel, stats.Models)
+		}
+		if !stats.Since.Equal(recorder.Snapshot().Since) {
+			t.Error("Expected the original start time to be kept")
+		}
+	})
+
+	t.Run("unknown version is rejected", func(t *testing.T) {
+		other := filepath.Join(t.TempDir(), "stats.json")
+		if err := os.WriteFile(other, []byte(`{"version":99}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadUsageStats(other); err == nil {
+			t.Error("Expected an error for an unsupported version")
+		}
+	})
+}
+
+func TestProxyRecordsUsage(t *testing.T) {
+	const (
+		jsonBody   = `{"id":"1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"\"usage\": 1"}}],"usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`
+		streamBody = "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}],\"usage\":null}\n\n" +
+			"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":4,\"completion_tokens\":2,\"total_tokens\":6}}\n\n" +
+			"data: [DONE]\n\n"
+	)
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Request: req}
+		switch {
+		case strings.Contains(string(body), `"model":"o3-mini"`):
+			resp.StatusCode = http.StatusBadRequest
+			resp.Body = io.NopCloser(strings.NewReader(`{"error":{"message":"bad"}}`))
+		case strings.Contains(string(body), `"stream":true`):
+			resp.Header.Set("Content-Type", "text/event-stream")
+			resp.Body = io.NopCloser(strings.NewReader(streamBody))
+		default:
+			resp.Header.Set("Content-Type", "application/json")
+			resp.Body = io.NopCloser(strings.NewReader(jsonBody))
+		}
+		return resp, nil
+	})}
+
+	cfg := &Config{CopilotToken: "test-token", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	SetDefaultHeaders(cfg)
+	SetDefaultCORS(cfg)
+	SetDefaultTimeouts(cfg)
+	workerPool := NewWorkerPool(2)
+	t.Cleanup(workerPool.Stop)
+	proxy := NewProxyService(cfg, client, NewAuthService(client), workerPool)
+	recorder, err := NewUsageRecorder(filepath.Join(t.TempDir(), "stats.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.usage = recorder
+
+	for _, body := range []string{
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`,
+		`{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`,
+		`{"model":"o3-mini","messages":[{"role":"user","content":"hi"}]}`,
+	} {
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, chatCompletionsRoute, strings.NewReader(body)))
+	}
+
+	stats := recorder.Snapshot()
+	if got, want := stats.Models["gpt-4o"], (UsageCounters{Requests: 2, PromptTokens: 11, CompletionTokens: 5, TotalTokens: 16}); got != want {
+		t.Errorf("Expected gpt-4o counters %+v, got %+v", want, got)
+	}
+	if got := stats.Models["o3-mini"]; got.Requests != 1 || got.Errors != 1 {
+		t.Errorf("Expected one failed o3-mini request, got %+v", got)
+	}
+	if stats.Total.Requests != 3 || stats.Total.Errors != 1 {
+		t.Errorf("Unexpected totals %+v", stats.Total)
+	}
+}
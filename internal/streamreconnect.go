@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// maxStreamReconnects caps proxy.stream_reconnects
+const maxStreamReconnects = 3
+
+// errStreamTruncated is reported when the upstream ends a stream cleanly but before
+// [DONE] or a finish_reason
+var errStreamTruncated = errors.New("upstream stream ended before [DONE]")
+
+// clientWriteError marks a failure writing the stream to the client, as opposed to
+// reading it from the upstream; there is no one left to continue the stream for
+type clientWriteError struct {
+	err error
+}
+
+func (e *clientWriteError) Error() string { return "writing to client: " + e.err.Error() }
+
+func (e *clientWriteError) Unwrap() error { return e.err }
+
+// streamProgress tracks what the client has been sent of a chat completion stream
+type streamProgress struct {
+	content  bytes.Buffer // assistant text of choice 0 so far
+	finished bool         // a finish_reason or [DONE] was seen
+	// A continuation can only rebuild plain text from a single choice
+	unsupported bool
+}
+
+// observe records one complete SSE event
+func (p *streamProgress) observe(event []byte) {
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r"), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if string(data) == "[DONE]" {
+			p.finished = true
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Index int `json:"index"`
+				Delta struct {
+					Content   string          `json:"content"`
+					ToolCalls json.RawMessage `json:"tool_calls"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal(data, &chunk) != nil {
+			continue
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 || len(choice.Delta.ToolCalls) > 0 {
+				p.unsupported = true
+			}
+			if choice.FinishReason != nil && *choice.FinishReason != "" {
+				p.finished = true
+			}
+			if choice.Index == 0 {
+				p.content.WriteString(choice.Delta.Content)
+			}
+		}
+	}
+}
+
+// streamReconnects returns how many times a dropped stream may be continued
+func (s *ProxyService) streamReconnects() int {
+	return min(s.config.Proxy.StreamReconnects, maxStreamReconnects)
+}
+
+// handleReconnectingStream copies a chat completion stream event by event. When the
+// upstream drops it before [DONE], the request is sent again with the text received
+// so far as an assistant message, and the continuation is appended to the client's
+// stream. This is best effort: each attempt must add content, and streams with tool
+// calls or several choices are terminated as usual. A client that can no longer be
+// written to ends the stream without a continuation.
+func (s *ProxyService) handleReconnectingStream(w http.ResponseWriter, req *http.Request, body []byte, current *seat, resp *http.Response) error {
+	var progress streamProgress
+	for reconnects := 0; ; reconnects++ {
+		before := progress.content.Len()
+		err := s.copyStreamEvents(w, resp, &progress)
+		if err == nil || progress.finished {
+			return nil
+		}
+		var writeErr *clientWriteError
+		if errors.As(err, &writeErr) || req.Context().Err() != nil {
+			return err
+		}
+
+		madeProgress := reconnects == 0 || progress.content.Len() > before
+		if reconnects >= s.streamReconnects() || progress.unsupported || !madeProgress {
+			Error("Error reading streaming response", "error", err, "reconnects", reconnects)
+			s.endStream(w, resp, err)
+			return err
+		}
+
+		Warn("Upstream stream dropped, continuing", "attempt", reconnects+1, "received_bytes", progress.content.Len(), "error", err)
+		next, nextErr := s.continueStream(req, body, current, progress.content.String())
+		if nextErr != nil {
+			Error("Failed to continue dropped stream", "error", nextErr)
+			s.endStream(w, resp, err)
+			return err
+		}
+		// processProxyRequest closes the first response; continuations close on return
+		resp = next
+		defer closeBody(next)
+	}
+}
+
+// copyStreamEvents forwards complete SSE events from resp to w, so a drop never leaves
+// the client with half an event. It returns nil once the stream ends cleanly.
+func (s *ProxyService) copyStreamEvents(w http.ResponseWriter, resp *http.Response, progress *streamProgress) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, s.streamBufferSize())
+	var pending []byte
+	for {
+		n, readErr := resp.Body.Read(buf)
+		pending = append(pending, buf[:n]...)
+		if end := bytes.LastIndex(pending, []byte("\n\n")); end >= 0 {
+			events := pending[:end+2]
+			for _, event := range bytes.SplitAfter(events, []byte("\n\n")) {
+				progress.observe(event)
+			}
+			if _, err := w.Write(events); err != nil {
+				Error("Error writing streaming chunk", "error", err)
+				return &clientWriteError{err: err}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			pending = append(pending[:0], pending[end+2:]...)
+		}
+
+		if readErr == io.EOF {
+			if !progress.finished {
+				return errStreamTruncated
+			}
+			Debug("Streaming response completed successfully")
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// continueStream re-issues the chat request with partial appended as the assistant's
+// reply so far, returning the new upstream stream
+func (s *ProxyService) continueStream(req *http.Request, body []byte, current *seat, partial string) (*http.Response, error) {
+	continuation, err := continuationBody(body, partial)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.makeRequestWithRetry(req, continuation, current)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || !isEventStream(resp.Header.Get("Content-Type")) {
+		closeBody(resp)
+		return nil, NewProxyError("continue_stream", "upstream did not return a stream", nil)
+	}
+	return resp, nil
+}
+
+// continuationBody appends partial to the request's messages as an assistant message;
+// with nothing received yet the original request is sent again
+func continuationBody(body []byte, partial string) ([]byte, error) {
+	if partial == "" {
+		return body, nil
+	}
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	var messages []json.RawMessage
+	if err := json.Unmarshal(request["messages"], &messages); err != nil {
+		return nil, err
+	}
+	assistant, err := json.Marshal(map[string]string{"role": "assistant", "content": partial})
+	if err != nil {
+		return nil, err
+	}
+	if request["messages"], err = json.Marshal(append(messages, assistant)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(request)
+}
+
+// endStream closes a stream that could not be continued with an error event and [DONE]
+func (s *ProxyService) endStream(w http.ResponseWriter, resp *http.Response, err error) {
+	terminateStream(w, resp, false, err)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func closeBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		Debug("Error closing response body", "error", err)
+	}
+}
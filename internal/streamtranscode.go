@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
+)
+
+// maxTranscodeBodySize caps the non-streamed completion read into memory for transcoding
+const maxTranscodeBodySize = 16 * 1024 * 1024 // 16MB
+
+// needsStreamTranscoding reports whether resp answers a streamed chat request with a
+// complete JSON body, as models that cannot stream do. The client is waiting for SSE.
+func needsStreamTranscoding(upstreamPath string, stream bool, resp *http.Response) bool {
+	if upstreamPath != chatCompletionsPath || resp.StatusCode != http.StatusOK || !stream {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json" && resp.Header.Get("Content-Encoding") == ""
+}
+
+// transcodeToStream reads the JSON completion of resp and returns the SSE sequence a
+// streamed request expects (see transform.SplitChatResponse), ending with [DONE]. The
+// usage chunk is only sent when includeUsage is set. A body that is not a chat completion
+// becomes an error event, so SSE parsers still end cleanly.
+func transcodeToStream(resp *http.Response, includeUsage bool) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTranscodeBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxTranscodeBodySize {
+		return nil, fmt.Errorf("non-streamed response exceeds %d bytes", maxTranscodeBodySize)
+	}
+
+	var (
+		out        bytes.Buffer
+		completion transform.ChatCompletionResponse
+	)
+	if err := json.Unmarshal(body, &completion); err != nil || len(completion.Choices) == 0 {
+		Warn("Upstream answered a streamed request with JSON that is not a chat completion", "error", err, "body_length", len(body))
+		event, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": "Upstream returned a non-streamed response that is not a chat completion",
+				"type":    "upstream_stream_error",
+				"code":    http.StatusBadGateway,
+			},
+		})
+		fmt.Fprintf(&out, "event: error\ndata: %s\n\n", event)
+	} else {
+		Debug("Upstream did not stream, converting the completion to SSE", "model", completion.Model, "choices", len(completion.Choices))
+		for _, chunk := range transform.SplitChatResponse(&completion, includeUsage) {
+			data, err := json.Marshal(chunk)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&out, "data: %s\n\n", data)
+		}
+	}
+	out.WriteString("data: [DONE]\n\n")
+	return out.Bytes(), nil
+}
+
+// includeStreamUsage reports whether a streamed chat request asked for a final usage
+// chunk with stream_options.include_usage
+func includeStreamUsage(req *proxyRequest) bool {
+	var options struct {
+		IncludeUsage bool `json:"include_usage"`
+	}
+	_, err := req.decode("stream_options", &options)
+	return err == nil && options.IncludeUsage
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/privapps/github-copilot-svcs/pkg/transform"
+)
+
+const (
+	// Query parameter and value selecting plain text chat responses
+	formatParam     = "format"
+	formatPlainText = "text"
+
+	plainTextContentType = "text/plain; charset=utf-8"
+)
+
+// wantsPlainText reports whether a chat request asks for plain text, with ?format=text
+// or an Accept header preferring text/plain
+func wantsPlainText(r *http.Request) bool {
+	if r.URL.Query().Get(formatParam) == formatPlainText {
+		return true
+	}
+	first, _, _ := strings.Cut(r.Header.Get("Accept"), ",")
+	mediaType, _, err := mime.ParseMediaType(first)
+	return err == nil && mediaType == "text/plain"
+}
+
+// PlainTextHandler serves chat completions as bare text to clients asking for it (see
+// wantsPlainText): streams carry only the content deltas, other responses only the
+// message content. Everything else goes to next unchanged.
+func PlainTextHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !wantsPlainText(r) {
+			next(w, r)
+			return
+		}
+		// The upstream answers in JSON or SSE either way
+		r = r.Clone(r.Context())
+		r.Header.Del("Accept")
+
+		tw := &responseRewriter{
+			ResponseWriter:    w,
+			rewriteLines:      streamText,
+			rewriteBody:       plainTextBody,
+			streamContentType: plainTextContentType,
+		}
+		next(tw, r)
+		tw.finish()
+	}
+}
+
+// plainTextBody returns the message content of the first choice of a chat completion
+func plainTextBody(body []byte) ([]byte, string, error) {
+	var chatResp transform.ChatCompletionResponse
+	if err := json.Unmarshal(body, &chatResp); err != nil {
+		return nil, "", err
+	}
+	if len(chatResp.Choices) == 0 {
+		return nil, plainTextContentType, nil
+	}
+	return []byte(chatResp.Choices[0].Message.Content), plainTextContentType, nil
+}
+
+// streamText returns the content deltas of the first choice in SSE data lines;
+// other lines, [DONE] and chunks without content produce nothing
+func streamText(data []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		payload, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r"), []byte("data:"))
+		payload = bytes.TrimSpace(payload)
+		if !ok || string(payload) == "[DONE]" {
+			continue
+		}
+		var chunk transform.ChatCompletionChunk
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			continue
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Index == 0 {
+				out.WriteString(choice.Delta.Content)
+			}
+		}
+	}
+	return out.Bytes()
+}
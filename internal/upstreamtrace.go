@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// upstreamTraceContextKey holds the request ID of a request whose upstream calls are
+// traced; set by processProxyRequest with debug.trace_upstream
+type upstreamTraceContextKey struct{}
+
+// withUpstreamTracing marks ctx so upstream requests made with it log their timings
+func withUpstreamTracing(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, upstreamTraceContextKey{}, requestID)
+}
+
+// upstreamTrace records the connection phases of one upstream request. The callbacks
+// run on transport goroutines, so every field is guarded by mutex.
+type upstreamTrace struct {
+	requestID string
+	start     time.Time
+
+	mutex        sync.Mutex
+	dnsStart     time.Time
+	dns          time.Duration
+	connectStart time.Time
+	connect      time.Duration
+	tlsStart     time.Time
+	tls          time.Duration
+	wroteRequest time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+// traceUpstream returns req with a client trace attached when its context was marked
+// by withUpstreamTracing, and the trace to log once the response headers arrive
+func traceUpstream(req *http.Request) (*http.Request, *upstreamTrace) {
+	requestID, ok := req.Context().Value(upstreamTraceContextKey{}).(string)
+	if !ok {
+		return req, nil
+	}
+	t := &upstreamTrace{requestID: requestID, start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.since(&t.dns, t.dnsStart) },
+		ConnectStart: func(_, _ string) {
+			t.mark(&t.connectStart)
+		},
+		ConnectDone: func(_, _ string, _ error) {
+			t.since(&t.connect, t.connectStart)
+		},
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.since(&t.tls, t.tlsStart) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			t.reused = info.Reused
+			t.mutex.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+func (t *upstreamTrace) mark(at *time.Time) {
+	t.mutex.Lock()
+	*at = time.Now()
+	t.mutex.Unlock()
+}
+
+// since records the time from start until now; phases that were not started (e.g. DNS
+// for an IP address) stay zero
+func (t *upstreamTrace) since(d *time.Duration, start time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !start.IsZero() {
+		*d = time.Since(start)
+	}
+}
+
+// log writes the phase durations at debug level. DNS, connect and TLS are zero on a
+// reused connection; upstream is the time between sending the request and the first
+// response byte, i.e. the model-side latency.
+func (t *upstreamTrace) log(req *http.Request, err error) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	args := []any{
+		"request_id", t.requestID,
+		"url", req.URL.String(),
+		"reused_conn", t.reused,
+		"dns", t.dns,
+		"connect", t.connect,
+		"tls_handshake", t.tls,
+	}
+	if !t.firstByte.IsZero() {
+		args = append(args, "ttfb", t.firstByte.Sub(t.start))
+		if !t.wroteRequest.IsZero() {
+			args = append(args, "upstream", t.firstByte.Sub(t.wroteRequest))
+		}
+	}
+	if err != nil {
+		args = append(args, "error", err)
+	}
+	Debug("Upstream request timing", args...)
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTracing(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"1","object":"chat.completion","choices":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	// Dial the stub by name, so the request goes through DNS, connect and TLS
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	transport := upstream.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.ServerName = "example.com"
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort("localhost", port))
+	}
+	client := &http.Client{Transport: transport}
+	t.Cleanup(client.CloseIdleConnections)
+
+	run := func(t *testing.T, trace bool) string {
+		t.Helper()
+		original := logger
+		t.Cleanup(func() { logger = original })
+		var logs bytes.Buffer
+		logger = &Logger{Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})), level: slog.LevelDebug}
+
+		cfg := &Config{CopilotToken: "test-token", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+		SetDefaultHeaders(cfg)
+		SetDefaultCORS(cfg)
+		SetDefaultTimeouts(cfg)
+		cfg.Debug.TraceUpstream = trace
+		workerPool := NewWorkerPool(2)
+		t.Cleanup(workerPool.Stop)
+		proxy := NewProxyService(cfg, client, NewAuthService(client), workerPool)
+
+		req := httptest.NewRequest(http.MethodPost, chatCompletionsRoute, strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set(requestIDHeader, "trace-me")
+		w := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		client.CloseIdleConnections()
+		return logs.String()
+	}
+
+	t.Run("phases are logged when enabled", func(t *testing.T) {
+		logs := run(t, true)
+		var line string
+		for _, l := range strings.Split(logs, "\n") {
+			if strings.Contains(l, `msg="Upstream request timing"`) {
+				line = l
+			}
+		}
+		if line == "" {
+			t.Fatalf("Expected an upstream timing log, got:\n%s", logs)
+		}
+		for _, want := range []string{"request_id=trace-me", "reused_conn=false", "dns=", "connect=", "tls_handshake=", "ttfb=", "upstream="} {
+			if !strings.Contains(line, want) {
+				t.Errorf("Expected %q in %s", want, line)
+			}
+		}
+		for _, phase := range []string{"dns=0s", "connect=0s", "tls_handshake=0s"} {
+			if strings.Contains(line, phase) {
+				t.Errorf("Expected a measured %s phase, got %s", strings.TrimSuffix(phase, "=0s"), line)
+			}
+		}
+	})
+
+	t.Run("nothing is logged when disabled", func(t *testing.T) {
+		if logs := run(t, false); strings.Contains(logs, "Upstream request timing") {
+			t.Errorf("Expected no upstream timing without debug.trace_upstream, got:\n%s", logs)
+		}
+	})
+}
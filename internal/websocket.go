@@ -0,0 +1,458 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // required by the WebSocket handshake (RFC 6455)
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatWebSocketRoute serves chat completions streamed over a WebSocket
+const chatWebSocketRoute = "/v1/chat/ws"
+
+// WebSocket protocol constants (RFC 6455)
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+	wsCloseInternalError = 1011
+
+	// How long to wait for the client to answer our close frame
+	wsCloseTimeout = 5 * time.Second
+)
+
+var (
+	errWebSocketClosed   = errors.New("websocket closed")
+	errWebSocketProtocol = errors.New("websocket protocol error")
+	errWebSocketTooBig   = errors.New("websocket message too large")
+)
+
+// ChatWebSocketHandler bridges chat completion streams to WebSocket clients. After the
+// upgrade the client sends one chat request as a text message; it is run through
+// Handler as a streaming request, and the data of every SSE event (including the final
+// [DONE]) is sent back as a text frame before the server closes the connection. A
+// client closing the connection early cancels the upstream request.
+func (s *ProxyService) ChatWebSocketHandler() http.HandlerFunc {
+	chat := s.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			w.Header().Set("Upgrade", "websocket")
+			http.Error(w, "expected a websocket upgrade", http.StatusUpgradeRequired)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "bad request: unsupported websocket handshake", http.StatusBadRequest)
+			return
+		}
+		if !websocketOriginAllowed(r, s.config.Live().CORS.AllowedOrigins) {
+			Warn("Rejected cross-origin websocket upgrade", "origin", r.Header.Get("Origin"))
+			http.Error(w, "forbidden: websocket origin not allowed", http.StatusForbidden)
+			return
+		}
+		netConn, buf, err := http.NewResponseController(w).Hijack()
+		if errors.Is(err, http.ErrNotSupported) {
+			http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			Error("Failed to hijack websocket connection", "error", err)
+			return
+		}
+		defer netConn.Close()
+
+		// The connection outlives the server's read and write timeouts, but the chat
+		// request must still arrive within server_read
+		_ = netConn.SetDeadline(time.Time{})
+		_ = netConn.SetReadDeadline(time.Now().Add(websocketRequestTimeout(s.config)))
+		handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+		if _, err := netConn.Write([]byte(handshake)); err != nil {
+			Warn("Failed to complete websocket handshake", "error", err)
+			return
+		}
+
+		s.serveChatWebSocket(r, &wsConn{conn: netConn, r: buf.Reader}, chat)
+	}
+}
+
+// websocketRequestTimeout returns how long an upgraded client has to send its chat request
+func websocketRequestTimeout(cfg *Config) time.Duration {
+	seconds := cfg.Live().Timeouts.ServerRead
+	if seconds <= 0 {
+		seconds = defaultServerReadTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// websocketOriginAllowed reports whether a browser may open the chat socket: requests
+// without an Origin (non-browser clients), same-origin requests and origins listed in
+// cors.allowed_origins are accepted. Browsers do not apply CORS to WebSocket upgrades,
+// so without this check any page could drive the proxy with the user's credentials.
+func websocketOriginAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return containsOrigin(allowed, origin)
+}
+
+// serveChatWebSocket reads the chat request, streams the completion and closes the
+// connection
+func (s *ProxyService) serveChatWebSocket(r *http.Request, ws *wsConn, chat http.HandlerFunc) {
+	message, err := ws.readMessage()
+	if err != nil {
+		if !errors.Is(err, errWebSocketClosed) {
+			Warn("Failed to read websocket chat request", "error", err)
+			_ = ws.writeClose(wsCloseCode(err), "")
+		}
+		return
+	}
+	_ = ws.conn.SetReadDeadline(time.Time{})
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Only control frames are expected from now on; a close or a broken connection
+	// cancels the upstream request
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		defer cancel()
+		for {
+			if _, err := ws.readMessage(); err != nil {
+				if !errors.Is(err, errWebSocketClosed) && ctx.Err() == nil {
+					Debug("Websocket client went away", "error", err)
+				}
+				return
+			}
+		}
+	}()
+
+	body := streamingChatBody(message)
+	chatReq := r.Clone(ctx)
+	chatReq.Method = http.MethodPost
+	chatReq.URL.Path = chatCompletionsRoute
+	chatReq.Body = io.NopCloser(bytes.NewReader(body))
+	chatReq.ContentLength = int64(len(body))
+	for _, name := range []string{"Connection", "Upgrade", "Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Extensions", "Sec-WebSocket-Protocol"} {
+		chatReq.Header.Del(name)
+	}
+	chatReq.Header.Set("Content-Type", "application/json")
+
+	sw := &websocketStreamWriter{ws: ws, header: make(http.Header)}
+	chat(sw, chatReq)
+	sw.finish()
+
+	select {
+	case <-clientDone:
+	case <-time.After(wsCloseTimeout):
+		Debug("Websocket client did not answer the close frame")
+	}
+}
+
+// streamingChatBody asks for a streamed completion; bodies that are not a JSON object
+// are passed on unchanged for the chat handler to reject
+func streamingChatBody(message []byte) []byte {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(message, &request); err != nil || request == nil {
+		return message
+	}
+	request["stream"] = json.RawMessage("true")
+	body, err := json.Marshal(request)
+	if err != nil {
+		return message
+	}
+	return body
+}
+
+// websocketStreamWriter receives the chat handler's response and forwards it as
+// WebSocket text frames: one per SSE event while streaming, or the whole body otherwise
+type websocketStreamWriter struct {
+	ws        *wsConn
+	header    http.Header
+	status    int
+	streaming bool
+	pending   []byte   // partial SSE line, or the buffered body when not streaming
+	data      [][]byte // data lines of the event being read
+	err       error
+}
+
+func (sw *websocketStreamWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *websocketStreamWriter) WriteHeader(statusCode int) {
+	if sw.status != 0 {
+		return
+	}
+	sw.status = statusCode
+	sw.streaming = statusCode == http.StatusOK && isEventStream(sw.header.Get("Content-Type"))
+}
+
+func (sw *websocketStreamWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	sw.pending = append(sw.pending, data...)
+	if !sw.streaming {
+		return len(data), nil
+	}
+
+	// Forward complete events; keep a trailing partial line for the next write
+	for {
+		end := bytes.IndexByte(sw.pending, '\n')
+		if end < 0 {
+			break
+		}
+		line := bytes.TrimRight(sw.pending[:end], "\r")
+		if err := sw.line(line); err != nil {
+			sw.err = err
+			return 0, err
+		}
+		sw.pending = sw.pending[end+1:]
+	}
+	sw.pending = append([]byte(nil), sw.pending...)
+	return len(data), nil
+}
+
+// Flush is a no-op: every frame is written as soon as its event is complete
+func (sw *websocketStreamWriter) Flush() {}
+
+// line collects the data lines of an SSE event and sends the event on the blank line
+// that ends it
+func (sw *websocketStreamWriter) line(line []byte) error {
+	if len(line) == 0 {
+		if len(sw.data) == 0 {
+			return nil
+		}
+		payload := bytes.Join(sw.data, []byte("\n"))
+		sw.data = sw.data[:0]
+		return sw.ws.writeFrame(wsOpText, payload)
+	}
+	if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+		sw.data = append(sw.data, bytes.TrimPrefix(append([]byte(nil), data...), []byte(" ")))
+	}
+	return nil
+}
+
+// finish sends whatever is left and closes the connection: normally when the chat
+// completed, with an internal error code otherwise
+func (sw *websocketStreamWriter) finish() {
+	if sw.err != nil {
+		return
+	}
+	switch {
+	case sw.streaming:
+		if err := sw.line(nil); err != nil {
+			return
+		}
+	case len(sw.pending) > 0:
+		if err := sw.ws.writeFrame(wsOpText, sw.pending); err != nil {
+			return
+		}
+	}
+
+	code, reason := wsCloseNormal, ""
+	if sw.status != http.StatusOK {
+		code, reason = wsCloseInternalError, fmt.Sprintf("HTTP %d", sw.status)
+	}
+	if err := sw.ws.writeClose(code, reason); err != nil {
+		Debug("Failed to close websocket", "error", err)
+	}
+}
+
+// wsConn is a server-side WebSocket connection. Frames are written by the chat stream
+// and by the reader answering pings and closes, so writes are serialized.
+type wsConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	mu        sync.Mutex
+	closeSent bool
+}
+
+// readMessage returns the next text or binary message, answering pings on the way. A
+// close frame from the client is acknowledged and reported as errWebSocketClosed.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			_ = c.writeClose(wsCloseNormal, "")
+			return nil, errWebSocketClosed
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, errWebSocketProtocol
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, errWebSocketProtocol
+			}
+		default:
+			return nil, errWebSocketProtocol
+		}
+
+		if len(message)+len(payload) > maxRequestBodySize {
+			return nil, errWebSocketTooBig
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads one frame from the client, which must mask it
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0F
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (length > 125 || !fin) {
+		return false, 0, nil, errWebSocketProtocol
+	}
+	if length > maxRequestBodySize {
+		return false, 0, nil, errWebSocketTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame sends one unmasked frame; nothing is sent after a close frame
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return errWebSocketClosed
+	}
+	if op == wsOpClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+// writeClose starts or completes the closing handshake
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	err := c.writeFrame(wsOpClose, append(payload, reason...))
+	if errors.Is(err, errWebSocketClosed) {
+		return nil
+	}
+	return err
+}
+
+// wsCloseCode returns the close code reporting a failed read
+func wsCloseCode(err error) int {
+	switch {
+	case errors.Is(err, errWebSocketProtocol):
+		return wsCloseProtocolError
+	case errors.Is(err, errWebSocketTooBig):
+		return wsCloseTooBig
+	default:
+		return wsCloseInternalError
+	}
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket protocol
+func isWebSocketUpgrade(r *http.Request) bool {
+	if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value for a handshake key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID)) //nolint:gosec // mandated by RFC 6455
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,119 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Object types of non-streamed chat completions and of streamed chunks
+const (
+	ChatCompletionObject      = "chat.completion"
+	ChatCompletionChunkObject = "chat.completion.chunk"
+)
+
+// maxStreamLine bounds a single SSE line while aggregating
+const maxStreamLine = 1024 * 1024
+
+// ErrEmptyStream is returned when a stream ends without a single chat chunk
+var ErrEmptyStream = errors.New("stream contained no chat completion chunks")
+
+// AggregateChatStream reads a streamed chat completion (SSE) and assembles the response
+// a non-streaming request would have received. Content deltas are concatenated per
+// choice and the last finish_reason wins. With stream_options.include_usage the usage
+// arrives in a trailing chunk without choices; it becomes the response's Usage.
+func AggregateChatStream(r io.Reader) (*ChatCompletionResponse, error) {
+	resp := &ChatCompletionResponse{Object: ChatCompletionObject}
+	choices := make(map[int]*ChatCompletionChoice)
+	seen := false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if string(data) == "[DONE]" {
+			break
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return nil, fmt.Errorf("invalid stream chunk: %w", err)
+		}
+		seen = true
+		if resp.ID == "" {
+			resp.ID, resp.Created, resp.Model = chunk.ID, chunk.Created, chunk.Model
+		}
+		if chunk.Usage != nil {
+			resp.Usage = *chunk.Usage
+		}
+		for _, delta := range chunk.Choices {
+			choice, ok := choices[delta.Index]
+			if !ok {
+				choice = &ChatCompletionChoice{Index: delta.Index, Message: ChatCompletionMessage{Role: "assistant"}}
+				choices[delta.Index] = choice
+			}
+			if delta.Delta.Role != "" {
+				choice.Message.Role = delta.Delta.Role
+			}
+			choice.Message.Content += delta.Delta.Content
+			if delta.FinishReason != nil && *delta.FinishReason != "" {
+				choice.FinishReason = *delta.FinishReason
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !seen {
+		return nil, ErrEmptyStream
+	}
+
+	resp.Choices = make([]ChatCompletionChoice, 0, len(choices))
+	for _, choice := range choices {
+		resp.Choices = append(resp.Choices, *choice)
+	}
+	sort.Slice(resp.Choices, func(i, j int) bool { return resp.Choices[i].Index < resp.Choices[j].Index })
+	return resp, nil
+}
+
+// SplitChatResponse is the inverse of AggregateChatStream: it returns the chunks of a
+// minimal stream carrying resp, one per choice with its whole content and finish_reason.
+// With includeUsage, as a request's stream_options.include_usage asks, a usage chunk
+// without choices follows.
+func SplitChatResponse(resp *ChatCompletionResponse, includeUsage bool) []ChatCompletionChunk {
+	chunks := make([]ChatCompletionChunk, 0, len(resp.Choices)+1)
+	chunk := func(choices []ChatCompletionChunkChoice, usage *ChatCompletionUsage) ChatCompletionChunk {
+		return ChatCompletionChunk{
+			ID:      resp.ID,
+			Object:  ChatCompletionChunkObject,
+			Created: resp.Created,
+			Model:   resp.Model,
+			Choices: choices,
+			Usage:   usage,
+		}
+	}
+	for _, choice := range resp.Choices {
+		delta := choice.Message
+		if delta.Role == "" {
+			delta.Role = "assistant"
+		}
+		finishReason := choice.FinishReason
+		if finishReason == "" {
+			finishReason = "stop"
+		}
+		chunks = append(chunks, chunk([]ChatCompletionChunkChoice{{Index: choice.Index, Delta: delta, FinishReason: &finishReason}}, nil))
+	}
+	if !includeUsage {
+		return chunks
+	}
+	usage := resp.Usage
+	return append(chunks, chunk([]ChatCompletionChunkChoice{}, &usage))
+}
@@ -0,0 +1,147 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// TextCompletionObject is the object type of legacy completion responses
+const TextCompletionObject = "text_completion"
+
+// ErrUnsupportedPrompt is returned for prompts that cannot become a single chat message
+var ErrUnsupportedPrompt = errors.New("prompt must be a string or an array with one string")
+
+// CompletionRequest is a legacy /v1/completions request
+type CompletionRequest struct {
+	Model            string          `json:"model"`
+	Prompt           json.RawMessage `json:"prompt"` // string or array of strings
+	Temperature      *float64        `json:"temperature,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	N                *int            `json:"n,omitempty"`
+	MaxTokens        *int            `json:"max_tokens,omitempty"`
+	Stop             json.RawMessage `json:"stop,omitempty"`
+	PresencePenalty  *float64        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty,omitempty"`
+	Seed             *int64          `json:"seed,omitempty"`
+	User             string          `json:"user,omitempty"`
+	Stream           bool            `json:"stream,omitempty"`
+}
+
+// CompletionResponse is a legacy completion, also used for each streamed chunk
+type CompletionResponse struct {
+	ID      string               `json:"id"`
+	Object  string               `json:"object"`
+	Created int64                `json:"created"`
+	Model   string               `json:"model"`
+	Choices []CompletionChoice   `json:"choices"`
+	Usage   *ChatCompletionUsage `json:"usage,omitempty"`
+}
+
+// CompletionChoice is one generated text. FinishReason is null while streaming.
+type CompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     *string `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// ChatCompletionChunk is one server-sent event of a streamed chat completion
+type ChatCompletionChunk struct {
+	ID      string                      `json:"id"`
+	Object  string                      `json:"object"`
+	Created int64                       `json:"created"`
+	Model   string                      `json:"model"`
+	Choices []ChatCompletionChunkChoice `json:"choices"`
+	Usage   *ChatCompletionUsage        `json:"usage,omitempty"`
+}
+
+// ChatCompletionChunkChoice ...
+type ChatCompletionChunkChoice struct {
+	Index        int                   `json:"index"`
+	Delta        ChatCompletionMessage `json:"delta"`
+	FinishReason *string               `json:"finish_reason"`
+}
+
+// CompletionToChat converts a legacy completion request into a chat request with the
+// prompt as a single user message
+func CompletionToChat(req *CompletionRequest) (*ChatCompletionRequest, error) {
+	prompt, err := singlePrompt(req.Prompt)
+	if err != nil {
+		return nil, err
+	}
+	return &ChatCompletionRequest{
+		Model:            req.Model,
+		Messages:         []ChatCompletionMessage{{Role: "user", Content: prompt}},
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		N:                req.N,
+		MaxTokens:        req.MaxTokens,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Seed:             req.Seed,
+		User:             req.User,
+		Stream:           req.Stream,
+	}, nil
+}
+
+// singlePrompt extracts the prompt text from a string or one-element array
+func singlePrompt(raw json.RawMessage) (string, error) {
+	var prompt string
+	if err := json.Unmarshal(raw, &prompt); err == nil {
+		return prompt, nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(raw, &prompts); err != nil || len(prompts) != 1 {
+		return "", ErrUnsupportedPrompt
+	}
+	return prompts[0], nil
+}
+
+// ChatToCompletion converts a chat completion response into the legacy completion shape
+func ChatToCompletion(resp *ChatCompletionResponse) *CompletionResponse {
+	usage := resp.Usage
+	out := &CompletionResponse{
+		ID:      resp.ID,
+		Object:  TextCompletionObject,
+		Created: resp.Created,
+		Model:   resp.Model,
+		Choices: make([]CompletionChoice, 0, len(resp.Choices)),
+		Usage:   &usage,
+	}
+	for _, choice := range resp.Choices {
+		out.Choices = append(out.Choices, CompletionChoice{
+			Text:         choice.Message.Content,
+			Index:        choice.Index,
+			FinishReason: finishReason(choice.FinishReason),
+		})
+	}
+	return out
+}
+
+// ChatChunkToCompletion converts a streamed chat chunk into a legacy completion chunk
+func ChatChunkToCompletion(chunk *ChatCompletionChunk) *CompletionResponse {
+	out := &CompletionResponse{
+		ID:      chunk.ID,
+		Object:  TextCompletionObject,
+		Created: chunk.Created,
+		Model:   chunk.Model,
+		Choices: make([]CompletionChoice, 0, len(chunk.Choices)),
+		Usage:   chunk.Usage,
+	}
+	for _, choice := range chunk.Choices {
+		out.Choices = append(out.Choices, CompletionChoice{
+			Text:         choice.Delta.Content,
+			Index:        choice.Index,
+			FinishReason: choice.FinishReason,
+		})
+	}
+	return out
+}
+
+func finishReason(reason string) *string {
+	if reason == "" {
+		return nil
+	}
+	return &reason
+}
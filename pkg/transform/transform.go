@@ -1,13 +1,42 @@
 // Package transform provides OpenAI-compatible request/response structures for github-copilot-svcs.
 package transform
 
+import "encoding/json"
+
 // ChatCompletionRequest ...
 type ChatCompletionRequest struct {
-	Model       string                  `json:"model"`
-	Messages    []ChatCompletionMessage `json:"messages"`
-	Temperature *float64                `json:"temperature,omitempty"`
-	MaxTokens   *int                    `json:"max_tokens,omitempty"`
-	Stream      bool                    `json:"stream,omitempty"`
+	Model            string                  `json:"model"`
+	Messages         []ChatCompletionMessage `json:"messages"`
+	Temperature      *float64                `json:"temperature,omitempty"`
+	TopP             *float64                `json:"top_p,omitempty"`
+	N                *int                    `json:"n,omitempty"`
+	MaxTokens        *int                    `json:"max_tokens,omitempty"`
+	Stop             json.RawMessage         `json:"stop,omitempty"` // string or array of strings
+	PresencePenalty  *float64                `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64                `json:"frequency_penalty,omitempty"`
+	Seed             *int64                  `json:"seed,omitempty"`
+	ResponseFormat   json.RawMessage         `json:"response_format,omitempty"` // kept verbatim, e.g. a json_schema
+	User             string                  `json:"user,omitempty"`
+	Stream           bool                    `json:"stream,omitempty"`
+}
+
+// Response format types a chat request may ask for
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// ResponseFormatType returns the type of a response_format value, or "" when it is
+// missing or malformed
+func ResponseFormatType(raw json.RawMessage) string {
+	var format struct {
+		Type string `json:"type"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &format) != nil {
+		return ""
+	}
+	return format.Type
 }
 
 // ChatCompletionMessage ...
@@ -48,8 +77,9 @@ type ModelList struct {
 
 // Model ...
 type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID          string `json:"id"`
+	Object      string `json:"object"`
+	Created     int64  `json:"created"`
+	OwnedBy     string `json:"owned_by"`
+	ReleaseDate string `json:"release_date,omitempty"`
 }
@@ -0,0 +1,224 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestChatCompletionRequestRoundTrip(t *testing.T) {
+	tests := map[string]string{
+		"all common parameters": `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],` +
+			`"temperature":0.2,"top_p":0.9,"n":3,"max_tokens":256,"stop":["\n","END"],` +
+			`"presence_penalty":0.5,"frequency_penalty":-0.5,"seed":42,"user":"user-1","stream":true}`,
+		"json schema response format": `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],` +
+			`"response_format":{"type":"json_schema","json_schema":{"name":"answer","strict":true,` +
+			`"schema":{"type":"object","properties":{"value":{"type":"integer"}},"required":["value"]}}}}`,
+		"stop as string": `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stop":"END"}`,
+		"minimal":        `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`,
+	}
+
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			var req ChatCompletionRequest
+			if err := json.Unmarshal([]byte(body), &req); err != nil {
+				t.Fatalf("unmarshal failed: %v", err)
+			}
+			out, err := json.Marshal(req)
+			if err != nil {
+				t.Fatalf("marshal failed: %v", err)
+			}
+			if string(out) != body {
+				t.Errorf("round trip changed the request\nwant: %s\n got: %s", body, out)
+			}
+		})
+	}
+}
+
+func TestResponseFormatType(t *testing.T) {
+	tests := map[string]string{
+		`{"type":"json_object"}`:                            ResponseFormatJSONObject,
+		`{"type":"json_schema","json_schema":{"name":"a"}}`: ResponseFormatJSONSchema,
+		`"json"`: "",
+		``:       "",
+	}
+	for raw, want := range tests {
+		if got := ResponseFormatType(json.RawMessage(raw)); got != want {
+			t.Errorf("ResponseFormatType(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestCompletionToChat(t *testing.T) {
+	tests := map[string]struct {
+		body    string
+		want    string
+		wantErr bool
+	}{
+		"string prompt": {
+			body: `{"model":"gpt-4o","prompt":"Say hi","max_tokens":16,"temperature":0,"stop":"\n","stream":true}`,
+			want: `{"model":"gpt-4o","messages":[{"role":"user","content":"Say hi"}],"temperature":0,"max_tokens":16,"stop":"\n","stream":true}`,
+		},
+		"single-element array prompt": {
+			body: `{"model":"gpt-4o","prompt":["Say hi"]}`,
+			want: `{"model":"gpt-4o","messages":[{"role":"user","content":"Say hi"}]}`,
+		},
+		"batched prompts": {body: `{"model":"gpt-4o","prompt":["a","b"]}`, wantErr: true},
+		"missing prompt":  {body: `{"model":"gpt-4o"}`, wantErr: true},
+		"token prompt":    {body: `{"model":"gpt-4o","prompt":[1,2,3]}`, wantErr: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var req CompletionRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatalf("unmarshal failed: %v", err)
+			}
+			chat, err := CompletionToChat(&req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			out, err := json.Marshal(chat)
+			if err != nil {
+				t.Fatalf("marshal failed: %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("unexpected chat request\nwant: %s\n got: %s", tt.want, out)
+			}
+		})
+	}
+}
+
+func TestChatToCompletion(t *testing.T) {
+	var resp ChatCompletionResponse
+	body := `{"id":"chatcmpl-1","object":"chat.completion","created":1700000000,"model":"gpt-4o",` +
+		`"choices":[{"index":0,"message":{"role":"assistant","content":"Hi!"},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	out, err := json.Marshal(ChatToCompletion(&resp))
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	want := `{"id":"chatcmpl-1","object":"text_completion","created":1700000000,"model":"gpt-4o",` +
+		`"choices":[{"text":"Hi!","index":0,"logprobs":null,"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`
+	if string(out) != want {
+		t.Errorf("unexpected completion\nwant: %s\n got: %s", want, out)
+	}
+}
+
+func TestChatChunkToCompletion(t *testing.T) {
+	tests := map[string]struct {
+		chunk string
+		want  string
+	}{
+		"content delta": {
+			chunk: `{"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":null}]}`,
+			want:  `{"id":"c1","object":"text_completion","created":1,"model":"gpt-4o","choices":[{"text":"Hi","index":0,"logprobs":null,"finish_reason":null}]}`,
+		},
+		"final chunk": {
+			chunk: `{"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"length"}]}`,
+			want:  `{"id":"c1","object":"text_completion","created":1,"model":"gpt-4o","choices":[{"text":"","index":0,"logprobs":null,"finish_reason":"length"}]}`,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal([]byte(tt.chunk), &chunk); err != nil {
+				t.Fatalf("unmarshal failed: %v", err)
+			}
+			out, err := json.Marshal(ChatChunkToCompletion(&chunk))
+			if err != nil {
+				t.Fatalf("marshal failed: %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("unexpected chunk\nwant: %s\n got: %s", tt.want, out)
+			}
+		})
+	}
+}
+
+func TestAggregateChatStream(t *testing.T) {
+	stream := strings.Join([]string{
+		`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"},"finish_reason":null}]}`,
+		`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"lo!"},"finish_reason":null}]}`,
+		`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`,
+		`data: [DONE]`,
+	}, "\n\n") + "\n\n"
+
+	resp, err := AggregateChatStream(strings.NewReader(stream))
+	if err != nil {
+		t.Fatalf("aggregation failed: %v", err)
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	want := `{"id":"c1","object":"chat.completion","created":1,"model":"gpt-4o",` +
+		`"choices":[{"index":0,"message":{"role":"assistant","content":"Hello!"},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`
+	if string(out) != want {
+		t.Errorf("unexpected response\nwant: %s\n got: %s", want, out)
+	}
+
+	if _, err := AggregateChatStream(strings.NewReader("data: [DONE]\n\n")); !errors.Is(err, ErrEmptyStream) {
+		t.Errorf("expected ErrEmptyStream for a stream without chunks, got %v", err)
+	}
+}
+
+func TestSplitChatResponse(t *testing.T) {
+	resp := &ChatCompletionResponse{
+		ID: "c1", Object: ChatCompletionObject, Created: 1, Model: "gpt-4o",
+		Choices: []ChatCompletionChoice{
+			{Index: 0, Message: ChatCompletionMessage{Role: "assistant", Content: "Hello!"}, FinishReason: "stop"},
+			{Index: 1, Message: ChatCompletionMessage{Role: "assistant", Content: "Hi!"}, FinishReason: "length"},
+		},
+		Usage: ChatCompletionUsage{PromptTokens: 9, CompletionTokens: 5, TotalTokens: 14},
+	}
+
+	var stream strings.Builder
+	for _, chunk := range SplitChatResponse(resp, true) {
+		if chunk.Object != ChatCompletionChunkObject {
+			t.Errorf("expected chunk object %q, got %q", ChatCompletionChunkObject, chunk.Object)
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			t.Fatalf("marshal failed: %v", err)
+		}
+		stream.WriteString("data: " + string(data) + "\n\n")
+	}
+	stream.WriteString("data: [DONE]\n\n")
+
+	// Aggregating the chunks again gives back the original response
+	got, err := AggregateChatStream(strings.NewReader(stream.String()))
+	if err != nil {
+		t.Fatalf("aggregation failed: %v", err)
+	}
+	want, _ := json.Marshal(resp)
+	if out, _ := json.Marshal(got); string(out) != string(want) {
+		t.Errorf("unexpected round trip\nwant: %s\n got: %s", want, out)
+	}
+
+	// Without include_usage the stream carries only the choices
+	chunks := SplitChatResponse(resp, false)
+	if len(chunks) != len(resp.Choices) {
+		t.Fatalf("expected %d chunks without usage, got %d", len(resp.Choices), len(chunks))
+	}
+	for _, chunk := range chunks {
+		if chunk.Usage != nil {
+			t.Errorf("expected no usage without include_usage, got %+v", chunk.Usage)
+		}
+	}
+}
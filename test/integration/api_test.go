@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -408,6 +409,18 @@ func TestServerShutdown(t *testing.T) {
 	_ = server // Use server variable to avoid unused warning
 }
 
+// rejectingUpstream answers every upstream call with 401, as GitHub does for the test token
+type rejectingUpstream struct{}
+
+func (rejectingUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"error":"unauthorized"}`)),
+		Request:    req,
+	}, nil
+}
+
 // setupTestServer creates a test server instance and returns cleanup function
 func setupTestServer() (server *internal.Server, baseURL string, cleanup func(), err error) {
 	// Find an available port
@@ -423,18 +436,25 @@ func setupTestServer() (server *internal.Server, baseURL string, cleanup func(),
 		Port: port,
 	}
 
+	// Keep the server away from any real config file
+	configDir, err := os.MkdirTemp("", "copilot-integration-*")
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to create config dir: %w", err)
+	}
+
 	// Set default headers to prevent validation errors
 	internal.SetDefaultHeaders(cfg)
 	internal.SetDefaultCORS(cfg)
 	internal.SetDefaultTimeouts(cfg)
 
-	// Create HTTP client for the server
+	// Create HTTP client for the server; upstream calls never leave the test
 	httpClient := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout:   30 * time.Second,
+		Transport: rejectingUpstream{},
 	}
 
 	// Create server instance
-	server = internal.NewServer(cfg, httpClient)
+	server = internal.NewServer(cfg, httpClient, internal.WithServerConfigPath(filepath.Join(configDir, "config.json")))
 	baseURL = fmt.Sprintf("http://localhost:%d", port)
 
 	// Start server in background goroutine
@@ -455,6 +475,7 @@ func setupTestServer() (server *internal.Server, baseURL string, cleanup func(),
 		}
 		// Give server time to shutdown gracefully
 		time.Sleep(200 * time.Millisecond)
+		_ = os.RemoveAll(configDir)
 	}
 
 	// Check for immediate startup errors